@@ -0,0 +1,105 @@
+package dfjson
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// chunkFilename returns the name of the file that the nth chunk of a slice
+// field tagged with "dfjson:distributable,chunk=1000" is written to
+func chunkFilename(n int) string {
+	return "chunk_" + strconv.Itoa(n) + ".json"
+}
+
+// isChunkFilename reports whether name was returned by chunkFilename
+func isChunkFilename(name string) bool {
+	const prefix, suffix = "chunk_", ".json"
+	if len(name) <= len(prefix)+len(suffix) || name[:len(prefix)] != prefix || name[len(name)-len(suffix):] != suffix {
+		return false
+	}
+	n, err := strconv.Atoi(name[len(prefix) : len(name)-len(suffix)])
+	return err == nil && n >= 0 && chunkFilename(n) == name
+}
+
+// encodeChunks writes the elements of slice or array v into chunk files of
+// chunkSize elements each, next to path. There's always at least one chunk
+// so that an empty slice decodes as empty rather than nil.
+func (state *encodeState) encodeChunks(path string, v reflect.Value, chunkSize int) error {
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("%s: chunk option requires a slice or array, not %s", dirOf(path), v.Type().String())
+	}
+	dir := dirOf(path)
+	for start, n := 0, 0; start == 0 || start < v.Len(); start, n = start+chunkSize, n+1 {
+		end := start + chunkSize
+		if end > v.Len() {
+			end = v.Len()
+		}
+		buf := state.getBuffer()
+		buf.WriteRune('[')
+		for i := start; i < end; i++ {
+			state.writeElementStart(buf, i == start)
+			if err := state.writeValue(buf, v.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		state.writeEnd(buf, ']', end > start)
+		data := copyBytes(buf.Bytes())
+		putBuffer(buf)
+		if err := state.addFile(JSONFile{
+			Path: joinDir(dir, chunkFilename(n)),
+			Data: data,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeChunks reads the chunk files within dir in order and writes their
+// elements into the buffers as a single array.
+func (state *decodeState) decodeChunks(dir string) error {
+	if err := state.WriteRuneAll('['); err != nil {
+		return err
+	}
+	// hasElements records whether each side has had an element written yet
+	hasElements := make([]bool, len(state.bufs))
+	for n := 0; ; n++ {
+		path := dir + "/" + chunkFilename(n)
+		fileStarts := state.bufLens()
+		state.markSegment(path)
+		hasFile, err := state.readFile(path, fileStarts)
+		if err != nil {
+			return err
+		}
+		if !hasFile {
+			break
+		}
+		// Remove the brackets of the chunk so its
+		// elements join those of the previous chunks
+		for i, buf := range state.bufs {
+			data := bytes.TrimSpace(buf.Bytes()[fileStarts[i]:])
+			if len(data) < 2 || data[0] != '[' || data[len(data)-1] != ']' {
+				return fmt.Errorf("%s: expected JSON array", path)
+			}
+			elements := bytes.TrimSpace(data[1 : len(data)-1])
+			if len(elements) == 0 {
+				buf.Truncate(fileStarts[i])
+				continue
+			}
+			if hasElements[i] {
+				elements = append([]byte{','}, elements...)
+			}
+			hasElements[i] = true
+			buf.Truncate(fileStarts[i])
+			if _, err := buf.Write(elements); err != nil {
+				return err
+			}
+		}
+	}
+	return state.WriteRuneAll(']')
+}
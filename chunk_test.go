@@ -0,0 +1,85 @@
+package dfjson
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type chunkTestWorld struct {
+	Values []int `json:"values" dfjson:"distributable,chunk=3"`
+}
+
+type chunkTestInvalid struct {
+	Values []int `json:"values" dfjson:"distributable,chunk=many"`
+}
+
+func TestChunks(t *testing.T) {
+	tests := []struct {
+		name       string
+		len        int
+		wantChunks []string
+	}{
+		{"empty", 0, []string{"chunk_0.json"}},
+		{"less than a chunk", 2, []string{"chunk_0.json"}},
+		{"chunk boundary", 3, []string{"chunk_0.json"}},
+		{"one past chunk boundary", 4, []string{"chunk_0.json", "chunk_1.json"}},
+		{"many chunks", 10, []string{"chunk_0.json", "chunk_1.json", "chunk_2.json", "chunk_3.json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := &chunkTestWorld{Values: make([]int, test.len)}
+			for i := range in.Values {
+				in.Values[i] = i * 10
+			}
+			files, err := Marshal("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var chunks []string
+			for _, path := range filePaths(files) {
+				if strings.HasPrefix(path, "values/") {
+					chunks = append(chunks, strings.TrimPrefix(path, "values/"))
+				}
+			}
+			if !reflect.DeepEqual(chunks, test.wantChunks) {
+				t.Errorf("got chunks %q, want %q", chunks, test.wantChunks)
+			}
+			var out chunkTestWorld
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %v, want %v", out.Values, in.Values)
+			}
+		})
+	}
+}
+
+func TestChunkErrors(t *testing.T) {
+	_, err := Marshal("index.json", &chunkTestInvalid{Values: []int{1}})
+	want := "dfjson.chunkTestInvalid.Values: chunk option must be a positive number"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestIsChunkFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"chunk_0.json", true},
+		{"chunk_12.json", true},
+		{"chunk_.json", false},
+		{"chunk_01.json", false},
+		{"chunk_-1.json", false},
+		{"chunk_1.yaml", false},
+		{"index.json", false},
+	}
+	for _, test := range tests {
+		if got := isChunkFilename(test.name); got != test.want {
+			t.Errorf("isChunkFilename(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
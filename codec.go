@@ -0,0 +1,76 @@
+package dfjson
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Codec converts the files of a subtree tagged with a format option, ie.
+// `dfjson:"distributable,format=yaml"`, to and from JSON so that they can be
+// written in a format that's nicer to edit by hand. Codecs are registered
+// with Options.Codecs under the name of their format.
+type Codec interface {
+	// FromJSON converts JSON data into the format of the codec
+	FromJSON(data []byte) ([]byte, error)
+
+	// ToJSON converts data in the format of the codec back into JSON
+	ToJSON(data []byte) ([]byte, error)
+}
+
+// fieldFormat returns the format that the subtree of field f is written in
+// when its parent is written in format, where "" is JSON.
+func fieldFormat(f field, format string) string {
+	switch f.format {
+	case "":
+		// Nested fields inherit the format of their parent
+		return format
+	case "json":
+		return ""
+	}
+	return f.format
+}
+
+// codec returns the Codec registered for format
+func (opts *Options) codec(format string) (Codec, error) {
+	codec, ok := opts.Codecs[format]
+	if !ok || codec == nil {
+		return nil, fmt.Errorf("no codec registered for format %q", format)
+	}
+	return codec, nil
+}
+
+// formatFilename returns the name of the index files written in format,
+// ie. "index.yaml" for "yaml".
+func (opts *Options) formatFilename(format string) string {
+	name := opts.indexFilename()
+	if format == "" {
+		return name
+	}
+	return strings.TrimSuffix(name, path.Ext(name)) + "." + format
+}
+
+// fileFormat returns the format of the index file at filePath,
+// or "" if it's JSON or not an index file.
+func (opts *Options) fileFormat(filePath string) string {
+	name := path.Base(filePath)
+	indexName := opts.indexFilename()
+	if name == indexName {
+		return ""
+	}
+	prefix := strings.TrimSuffix(indexName, path.Ext(indexName)) + "."
+	if !strings.HasPrefix(name, prefix) {
+		return ""
+	}
+	return name[len(prefix):]
+}
+
+// isIndexFilename reports whether name is an index file
+// in JSON or the format of a registered Codec
+func (opts *Options) isIndexFilename(name string) bool {
+	if name == opts.indexFilename() {
+		return true
+	}
+	_, ok := opts.Codecs[opts.fileFormat(name)]
+	return ok
+}
@@ -0,0 +1,151 @@
+package dfjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// flatYAMLCodec writes JSON objects holding scalar values as YAML with a
+// "key: value" line per field, using the JSON encoding of each value
+type flatYAMLCodec struct{}
+
+func (flatYAMLCodec) FromJSON(data []byte) ([]byte, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		var value bytes.Buffer
+		if err := json.Compact(&value, object[key]); err != nil {
+			return nil, err
+		}
+		buf.WriteString(key + ": " + value.String() + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+func (flatYAMLCodec) ToJSON(data []byte) ([]byte, error) {
+	object := make(map[string]json.RawMessage)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		colon := strings.Index(line, ": ")
+		if colon == -1 {
+			return nil, errors.New("expected \"key: value\" but got " + line)
+		}
+		object[line[:colon]] = json.RawMessage(line[colon+2:])
+	}
+	return json.Marshal(object)
+}
+
+type codecTestConfig struct {
+	Difficulty string `json:"difficulty"`
+	Lives      int    `json:"lives"`
+}
+
+type codecTestWorld struct {
+	Name      string                         `json:"name"`
+	Config    *codecTestConfig               `json:"config" dfjson:"distributable,format=yaml"`
+	Monsters  map[string]*encodeTestCreature `json:"monsters" dfjson:"distributable,format=yaml"`
+	Creatures map[string]*encodeTestCreature `json:"creatures" dfjson:"distributable"`
+}
+
+func TestCodec(t *testing.T) {
+	in := &codecTestWorld{
+		Name:      "world",
+		Config:    &codecTestConfig{Difficulty: "hard", Lives: 3},
+		Monsters:  map[string]*encodeTestCreature{"dragon": {Name: "Dragon", HP: 500}},
+		Creatures: map[string]*encodeTestCreature{"goblin": {Name: "Goblin", HP: 12}},
+	}
+	opts := Options{Codecs: map[string]Codec{"yaml": flatYAMLCodec{}}}
+	files, err := MarshalWithOptions("index.json", in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fileData(files)
+	want := map[string]string{
+		"config/index.yaml":           "difficulty: \"hard\"\nlives: 3\n",
+		"monsters/dragon/index.yaml":  "hp: 500\nname: \"Dragon\"\n",
+		"creatures/goblin/index.json": "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}",
+		"index.json":                  "{\n\t\"name\": \"world\"\n}",
+	}
+	for path, data := range want {
+		if got[path] != data {
+			t.Errorf("%s: got %q, want %q", path, got[path], data)
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			t.Errorf("unexpected file %s", path)
+		}
+	}
+
+	var out codecTestWorld
+	if err := UnmarshalFS(filesFS(files), "index.json", &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&out, in) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+
+	// The stitched document is plain JSON
+	stitched, err := MarshalStitched("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stitchedOut codecTestWorld
+	if err := json.Unmarshal(stitched, &stitchedOut); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&stitchedOut, in) {
+		t.Errorf("stitched: got %+v, want %+v", stitchedOut, in)
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	in := &codecTestWorld{Config: &codecTestConfig{}}
+	_, err := Marshal("index.json", in)
+	if want := `no codec registered for format "yaml"`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestFileFormat(t *testing.T) {
+	opts := Options{Codecs: map[string]Codec{"yaml": flatYAMLCodec{}}}
+	tests := []struct {
+		path     string
+		format   string
+		isIndex  bool
+		filename string
+	}{
+		{"a/index.json", "", true, "index.json"},
+		{"a/index.yaml", "yaml", true, "index.yaml"},
+		{"a/index.toml", "toml", false, "index.toml"},
+		{"a/other.yaml", "", false, ""},
+	}
+	for _, test := range tests {
+		if got := opts.fileFormat(test.path); got != test.format {
+			t.Errorf("fileFormat(%q) = %q, want %q", test.path, got, test.format)
+		}
+		if got := opts.isIndexFilename(test.path[2:]); got != test.isIndex {
+			t.Errorf("isIndexFilename(%q) = %v, want %v", test.path[2:], got, test.isIndex)
+		}
+		if test.filename != "" {
+			if got := opts.formatFilename(test.format); got != test.filename {
+				t.Errorf("formatFilename(%q) = %q, want %q", test.format, got, test.filename)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package dfjson
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// ConflictMarkers are the strings that start the lines delimiting each side
+// of a conflict within a file. Empty fields use the Git defaults.
+type ConflictMarkers struct {
+	// Ours starts our side of a conflict, "<<<<<<<" if empty
+	Ours string
+
+	// Base starts the common ancestor, as written by Git's "diff3"
+	// conflict style, "|||||||" if empty
+	Base string
+
+	// Separator ends our side or the base and starts their side, "=======" if empty
+	Separator string
+
+	// Theirs ends their side of a conflict, ">>>>>>>" if empty
+	Theirs string
+}
+
+// DefaultConflictMarkers are the conflict markers written by Git
+var DefaultConflictMarkers = ConflictMarkers{
+	Ours:      "<<<<<<<",
+	Base:      "|||||||",
+	Separator: "=======",
+	Theirs:    ">>>>>>>",
+}
+
+func (markers ConflictMarkers) withDefaults() ConflictMarkers {
+	if markers.Ours == "" {
+		markers.Ours = DefaultConflictMarkers.Ours
+	}
+	if markers.Base == "" {
+		markers.Base = DefaultConflictMarkers.Base
+	}
+	if markers.Separator == "" {
+		markers.Separator = DefaultConflictMarkers.Separator
+	}
+	if markers.Theirs == "" {
+		markers.Theirs = DefaultConflictMarkers.Theirs
+	}
+	return markers
+}
+
+// isMarkerLine reports whether line is the given conflict marker, optionally
+// followed by a space and a label, ie. "<<<<<<< HEAD"
+func isMarkerLine(line []byte, marker string) bool {
+	if !bytes.HasPrefix(line, []byte(marker)) {
+		return false
+	}
+	rest := bytes.TrimRight(line[len(marker):], "\r\n")
+	return len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t'
+}
+
+// splitConflict splits data containing conflict markers into the sides
+// of the conflict. Lines outside of a conflict belong to every side and
+// the base falls back to our side if the file doesn't include it.
+// ok is false if data doesn't contain any conflicts.
+func splitConflict(data []byte, markers ConflictMarkers) (sides map[string][]byte, ok bool, err error) {
+	markers = markers.withDefaults()
+
+	const (
+		outside = iota
+		inOurs
+		inBase
+		inTheirs
+	)
+	var ours, base, theirs bytes.Buffer
+	hasBase := false
+	section := outside
+	lineNumber := 0
+	for len(data) > 0 {
+		lineNumber++
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		line := data[:end]
+		data = data[end:]
+
+		switch {
+		case section == outside && isMarkerLine(line, markers.Ours):
+			ok = true
+			section = inOurs
+			continue
+		case section == inOurs && isMarkerLine(line, markers.Base):
+			hasBase = true
+			section = inBase
+			continue
+		case (section == inOurs || section == inBase) && isMarkerLine(line, markers.Separator):
+			section = inTheirs
+			continue
+		case section == inTheirs && isMarkerLine(line, markers.Theirs):
+			section = outside
+			continue
+		}
+		switch section {
+		case outside:
+			ours.Write(line)
+			base.Write(line)
+			theirs.Write(line)
+		case inOurs:
+			ours.Write(line)
+		case inBase:
+			base.Write(line)
+		case inTheirs:
+			theirs.Write(line)
+		}
+	}
+	if section != outside {
+		return nil, false, fmt.Errorf("line %d: unterminated conflict, expected %q", lineNumber, markers.Theirs)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	sides = map[string][]byte{
+		dfvcs.SideOurs:   ours.Bytes(),
+		dfvcs.SideTheirs: theirs.Bytes(),
+	}
+	if hasBase {
+		sides[dfvcs.SideBase] = base.Bytes()
+	} else {
+		sides[dfvcs.SideBase] = ours.Bytes()
+	}
+	return sides, true, nil
+}
+
+// splitConflictMarkers replaces the file that was last written into each
+// buffer with its side of the conflict, if it contains conflict markers.
+// It reports whether it did, which is never the case once the conflict was
+// resolved with Options.ConflictResolver.
+func (state *decodeState) splitConflictMarkers(path string, fileStarts []int) (bool, error) {
+	data := state.bufs[0].Bytes()[fileStarts[0]:]
+	sides, ok, err := splitConflict(data, *state.opts.ConflictMarkers)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if !ok {
+		return false, nil
+	}
+	if state.opts.ConflictResolver != nil {
+		if err := state.resolveConflict(path, fileStarts, sides[dfvcs.SideOurs], sides[dfvcs.SideTheirs]); err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		return false, nil
+	}
+	for i, buf := range state.bufs {
+		side, ok := sides[state.sides[i]]
+		if !ok {
+			// Sides we don't know about get our side, as with dfvcs.SidesFromVCSDriver
+			side = sides[dfvcs.SideOurs]
+		}
+		buf.Truncate(fileStarts[i])
+		if _, err := buf.Write(side); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
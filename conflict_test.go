@@ -0,0 +1,124 @@
+package dfjson
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+func TestSplitConflict(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		markers ConflictMarkers
+		// want is the ours, theirs and base sides, nil if there's no conflict
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "no conflict",
+			data: "{\n\t\"hp\": 1\n}",
+		},
+		{
+			name: "conflict",
+			data: "{\n<<<<<<< HEAD\n\t\"hp\": 1\n=======\n\t\"hp\": 2\n>>>>>>> other\n}",
+			want: []string{"{\n\t\"hp\": 1\n}", "{\n\t\"hp\": 2\n}", "{\n\t\"hp\": 1\n}"},
+		},
+		{
+			name: "diff3 base",
+			data: "{\n<<<<<<< HEAD\n\t\"hp\": 1\n||||||| base\n\t\"hp\": 0\n=======\n\t\"hp\": 2\n>>>>>>> other\n}",
+			want: []string{"{\n\t\"hp\": 1\n}", "{\n\t\"hp\": 2\n}", "{\n\t\"hp\": 0\n}"},
+		},
+		{
+			name: "multiple conflicts",
+			data: "{\n<<<<<<<\n\t\"a\": 1,\n=======\n\t\"a\": 2,\n>>>>>>>\n\t\"b\": 0,\n<<<<<<<\n\t\"c\": 1\n=======\n\t\"c\": 2\n>>>>>>>\n}",
+			want: []string{"{\n\t\"a\": 1,\n\t\"b\": 0,\n\t\"c\": 1\n}", "{\n\t\"a\": 2,\n\t\"b\": 0,\n\t\"c\": 2\n}", "{\n\t\"a\": 1,\n\t\"b\": 0,\n\t\"c\": 1\n}"},
+		},
+		{
+			name: "windows line endings",
+			data: "{\r\n<<<<<<< HEAD\r\n\t\"hp\": 1\r\n=======\r\n\t\"hp\": 2\r\n>>>>>>> other\r\n}",
+			want: []string{"{\r\n\t\"hp\": 1\r\n}", "{\r\n\t\"hp\": 2\r\n}", "{\r\n\t\"hp\": 1\r\n}"},
+		},
+		{
+			name: "longer marker isn't a marker",
+			data: "{\n\"a\": \"\n<<<<<<<<\n\"}",
+		},
+		{
+			name:    "custom markers",
+			data:    "{\n<<< mine\n\"hp\": 1\n--- \n\"hp\": 2\n>>> yours\n}",
+			markers: ConflictMarkers{Ours: "<<<", Separator: "---", Theirs: ">>>"},
+			want:    []string{"{\n\"hp\": 1\n}", "{\n\"hp\": 2\n}", "{\n\"hp\": 1\n}"},
+		},
+		{
+			name:    "unterminated",
+			data:    "{\n<<<<<<< HEAD\n\"hp\": 1\n=======\n\"hp\": 2\n}",
+			wantErr: `line 6: unterminated conflict, expected ">>>>>>>"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sides, ok, err := splitConflict([]byte(test.data), test.markers)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (test.want != nil) {
+				t.Fatalf("got conflict %v, want %v", ok, test.want != nil)
+			}
+			if !ok {
+				return
+			}
+			got := []string{string(sides[dfvcs.SideOurs]), string(sides[dfvcs.SideTheirs]), string(sides[dfvcs.SideBase])}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got sides %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalConflictMarkers(t *testing.T) {
+	root := t.TempDir()
+	in := &decodeTestWorld{Name: "world", Creatures: map[string]*decodeTestCreature{"goblin": {HP: 5}, "orc": {HP: 30}}}
+	if err := MarshalTo(root, "index.json", in, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	conflicted := "{\n<<<<<<< HEAD\n\t\"hp\": 6\n=======\n\t\"hp\": 7\n>>>>>>> other\n}"
+	if err := os.WriteFile(filepath.Join(root, "creatures", "goblin", "index.json"), []byte(conflicted), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entryFilename := filepath.Join(root, "index.json")
+
+	var ours, theirs decodeTestWorld
+	opts := Options{ConflictMarkers: &ConflictMarkers{}}
+	hasMergeConflict, err := NewDecoder(WithOptions(opts)).Decode(entryFilename, &ours, &theirs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasMergeConflict {
+		t.Error("expected a merge conflict")
+	}
+	if got := ours.Creatures["goblin"].HP; got != 6 {
+		t.Errorf("got our goblin hp %d, want 6", got)
+	}
+	if got := theirs.Creatures["goblin"].HP; got != 7 {
+		t.Errorf("got their goblin hp %d, want 7", got)
+	}
+	// Files without markers are the same on both sides
+	if ours.Creatures["orc"].HP != 30 || theirs.Creatures["orc"].HP != 30 {
+		t.Errorf("got orcs %+v and %+v, want hp 30", ours.Creatures["orc"], theirs.Creatures["orc"])
+	}
+
+	// Without Markers the file isn't valid JSON
+	var out decodeTestWorld
+	if _, err := Unmarshal(entryFilename, &out, nil, nil); err == nil {
+		t.Error("expected an error decoding conflict markers without Markers set")
+	}
+}
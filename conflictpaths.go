@@ -0,0 +1,108 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// UnmarshalConflicts is like Unmarshal but also returns the path of each JSON
+// value that differs between v and incomingV, see ConflictPaths, so that a UI
+// can highlight exactly what needs resolving.
+func UnmarshalConflicts(entryFilename string, v interface{}, incomingV interface{}, vcsDriver dfvcs.VCSDriver) (hasMergeConflict bool, conflicts []string, err error) {
+	return NewDecoder().DecodeConflicts(entryFilename, v, incomingV, vcsDriver)
+}
+
+// DecodeConflicts is like Decode but also returns the paths of the JSON
+// values that differ between v and incomingV, see UnmarshalConflicts.
+func (dec *Decoder) DecodeConflicts(entryFilename string, v interface{}, incomingV interface{}, vcsDriver dfvcs.VCSDriver) (hasMergeConflict bool, conflicts []string, err error) {
+	hasMergeConflict, err = dec.Decode(entryFilename, v, incomingV, vcsDriver)
+	if err != nil || !hasMergeConflict {
+		return hasMergeConflict, nil, err
+	}
+	conflicts, err = ConflictPaths(v, incomingV)
+	if err != nil {
+		return false, nil, err
+	}
+	return hasMergeConflict, conflicts, nil
+}
+
+// ConflictPaths returns the path of each value that differs between the JSON
+// encodings of ours and theirs, in sorted order. Paths are made of the JSON
+// field names, map keys and array indexes leading to the value, joined by
+// dots, ie. "Items.sword.Damage" or "Tags.2".
+//
+// Objects are compared key by key and arrays element by element, so a key
+// or element that only one side has is reported by its own path.
+func ConflictPaths(ours, theirs interface{}) ([]string, error) {
+	oursValue, err := genericValue(ours)
+	if err != nil {
+		return nil, err
+	}
+	theirsValue, err := genericValue(theirs)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	diffValues(oursValue, theirsValue, nil, &paths)
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// genericValue returns v as encoding/json decodes its JSON encoding into an
+// interface{}, with numbers kept as json.Number to compare them exactly
+func genericValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := unmarshalUseNumber(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// diffValues adds the paths of the values that differ between a and b,
+// which are at path, to paths
+func diffValues(a, b interface{}, path []string, paths *[]string) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			for key, aValue := range a {
+				keyPath := append(path[:len(path):len(path)], key)
+				bValue, ok := b[key]
+				if !ok {
+					*paths = append(*paths, strings.Join(keyPath, "."))
+					continue
+				}
+				diffValues(aValue, bValue, keyPath, paths)
+			}
+			for key := range b {
+				if _, ok := a[key]; !ok {
+					*paths = append(*paths, strings.Join(append(path[:len(path):len(path)], key), "."))
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			for i := 0; i < len(a) || i < len(b); i++ {
+				indexPath := append(path[:len(path):len(path)], strconv.Itoa(i))
+				if i >= len(a) || i >= len(b) {
+					*paths = append(*paths, strings.Join(indexPath, "."))
+					continue
+				}
+				diffValues(a[i], b[i], indexPath, paths)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*paths = append(*paths, strings.Join(path, "."))
+	}
+}
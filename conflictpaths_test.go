@@ -0,0 +1,124 @@
+package dfjson
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+type conflictPathsTestItem struct {
+	Damage int      `json:"damage"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+type conflictPathsTestInventory struct {
+	Owner string                            `json:"owner"`
+	Items map[string]*conflictPathsTestItem `json:"items" dfjson:"distributable"`
+}
+
+func TestConflictPaths(t *testing.T) {
+	tests := []struct {
+		name         string
+		ours, theirs interface{}
+		want         []string
+	}{
+		{
+			name:   "equal",
+			ours:   &conflictPathsTestItem{Damage: 1, Tags: []string{"a"}},
+			theirs: &conflictPathsTestItem{Damage: 1, Tags: []string{"a"}},
+		},
+		{
+			name:   "field",
+			ours:   &conflictPathsTestItem{Damage: 1},
+			theirs: &conflictPathsTestItem{Damage: 2},
+			want:   []string{"damage"},
+		},
+		{
+			name:   "array elements",
+			ours:   &conflictPathsTestItem{Tags: []string{"a", "b", "c"}},
+			theirs: &conflictPathsTestItem{Tags: []string{"a", "x"}},
+			want:   []string{"tags.1", "tags.2"},
+		},
+		{
+			name:   "key on one side",
+			ours:   &conflictPathsTestItem{Tags: []string{"a"}},
+			theirs: &conflictPathsTestItem{},
+			want:   []string{"tags"},
+		},
+		{
+			name: "nested map keys",
+			ours: &conflictPathsTestInventory{Owner: "a", Items: map[string]*conflictPathsTestItem{
+				"sword":  {Damage: 10},
+				"shield": {Damage: 1},
+				"bow":    {Damage: 5},
+			}},
+			theirs: &conflictPathsTestInventory{Owner: "b", Items: map[string]*conflictPathsTestItem{
+				"sword":  {Damage: 12},
+				"shield": {Damage: 1},
+				"axe":    {Damage: 7},
+			}},
+			want: []string{"items.axe", "items.bow", "items.sword.damage", "owner"},
+		},
+		{
+			name:   "numbers are compared exactly",
+			ours:   map[string]interface{}{"n": 1.0, "big": uint64(1<<63 + 1)},
+			theirs: map[string]interface{}{"n": 1, "big": uint64(1<<63 + 2)},
+			want:   []string{"big"},
+		},
+		{
+			name:   "different types",
+			ours:   map[string]interface{}{"v": []int{1}},
+			theirs: map[string]interface{}{"v": map[string]int{"0": 1}},
+			want:   []string{"v"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ConflictPaths(test.ours, test.theirs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalConflicts(t *testing.T) {
+	root := t.TempDir()
+	in := &conflictPathsTestInventory{Owner: "a", Items: map[string]*conflictPathsTestItem{
+		"sword":  {Damage: 10, Tags: []string{"sharp"}},
+		"shield": {Damage: 1},
+	}}
+	if err := MarshalTo(root, "index.json", in, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	entryFilename := filepath.Join(root, "index.json")
+
+	var ours, theirs conflictPathsTestInventory
+	hasMergeConflict, conflicts, err := UnmarshalConflicts(entryFilename, &ours, &theirs, dfvcs.NewMockDriver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasMergeConflict || conflicts != nil {
+		t.Errorf("got %v %q without conflicts, want false and no paths", hasMergeConflict, conflicts)
+	}
+
+	driver := dfvcs.NewMockDriver()
+	driver.Add(filepath.Join(root, "items", "sword", "index.json"),
+		[]byte(`{"damage": 10, "tags": ["sharp"]}`),
+		[]byte(`{"damage": 12, "tags": ["sharp", "heavy"]}`))
+	hasMergeConflict, conflicts, err = UnmarshalConflicts(entryFilename, &ours, &theirs, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasMergeConflict {
+		t.Error("expected a merge conflict")
+	}
+	if want := []string{"items.sword.damage", "items.sword.tags.1"}; !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got %q, want %q", conflicts, want)
+	}
+}
@@ -2,44 +2,149 @@ package dfjson
 
 import (
 	"bytes"
+	"context"
+	"encoding"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
-	"unicode/utf8"
 
-	"github.com/karrick/godirwalk"
 	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
 )
 
 type decodeState struct {
-	buf              bytes.Buffer
-	incomingBuf      bytes.Buffer
-	vscDriver        dfvcs.VCSDriver
+	// sides names each version of the data being decoded, ie. "ours" and
+	// "theirs", and bufs holds the JSON stitched together so far for each
+	// of them. The first side is the one decoded when there's no merge conflict.
+	sides            []string
+	bufs             []*bytes.Buffer
+	sideBufs         map[string]*bytes.Buffer
+	sidesDriver      dfvcs.SidesDriver
+	source           fileSource
 	hasMergeConflict bool
+	opts             Options
+	entryFilename    string
+	entryDepth       int
+	// ctx is checked before reading each file so that
+	// decoding stops once it's cancelled
+	ctx context.Context
+	// prefetcher is source if Options.ReadWorkers is more than 1, and
+	// is given the paths that are about to be read
+	prefetcher *prefetchSource
+	// ignoredPaths holds the absolute paths of Options.IgnoreExtra
+	ignoredPaths map[string]bool
+
+	// requiredKeys maps the directory of a map to the keys that
+	// must exist within it, and missing lists those that don't
+	requiredKeys map[string][]string
+	missing      []string
+
+	// totalBytes is the number of bytes read from files so far
+	totalBytes int64
+	filesRead  int
+	emptyDirs  []string
+
+	// segments records which file each part of the buffers came from
+	// so that errors from encoding/json can point at the file
+	segments []fileSegment
+
+	// format is the format of the subtree currently being decoded, as set
+	// by the format option of a field. rawFormats is set if its files are
+	// still JSON, ie. when stitching the output of marshal.
+	format     string
+	rawFormats bool
+}
+
+// fileSegment marks where data belonging to path begins in each buffer
+type fileSegment struct {
+	starts []int
+	path   string
 }
 
-// truncateLastBracket returns true if the operation happened.
-func (state *decodeState) truncateLastBracket() bool {
-	data := state.buf.Bytes()
-	i := 0
+// initSides creates a buffer for each of the named sides
+func (state *decodeState) initSides(sides []string) {
+	state.sides = sides
+	state.bufs = make([]*bytes.Buffer, len(sides))
+	state.sideBufs = make(map[string]*bytes.Buffer, len(sides))
+	for i, side := range sides {
+		buf := new(bytes.Buffer)
+		if state.opts.InitialBufferSize > 0 {
+			buf.Grow(state.opts.InitialBufferSize)
+		}
+		state.bufs[i] = buf
+		state.sideBufs[side] = buf
+	}
+}
+
+// bufLens returns the current length of each buffer
+func (state *decodeState) bufLens() []int {
+	lens := make([]int, len(state.bufs))
+	for i, buf := range state.bufs {
+		lens[i] = buf.Len()
+	}
+	return lens
+}
+
+// reopenObject removes the closing bracket of the object written into buf
+// from start onwards, followed by a comma if the object has any keys, so that
+// more keys can be written into it. It returns false if there's no closing bracket.
+//
+// Brackets within string values are skipped, ie. {"note":"closed }"}
+func reopenObject(buf *bytes.Buffer, start int) bool {
+	data := buf.Bytes()[start:]
 	lastBracketIndex := -1
-	for i < len(data) {
-		r, n := utf8.DecodeRune(data[i:])
-		if r == '}' {
+	// lastTokenIndex is the index of the last byte outside of whitespace
+	// before lastBracketIndex
+	lastTokenIndex, tokenIndex := -1, -1
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch c {
+			case '\\':
+				// Skip the escaped character, ie. \"
+				i++
+			case '"':
+				inString = false
+				tokenIndex = i
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			inString = true
+		case '}':
 			lastBracketIndex = i
+			lastTokenIndex = tokenIndex
 		}
-		i += n
+		tokenIndex = i
 	}
-	if lastBracketIndex != -1 {
-		state.buf.Truncate(lastBracketIndex)
-		state.incomingBuf.Truncate(lastBracketIndex)
-		return true
+	if lastBracketIndex == -1 {
+		return false
 	}
-	return false
+	hasKeys := lastTokenIndex != -1 && data[lastTokenIndex] != '{'
+	buf.Truncate(start + lastBracketIndex)
+	if hasKeys {
+		buf.WriteByte(',')
+	}
+	return true
+}
+
+// closeObject undoes reopenObject when no keys were written after it
+func closeObject(buf *bytes.Buffer) {
+	if data := buf.Bytes(); len(data) > 0 && data[len(data)-1] == ',' {
+		buf.Truncate(len(data) - 1)
+	}
+	buf.WriteByte('}')
 }
 
 // Unmarshal parses the JSON-encoded data and stores the result
@@ -50,176 +155,976 @@ func (state *decodeState) truncateLastBracket() bool {
 // by loading data from nested files depending on if a struct field was tagged
 // with "dfjson:distributable" or not.
 //
+// As with encoding/json, only what's in the files is stored in v, so fields
+// that aren't in them keep their current value. This includes distributable
+// fields whose directory doesn't exist.
+//
 // The purpose of this implementation is to spread out data in a way that makes
 // concurrent data editing with most version control systems easier, at the cost of more hard drive reads.
 //
 // Data in production should not be written or read this way.
 func Unmarshal(entryFilename string, v interface{}, incomingV interface{}, vcsDriver dfvcs.VCSDriver) (hasMergeConflict bool, err error) {
-	decodeType := reflect.TypeOf(v)
-	if decodeType.Kind() != reflect.Ptr {
-		return false, errors.New("Must provide pointer value")
+	return NewDecoder().Decode(entryFilename, v, incomingV, vcsDriver)
+}
+
+// UnmarshalContext is like Unmarshal but stops decoding and
+// returns ctx.Err() once ctx is cancelled.
+func UnmarshalContext(ctx context.Context, entryFilename string, v interface{}, incomingV interface{}, vcsDriver dfvcs.VCSDriver) (hasMergeConflict bool, err error) {
+	return NewDecoder().DecodeContext(ctx, entryFilename, v, incomingV, vcsDriver)
+}
+
+// UnmarshalWithOptions is like Unmarshal but allows configuring the decoding behaviour.
+func UnmarshalWithOptions(entryFilename string, v interface{}, incomingV interface{}, vcsDriver dfvcs.VCSDriver, opts Options) (hasMergeConflict bool, err error) {
+	return NewDecoder(WithOptions(opts)).Decode(entryFilename, v, incomingV, vcsDriver)
+}
+
+// UnmarshalWithBase is like Unmarshal but also decodes the common ancestor
+// of conflicted files into baseV, allowing a three-way merge. driver must
+// populate dfvcs.SideBase, such as dfgit.GitDriver or dfsvn.SVNDriver.
+func UnmarshalWithBase(entryFilename string, v, incomingV, baseV interface{}, driver dfvcs.SidesDriver) (hasMergeConflict bool, err error) {
+	return NewDecoder().DecodeWithBase(entryFilename, v, incomingV, baseV, driver)
+}
+
+// Decoder decodes files into values like Unmarshal, with the configuration
+// it was created with.
+type Decoder struct {
+	opts Options
+}
+
+// NewDecoder returns a Decoder configured by opts
+func NewDecoder(opts ...Option) *Decoder {
+	dec := &Decoder{}
+	for _, opt := range opts {
+		opt(&dec.opts)
 	}
-	var state decodeState
-	state.vscDriver = vcsDriver
-	if state.vscDriver != nil {
-		if err := state.vscDriver.Init(); err != nil {
-			return false, err
-		}
+	return dec
+}
+
+// Decode reads the files of entryFilename into v, see Unmarshal.
+func (dec *Decoder) Decode(entryFilename string, v interface{}, incomingV interface{}, vcsDriver dfvcs.VCSDriver) (hasMergeConflict bool, err error) {
+	return dec.DecodeContext(context.Background(), entryFilename, v, incomingV, vcsDriver)
+}
+
+// DecodeContext is like Decode but stops decoding and
+// returns ctx.Err() once ctx is cancelled.
+func (dec *Decoder) DecodeContext(ctx context.Context, entryFilename string, v interface{}, incomingV interface{}, vcsDriver dfvcs.VCSDriver) (hasMergeConflict bool, err error) {
+	targets := map[string]interface{}{
+		dfvcs.SideOurs: v,
+	}
+	var driver dfvcs.SidesDriver
+	if vcsDriver != nil {
+		targets[dfvcs.SideTheirs] = incomingV
+		driver = dfvcs.SidesFromVCSDriver(vcsDriver)
+	} else if dec.opts.ConflictMarkers != nil && incomingV != nil {
+		targets[dfvcs.SideTheirs] = incomingV
 	}
+	return unmarshalSidesFile(ctx, entryFilename, targets, driver, dec.opts)
+}
+
+// DisallowUnknownFields makes the Decoder return an error when the data
+// holds a key that isn't a field of the struct it's decoded into,
+// see Options.DisallowUnknownFields.
+func (dec *Decoder) DisallowUnknownFields() {
+	dec.opts.DisallowUnknownFields = true
+}
+
+// UseNumber makes the Decoder store numbers in interface{} values
+// as a json.Number, see Options.UseNumber.
+func (dec *Decoder) UseNumber() {
+	dec.opts.UseNumber = true
+}
+
+// DecodeWithBase is like Decode but also decodes the common ancestor of
+// conflicted files into baseV, as populated by driver into dfvcs.SideBase.
+func (dec *Decoder) DecodeWithBase(entryFilename string, v, incomingV, baseV interface{}, driver dfvcs.SidesDriver) (hasMergeConflict bool, err error) {
+	targets := map[string]interface{}{
+		dfvcs.SideOurs:   v,
+		dfvcs.SideTheirs: incomingV,
+		dfvcs.SideBase:   baseV,
+	}
+	return unmarshalSidesFile(context.Background(), entryFilename, targets, driver, dec.opts)
+}
+
+// DecodeFS is like Decode but reads files and directories from fsys, ie. an
+// embed.FS, a dfhttp.FS or an fstest.MapFS holding test fixtures.
+// entryFilename is a slash-separated path within fsys.
+func (dec *Decoder) DecodeFS(fsys fs.FS, entryFilename string, v interface{}) error {
+	targets := map[string]interface{}{
+		dfvcs.SideOurs: v,
+	}
+	_, err := unmarshalSides(context.Background(), fsSource{fsys: fsys}, cleanPath(entryFilename), targets, nil, dec.opts)
+	return err
+}
+
+// UnmarshalSides is like UnmarshalWithOptions but decodes any number of named
+// sides of conflicted files, as populated by driver, ie. "base", "ours" and
+// "theirs". targets maps the name of each side to the value to decode it into.
+//
+// targets must hold a value for dfvcs.SideOurs, which is the only side that's
+// decoded if there are no merge conflicts.
+func UnmarshalSides(entryFilename string, targets map[string]interface{}, driver dfvcs.SidesDriver, opts Options) (hasMergeConflict bool, err error) {
+	return unmarshalSidesFile(context.Background(), entryFilename, targets, driver, opts)
+}
+
+// unmarshalSidesFile decodes the files of entryFilename on disk into targets
+func unmarshalSidesFile(ctx context.Context, entryFilename string, targets map[string]interface{}, driver dfvcs.SidesDriver, opts Options) (hasMergeConflict bool, err error) {
 	absEntryFilename, err := filepath.Abs(entryFilename)
 	if err != nil {
 		return false, err
 	}
 	// normalize paths to use / for every OS, even Windows
 	absEntryFilename = strings.ReplaceAll(absEntryFilename, "\\", "/")
-	state.decode(absEntryFilename)
-	bufBytes := state.buf.Bytes()
-	if err := json.Unmarshal(bufBytes, v); err != nil {
-		// DEBUG: Check state of JSON
-		panic("failed to parse:" + string(bufBytes) + "\n" + err.Error())
+	return unmarshalSides(ctx, osSource{}, absEntryFilename, targets, driver, opts)
+}
+
+// UnmarshalFS is like UnmarshalWithOptions but reads files and directories
+// from fsys, ie. an embed.FS or a dfhttp.FS. entryFilename is a slash-separated
+// path within fsys.
+func UnmarshalFS(fsys fs.FS, entryFilename string, v interface{}, opts Options) error {
+	return NewDecoder(WithOptions(opts)).DecodeFS(fsys, entryFilename, v)
+}
+
+// unmarshalSides decodes the files of entryFilename from source into targets
+func unmarshalSides(ctx context.Context, source fileSource, entryFilename string, targets map[string]interface{}, driver dfvcs.SidesDriver, opts Options) (hasMergeConflict bool, err error) {
+	v := targets[dfvcs.SideOurs]
+	if v == nil || reflect.TypeOf(v).Kind() != reflect.Ptr {
+		return false, errors.New("Must provide pointer value")
+	}
+	sides := []string{dfvcs.SideOurs}
+	for side := range targets {
+		if side != dfvcs.SideOurs {
+			sides = append(sides, side)
+		}
+	}
+	sort.Strings(sides[1:])
+	opts = detectFormat(entryFilename, opts).withDefaults()
+
+	var state decodeState
+	state.ctx = ctx
+	state.opts = opts
+	state.source = source
+	if opts.ReadWorkers > 1 {
+		state.prefetcher = newPrefetchSource(ctx, source, &state.opts)
+		state.source = state.prefetcher
+		defer state.prefetcher.stop()
+	}
+	state.initSides(sides)
+	state.sidesDriver = driver
+	if state.sidesDriver != nil {
+		// Close even if Init fails, as it may have failed partway
+		// through, ie. after starting a process
+		defer func() {
+			if closeErr := state.sidesDriver.Close(); closeErr != nil && err == nil {
+				hasMergeConflict, err = false, closeErr
+			}
+		}()
+		if err := state.sidesDriver.Init(state.ctx); err != nil {
+			return false, err
+		}
+	}
+	state.entryFilename = entryFilename
+	state.entryDepth = pathDepth(entryFilename)
+	if len(opts.IgnoreExtra) > 0 {
+		state.ignoredPaths = make(map[string]bool, len(opts.IgnoreExtra))
+		entryDir := dirOf(entryFilename)
+		for _, path := range opts.IgnoreExtra {
+			state.ignoredPaths[cleanPath(entryDir+"/"+path)] = true
+		}
+	}
+	state.requiredKeys = make(map[string][]string)
+	if err := state.decode(entryFilename, reflect.TypeOf(v)); err != nil {
 		return false, err
 	}
+	if len(state.missing) > 0 {
+		return false, &RequiredError{Missing: state.missing}
+	}
+
+	// Other sides only differ from ours if there's a merge conflict
+	decodedSides := 1
 	if state.hasMergeConflict {
-		incomingBufBytes := state.incomingBuf.Bytes()
-		if err := json.Unmarshal(incomingBufBytes, incomingV); err != nil {
-			// DEBUG: Check state of JSON
-			panic("failed to parse incoming:" + state.incomingBuf.String() + "\n" + err.Error())
+		decodedSides = len(sides)
+	}
+	for i, side := range sides[:decodedSides] {
+		target := targets[side]
+		if err := opts.validateSchema(side, state.bufs[i].Bytes()); err != nil {
 			return false, err
 		}
-		// panic("we have a conflict!")
+		dec := json.NewDecoder(bytes.NewReader(state.bufs[i].Bytes()))
+		if opts.DisallowUnknownFields {
+			// Catches unknown keys of objects nested within a file
+			dec.DisallowUnknownFields()
+		}
+		if opts.UseNumber {
+			dec.UseNumber()
+		}
+		if err := decodeValue(dec, state.bufs[i].Bytes(), target); err != nil {
+			return false, state.fileError(err, i)
+		}
+		if len(opts.TypeTransform) > 0 {
+			if err := transformTypes(target, opts.TypeTransform); err != nil {
+				return false, err
+			}
+		}
+		// Validate after transforming so that transforms can clamp values
+		if hasValidateFields(reflect.TypeOf(target)) {
+			if err := validateRanges(target); err != nil {
+				if i > 0 {
+					return false, fmt.Errorf("%s: %w", side, err)
+				}
+				return false, err
+			}
+		}
+		if opts.InternStrings {
+			internStrings(target)
+		}
+		if hasParentFields(reflect.TypeOf(target)) {
+			linkParents(target)
+		}
+	}
+	if opts.Stats != nil {
+		*opts.Stats = DecodeStats{
+			FilesRead: state.filesRead,
+			BytesRead: state.totalBytes,
+			EmptyDirs: state.emptyDirs,
+		}
 	}
-	// DEBUG: Check state of JSON
-	//panic("succeeded in parsing:" + state.buf.String())
 	return state.hasMergeConflict, nil
 }
 
 func (state *decodeState) WriteAll(b []byte) error {
-	if _, err := state.buf.Write(b); err != nil {
-		return err
-	}
-	if _, err := state.incomingBuf.Write(b); err != nil {
-		return err
+	for _, buf := range state.bufs {
+		if _, err := buf.Write(b); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (state *decodeState) WriteRuneAll(r rune) error {
-	if _, err := state.buf.WriteRune(r); err != nil {
-		return err
-	}
-	if _, err := state.incomingBuf.WriteRune(r); err != nil {
-		return err
+	for _, buf := range state.bufs {
+		if _, err := buf.WriteRune(r); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (state *decodeState) WriteStringAll(str string) error {
-	if _, err := state.buf.WriteString(str); err != nil {
-		return err
-	}
-	if _, err := state.incomingBuf.WriteString(str); err != nil {
-		return err
+	for _, buf := range state.bufs {
+		if _, err := buf.WriteString(str); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (state *decodeState) decode(path string) {
+// decode reads the file at path and the directories next to it into the buffers.
+// t is the type the data will be decoded into, or nil if it isn't known.
+func (state *decodeState) decode(path string, t reflect.Type) error {
+	if err := state.ctx.Err(); err != nil {
+		return err
+	}
+	if err := state.opts.checkDepth(path, state.entryDepth); err != nil {
+		return err
+	}
 	hasOpenedBracket := false
 	hasClosingBracket := false
+	fileStarts := state.bufLens()
+	state.markSegment(path)
 
 	// Read JSON entry file (if it exists)
-	{
-		fileHandledByVCSDriver := false
-		if state.vscDriver != nil {
-			var err error
-			fileHandledByVCSDriver, err = state.vscDriver.HandleFile(path, &state.buf, &state.incomingBuf)
-			if err != nil {
-				panic(err)
-			}
-			if fileHandledByVCSDriver {
-				state.hasMergeConflict = true
-
-				// We have an entry point file, and so
-				// we don't need to insert an opening or closing bracket
-				// into the JSON stream
-				hasOpenedBracket = true
-				hasClosingBracket = true
+	hasFile, err := state.readFile(path, fileStarts)
+	if err != nil {
+		return err
+	}
+	if hasFile {
+		// We have an entry point file, and so
+		// we don't need to insert an opening or closing bracket
+		// into the JSON stream
+		hasOpenedBracket = true
+		hasClosingBracket = true
+	}
+	if empty := emptyFileValue(t); hasFile && empty != nil {
+		// A blank file, ie. one created by hand before it had any content,
+		// is treated as empty so that distributed data can still be added
+		if err := state.rewriteFile(fileStarts, func(data []byte) ([]byte, error) {
+			if len(bytes.TrimSpace(data)) == 0 {
+				return empty, nil
 			}
+			return data, nil
+		}); err != nil {
+			return err
 		}
-		if !fileHandledByVCSDriver {
-			f, err := os.Open(path)
-			if err != nil && !os.IsNotExist(err) {
-				// if error is not a "file does not exist" error
-				panic(err)
-			}
-			if f != nil {
-				b, err := ioutil.ReadAll(f)
-				if err != nil {
-					f.Close()
-					panic(err)
-				}
-				f.Close()
-
-				if err := state.WriteAll(b); err != nil {
-					panic(err)
-				}
-
-				// We have an entry point file, and so
-				// we don't need to insert an opening or closing bracket
-				// into the JSON stream
-				hasOpenedBracket = true
-				hasClosingBracket = true
-			}
+	}
+	if isDistributedArray(t) {
+		return state.decodeElements(path, fileStarts, hasFile, derefType(t))
+	}
+	if hasFile && path == state.entryFilename && state.opts.WrapKey != "" {
+		if err := state.rewriteFile(fileStarts, func(data []byte) ([]byte, error) {
+			return unwrapKey(data, state.opts.WrapKey)
+		}); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if hasFile && state.opts.Provenance {
+		if err := state.rewriteFile(fileStarts, func(data []byte) ([]byte, error) {
+			return removeObjectKey(data, sourceKey)
+		}); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if hasFile && state.opts.DisallowUnknownFields {
+		if err := state.checkUnknownFields(path, t, fileStarts); err != nil {
+			return err
 		}
 	}
 
 	if !hasOpenedBracket {
 		if err := state.WriteRuneAll('{'); err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	// Read distributed data
 	{
+		parentPath := path
 		topDir := filepath.Dir(path)
 		topDir = strings.ReplaceAll(topDir, "\\", "/")
-		dirList, err := godirwalk.ReadDirents(topDir, nil)
+		dirList, err := state.source.ReadDirNames(topDir)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		hasWrittenFirstField := false
-		for _, fileOrDir := range dirList {
-			if !fileOrDir.IsDir() {
+		var renamedKeys map[string]string
+		if state.opts.isRenamingKeys() {
+			renamedKeys, err = state.readKeysFile(topDir + "/" + keysFilename)
+			if err != nil {
+				return err
+			}
+		}
+		// Directories of fields in a group are within the group
+		// directory but are keys of this object
+		type dirKey struct {
+			key, dir  string
+			t         reflect.Type
+			chunkSize int
+			format    string
+			// orderKey is the key that the order file of the
+			// directory is written under, if it has one
+			orderKey string
+		}
+		keys := make([]dirKey, 0, len(dirList))
+		for _, dir := range dirList {
+			if state.opts.skipDir(dir) {
 				continue
 			}
+			if err := checkDirName(dir); err != nil {
+				return fmt.Errorf("%s: directory %q: %w", path, dir, err)
+			}
+			if state.isIgnored(topDir + "/" + dir) {
+				continue
+			}
+			name := state.originalDirName(topDir, dir)
+			if fields := groupFields(t, name); fields != nil {
+				groupDirList, err := state.source.ReadDirNames(topDir + "/" + dir)
+				if err != nil {
+					return err
+				}
+				for _, fieldDir := range groupDirList {
+					if state.opts.skipDir(fieldDir) {
+						continue
+					}
+					if err := checkDirName(fieldDir); err != nil {
+						return fmt.Errorf("%s: directory %q: %w", path, dir+"/"+fieldDir, err)
+					}
+					fieldName := state.originalDirName(topDir+"/"+dir, fieldDir)
+					f, ok := fields[fieldName]
+					if !ok {
+						return fmt.Errorf("%s: %q is not a field of group %q", path, fieldName, name)
+					}
+					keys = append(keys, dirKey{key: fieldName, dir: dir + "/" + fieldDir, t: f.typ, chunkSize: f.chunkSize, format: fieldFormat(f, state.format), orderKey: orderKey(t, f)})
+				}
+				continue
+			}
+			key := name
+			if originalKey, ok := renamedKeys[name]; ok {
+				key = originalKey
+			} else {
+				if state.opts.KeyEscaper != nil && !isStructType(t) {
+					key, err = state.opts.KeyEscaper.UnescapeKey(name)
+					if err != nil {
+						return fmt.Errorf("%s: directory %q: %w", path, dir, err)
+					}
+				}
+				key = state.opts.canonicalKey(t, key)
+			}
+			if err := checkIntegerKey(t, key); err != nil {
+				return fmt.Errorf("%s: directory %q: %w", path, dir, err)
+			}
+			if state.isUnknownField(t, key) {
+				return fmt.Errorf("%s: unknown field %q", cleanPath(topDir+"/"+dir), key)
+			}
+			k := dirKey{key: key, dir: dir, t: childType(t, key), format: state.format}
+			if f, ok := structField(t, key); ok && f.distributable {
+				k.chunkSize = f.chunkSize
+				k.format = fieldFormat(f, state.format)
+				k.orderKey = orderKey(t, f)
+			}
+			keys = append(keys, k)
+		}
+
+		var fileKeys map[string]bool
+		readFileKeys := func() (map[string]bool, error) {
+			if hasFile && fileKeys == nil {
+				keys, err := objectKeys(state.bufs[0].Bytes()[fileStarts[0]:])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				fileKeys = keys
+			}
+			return fileKeys, nil
+		}
+		present := make(map[string]string, len(keys))
+		for _, k := range keys {
+			if otherDir, ok := present[k.key]; ok {
+				return fmt.Errorf("%s: directories %q and %q are both key %q", path, otherDir, k.dir, k.key)
+			}
+			present[k.key] = k.dir
+		}
+		if err := state.checkRequired(topDir, t, present, readFileKeys); err != nil {
+			return err
+		}
+		if state.prefetcher != nil {
+			for _, k := range keys {
+				path := topDir + "/" + strings.ReplaceAll(k.dir, "\\", "/") + "/" + state.opts.formatFilename(k.format)
+				if k.chunkSize > 0 && !state.opts.isCombined(path, state.entryDepth) {
+					continue
+				}
+				state.prefetcher.prefetch(path)
+			}
+		}
+
+		hasWrittenFirstField := false
+		for _, k := range keys {
+			key := k.key
+
+			// Directories become keys of the object in the file, so
+			// a key existing in both is a user mistake, ie. a field that
+			// used to be inline was made distributable.
+			keysInFile, err := readFileKeys()
+			if err != nil {
+				return err
+			}
+			if keysInFile[key] {
+				return fmt.Errorf("%s: key %q is defined in the file and also as a directory", path, key)
+			}
+
+			// Where to go back to if the directory turns out to be empty
+			lens := state.bufLens()
+			segmentCount := len(state.segments)
+			isReopened := false
 			if hasWrittenFirstField {
 				if err := state.WriteStringAll(","); err != nil {
-					panic(err)
+					return err
 				}
-			} else {
-				if state.truncateLastBracket() {
-					if err := state.WriteStringAll(","); err != nil {
-						panic(err)
+			} else if hasClosingBracket {
+				// Add the directories as keys to the object in the file
+				for i, buf := range state.bufs {
+					if !reopenObject(buf, fileStarts[i]) {
+						return fmt.Errorf("%s: expected JSON object", path)
 					}
-					hasClosingBracket = false
 				}
+				hasClosingBracket = false
+				isReopened = true
+				lens = state.bufLens()
 			}
 
-			dir := fileOrDir.Name()
+			// Key of map is the directory name, quoted as it may
+			// hold characters that need escaping in JSON
+			quotedKey, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if err := state.WriteAll(append(quotedKey, ':')); err != nil {
+				return err
+			}
+			parentFormat := state.format
+			state.format = k.format
+			path := topDir + "/" + strings.ReplaceAll(k.dir, "\\", "/") + "/" + state.opts.formatFilename(state.format)
+			filesRead := state.filesRead
+			emptyDirCount := len(state.emptyDirs)
+			if k.chunkSize > 0 && !state.opts.isCombined(path, state.entryDepth) {
+				// Chunk files are always JSON
+				state.format = ""
+				if err := state.decodeChunks(dirOf(path)); err != nil {
+					return err
+				}
+			} else if err := state.decode(path, k.t); err != nil {
+				return err
+			}
+			state.format = parentFormat
+			// Anything written after the directory belongs to us again
+			state.markSegment(parentPath)
+			if state.filesRead == filesRead {
+				// Only report the outermost directory of an empty tree
+				state.emptyDirs = append(state.emptyDirs[:emptyDirCount], dirOf(path))
 
-			// Key of map is the directory name
-			if err := state.WriteStringAll("\"" + dir + "\":"); err != nil {
-				panic(err)
+				// Leave out the key so the decoded value is the same as
+				// if the directory didn't exist
+				for i, buf := range state.bufs {
+					buf.Truncate(lens[i])
+					if isReopened {
+						closeObject(buf)
+					}
+				}
+				state.segments = state.segments[:segmentCount]
+				hasClosingBracket = isReopened
+				continue
+			}
+			if k.orderKey != "" && !keysInFile[k.orderKey] {
+				order, err := state.readOrderFile(dirOf(path) + "/" + orderFilename)
+				if err != nil {
+					return err
+				}
+				if order != nil {
+					if err := state.WriteStringAll(",\"" + k.orderKey + "\":"); err != nil {
+						return err
+					}
+					if err := state.WriteAll(order); err != nil {
+						return err
+					}
+				}
 			}
-			path := topDir + "/" + strings.ReplaceAll(dir, "\\", "/") + "/index.json"
-			state.decode(path)
 			hasWrittenFirstField = true
 		}
 	}
 
 	if !hasClosingBracket {
 		if err := state.WriteRuneAll('}'); err != nil {
-			panic(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeElements reads the numbered directories next to path as the elements
+// of an array of type t, in the order of their index.
+func (state *decodeState) decodeElements(path string, fileStarts []int, hasFile bool, t reflect.Type) error {
+	topDir := dirOf(path)
+	dirList, err := state.source.ReadDirNames(topDir)
+	if err != nil {
+		return err
+	}
+	type element struct {
+		index int
+		dir   string
+	}
+	var elements []element
+	for _, dir := range dirList {
+		if state.opts.skipDir(dir) || state.isIgnored(topDir+"/"+dir) {
+			continue
+		}
+		index, err := strconv.Atoi(dir)
+		if err != nil || index < 0 || strconv.Itoa(index) != dir {
+			return fmt.Errorf("%s: directory %q is not an array index", topDir, dir)
+		}
+		elements = append(elements, element{index: index, dir: dir})
+	}
+	if len(elements) == 0 {
+		if hasFile {
+			// Empty arrays are written as-is to the file
+			return nil
+		}
+		return state.WriteStringAll("null")
+	}
+	if hasFile {
+		// The file is only written for empty arrays
+		if data := bytes.TrimSpace(state.bufs[0].Bytes()[fileStarts[0]:]); string(data) != "[]" {
+			return fmt.Errorf("%s: array elements are defined in the file and also as directories", path)
+		}
+		for i, buf := range state.bufs {
+			buf.Truncate(fileStarts[i])
+		}
+	}
+	sort.Slice(elements, func(i, j int) bool {
+		return elements[i].index < elements[j].index
+	})
+	if state.prefetcher != nil {
+		for _, element := range elements {
+			state.prefetcher.prefetch(topDir + "/" + element.dir + "/" + state.opts.formatFilename(state.format))
+		}
+	}
+	if err := state.WriteRuneAll('['); err != nil {
+		return err
+	}
+	for i, element := range elements {
+		if i > 0 {
+			if err := state.WriteRuneAll(','); err != nil {
+				return err
+			}
+		}
+		elementPath := topDir + "/" + element.dir + "/" + state.opts.formatFilename(state.format)
+		filesRead := state.filesRead
+		emptyDirCount := len(state.emptyDirs)
+		if err := state.decode(elementPath, t.Elem()); err != nil {
+			return err
+		}
+		// Anything written after the directory belongs to us again
+		state.markSegment(path)
+		if state.filesRead == filesRead {
+			// Only report the outermost directory of an empty tree
+			state.emptyDirs = append(state.emptyDirs[:emptyDirCount], dirOf(elementPath))
+		}
+	}
+	return state.WriteRuneAll(']')
+}
+
+// checkIntegerKey returns an error if t is a map with integer keys, as
+// written by mapKeyString, and key isn't an integer that fits in them
+func checkIntegerKey(t reflect.Type, key string) error {
+	t = derefType(t)
+	if t == nil || t.Kind() != reflect.Map || !isIntegerKeyType(t.Key()) {
+		return nil
+	}
+	kt := t.Key()
+	if reflect.PtrTo(kt).Implements(reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()) {
+		// encoding/json decodes the key with UnmarshalText
+		return nil
+	}
+	var err error
+	switch kt.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_, err = strconv.ParseInt(key, 10, kt.Bits())
+	default:
+		_, err = strconv.ParseUint(key, 10, kt.Bits())
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a valid %s map key", key, kt.String())
+	}
+	return nil
+}
+
+// isStructType reports whether t is a struct or a pointer to one
+func isStructType(t reflect.Type) bool {
+	t = derefType(t)
+	return t != nil && t.Kind() == reflect.Struct
+}
+
+// derefType returns the type that t points to, following any number of pointers
+func derefType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// emptyFileValue returns the JSON that a blank file of type t is treated as,
+// or nil if there's no sensible empty value, ie. for a number.
+func emptyFileValue(t reflect.Type) []byte {
+	if isDistributedArray(t) {
+		return []byte("[]")
+	}
+	t = derefType(t)
+	if t == nil {
+		return []byte("{}")
+	}
+	if isCustomMarshalerType(t) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Interface:
+		return []byte("{}")
+	}
+	return nil
+}
+
+// isDistributedArray reports whether values of type t have their
+// elements encoded into numbered directories
+func isDistributedArray(t reflect.Type) bool {
+	t = derefType(t)
+	if t == nil || isCustomMarshalerType(t) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		// []byte is encoded as a base64 string
+		return t.Elem().Kind() != reflect.Uint8
+	case reflect.Array:
+		return true
+	}
+	return false
+}
+
+// childType returns the type of the value stored under key within a value
+// of type t, or nil if it isn't known, ie. for interface{} values.
+func childType(t reflect.Type, key string) reflect.Type {
+	t = derefType(t)
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		return t.Elem()
+	case reflect.Struct:
+		if f, ok := structField(t, key); ok {
+			return f.typ
+		}
+	}
+	return nil
+}
+
+// structField returns the field of struct type t that key decodes into
+func structField(t reflect.Type, key string) (field, bool) {
+	t = derefType(t)
+	if t == nil || t.Kind() != reflect.Struct {
+		return field{}, false
+	}
+	fields := typeFields(t)
+	for _, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+	}
+	// Fallback to case-insensitive match like encoding/json
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// markSegment records that the data written into the buffers from now on belongs to path
+func (state *decodeState) markSegment(path string) {
+	state.segments = append(state.segments, fileSegment{
+		starts: state.bufLens(),
+		path:   path,
+	})
+}
+
+// fileError wraps an error returned by encoding/json with the path of the
+// file that the offending data in the buffer of the given side was read from.
+func (state *decodeState) fileError(err error, side int) error {
+	var offset int64
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+	case *trailingDataError:
+		offset = err.Offset
+	default:
+		return err
+	}
+	// Offset is the number of bytes read before the error occurred,
+	// so the offending byte is the one before it.
+	if offset > 0 {
+		offset--
+	}
+	path := state.entryFilename
+	for _, segment := range state.segments {
+		if int64(segment.starts[side]) > offset {
+			break
+		}
+		path = segment.path
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+// readFile writes the file at path into the buffers of every side, with
+// fileStarts being the current length of each buffer. It returns false
+// if the file doesn't exist.
+func (state *decodeState) readFile(path string, fileStarts []int) (bool, error) {
+	if err := state.ctx.Err(); err != nil {
+		return false, err
+	}
+	hasFile := false
+	isConflicted := false
+	if state.sidesDriver != nil {
+		var err error
+		hasFile, err = state.sidesDriver.HandleFileSides(state.ctx, path, state.sideBufs)
+		if err != nil {
+			return false, err
+		}
+		if hasFile {
+			size := 0
+			for i, buf := range state.bufs {
+				size += buf.Len() - fileStarts[i]
+			}
+			if err := state.countBytes(path, int64(size)); err != nil {
+				return false, err
+			}
+			state.filesRead++
+			if state.opts.ConflictResolver != nil {
+				if err := state.resolveDriverConflict(path, fileStarts); err != nil {
+					return false, fmt.Errorf("%s: %w", path, err)
+				}
+			} else {
+				isConflicted = true
+			}
+		}
+	}
+	if !hasFile {
+		f, err := state.source.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			// if error is not a "file does not exist" error
+			return false, err
+		}
+		if err != nil {
+			return false, nil
+		}
+		var r io.Reader = f
+		if state.opts.MaxTotalBytes > 0 {
+			// Stop reading once we're over the limit rather
+			// than reading the whole file in first
+			r = io.LimitReader(f, state.opts.MaxTotalBytes-state.totalBytes+1)
+		}
+		// Read straight into the first buffer rather than into a slice
+		// of its own first, so a large file isn't held in memory twice
+		buf := state.bufs[0]
+		if stat, ok := f.(interface{ Stat() (os.FileInfo, error) }); ok {
+			// Grow once up front, unless the file is over the limit anyway
+			if info, err := stat.Stat(); err == nil && info.Size() > 0 &&
+				(state.opts.MaxTotalBytes <= 0 || info.Size() <= state.opts.MaxTotalBytes-state.totalBytes) {
+				buf.Grow(int(info.Size()) + bytes.MinRead)
+			}
+		}
+		n, err := buf.ReadFrom(r)
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+		if err := state.countBytes(path, n); err != nil {
+			return false, err
+		}
+		state.filesRead++
+		for _, otherBuf := range state.bufs[1:] {
+			if _, err := otherBuf.Write(buf.Bytes()[fileStarts[0]:]); err != nil {
+				return false, err
+			}
+		}
+		if state.opts.ConflictMarkers != nil {
+			isConflicted, err = state.splitConflictMarkers(path, fileStarts)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	if state.opts.Gzip {
+		if err := state.rewriteFile(fileStarts, gunzip); err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if state.format != "" && !state.rawFormats {
+		codec, err := state.opts.codec(state.format)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := state.rewriteFile(fileStarts, codec.ToJSON); err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if state.opts.AllowComments {
+		if err := state.rewriteFile(fileStarts, func(data []byte) ([]byte, error) {
+			return stripComments(data), nil
+		}); err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if isConflicted {
+		state.hasMergeConflict = true
+	}
+	return true, nil
+}
+
+// rewriteFile replaces the bytes of the file that was last written
+// into each buffer with the result of calling fn on them.
+func (state *decodeState) rewriteFile(fileStarts []int, fn func(data []byte) ([]byte, error)) error {
+	for i, buf := range state.bufs {
+		data, err := fn(buf.Bytes()[fileStarts[i]:])
+		if err != nil {
+			return err
+		}
+		buf.Truncate(fileStarts[i])
+		if _, err := buf.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isIgnored reports whether the directory dir was listed in Options.IgnoreExtra
+func (state *decodeState) isIgnored(dir string) bool {
+	if state.ignoredPaths == nil {
+		return false
+	}
+	dir = cleanPath(dir)
+	return state.ignoredPaths[dir] || state.ignoredPaths[dir+"/"+state.opts.indexFilename()]
+}
+
+// countBytes records that n bytes were read from path and returns an
+// error if that puts us over Options.MaxTotalBytes
+func (state *decodeState) countBytes(path string, n int64) error {
+	state.totalBytes += n
+	if state.opts.MaxTotalBytes > 0 && state.totalBytes > state.opts.MaxTotalBytes {
+		return fmt.Errorf("%s: exceeded maximum total size of %d bytes", path, state.opts.MaxTotalBytes)
+	}
+	return nil
+}
+
+// trailingDataError is returned by decodeValue when there's more than
+// whitespace after the JSON value, as json.Unmarshal does
+type trailingDataError struct {
+	char byte
+	// Offset is the number of bytes read before the error occurred,
+	// like json.SyntaxError
+	Offset int64
+}
+
+func (err *trailingDataError) Error() string {
+	return fmt.Sprintf("invalid character %q after top-level value", rune(err.char))
+}
+
+// decodeValue decodes the JSON value in data into v with dec, which reads
+// from data. Unlike dec.Decode, it's an error for anything to follow it.
+func decodeValue(dec *json.Decoder, data []byte, v interface{}) error {
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err == io.EOF {
+		return nil
+	}
+	rest := bytes.TrimLeft(data[end:], " \t\r\n")
+	if len(rest) == 0 {
+		return nil
+	}
+	return &trailingDataError{char: rest[0], Offset: int64(len(data)-len(rest)) + 1}
+}
+
+// objectKeys returns the top-level keys of the JSON object in data
+func objectKeys(data []byte) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, errors.New("expected JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errors.New("expected JSON object key")
+		}
+		keys[key] = true
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
 		}
 	}
+	return keys, nil
 }
@@ -0,0 +1,1408 @@
+package dfjson
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+type decodeTestWorld struct {
+	Name      string                         `json:"name"`
+	Creatures map[string]*decodeTestCreature `json:"creatures" dfjson:"distributable"`
+}
+
+type decodeTestCreature struct {
+	HP int `json:"hp"`
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		entry   string
+		wantErr string
+	}{
+		{
+			name: "key in file and directory",
+			fsys: fstest.MapFS{
+				"index.json":                  {Data: []byte(`{"name": "world", "creatures": {}}`)},
+				"creatures/goblin/index.json": {Data: []byte(`{"hp": 1}`)},
+			},
+			wantErr: `index.json: key "creatures" is defined in the file and also as a directory`,
+		},
+		{
+			name: "missing entry directory",
+			fsys: fstest.MapFS{
+				"other/index.json": {Data: []byte(`{"name": "world"}`)},
+			},
+			entry:   "data/index.json",
+			wantErr: `open data: file does not exist`,
+		},
+		{
+			name: "malformed file",
+			fsys: fstest.MapFS{
+				"index.json":                  {Data: []byte(`{"name": "world"}`)},
+				"creatures/goblin/index.json": {Data: []byte(`{"hp": 1,}`)},
+			},
+			wantErr: `creatures/goblin/index.json: invalid character '}'`,
+		},
+		{
+			name: "wrong type",
+			fsys: fstest.MapFS{
+				"index.json":                  {Data: []byte(`{"name": "world"}`)},
+				"creatures/goblin/index.json": {Data: []byte(`{"hp": "many"}`)},
+			},
+			wantErr: `creatures/goblin/index.json: json: cannot unmarshal string`,
+		},
+		{
+			name: "not an object",
+			fsys: fstest.MapFS{
+				"index.json":                  {Data: []byte(`[]`)},
+				"creatures/goblin/index.json": {Data: []byte(`{"hp": 1}`)},
+			},
+			wantErr: `index.json: expected JSON object`,
+		},
+		{
+			name: "data after the object",
+			fsys: fstest.MapFS{
+				"index.json": {Data: []byte(`{"name": "world"} garbage {`)},
+			},
+			wantErr: `index.json: invalid character 'g' after top-level value`,
+		},
+		{
+			name: "data after the object with subdirectories",
+			fsys: fstest.MapFS{
+				"index.json":                  {Data: []byte("{\"name\": \"world\"}\n{\"name\": \"other\"}\n")},
+				"creatures/goblin/index.json": {Data: []byte(`{"hp": 1}`)},
+			},
+			wantErr: `index.json: invalid character`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := test.entry
+			if entry == "" {
+				entry = "index.json"
+			}
+			var out decodeTestWorld
+			err := UnmarshalFS(test.fsys, entry, &out, Options{})
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// deniedFS is an fs.FS that refuses to open the denied path
+type deniedFS struct {
+	fs.FS
+	denied string
+}
+
+func (fsys deniedFS) Open(name string) (fs.File, error) {
+	if name == fsys.denied {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return fsys.FS.Open(name)
+}
+
+func TestUnmarshalFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup returns the entry file to decode
+		setup      func(t *testing.T, root string) string
+		permission bool
+		want       error
+	}{
+		{
+			name: "missing entry directory",
+			setup: func(t *testing.T, root string) string {
+				return filepath.Join(root, "missing", "index.json")
+			},
+			want: fs.ErrNotExist,
+		},
+		{
+			name: "unreadable file",
+			setup: func(t *testing.T, root string) string {
+				if err := os.Chmod(filepath.Join(root, "creatures", "goblin", "index.json"), 0); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(root, "index.json")
+			},
+			permission: true,
+			want:       fs.ErrPermission,
+		},
+		{
+			name: "unreadable directory",
+			setup: func(t *testing.T, root string) string {
+				dir := filepath.Join(root, "creatures")
+				if err := os.Chmod(dir, 0); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() {
+					os.Chmod(dir, 0755)
+				})
+				return filepath.Join(root, "index.json")
+			},
+			permission: true,
+			want:       fs.ErrPermission,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.permission && (runtime.GOOS == "windows" || os.Geteuid() == 0) {
+				t.Skip("permissions can't be denied")
+			}
+			root := t.TempDir()
+			in := &decodeTestWorld{Name: "world", Creatures: map[string]*decodeTestCreature{"goblin": {HP: 1}}}
+			if err := MarshalTo(root, "index.json", in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			var out decodeTestWorld
+			_, err := Unmarshal(test.setup(t, root), &out, nil, nil)
+			if !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	// fs.FS sources return the same errors, which also tests
+	// permissions when running as root
+	fsys := fstest.MapFS{
+		"index.json":                  {Data: []byte(`{"name": "world"}`)},
+		"creatures/goblin/index.json": {Data: []byte(`{"hp": 1}`)},
+	}
+	var out decodeTestWorld
+	if err := UnmarshalFS(fsys, "missing/index.json", &out, Options{}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+	}
+	denied := deniedFS{FS: fsys, denied: "creatures/goblin/index.json"}
+	if err := UnmarshalFS(denied, "index.json", &out, Options{}); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got error %v, want %v", err, fs.ErrPermission)
+	}
+}
+
+// countingFS counts the files opened and bytes read from fsys
+type countingFS struct {
+	fsys      fs.FS
+	opened    int
+	paths     []string
+	bytesRead int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return f, nil
+	}
+	c.opened++
+	c.paths = append(c.paths, name)
+	return &countingFile{File: f, fsys: c}, nil
+}
+
+type countingFile struct {
+	fs.File
+	fsys *countingFS
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.fsys.bytesRead += n
+	return n, err
+}
+
+func TestMaxTotalBytes(t *testing.T) {
+	in := decodeTestWorld{Name: strings.Repeat("x", 1000), Creatures: make(map[string]*decodeTestCreature)}
+	for i := 0; i < 10; i++ {
+		in.Creatures["creature"+strconv.Itoa(i)] = &decodeTestCreature{HP: i}
+	}
+	files, err := Marshal("index.json", &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		maxTotalBytes int64
+		wantErr       string
+		maxBytesRead  int
+	}{
+		{
+			name: "no limit",
+		},
+		{
+			name:          "within limit",
+			maxTotalBytes: 2000,
+		},
+		{
+			name:          "entry file over limit",
+			maxTotalBytes: 100,
+			wantErr:       "index.json: exceeded maximum total size of 100 bytes",
+			maxBytesRead:  101,
+		},
+		{
+			name:          "directories over limit",
+			maxTotalBytes: 1050,
+			wantErr:       "exceeded maximum total size of 1050 bytes",
+			maxBytesRead:  1051,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := &countingFS{fsys: filesFS(files)}
+			var out decodeTestWorld
+			err := UnmarshalFS(fsys, "index.json", &out, Options{MaxTotalBytes: test.maxTotalBytes})
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fsys.opened != len(files) {
+					t.Errorf("opened %d files, want %d", fsys.opened, len(files))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+			if fsys.bytesRead > test.maxBytesRead {
+				t.Errorf("read %d bytes, want at most %d", fsys.bytesRead, test.maxBytesRead)
+			}
+			if fsys.opened >= len(files) {
+				t.Errorf("opened all %d files before stopping", fsys.opened)
+			}
+		})
+	}
+}
+
+type decodeTestStats struct {
+	Level int `json:"level"`
+}
+
+type decodeTestPlayer struct {
+	Name  string           `json:"name"`
+	Stats *decodeTestStats `json:"stats" dfjson:"distributable"`
+}
+
+func TestUnmarshalNilPointers(t *testing.T) {
+	tests := []struct {
+		name      string
+		fsys      fstest.MapFS
+		wantStats *decodeTestStats
+	}{
+		{
+			name: "directory exists",
+			fsys: fstest.MapFS{
+				"index.json":       {Data: []byte(`{"name": "p"}`)},
+				"stats/index.json": {Data: []byte(`{"level": 3}`)},
+			},
+			wantStats: &decodeTestStats{Level: 3},
+		},
+		{
+			name: "directory absent",
+			fsys: fstest.MapFS{
+				"index.json": {Data: []byte(`{"name": "p"}`)},
+			},
+		},
+		{
+			name: "directory empty",
+			fsys: fstest.MapFS{
+				"index.json": {Data: []byte(`{"name": "p"}`)},
+				"stats":      {Mode: fs.ModeDir | 0755},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out decodeTestPlayer
+			if err := UnmarshalFS(test.fsys, "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Stats, test.wantStats) {
+				t.Errorf("got %+v, want %+v", out.Stats, test.wantStats)
+			}
+
+			// A nil pointer to the whole value is allocated too
+			var outPtr *decodeTestPlayer
+			if err := UnmarshalFS(test.fsys, "index.json", &outPtr, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if outPtr == nil || outPtr.Name != "p" || !reflect.DeepEqual(outPtr.Stats, test.wantStats) {
+				t.Errorf("got %+v, want name %q and stats %+v", outPtr, "p", test.wantStats)
+			}
+		})
+	}
+}
+
+type decodeTestPrefilled struct {
+	Name      string                         `json:"name"`
+	Motto     string                         `json:"motto"`
+	Creatures map[string]*decodeTestCreature `json:"creatures" dfjson:"distributable"`
+	Stats     *decodeTestStats               `json:"stats" dfjson:"distributable"`
+}
+
+func TestUnmarshalPrefilled(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want decodeTestPrefilled
+	}{
+		{
+			name: "only the entry file",
+			fsys: fstest.MapFS{
+				"index.json": {Data: []byte(`{"name": "decoded"}`)},
+			},
+			want: decodeTestPrefilled{
+				Name:      "decoded",
+				Motto:     "prefilled",
+				Creatures: map[string]*decodeTestCreature{"goblin": {HP: 5}, "orc": {HP: 6}},
+				Stats:     &decodeTestStats{Level: 7},
+			},
+		},
+		{
+			name: "some map keys",
+			fsys: fstest.MapFS{
+				"index.json":                  {Data: []byte(`{"name": "decoded"}`)},
+				"creatures/goblin/index.json": {Data: []byte(`{"hp": 1}`)},
+				"creatures/bat/index.json":    {Data: []byte(`{"hp": 2}`)},
+			},
+			want: decodeTestPrefilled{
+				Name:      "decoded",
+				Motto:     "prefilled",
+				Creatures: map[string]*decodeTestCreature{"goblin": {HP: 1}, "orc": {HP: 6}, "bat": {HP: 2}},
+				Stats:     &decodeTestStats{Level: 7},
+			},
+		},
+		{
+			name: "pointer",
+			fsys: fstest.MapFS{
+				"index.json":       {Data: []byte(`{"motto": "decoded"}`)},
+				"stats/index.json": {Data: []byte(`{"level": 8}`)},
+			},
+			want: decodeTestPrefilled{
+				Name:      "prefilled",
+				Motto:     "decoded",
+				Creatures: map[string]*decodeTestCreature{"goblin": {HP: 5}, "orc": {HP: 6}},
+				Stats:     &decodeTestStats{Level: 8},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := decodeTestPrefilled{
+				Name:      "prefilled",
+				Motto:     "prefilled",
+				Creatures: map[string]*decodeTestCreature{"goblin": {HP: 5}, "orc": {HP: 6}},
+				Stats:     &decodeTestStats{Level: 7},
+			}
+			stats := out.Stats
+			if err := UnmarshalFS(test.fsys, "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, test.want) {
+				t.Errorf("got %s, want %s", decodeTestJSON(t, out), decodeTestJSON(t, test.want))
+			}
+			// Like encoding/json, the existing pointer is decoded into
+			if out.Stats != stats {
+				t.Error("got a new stats pointer, want the prefilled one")
+			}
+		})
+	}
+}
+
+func decodeTestJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestKeyFilter(t *testing.T) {
+	in := decodeTestWorld{
+		Name: "world",
+		Creatures: map[string]*decodeTestCreature{
+			"goblin_archer":  {HP: 1},
+			"goblin_warrior": {HP: 2},
+			"orc_archer":     {HP: 3},
+		},
+	}
+	files, err := Marshal("index.json", &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		keyFilter func(dirName string) bool
+		want      map[string]*decodeTestCreature
+		wantPaths []string
+	}{
+		{
+			name: "no filter",
+			want: in.Creatures,
+			wantPaths: []string{
+				"creatures/goblin_archer/index.json",
+				"creatures/goblin_warrior/index.json",
+				"creatures/orc_archer/index.json",
+				"index.json",
+			},
+		},
+		{
+			name: "prefix",
+			keyFilter: func(dirName string) bool {
+				return dirName == "creatures" || strings.HasPrefix(dirName, "goblin_")
+			},
+			want: map[string]*decodeTestCreature{
+				"goblin_archer":  {HP: 1},
+				"goblin_warrior": {HP: 2},
+			},
+			wantPaths: []string{
+				"creatures/goblin_archer/index.json",
+				"creatures/goblin_warrior/index.json",
+				"index.json",
+			},
+		},
+		{
+			name: "no matches",
+			keyFilter: func(dirName string) bool {
+				return dirName == "creatures"
+			},
+			wantPaths: []string{"index.json"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := &countingFS{fsys: filesFS(files)}
+			var out decodeTestWorld
+			if err := UnmarshalFS(fsys, "index.json", &out, Options{KeyFilter: test.keyFilter}); err != nil {
+				t.Fatal(err)
+			}
+			if len(out.Creatures) != 0 || len(test.want) != 0 {
+				if !reflect.DeepEqual(out.Creatures, test.want) {
+					t.Errorf("got %+v, want %+v", out.Creatures, test.want)
+				}
+			}
+			sort.Strings(fsys.paths)
+			if !reflect.DeepEqual(fsys.paths, test.wantPaths) {
+				t.Errorf("read %q, want %q", fsys.paths, test.wantPaths)
+			}
+		})
+	}
+}
+
+func TestEmptyDirStats(t *testing.T) {
+	files := fstest.MapFS{
+		"index.json":                  {Data: []byte(`{"name": "world"}`)},
+		"creatures/goblin/index.json": {Data: []byte(`{"hp": 1}`)},
+	}
+	dir := &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	tests := []struct {
+		name      string
+		dirs      []string
+		want      map[string]*decodeTestCreature
+		wantEmpty []string
+	}{
+		{
+			name: "none",
+			want: map[string]*decodeTestCreature{"goblin": {HP: 1}},
+		},
+		{
+			name:      "empty key directory",
+			dirs:      []string{"creatures/ghost"},
+			want:      map[string]*decodeTestCreature{"goblin": {HP: 1}},
+			wantEmpty: []string{"creatures/ghost"},
+		},
+		{
+			name:      "nested empty directories",
+			dirs:      []string{"creatures/ghost/a/b", "creatures/ghost/c"},
+			want:      map[string]*decodeTestCreature{"goblin": {HP: 1}},
+			wantEmpty: []string{"creatures/ghost"},
+		},
+		{
+			name:      "empty directories after data",
+			dirs:      []string{"creatures/orc", "empty"},
+			want:      map[string]*decodeTestCreature{"goblin": {HP: 1}},
+			wantEmpty: []string{"creatures/orc", "empty"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := make(fstest.MapFS, len(files)+len(test.dirs))
+			for path, file := range files {
+				fsys[path] = file
+			}
+			for _, path := range test.dirs {
+				fsys[path] = dir
+			}
+			var stats DecodeStats
+			var out decodeTestWorld
+			if err := UnmarshalFS(fsys, "index.json", &out, Options{Stats: &stats}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Creatures, test.want) {
+				t.Errorf("got %+v, want %+v", out.Creatures, test.want)
+			}
+			if !reflect.DeepEqual(stats.EmptyDirs, test.wantEmpty) {
+				t.Errorf("got empty dirs %q, want %q", stats.EmptyDirs, test.wantEmpty)
+			}
+			if stats.FilesRead != len(files) {
+				t.Errorf("read %d files, want %d", stats.FilesRead, len(files))
+			}
+		})
+	}
+}
+
+func TestUnmarshalSides(t *testing.T) {
+	goblinSides := map[string][]byte{
+		dfvcs.SideBase:   []byte(`{"hp": 1}`),
+		dfvcs.SideOurs:   []byte(`{"hp": 2}`),
+		dfvcs.SideTheirs: []byte(`{"hp": 3}`),
+		"upstream":       []byte(`{"hp": 4}`),
+	}
+	tests := []struct {
+		name      string
+		sides     []string
+		driver    func(goblinPath string) dfvcs.SidesDriver
+		wantHP    map[string]int
+		wantMerge bool
+	}{
+		{
+			name:  "three sides",
+			sides: []string{dfvcs.SideBase, dfvcs.SideOurs, dfvcs.SideTheirs},
+			driver: func(goblinPath string) dfvcs.SidesDriver {
+				driver := dfvcs.NewMockDriver()
+				driver.AddSides(goblinPath, goblinSides)
+				return driver
+			},
+			wantHP:    map[string]int{dfvcs.SideBase: 1, dfvcs.SideOurs: 2, dfvcs.SideTheirs: 3},
+			wantMerge: true,
+		},
+		{
+			name:  "custom side",
+			sides: []string{dfvcs.SideBase, dfvcs.SideOurs, dfvcs.SideTheirs, "upstream"},
+			driver: func(goblinPath string) dfvcs.SidesDriver {
+				driver := dfvcs.NewMockDriver()
+				driver.AddSides(goblinPath, goblinSides)
+				return driver
+			},
+			wantHP:    map[string]int{dfvcs.SideBase: 1, dfvcs.SideOurs: 2, dfvcs.SideTheirs: 3, "upstream": 4},
+			wantMerge: true,
+		},
+		{
+			name:  "two sided driver",
+			sides: []string{dfvcs.SideBase, dfvcs.SideOurs, dfvcs.SideTheirs},
+			driver: func(goblinPath string) dfvcs.SidesDriver {
+				driver := dfvcs.NewMockDriver()
+				driver.Add(goblinPath, goblinSides[dfvcs.SideOurs], goblinSides[dfvcs.SideTheirs])
+				return dfvcs.SidesFromVCSDriver(driver)
+			},
+			wantHP:    map[string]int{dfvcs.SideBase: 2, dfvcs.SideOurs: 2, dfvcs.SideTheirs: 3},
+			wantMerge: true,
+		},
+		{
+			name:  "no conflicts",
+			sides: []string{dfvcs.SideBase, dfvcs.SideOurs, dfvcs.SideTheirs},
+			driver: func(goblinPath string) dfvcs.SidesDriver {
+				return dfvcs.NewMockDriver()
+			},
+			// Only ours is decoded if there's nothing to merge
+			wantHP: map[string]int{dfvcs.SideOurs: 5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			in := &decodeTestWorld{Name: "world", Creatures: map[string]*decodeTestCreature{"goblin": {HP: 5}}}
+			if err := MarshalTo(root, "index.json", in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			targets := make(map[string]interface{}, len(test.sides))
+			for _, side := range test.sides {
+				targets[side] = &decodeTestWorld{}
+			}
+			driver := test.driver(filepath.Join(root, "creatures", "goblin", "index.json"))
+			hasMergeConflict, err := UnmarshalSides(filepath.Join(root, "index.json"), targets, driver, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasMergeConflict != test.wantMerge {
+				t.Errorf("got merge conflict %v, want %v", hasMergeConflict, test.wantMerge)
+			}
+			for side, target := range targets {
+				world := target.(*decodeTestWorld)
+				wantHP, ok := test.wantHP[side]
+				if !ok {
+					if world.Creatures != nil {
+						t.Errorf("%s: got %+v, want it left as is", side, world)
+					}
+					continue
+				}
+				if goblin := world.Creatures["goblin"]; goblin == nil || goblin.HP != wantHP || world.Name != "world" {
+					t.Errorf("%s: got %+v with goblin %+v, want hp %d", side, world, goblin, wantHP)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalWithBase(t *testing.T) {
+	tests := []struct {
+		name     string
+		sides    map[string][]byte
+		wantBase *decodeTestCreature
+	}{
+		{
+			name: "modified on both sides",
+			sides: map[string][]byte{
+				dfvcs.SideBase:   []byte(`{"hp": 1}`),
+				dfvcs.SideOurs:   []byte(`{"hp": 2}`),
+				dfvcs.SideTheirs: []byte(`{"hp": 3}`),
+			},
+			wantBase: &decodeTestCreature{HP: 1},
+		},
+		{
+			name: "added on both sides",
+			sides: map[string][]byte{
+				dfvcs.SideBase:   []byte(`{}`),
+				dfvcs.SideOurs:   []byte(`{"hp": 2}`),
+				dfvcs.SideTheirs: []byte(`{"hp": 3}`),
+			},
+			wantBase: &decodeTestCreature{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			in := &decodeTestWorld{Name: "world", Creatures: map[string]*decodeTestCreature{"goblin": {HP: 5}}}
+			if err := MarshalTo(root, "index.json", in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			driver := dfvcs.NewMockDriver()
+			driver.AddSides(filepath.Join(root, "creatures", "goblin", "index.json"), test.sides)
+			var ours, theirs, base decodeTestWorld
+			hasMergeConflict, err := UnmarshalWithBase(filepath.Join(root, "index.json"), &ours, &theirs, &base, driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hasMergeConflict {
+				t.Error("expected a merge conflict")
+			}
+			if got := base.Creatures["goblin"]; !reflect.DeepEqual(got, test.wantBase) || base.Name != "world" {
+				t.Errorf("got base %+v with goblin %+v, want goblin %+v", base, got, test.wantBase)
+			}
+			if ours.Creatures["goblin"].HP != 2 || theirs.Creatures["goblin"].HP != 3 {
+				t.Errorf("got ours %+v and theirs %+v", ours.Creatures["goblin"], theirs.Creatures["goblin"])
+			}
+		})
+	}
+}
+
+func ExampleUnmarshal_mockDriver() {
+	root, err := os.MkdirTemp("", "dfjson")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+	world := &decodeTestWorld{
+		Name:      "world",
+		Creatures: map[string]*decodeTestCreature{"goblin": {HP: 10}},
+	}
+	if err := MarshalTo(root, "index.json", world, Options{}); err != nil {
+		panic(err)
+	}
+
+	// The goblin was edited on both sides of a merge
+	driver := dfvcs.NewMockDriver()
+	driver.Add(filepath.Join(root, "creatures", "goblin", "index.json"), []byte(`{"hp": 15}`), []byte(`{"hp": 20}`))
+
+	var ours, theirs decodeTestWorld
+	hasMergeConflict, err := Unmarshal(filepath.Join(root, "index.json"), &ours, &theirs, driver)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(hasMergeConflict)
+	fmt.Println(ours.Creatures["goblin"].HP, theirs.Creatures["goblin"].HP)
+	// Output:
+	// true
+	// 15 20
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	root := b.TempDir()
+	if err := MarshalTo(root, "index.json", newBenchmarkWorld(1000), Options{}); err != nil {
+		b.Fatal(err)
+	}
+	entryFilename := filepath.Join(root, "index.json")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out encodeTestWorld
+		if _, err := Unmarshal(entryFilename, &out, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUnmarshalDirs decodes a tree with thousands of subdirectories,
+// where most of the time goes to listing and opening them
+func BenchmarkUnmarshalDirs(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			root := b.TempDir()
+			if err := MarshalTo(root, "index.json", newBenchmarkWorld(n), Options{}); err != nil {
+				b.Fatal(err)
+			}
+			entryFilename := filepath.Join(root, "index.json")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var out encodeTestWorld
+				if _, err := Unmarshal(entryFilename, &out, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// cancelSource is a fileSource that cancels decoding once it
+// has opened cancelAfter files
+type cancelSource struct {
+	fileSource
+	cancel      context.CancelFunc
+	cancelAfter int
+
+	mu     sync.Mutex
+	opened int
+}
+
+func (source *cancelSource) Open(path string) (io.ReadCloser, error) {
+	source.mu.Lock()
+	source.opened++
+	if source.opened == source.cancelAfter {
+		source.cancel()
+	}
+	source.mu.Unlock()
+	return source.fileSource.Open(path)
+}
+
+// cancelDriver is a dfvcs.SidesDriver that cancels decoding once
+// it has been asked for cancelAfter files
+type cancelDriver struct {
+	*dfvcs.MockDriver
+	cancel      context.CancelFunc
+	cancelAfter int
+	handled     int
+}
+
+func (driver *cancelDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	driver.handled++
+	if driver.handled == driver.cancelAfter {
+		driver.cancel()
+	}
+	return driver.MockDriver.HandleFileSides(ctx, path, sides)
+}
+
+func TestUnmarshalContext(t *testing.T) {
+	files, err := Marshal("index.json", newBenchmarkWorld(2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("cancelled while reading files", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		source := &cancelSource{fileSource: newMemorySource(files), cancel: cancel, cancelAfter: 100}
+		var out encodeTestWorld
+		_, err := unmarshalSides(ctx, source, "index.json", map[string]interface{}{dfvcs.SideOurs: &out}, nil, Options{})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+		// Decoding stops at the next file rather than reading the rest of the tree
+		if source.opened != source.cancelAfter {
+			t.Errorf("opened %d files, want %d", source.opened, source.cancelAfter)
+		}
+	})
+	t.Run("cancelled by the driver", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		driver := &cancelDriver{MockDriver: dfvcs.NewMockDriver(), cancel: cancel, cancelAfter: 10}
+		var ours, theirs encodeTestWorld
+		targets := map[string]interface{}{dfvcs.SideOurs: &ours, dfvcs.SideTheirs: &theirs}
+		_, err := unmarshalSides(ctx, newMemorySource(files), "index.json", targets, driver, Options{})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+		if driver.handled != driver.cancelAfter {
+			t.Errorf("driver handled %d files, want %d", driver.handled, driver.cancelAfter)
+		}
+	})
+	t.Run("deadline on disk", func(t *testing.T) {
+		root := t.TempDir()
+		if err := WriteFiles(root, files, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		<-ctx.Done()
+		var out encodeTestWorld
+		_, err := UnmarshalContext(ctx, filepath.Join(root, "index.json"), &out, nil, nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+		if out.Name != "" || out.Creatures != nil {
+			t.Errorf("got %+v, want nothing decoded", out)
+		}
+	})
+}
+
+// decodeTestContextKey is the key of a value that
+// contextDriver expects every context to hold
+type decodeTestContextKey struct{}
+
+// contextDriver is a dfvcs.VCSDriver that records the value of
+// decodeTestContextKey in each context it's given
+type contextDriver struct {
+	*dfvcs.MockDriver
+	values []interface{}
+}
+
+func (driver *contextDriver) Init(ctx context.Context) error {
+	driver.values = append(driver.values, ctx.Value(decodeTestContextKey{}))
+	return driver.MockDriver.Init(ctx)
+}
+
+func (driver *contextDriver) HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
+	driver.values = append(driver.values, ctx.Value(decodeTestContextKey{}))
+	return driver.MockDriver.HandleFile(ctx, path, oursBuffer, theirsBuffer)
+}
+
+func (driver *contextDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	driver.values = append(driver.values, ctx.Value(decodeTestContextKey{}))
+	return driver.MockDriver.HandleFileSides(ctx, path, sides)
+}
+
+func TestUnmarshalContextDriver(t *testing.T) {
+	root := t.TempDir()
+	if err := MarshalTo(root, "index.json", newBenchmarkWorld(3), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	driver := &contextDriver{MockDriver: dfvcs.NewMockDriver()}
+	driver.Add(filepath.Join(root, "creatures", "creature1", "index.json"), []byte(`{"hp": 1}`), []byte(`{"hp": 2}`))
+
+	ctx := context.WithValue(context.Background(), decodeTestContextKey{}, "caller")
+	var ours, theirs encodeTestWorld
+	hasMergeConflict, err := UnmarshalContext(ctx, filepath.Join(root, "index.json"), &ours, &theirs, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasMergeConflict {
+		t.Error("expected a merge conflict")
+	}
+	// Init and a call for each of the 5 files
+	if len(driver.values) != 6 {
+		t.Errorf("driver was called %d times, want 6", len(driver.values))
+	}
+	for i, value := range driver.values {
+		if value != "caller" {
+			t.Errorf("call %d: got context value %v, want the context of the caller", i, value)
+		}
+	}
+}
+
+// closeDriver is a dfvcs.SidesDriver that counts calls to Close and
+// returns the errors set on it
+type closeDriver struct {
+	*dfvcs.MockDriver
+	initErr, handleErr, closeErr error
+	closed                       int
+}
+
+func (driver *closeDriver) Init(ctx context.Context) error {
+	if driver.initErr != nil {
+		return driver.initErr
+	}
+	return driver.MockDriver.Init(ctx)
+}
+
+func (driver *closeDriver) HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
+	if driver.handleErr != nil {
+		return false, driver.handleErr
+	}
+	return driver.MockDriver.HandleFile(ctx, path, oursBuffer, theirsBuffer)
+}
+
+func (driver *closeDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	if driver.handleErr != nil {
+		return false, driver.handleErr
+	}
+	return driver.MockDriver.HandleFileSides(ctx, path, sides)
+}
+
+func (driver *closeDriver) Close() error {
+	driver.closed++
+	return driver.closeErr
+}
+
+func TestUnmarshalClosesDriver(t *testing.T) {
+	errDriver := errors.New("driver failed")
+	tests := []struct {
+		name    string
+		driver  *closeDriver
+		theirs  string
+		wantErr error
+	}{
+		{name: "decoded", driver: &closeDriver{}, theirs: `{"hp": 2}`},
+		{name: "init fails", driver: &closeDriver{initErr: errDriver}, theirs: `{"hp": 2}`, wantErr: errDriver},
+		{name: "handle file fails", driver: &closeDriver{handleErr: errDriver}, theirs: `{"hp": 2}`, wantErr: errDriver},
+		{name: "decoding fails", driver: &closeDriver{}, theirs: `{"hp": "many"}`, wantErr: new(json.UnmarshalTypeError)},
+		{name: "close fails", driver: &closeDriver{closeErr: errDriver}, theirs: `{"hp": 2}`, wantErr: errDriver},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := MarshalTo(root, "index.json", newBenchmarkWorld(3), Options{}); err != nil {
+				t.Fatal(err)
+			}
+			driver := test.driver
+			driver.MockDriver = dfvcs.NewMockDriver()
+			driver.Add(filepath.Join(root, "creatures", "creature1", "index.json"), []byte(`{"hp": 1}`), []byte(test.theirs))
+
+			var ours, theirs encodeTestWorld
+			_, err := Unmarshal(filepath.Join(root, "index.json"), &ours, &theirs, driver)
+			switch want := test.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case *json.UnmarshalTypeError:
+				if !errors.As(err, &want) {
+					t.Errorf("got error %v, want a %T", err, want)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Errorf("got error %v, want %v", err, want)
+				}
+			}
+			if driver.closed != 1 {
+				t.Errorf("driver was closed %d times, want once", driver.closed)
+			}
+		})
+	}
+}
+
+// peakHeap samples the bytes of heap objects until the returned function
+// is called, which returns the most that were seen
+func peakHeap() func() uint64 {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		ticker := time.NewTicker(50 * time.Microsecond)
+		defer ticker.Stop()
+		for {
+			metrics.Read(samples)
+			if value := samples[0].Value.Uint64(); value > max {
+				max = value
+			}
+			select {
+			case <-done:
+				peak <- max
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		return <-peak
+	}
+}
+
+// BenchmarkUnmarshalLargeFiles decodes a few files of 8MB each, reporting
+// the peak heap size above what was in use before decoding
+func BenchmarkUnmarshalLargeFiles(b *testing.B) {
+	world := &decodeTestWorld{Name: "world", Creatures: make(map[string]*decodeTestCreature)}
+	files, err := Marshal("index.json", world)
+	if err != nil {
+		b.Fatal(err)
+	}
+	large := `{"hp": 1, "notes": "` + strings.Repeat("a", 8<<20) + `"}`
+	for _, name := range []string{"a", "b", "c", "d"} {
+		files = append(files, JSONFile{Path: "creatures/" + name + "/index.json", Data: []byte(large)})
+	}
+	root := b.TempDir()
+	if err := WriteFiles(root, files, 0644); err != nil {
+		b.Fatal(err)
+	}
+	entryFilename := filepath.Join(root, "index.json")
+	b.ReportAllocs()
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+		stop := peakHeap()
+		b.StartTimer()
+		var out decodeTestWorld
+		if _, err := Unmarshal(entryFilename, &out, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		if p := stop() - before.HeapAlloc; p > peak {
+			peak = p
+		}
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(peak), "peak-heap-B")
+}
+
+func TestInitialBufferSize(t *testing.T) {
+	in := newBenchmarkWorld(20)
+	want, err := Marshal("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{1, 64, 1 << 20} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			opts := Options{InitialBufferSize: size}
+			files, err := MarshalWithOptions("index.json", in, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("got %q, want %q", fileData(files), fileData(want))
+			}
+			var out encodeTestWorld
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("decoded %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+func BenchmarkInitialBufferSize(b *testing.B) {
+	files, err := Marshal("index.json", newBenchmarkWorld(1000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// The files are read into the buffer as is, with the keys of the
+	// directories that they were in
+	var size int
+	for _, file := range files {
+		size += len(file.Data) + len(file.Path)
+	}
+	fsys := filesFS(files)
+	for _, size := range []int{0, size} {
+		b.Run("size="+strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var out encodeTestWorld
+				if err := UnmarshalFS(fsys, "index.json", &out, Options{InitialBufferSize: size}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalTopLevelMap(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+	}{
+		{"structs", map[string]decodeTestCreature{"goblin": {HP: 1}, "orc": {HP: 2}}},
+		{"nested distributable fields", map[string]*decodeTestWorld{
+			"a": {Name: "a", Creatures: map[string]*decodeTestCreature{"goblin": {HP: 1}}},
+			"b": {Name: "b"},
+		}},
+		{"integer keys", map[int]*decodeTestPlayer{-1: {Name: "p", Stats: &decodeTestStats{Level: 3}}}},
+		{"empty", map[string]decodeTestCreature{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("data/index.json", test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := reflect.New(reflect.TypeOf(test.in))
+			if err := UnmarshalFS(filesFS(files), "data/index.json", out.Interface(), Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.Elem().Interface(); !reflect.DeepEqual(got, test.in) {
+				t.Errorf("got %+v, want %+v", got, test.in)
+			}
+		})
+	}
+}
+
+func TestReopenObject(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`{"a": 1}`, `{"a": 1,`},
+		{"{\"a\": 1}\n", `{"a": 1,`},
+		{`{}`, `{`},
+		{"{\n}\n", "{\n"},
+		{`{"note": "closed }"}`, `{"note": "closed }",`},
+		{`{"note": "quote \" }"}`, `{"note": "quote \" }",`},
+		{`{"note": "backslash \\"}`, `{"note": "backslash \\",`},
+		{`{"a": {"b": "}"}}`, `{"a": {"b": "}"},`},
+		{`{"a": {}}`, `{"a": {},`},
+	}
+	for _, test := range tests {
+		// Data before the file must be left alone
+		buf := bytes.NewBufferString(`{"x":`)
+		start := buf.Len()
+		buf.WriteString(test.data)
+		if !reopenObject(buf, start) {
+			t.Errorf("%s: no closing bracket found", test.data)
+			continue
+		}
+		if got := buf.String()[start:]; got != test.want {
+			t.Errorf("%s: got %s, want %s", test.data, got, test.want)
+		}
+		closeObject(buf)
+		if !json.Valid(append(buf.Bytes(), '}')) {
+			t.Errorf("%s: got %s after closing it again", test.data, buf.Bytes())
+		}
+	}
+	for _, data := range []string{`"}"`, `[1]`, ``} {
+		if reopenObject(bytes.NewBufferString(data), 0) {
+			t.Errorf("%s: got a closing bracket", data)
+		}
+	}
+}
+
+func TestUnmarshalBracesInStrings(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.json":                  {Data: []byte(`{"name": "closed } \" }"}`)},
+		"creatures/goblin/index.json": {Data: []byte(`{"hp": 1}`)},
+	}
+	var out decodeTestWorld
+	if err := UnmarshalFS(fsys, "index.json", &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	want := decodeTestWorld{Name: `closed } " }`, Creatures: map[string]*decodeTestCreature{"goblin": {HP: 1}}}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %+v, want %+v", out, want)
+	}
+}
+
+func TestUnmarshalEmptyFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		worldData string
+		want      decodeTestWorld
+	}{
+		{"empty", "", decodeTestWorld{Name: "old"}},
+		{"whitespace", " \n\t\r\n", decodeTestWorld{Name: "old"}},
+		{"empty object", "{}", decodeTestWorld{Name: "old"}},
+		{"empty object with whitespace", "\n{ }\n", decodeTestWorld{Name: "old"}},
+		{"object", `{"name": "world"}`, decodeTestWorld{Name: "world"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"index.json":                  {Data: []byte(test.worldData)},
+				"creatures/goblin/index.json": {Data: []byte(test.worldData)},
+				"creatures/orc/index.json":    {Data: []byte(`{"hp": 2}`)},
+			}
+			out := decodeTestWorld{Name: "old"}
+			if err := UnmarshalFS(fsys, "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			want := test.want
+			want.Creatures = map[string]*decodeTestCreature{"goblin": {}, "orc": {HP: 2}}
+			if !reflect.DeepEqual(out, want) {
+				t.Errorf("got %+v, want %+v", out, want)
+			}
+		})
+	}
+}
+
+func TestDirFilter(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.json":                        {Data: []byte(`{"name": "world"}`)},
+		"creatures/goblin/index.json":       {Data: []byte(`{"hp": 1}`)},
+		"creatures/.git/HEAD":               {Data: []byte(`ref: refs/heads/main`)},
+		"creatures/.git/objects/ab/cdef":    {Data: []byte(`not json`)},
+		"creatures/node_modules/index.json": {Data: []byte(`{"hp": 3}`)},
+		".svn/index.json":                   {Data: []byte(`not json`)},
+	}
+	tests := []struct {
+		name      string
+		dirFilter func(dirName string) bool
+		want      map[string]*decodeTestCreature
+	}{
+		{
+			name: "default skips hidden directories",
+			want: map[string]*decodeTestCreature{"goblin": {HP: 1}, "node_modules": {HP: 3}},
+		},
+		{
+			name: "custom",
+			dirFilter: func(dirName string) bool {
+				return !strings.HasPrefix(dirName, ".") && dirName != "node_modules"
+			},
+			want: map[string]*decodeTestCreature{"goblin": {HP: 1}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out decodeTestWorld
+			if err := NewDecoder(WithDirFilter(test.dirFilter)).DecodeFS(fsys, "index.json", &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Creatures, test.want) {
+				t.Errorf("got %+v, want %+v", out.Creatures, test.want)
+			}
+		})
+	}
+}
+
+type decodeTestNode struct {
+	Children map[string]*decodeTestNode `json:"children" dfjson:"distributable"`
+}
+
+// newDecodeTestTree returns a node with depth levels of children below it
+func newDecodeTestTree(depth int) *decodeTestNode {
+	root := &decodeTestNode{}
+	for node, i := root, 0; i < depth; i++ {
+		child := &decodeTestNode{}
+		node.Children = map[string]*decodeTestNode{"n": child}
+		node = child
+	}
+	return root
+}
+
+func TestMaxDepth(t *testing.T) {
+	tests := []struct {
+		name     string
+		depth    int
+		maxDepth int
+		wantErr  string
+	}{
+		{"within limit", 1, 4, ""},
+		{"at limit", 2, 4, ""},
+		{"above limit", 3, 4, "data/children/n/children/n/children: exceeded maximum depth of 4"},
+		{"above default limit", 33, 0, "data" + strings.Repeat("/children/n", 32) + "/children: exceeded maximum depth of 64"},
+		{"no limit", 40, -1, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := newDecodeTestTree(test.depth)
+			opts := Options{MaxDepth: test.maxDepth}
+			files, err := MarshalWithOptions("data/index.json", in, opts)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("marshal: got error %v, want %q", err, test.wantErr)
+				}
+				// Decode a tree written without the limit
+				files, err = MarshalWithOptions("data/index.json", in, Options{MaxDepth: -1})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out decodeTestNode
+			err = UnmarshalFS(filesFS(files), "data/index.json", &out, opts)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("unmarshal: got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("decoded tree differs from the encoded one")
+			}
+		})
+	}
+}
+
+type decodeTestNumbers struct {
+	Exact  int64                  `json:"exact"`
+	Values map[string]interface{} `json:"values" dfjson:"distributable"`
+}
+
+func TestUseNumber(t *testing.T) {
+	// 1<<53 + 1 is the smallest integer that a float64 can't hold
+	const large = int64(1)<<53 + 1
+	in := &decodeTestNumbers{
+		Exact: large,
+		Values: map[string]interface{}{
+			"large":   large,
+			"decimal": json.Number("0.1000000000000000055511151231257827"),
+		},
+	}
+	files, err := Marshal("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		useNumber bool
+		want      map[string]interface{}
+	}{
+		{
+			name:      "use number",
+			useNumber: true,
+			want: map[string]interface{}{
+				"large":   json.Number("9007199254740993"),
+				"decimal": json.Number("0.1000000000000000055511151231257827"),
+			},
+		},
+		{
+			name: "float64",
+			want: map[string]interface{}{
+				"large":   float64(large),
+				"decimal": 0.1,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dec := NewDecoder()
+			if test.useNumber {
+				dec.UseNumber()
+			}
+			var out decodeTestNumbers
+			if err := dec.DecodeFS(filesFS(files), "index.json", &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Exact != large {
+				t.Errorf("got exact %d, want %d", out.Exact, large)
+			}
+			if !reflect.DeepEqual(out.Values, test.want) {
+				t.Errorf("got %#v, want %#v", out.Values, test.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,49 @@
 package dfgit
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
 )
 
 type GitDriver struct {
-	gitPath           string
-	gitTopPath        string
+	// Batch makes Init read every side of every conflicted file up front
+	// using a single "git cat-file --batch" process, rather than running
+	// git for each of them as they're decoded. This is much faster when
+	// there are many conflicts, at the cost of holding them all in memory.
+	Batch bool
+
+	gitPath    string
+	gitTopPath string
+	// theirsRef is the ref of the other side of the operation in progress,
+	// one of theirsRefs, or empty if there isn't one
+	theirsRef         string
+	mergeBase         string
 	conflictedFileMap map[string]bool
+	// batchFiles maps "<ref>:<path>" to the contents of
+	// the file at path in ref, if Batch is set
+	batchFiles map[string]string
 }
 
-var _ dfvcs.VCSDriver = new(GitDriver)
+var (
+	_ dfvcs.VCSDriver   = new(GitDriver)
+	_ dfvcs.SidesDriver = new(GitDriver)
+)
+
+// theirsRefs are the refs that git keeps the other side in while a merge,
+// cherry-pick or rebase is stopped on conflicts, in the order they're looked for
+var theirsRefs = []string{"MERGE_HEAD", "CHERRY_PICK_HEAD", "REBASE_HEAD"}
 
-func (vcs *GitDriver) Init() error {
+func (vcs *GitDriver) Init(ctx context.Context) error {
 	// Get time taken
 	//startTime := time.Now()
 	//defer func() {
@@ -27,6 +52,7 @@ func (vcs *GitDriver) Init() error {
 
 	// Reset
 	vcs.conflictedFileMap = make(map[string]bool)
+	vcs.batchFiles = nil
 
 	// Check if we have git
 	{
@@ -39,7 +65,7 @@ func (vcs *GitDriver) Init() error {
 
 	// Get the top level directory
 	{
-		topPath, err := execCommand(vcs.gitPath, "rev-parse", "--show-toplevel")
+		topPath, err := execCommand(ctx, vcs.gitPath, "rev-parse", "--show-toplevel")
 		if err != nil {
 			return err
 		}
@@ -48,9 +74,43 @@ func (vcs *GitDriver) Init() error {
 		vcs.gitTopPath = topPath
 	}
 
+	// Get the other side of the merge, cherry-pick or rebase in progress,
+	// if there is one, and the common ancestor of both sides
+	{
+		vcs.theirsRef = ""
+		vcs.mergeBase = ""
+		for _, ref := range theirsRefs {
+			if vcs.hasRef(ctx, ref) {
+				vcs.theirsRef = ref
+				break
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch vcs.theirsRef {
+		case "MERGE_HEAD":
+			mergeBase, err := execCommand(ctx, vcs.gitPath, "merge-base", "HEAD", "MERGE_HEAD")
+			if err != nil {
+				return err
+			}
+			vcs.mergeBase = strings.TrimSpace(mergeBase)
+		case "CHERRY_PICK_HEAD", "REBASE_HEAD":
+			// Only the changes of that commit are applied, so its
+			// parent is the common ancestor rather than the merge base
+			if parent := vcs.theirsRef + "^"; vcs.hasRef(ctx, parent) {
+				mergeBase, err := execCommand(ctx, vcs.gitPath, "rev-parse", parent)
+				if err != nil {
+					return err
+				}
+				vcs.mergeBase = strings.TrimSpace(mergeBase)
+			}
+		}
+	}
+
 	// Get the files changed
 	{
-		cmd := exec.Command(vcs.gitPath, "--no-pager", "diff", "--name-status")
+		cmd := exec.CommandContext(ctx, vcs.gitPath, "--no-pager", "diff", "--name-status", "-z")
 		cmdOut, err := cmd.StdoutPipe()
 		if err != nil {
 			return err
@@ -62,50 +122,251 @@ func (vcs *GitDriver) Init() error {
 		if err := cmd.Start(); err != nil {
 			return err
 		}
-		errOutput, err := ioutil.ReadAll(cmdErr)
+		errOutput, err := io.ReadAll(cmdErr)
 		if err != nil {
 			return err
 		}
-		stdOutput, err := ioutil.ReadAll(cmdOut)
+		stdOutput, err := io.ReadAll(cmdOut)
 		if err != nil {
 			return err
 		}
+		// Wait to release the process, failures are reported on stderr
+		cmd.Wait()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if len(errOutput) > 0 {
 			return errors.New(string(errOutput))
 		}
-		changedFileList := strings.Split(string(stdOutput), "\n")
-		// the last split entry is an empty line, so we cut it off
-		changedFileList = changedFileList[:len(changedFileList)-1]
+		changedFileList, err := parseNameStatus(stdOutput)
+		if err != nil {
+			return err
+		}
 		for _, changedFile := range changedFileList {
-			if changedFile[0] != 'M' {
-				continue
+			switch changedFile.Status {
+			case 'M', 'U', 'R', 'C', 'A', 'D':
+				absPath := vcs.gitTopPath + "/" + changedFile.Path
+				vcs.conflictedFileMap[absPath] = true
 			}
-			// skip first letter and whitespace, just get relative path
-			changedFile = changedFile[2:]
-			absPath := vcs.gitTopPath + "/" + changedFile
-			vcs.conflictedFileMap[absPath] = true
+		}
+	}
+
+	if vcs.Batch {
+		refs := []string{"HEAD"}
+		if vcs.theirsRef != "" {
+			refs = append(refs, vcs.theirsRef)
+		}
+		if vcs.mergeBase != "" {
+			refs = append(refs, vcs.mergeBase)
+		}
+		if err := vcs.readBatch(ctx, refs); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (vcs *GitDriver) HandleFile(path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
-	if _, ok := vcs.conflictedFileMap[path]; ok {
+// readBatch reads the version of every conflicted file in each of refs
+// into batchFiles using a single "git cat-file --batch" process
+func (vcs *GitDriver) readBatch(ctx context.Context, refs []string) error {
+	paths := make([]string, 0, len(vcs.conflictedFileMap))
+	for path := range vcs.conflictedFileMap {
 		path = path[len(vcs.gitTopPath)+1:]
+		if strings.ContainsAny(path, "\n\r") {
+			// Can't be requested on a line of its own, so leave
+			// it for HandleFileSides to read with git show
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
 
-		oursData, err := execCommand(vcs.gitPath, "--no-pager", "show", "HEAD:"+path)
-		if err != nil {
-			return false, err
+	cmd := exec.CommandContext(ctx, vcs.gitPath, "cat-file", "--batch")
+	cmd.Dir = vcs.gitTopPath
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Request the files from another goroutine as git stops reading
+	// requests while its output is waiting to be read
+	go func() {
+		w := bufio.NewWriter(stdin)
+		for _, ref := range refs {
+			for _, path := range paths {
+				fmt.Fprintf(w, "%s:%s\n", ref, path)
+			}
 		}
-		if _, err := oursBuffer.WriteString(oursData); err != nil {
-			return false, err
+		w.Flush()
+		stdin.Close()
+	}()
+
+	vcs.batchFiles = make(map[string]string, len(refs)*len(paths))
+	r := bufio.NewReader(stdout)
+	readErr := func() error {
+		for _, ref := range refs {
+			for _, path := range paths {
+				data, err := readBatchObject(r)
+				if err != nil {
+					return fmt.Errorf("%s:%s: %w", ref, path, err)
+				}
+				vcs.batchFiles[ref+":"+path] = data
+			}
 		}
-		theirsData, err := execCommand(vcs.gitPath, "--no-pager", "show", "MERGE_HEAD:"+path)
-		if err != nil {
-			return false, err
+		return nil
+	}()
+	if readErr != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return readErr
+	}
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if stderr.Len() > 0 {
+			return errors.New(strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+	return nil
+}
+
+// readBatchObject reads the next object from the output of "git cat-file --batch",
+// which is a "<hash> <type> <size>" line followed by the contents and a newline,
+// or a "<object> missing" line. Like showFile, a missing file is returned as an
+// empty object.
+func readBatchObject(r *bufio.Reader) (string, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	// The object name of a missing file is the path, which can hold spaces
+	if strings.HasSuffix(strings.TrimRight(header, "\n"), " missing") {
+		return "{}", nil
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return "", errors.New("unexpected git cat-file output: " + strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", errors.New("unexpected git cat-file output: " + strings.TrimSpace(header))
+	}
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data[:size]), nil
+}
+
+// nameStatus is an entry of the output of "git diff --name-status -z"
+type nameStatus struct {
+	// Status is the letter of the status, ie. 'M' for modified or 'R' for renamed
+	Status byte
+	// Path is the path of the file, or the destination path if it was renamed or copied
+	Path string
+	// OldPath is the source path if the file was renamed or copied
+	OldPath string
+}
+
+// parseNameStatus parses the NUL-delimited output of "git diff --name-status -z",
+// where each entry is a status such as "M" or "R100" followed by the path,
+// or by the source and destination paths for renames and copies.
+func parseNameStatus(data []byte) ([]nameStatus, error) {
+	fields := strings.Split(string(data), "\x00")
+	// the output ends with NUL, so the last split entry is empty
+	if len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	var list []nameStatus
+	for i := 0; i < len(fields); {
+		status := fields[i]
+		if status == "" {
+			return nil, errors.New("unexpected empty status in git diff output")
 		}
-		if _, err := theirsBuffer.WriteString(theirsData); err != nil {
-			return false, err
+		entry := nameStatus{Status: status[0]}
+		pathCount := 1
+		if entry.Status == 'R' || entry.Status == 'C' {
+			pathCount = 2
+		}
+		if i+pathCount >= len(fields) {
+			return nil, errors.New("unexpected end of git diff output after status " + status)
+		}
+		if pathCount == 2 {
+			entry.OldPath = fields[i+1]
+		}
+		entry.Path = fields[i+pathCount]
+		list = append(list, entry)
+		i += 1 + pathCount
+	}
+	return list, nil
+}
+
+// Close releases the files read by Batch
+func (vcs *GitDriver) Close() error {
+	vcs.batchFiles = nil
+	return nil
+}
+
+func (vcs *GitDriver) HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
+	return vcs.HandleFileSides(ctx, path, map[string]*bytes.Buffer{
+		dfvcs.SideOurs:   oursBuffer,
+		dfvcs.SideTheirs: theirsBuffer,
+	})
+}
+
+// HandleFileSides writes the version of a conflicted file from HEAD into
+// dfvcs.SideOurs, from the commit being merged, cherry-picked or rebased
+// (MERGE_HEAD, CHERRY_PICK_HEAD or REBASE_HEAD) into dfvcs.SideTheirs and
+// from their common ancestor into dfvcs.SideBase.
+//
+// During a rebase HEAD is the branch being rebased onto, so "ours" is the
+// upstream and "theirs" is the commit being replayed, as git names them.
+func (vcs *GitDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	if _, ok := vcs.conflictedFileMap[path]; ok {
+		path = path[len(vcs.gitTopPath)+1:]
+
+		for side, buf := range sides {
+			var ref string
+			switch side {
+			case dfvcs.SideOurs:
+				ref = "HEAD"
+			case dfvcs.SideTheirs:
+				if vcs.theirsRef == "" {
+					return false, errors.New("unable to get theirs of " + path + ", no merge, cherry-pick or rebase is in progress")
+				}
+				ref = vcs.theirsRef
+			case dfvcs.SideBase:
+				if vcs.mergeBase == "" {
+					return false, errors.New("unable to get base of " + path + ", no merge, cherry-pick or rebase is in progress")
+				}
+				ref = vcs.mergeBase
+			default:
+				return false, errors.New("unsupported side: " + side)
+			}
+			data, ok := vcs.batchFiles[ref+":"+path]
+			if !ok {
+				var err error
+				data, err = vcs.showFile(ctx, ref, path)
+				if err != nil {
+					return false, err
+				}
+			}
+			if _, err := buf.WriteString(data); err != nil {
+				return false, err
+			}
 		}
 		return true, nil
 	}
@@ -113,8 +374,36 @@ func (vcs *GitDriver) HandleFile(path string, oursBuffer *bytes.Buffer, theirsBu
 	return false, nil
 }
 
-func execCommand(path string, arguments ...string) (string, error) {
-	cmd := exec.Command(path, arguments...)
+// hasRef reports whether ref names a commit
+func (vcs *GitDriver) hasRef(ctx context.Context, ref string) bool {
+	cmd := exec.CommandContext(ctx, vcs.gitPath, "rev-parse", "-q", "--verify", ref+"^{commit}")
+	cmd.Dir = vcs.gitTopPath
+	return cmd.Run() == nil
+}
+
+// showFile returns the contents of the file at path, relative to the top level
+// directory, in the commit ref. If the file was added or deleted on the other
+// side and so doesn't exist in ref, an empty object is returned so that the
+// conflict is still decoded.
+func (vcs *GitDriver) showFile(ctx context.Context, ref string, path string) (string, error) {
+	cmd := exec.CommandContext(ctx, vcs.gitPath, "cat-file", "-e", ref+":"+path)
+	cmd.Dir = vcs.gitTopPath
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			// Killed rather than exiting because the file doesn't exist
+			return "", ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "{}", nil
+		}
+		return "", err
+	}
+	return execCommand(ctx, vcs.gitPath, "--no-pager", "show", ref+":"+path)
+}
+
+func execCommand(ctx context.Context, path string, arguments ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, path, arguments...)
 	cmdOut, err := cmd.StdoutPipe()
 	if err != nil {
 		return "", err
@@ -126,14 +415,19 @@ func execCommand(path string, arguments ...string) (string, error) {
 	if err := cmd.Start(); err != nil {
 		return "", err
 	}
-	errOutput, err := ioutil.ReadAll(cmdErr)
+	errOutput, err := io.ReadAll(cmdErr)
 	if err != nil {
 		return "", err
 	}
-	stdOutput, err := ioutil.ReadAll(cmdOut)
+	stdOutput, err := io.ReadAll(cmdOut)
 	if err != nil {
 		return "", err
 	}
+	// Wait to release the process, failures are reported on stderr
+	cmd.Wait()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	if len(errOutput) > 0 {
 		return "", errors.New(string(errOutput))
 	}
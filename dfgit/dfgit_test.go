@@ -0,0 +1,465 @@
+package dfgit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+	"github.com/silbinarywolf/sweditor/internal/dfjson/internal/gittest"
+)
+
+func TestReadBatchObject(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"found", "0123abcd blob 7\n{\"a\":1}\n", `{"a":1}`},
+		{"empty", "0123abcd blob 0\n\n", ""},
+		{"missing", "HEAD:a.json missing\n", "{}"},
+		{"missing with space", "HEAD:a b.json missing\n", "{}"},
+		{"missing with spaces", "MERGE_HEAD:dir name/a  b c.json missing\n", "{}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readBatchObject(bufio.NewReader(strings.NewReader(test.output)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadBatchObjectError(t *testing.T) {
+	for _, output := range []string{
+		"0123abcd blob\n",
+		"0123abcd blob size\n",
+		"0123abcd blob 100\n{}\n",
+	} {
+		if _, err := readBatchObject(bufio.NewReader(strings.NewReader(output))); err == nil {
+			t.Fatalf("%q: expected an error", output)
+		}
+	}
+}
+
+func TestParseNameStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []nameStatus
+		wantErr string
+	}{
+		{
+			name:   "empty",
+			output: "",
+		},
+		{
+			name:   "modified",
+			output: "M\x00a.json\x00",
+			want:   []nameStatus{{Status: 'M', Path: "a.json"}},
+		},
+		{
+			name:   "spaces and tabs in paths",
+			output: "M\x00dir name/a b.json\x00A\x00tab\there.json\x00",
+			want: []nameStatus{
+				{Status: 'M', Path: "dir name/a b.json"},
+				{Status: 'A', Path: "tab\there.json"},
+			},
+		},
+		{
+			name:   "rename uses the destination path",
+			output: "R100\x00old name.json\x00new name.json\x00M\x00b.json\x00",
+			want: []nameStatus{
+				{Status: 'R', Path: "new name.json", OldPath: "old name.json"},
+				{Status: 'M', Path: "b.json"},
+			},
+		},
+		{
+			name:   "copy",
+			output: "C075\x00a.json\x00c.json\x00",
+			want:   []nameStatus{{Status: 'C', Path: "c.json", OldPath: "a.json"}},
+		},
+		{
+			name:   "each status",
+			output: "A\x00a\x00D\x00d\x00M\x00m\x00U\x00u\x00T\x00t\x00",
+			want: []nameStatus{
+				{Status: 'A', Path: "a"},
+				{Status: 'D', Path: "d"},
+				{Status: 'M', Path: "m"},
+				{Status: 'U', Path: "u"},
+				{Status: 'T', Path: "t"},
+			},
+		},
+		{
+			name:    "missing path",
+			output:  "M\x00",
+			wantErr: "unexpected end of git diff output after status M",
+		},
+		{
+			name:    "missing rename destination",
+			output:  "R100\x00old.json\x00",
+			wantErr: "unexpected end of git diff output after status R100",
+		},
+		{
+			name:    "empty status",
+			output:  "\x00a.json\x00",
+			wantErr: "unexpected empty status in git diff output",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseNameStatus([]byte(test.output))
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGitDriverBatchPathWithSpace(t *testing.T) {
+	dir := gittest.Repo(t)
+	// Deleted on our side and modified on theirs, so that
+	// "HEAD:a b.json" is missing when it's read
+	gittest.WriteFile(t, filepath.Join(dir, "a b.json"), `{"v":"base"}`)
+	gittest.Git(t, "add", ".")
+	gittest.Git(t, "commit", "-q", "-m", "base")
+	gittest.Git(t, "checkout", "-q", "-b", "other")
+	gittest.WriteFile(t, filepath.Join(dir, "a b.json"), `{"v":"theirs"}`)
+	gittest.Git(t, "commit", "-q", "-am", "other")
+	gittest.Git(t, "checkout", "-q", "main")
+	gittest.Git(t, "rm", "-q", "a b.json")
+	gittest.Git(t, "commit", "-q", "-m", "main")
+	gittest.GitMayFail(t, "merge", "-q", "other")
+
+	topPath := gittest.TopPath(t)
+	for _, batch := range []bool{false, true} {
+		driver := &GitDriver{Batch: batch}
+		if err := driver.Init(context.Background()); err != nil {
+			t.Fatalf("batch %v: %v", batch, err)
+		}
+		sides, hasFile := gittest.ReadSides(t, driver, topPath+"/a b.json")
+		if !hasFile {
+			t.Fatalf("batch %v: expected a b.json to be conflicted", batch)
+		}
+		want := map[string]string{
+			dfvcs.SideOurs:   "{}",
+			dfvcs.SideTheirs: `{"v":"theirs"}`,
+			dfvcs.SideBase:   `{"v":"base"}`,
+		}
+		for side, data := range want {
+			if sides[side] != data {
+				t.Fatalf("batch %v: got %s side %q, want %q", batch, side, sides[side], data)
+			}
+		}
+		if err := driver.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGitDriverAddDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		// base, ours and theirs are the contents of a.json on each
+		// branch, empty if it doesn't exist
+		base, ours, theirs string
+		want               map[string]string
+	}{
+		{
+			name:   "modify/modify",
+			base:   `{"v":"base"}`,
+			ours:   `{"v":"ours"}`,
+			theirs: `{"v":"theirs"}`,
+			want: map[string]string{
+				dfvcs.SideOurs:   `{"v":"ours"}`,
+				dfvcs.SideTheirs: `{"v":"theirs"}`,
+				dfvcs.SideBase:   `{"v":"base"}`,
+			},
+		},
+		{
+			name:   "add/add",
+			ours:   `{"v":"ours"}`,
+			theirs: `{"v":"theirs"}`,
+			want: map[string]string{
+				dfvcs.SideOurs:   `{"v":"ours"}`,
+				dfvcs.SideTheirs: `{"v":"theirs"}`,
+				dfvcs.SideBase:   "{}",
+			},
+		},
+		{
+			name:   "modify/delete",
+			base:   `{"v":"base"}`,
+			ours:   `{"v":"ours"}`,
+			theirs: "",
+			want: map[string]string{
+				dfvcs.SideOurs:   `{"v":"ours"}`,
+				dfvcs.SideTheirs: "{}",
+				dfvcs.SideBase:   `{"v":"base"}`,
+			},
+		},
+		{
+			name:   "delete/modify",
+			base:   `{"v":"base"}`,
+			ours:   "",
+			theirs: `{"v":"theirs"}`,
+			want: map[string]string{
+				dfvcs.SideOurs:   "{}",
+				dfvcs.SideTheirs: `{"v":"theirs"}`,
+				dfvcs.SideBase:   `{"v":"base"}`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := gittest.Repo(t)
+			path := filepath.Join(dir, "a.json")
+			// setFile writes or removes a.json and commits it
+			setFile := func(data, message string) {
+				if data == "" {
+					if _, err := os.Stat(path); err == nil {
+						gittest.Git(t, "rm", "-q", "a.json")
+					}
+				} else {
+					gittest.WriteFile(t, path, data)
+					gittest.Git(t, "add", "a.json")
+				}
+				gittest.Git(t, "commit", "-q", "--allow-empty", "-m", message)
+			}
+			setFile(test.base, "base")
+			gittest.Git(t, "checkout", "-q", "-b", "other")
+			setFile(test.theirs, "other")
+			gittest.Git(t, "checkout", "-q", "main")
+			setFile(test.ours, "main")
+			gittest.GitMayFail(t, "merge", "-q", "other")
+
+			topPath := gittest.TopPath(t)
+			for _, batch := range []bool{false, true} {
+				driver := &GitDriver{Batch: batch}
+				if err := driver.Init(context.Background()); err != nil {
+					t.Fatalf("batch %v: %v", batch, err)
+				}
+				sides, hasFile := gittest.ReadSides(t, driver, topPath+"/a.json")
+				if !hasFile {
+					t.Fatalf("batch %v: expected a.json to be conflicted", batch)
+				}
+				if !reflect.DeepEqual(sides, test.want) {
+					t.Errorf("batch %v: got sides %q, want %q", batch, sides, test.want)
+				}
+				if err := driver.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGitDriverWithoutMerge(t *testing.T) {
+	dir := gittest.Repo(t)
+	gittest.WriteFile(t, filepath.Join(dir, "a.json"), `{"v":"base"}`)
+	gittest.Git(t, "add", ".")
+	gittest.Git(t, "commit", "-q", "-m", "base")
+	// Modified in the working tree but nothing to merge with
+	gittest.WriteFile(t, filepath.Join(dir, "a.json"), `{"v":"ours"}`)
+
+	driver := &GitDriver{}
+	if err := driver.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	topPath := gittest.TopPath(t)
+	for side, want := range map[string]string{
+		dfvcs.SideTheirs: "unable to get theirs of a.json, no merge, cherry-pick or rebase is in progress",
+		dfvcs.SideBase:   "unable to get base of a.json, no merge, cherry-pick or rebase is in progress",
+	} {
+		_, err := driver.HandleFileSides(context.Background(), topPath+"/a.json", map[string]*bytes.Buffer{
+			side: new(bytes.Buffer),
+		})
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: got error %v, want %q", side, err, want)
+		}
+	}
+}
+
+func TestGitDriverBatch(t *testing.T) {
+	_, paths := gittest.ConflictedRepo(t, 50)
+	want := map[string]string{
+		dfvcs.SideOurs:   `{"side":"ours"}`,
+		dfvcs.SideTheirs: `{"side":"theirs"}`,
+		dfvcs.SideBase:   `{"side":"base"}`,
+	}
+	for _, batch := range []bool{false, true} {
+		driver := &GitDriver{Batch: batch}
+		if err := driver.Init(context.Background()); err != nil {
+			t.Fatalf("batch %v: %v", batch, err)
+		}
+		for _, path := range paths {
+			sides, hasFile := gittest.ReadSides(t, driver, path)
+			if !hasFile {
+				t.Fatalf("batch %v: expected %s to be conflicted", batch, path)
+			}
+			if !reflect.DeepEqual(sides, want) {
+				t.Errorf("batch %v: %s: got sides %q, want %q", batch, path, sides, want)
+			}
+		}
+		if err := driver.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGitDriverBatch runs Init and reads every side of 200 conflicted
+// files, with batch=false running git for each side as before Batch
+func BenchmarkGitDriverBatch(b *testing.B) {
+	_, paths := gittest.ConflictedRepo(b, 200)
+	for _, batch := range []bool{false, true} {
+		b.Run("batch="+strconv.FormatBool(batch), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				driver := &GitDriver{Batch: batch}
+				if err := driver.Init(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				for _, path := range paths {
+					gittest.ReadSides(b, driver, path)
+				}
+				if err := driver.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGitDriverContext(t *testing.T) {
+	_, paths := gittest.ConflictedRepo(t, 1)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	driver := &GitDriver{}
+	if err := driver.Init(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Init: got error %v, want %v", err, context.Canceled)
+	}
+	if err := driver.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+	_, err := driver.HandleFileSides(cancelled, paths[0], map[string]*bytes.Buffer{
+		dfvcs.SideOurs: new(bytes.Buffer),
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("HandleFileSides: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestGitDriverContextKillsGit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script in place of git")
+	}
+	// A git that never finishes, which exec replaces rather than
+	// starting a child process that would be left running
+	bin := t.TempDir()
+	gittest.WriteFile(t, filepath.Join(bin, "git"), "#!/bin/sh\nexec sleep 60\n")
+	if err := os.Chmod(filepath.Join(bin, "git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	driver := &GitDriver{}
+	err := driver.Init(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Init returned after %v, want soon after the deadline", elapsed)
+	}
+}
+
+func TestGitDriverOperations(t *testing.T) {
+	tests := []struct {
+		name string
+		// stop runs the operation that stops on the conflict in a.json,
+		// from the main branch
+		stop func(t *testing.T)
+	}{
+		{"merge", func(t *testing.T) {
+			gittest.GitMayFail(t, "merge", "-q", "other")
+		}},
+		{"cherry-pick", func(t *testing.T) {
+			gittest.GitMayFail(t, "cherry-pick", "other")
+		}},
+		{"rebase", func(t *testing.T) {
+			// Rebasing other onto main applies the commit of other to main
+			gittest.Git(t, "checkout", "-q", "other")
+			gittest.GitMayFail(t, "rebase", "main")
+		}},
+		{"rebase with the apply backend", func(t *testing.T) {
+			gittest.Git(t, "checkout", "-q", "other")
+			gittest.GitMayFail(t, "rebase", "--apply", "main")
+		}},
+	}
+	want := map[string]string{
+		dfvcs.SideOurs:   `{"v":"ours"}`,
+		dfvcs.SideTheirs: `{"v":"theirs"}`,
+		dfvcs.SideBase:   `{"v":"base"}`,
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := gittest.Repo(t)
+			path := filepath.Join(dir, "a.json")
+			gittest.WriteFile(t, path, `{"v":"base"}`)
+			gittest.Git(t, "add", ".")
+			gittest.Git(t, "commit", "-q", "-m", "base")
+			gittest.Git(t, "checkout", "-q", "-b", "other")
+			gittest.WriteFile(t, path, `{"v":"theirs"}`)
+			gittest.Git(t, "commit", "-q", "-am", "other")
+			gittest.Git(t, "checkout", "-q", "main")
+			gittest.WriteFile(t, path, `{"v":"ours"}`)
+			gittest.Git(t, "commit", "-q", "-am", "main")
+			test.stop(t)
+
+			topPath := gittest.TopPath(t)
+			for _, batch := range []bool{false, true} {
+				driver := &GitDriver{Batch: batch}
+				if err := driver.Init(context.Background()); err != nil {
+					t.Fatalf("batch %v: %v", batch, err)
+				}
+				sides, hasFile := gittest.ReadSides(t, driver, topPath+"/a.json")
+				if !hasFile {
+					t.Fatalf("batch %v: expected a.json to be conflicted", batch)
+				}
+				if !reflect.DeepEqual(sides, want) {
+					t.Errorf("batch %v: got sides %q, want %q", batch, sides, want)
+				}
+				if err := driver.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package dfgit
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// TreeFS reads the files of a commit straight from the object database of
+// a git repository, so data can be decoded with dfjson.UnmarshalFS without
+// checking it out, ie. from a bare clone.
+type TreeFS struct {
+	// Dir is the git directory of the repository or any directory within it
+	Dir string
+
+	// Ref is the commit to read, ie. "HEAD", "main" or a commit hash
+	Ref string
+}
+
+var (
+	_ fs.FS        = new(TreeFS)
+	_ fs.ReadDirFS = new(TreeFS)
+)
+
+// Open reads the file called name from the commit
+func (fsys *TreeFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if entry.isDir {
+		return &treeFile{info: entry}, nil
+	}
+	data, err := fsys.git("cat-file", "blob", entry.hash)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	entry.size = int64(len(data))
+	return &treeFile{info: entry, reader: bytes.NewReader(data)}, nil
+}
+
+// ReadDir lists the directory called name in the commit
+func (fsys *TreeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !entry.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	data, err := fsys.git("ls-tree", "-z", entry.hash)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	infos, err := parseLsTree(data)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	// ls-tree lists entries sorted by name as fs.ReadDirFS requires
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = treeDirEntry{info: info}
+	}
+	return entries, nil
+}
+
+// lookup returns the tree entry for name in the commit
+func (fsys *TreeFS) lookup(name string) (treeFileInfo, error) {
+	if name == "." {
+		return treeFileInfo{name: ".", hash: fsys.Ref + "^{tree}", isDir: true}, nil
+	}
+	data, err := fsys.git("ls-tree", "-z", "--full-tree", fsys.Ref, "--", name)
+	if err != nil {
+		return treeFileInfo{}, err
+	}
+	infos, err := parseLsTree(data)
+	if err != nil {
+		return treeFileInfo{}, err
+	}
+	if len(infos) != 1 || infos[0].name != path.Base(name) {
+		return treeFileInfo{}, fs.ErrNotExist
+	}
+	return infos[0], nil
+}
+
+// git runs git with arguments in Dir and returns what it wrote to stdout
+func (fsys *TreeFS) git(arguments ...string) ([]byte, error) {
+	cmd := exec.Command("git", arguments...)
+	cmd.Dir = fsys.Dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil, errors.New(strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// parseLsTree parses the NUL-delimited output of "git ls-tree -z", where
+// each entry is "<mode> <type> <hash>\t<path>"
+func parseLsTree(data []byte) ([]treeFileInfo, error) {
+	var infos []treeFileInfo
+	for _, line := range strings.Split(string(data), "\x00") {
+		if line == "" {
+			continue
+		}
+		tab := strings.IndexByte(line, '\t')
+		if tab == -1 {
+			return nil, errors.New("unexpected git ls-tree output: " + line)
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			return nil, errors.New("unexpected git ls-tree output: " + line)
+		}
+		infos = append(infos, treeFileInfo{
+			name:  path.Base(line[tab+1:]),
+			hash:  fields[2],
+			isDir: fields[1] == "tree",
+		})
+	}
+	return infos, nil
+}
+
+// treeFile is a file or directory opened from TreeFS
+type treeFile struct {
+	info   treeFileInfo
+	reader *bytes.Reader
+}
+
+func (f *treeFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *treeFile) Read(b []byte) (int, error) {
+	if f.info.isDir {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	return f.reader.Read(b)
+}
+
+func (f *treeFile) Close() error {
+	return nil
+}
+
+type treeFileInfo struct {
+	name  string
+	hash  string
+	size  int64
+	isDir bool
+}
+
+func (info treeFileInfo) Name() string       { return info.name }
+func (info treeFileInfo) Size() int64        { return info.size }
+func (info treeFileInfo) ModTime() time.Time { return time.Time{} }
+func (info treeFileInfo) IsDir() bool        { return info.isDir }
+func (info treeFileInfo) Sys() interface{}   { return nil }
+
+func (info treeFileInfo) Mode() fs.FileMode {
+	if info.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type treeDirEntry struct {
+	info treeFileInfo
+}
+
+func (entry treeDirEntry) Name() string               { return entry.info.Name() }
+func (entry treeDirEntry) IsDir() bool                { return entry.info.IsDir() }
+func (entry treeDirEntry) Type() fs.FileMode          { return entry.info.Mode().Type() }
+func (entry treeDirEntry) Info() (fs.FileInfo, error) { return entry.info, nil }
@@ -0,0 +1,155 @@
+package dfgit
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson"
+	"github.com/silbinarywolf/sweditor/internal/dfjson/internal/gittest"
+)
+
+type treeFSTestWorld struct {
+	Name      string                         `json:"name"`
+	Creatures map[string]*treeFSTestCreature `json:"creatures" dfjson:"distributable"`
+}
+
+type treeFSTestCreature struct {
+	HP int `json:"hp"`
+}
+
+// bareRepo commits each of versions in turn to a repository and returns a
+// bare clone of it along with the hash of each commit
+func bareRepo(t *testing.T, versions ...*treeFSTestWorld) (string, []string) {
+	t.Helper()
+	dir := gittest.Repo(t)
+	var hashes []string
+	for _, world := range versions {
+		gittest.Git(t, "rm", "-rq", "--ignore-unmatch", "data")
+		if err := dfjson.MarshalTo(filepath.Join(dir, "data"), "index.json", world, dfjson.Options{}); err != nil {
+			t.Fatal(err)
+		}
+		gittest.Git(t, "add", ".")
+		gittest.Git(t, "commit", "-q", "-m", "version")
+		hashes = append(hashes, strings.TrimSpace(gittest.Git(t, "rev-parse", "HEAD")))
+	}
+	bare := filepath.Join(t.TempDir(), "bare.git")
+	gittest.Git(t, "clone", "-q", "--bare", dir, bare)
+	return bare, hashes
+}
+
+func TestTreeFSUnmarshal(t *testing.T) {
+	v1 := &treeFSTestWorld{
+		Name: "world",
+		Creatures: map[string]*treeFSTestCreature{
+			"goblin": {HP: 12},
+			"orc":    {HP: 30},
+		},
+	}
+	v2 := &treeFSTestWorld{
+		Name: "world 2",
+		Creatures: map[string]*treeFSTestCreature{
+			"goblin":    {HP: 15},
+			"orc chief": {HP: 45},
+		},
+	}
+	bare, hashes := bareRepo(t, v1, v2)
+	tests := []struct {
+		ref  string
+		want *treeFSTestWorld
+	}{
+		{hashes[0], v1},
+		{hashes[1], v2},
+		{"HEAD", v2},
+		{"main~1", v1},
+	}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			var out treeFSTestWorld
+			fsys := &TreeFS{Dir: bare, Ref: test.ref}
+			if err := dfjson.UnmarshalFS(fsys, "data/index.json", &out, dfjson.Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, test.want) {
+				t.Errorf("got %+v, want %+v", out, test.want)
+			}
+		})
+	}
+}
+
+func TestTreeFS(t *testing.T) {
+	bare, hashes := bareRepo(t, &treeFSTestWorld{
+		Name: "world",
+		Creatures: map[string]*treeFSTestCreature{
+			"goblin": {HP: 12},
+		},
+	})
+	fsys := &TreeFS{Dir: bare, Ref: hashes[0]}
+
+	dirTests := []struct {
+		name string
+		want []string
+	}{
+		{".", []string{"data/"}},
+		{"data", []string{"creatures/", "index.json"}},
+		{"data/creatures/goblin", []string{"index.json"}},
+	}
+	for _, test := range dirTests {
+		entries, err := fs.ReadDir(fsys, test.name)
+		if err != nil {
+			t.Fatalf("ReadDir(%q): %v", test.name, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("ReadDir(%q) = %q, want %q", test.name, names, test.want)
+		}
+	}
+
+	f, err := fsys.Open("data/creatures/goblin/index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "{\n\t\"hp\": 12\n}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) || info.IsDir() {
+		t.Errorf("got size %d and directory %v, want size %d of a file", info.Size(), info.IsDir(), len(data))
+	}
+
+	errTests := []struct {
+		name string
+		want error
+	}{
+		{"data/creatures/orc/index.json", fs.ErrNotExist},
+		{"data/index", fs.ErrNotExist},
+		{"/data/index.json", fs.ErrInvalid},
+		{"data/../data/index.json", fs.ErrInvalid},
+	}
+	for _, test := range errTests {
+		if _, err := fsys.Open(test.name); !errors.Is(err, test.want) {
+			t.Errorf("Open(%q): got error %v, want %v", test.name, err, test.want)
+		}
+	}
+	if _, err := fsys.ReadDir("data/index.json"); err == nil {
+		t.Error("ReadDir of a file: expected an error")
+	}
+}
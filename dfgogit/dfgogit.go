@@ -0,0 +1,185 @@
+// Package dfgogit detects merge conflicts in a Git repository using go-git,
+// so that it works without an installed "git" binary. It's an alternative
+// to dfgit.GitDriver that opens the repository once and reads the versions
+// of conflicted files straight from its object database, rather than running
+// a process for each of them.
+//
+// It depends on github.com/go-git/go-git/v5 (v5.12.0 or later), which is why
+// it isn't part of dfgit, and so needs Go 1.19 or later rather than the Go 1.16
+// the rest of dfjson supports.
+package dfgogit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// GoGitDriver reads the sides of files left in conflict by a merge, from
+// HEAD, MERGE_HEAD and their common ancestor, like dfgit.GitDriver.
+type GoGitDriver struct {
+	// Dir is the directory to open the repository from, which can be any
+	// directory within it. If empty, the working directory is used.
+	Dir string
+
+	gitTopPath        string
+	head              *object.Commit
+	mergeHead         *object.Commit
+	mergeBase         *object.Commit
+	conflictedFileMap map[string]bool
+}
+
+var (
+	_ dfvcs.VCSDriver   = new(GoGitDriver)
+	_ dfvcs.SidesDriver = new(GoGitDriver)
+)
+
+func (vcs *GoGitDriver) Init(ctx context.Context) error {
+	// Reset
+	vcs.conflictedFileMap = make(map[string]bool)
+	vcs.head, vcs.mergeHead, vcs.mergeBase = nil, nil, nil
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dir := vcs.Dir
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = wd
+	}
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	topPath, err := filepath.Abs(worktree.Filesystem.Root())
+	if err != nil {
+		return err
+	}
+	vcs.gitTopPath = filepath.ToSlash(topPath)
+
+	// Get the commits of both sides of the merge, if there is one
+	headRef, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if vcs.head, err = repo.CommitObject(headRef.Hash()); err != nil {
+		return err
+	}
+	mergeHeadRef, err := repo.Reference(plumbing.ReferenceName("MERGE_HEAD"), true)
+	switch {
+	case errors.Is(err, plumbing.ErrReferenceNotFound):
+		// No merge is in progress
+	case err != nil:
+		return err
+	default:
+		if vcs.mergeHead, err = repo.CommitObject(mergeHeadRef.Hash()); err != nil {
+			return err
+		}
+		bases, err := vcs.head.MergeBase(vcs.mergeHead)
+		if err != nil {
+			return err
+		}
+		if len(bases) > 0 {
+			vcs.mergeBase = bases[0]
+		}
+	}
+
+	// Get the files in conflict, which have an entry in the
+	// index for each side rather than a single merged entry
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+	for _, entry := range idx.Entries {
+		switch entry.Stage {
+		case index.AncestorMode, index.OurMode, index.TheirMode:
+			vcs.conflictedFileMap[vcs.gitTopPath+"/"+entry.Name] = true
+		}
+	}
+	return nil
+}
+
+// Close releases the commits read by Init
+func (vcs *GoGitDriver) Close() error {
+	vcs.head, vcs.mergeHead, vcs.mergeBase = nil, nil, nil
+	return nil
+}
+
+func (vcs *GoGitDriver) HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
+	return vcs.HandleFileSides(ctx, path, map[string]*bytes.Buffer{
+		dfvcs.SideOurs:   oursBuffer,
+		dfvcs.SideTheirs: theirsBuffer,
+	})
+}
+
+// HandleFileSides writes the version of a conflicted file from HEAD into
+// dfvcs.SideOurs, from MERGE_HEAD into dfvcs.SideTheirs and from their
+// common ancestor into dfvcs.SideBase.
+func (vcs *GoGitDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	if _, ok := vcs.conflictedFileMap[path]; !ok {
+		// Fallback to default behaviour
+		return false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	path = path[len(vcs.gitTopPath)+1:]
+	for side, buf := range sides {
+		var commit *object.Commit
+		switch side {
+		case dfvcs.SideOurs:
+			commit = vcs.head
+		case dfvcs.SideTheirs:
+			if vcs.mergeHead == nil {
+				return false, errors.New("unable to get theirs of " + path + ", no merge is in progress")
+			}
+			commit = vcs.mergeHead
+		case dfvcs.SideBase:
+			if vcs.mergeBase == nil {
+				return false, errors.New("unable to get base of " + path + ", no merge is in progress")
+			}
+			commit = vcs.mergeBase
+		default:
+			return false, errors.New("unsupported side: " + side)
+		}
+		data, err := showFile(commit, path)
+		if err != nil {
+			return false, err
+		}
+		if _, err := buf.WriteString(data); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// showFile returns the contents of the file at path, relative to the top level
+// directory, in commit. If the file was added or deleted on the other side and
+// so doesn't exist in commit, an empty object is returned so that the conflict
+// is still decoded.
+func showFile(commit *object.Commit, path string) (string, error) {
+	file, err := commit.File(path)
+	if err != nil {
+		if errors.Is(err, object.ErrFileNotFound) {
+			return "{}", nil
+		}
+		return "", err
+	}
+	return file.Contents()
+}
@@ -0,0 +1,111 @@
+package dfgogit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfgit"
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+	"github.com/silbinarywolf/sweditor/internal/dfjson/internal/gittest"
+)
+
+func TestGoGitDriver(t *testing.T) {
+	clean, paths := gittest.ConflictedRepo(t, 3)
+	driver := &GoGitDriver{}
+	if err := driver.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+
+	if _, hasFile := gittest.ReadSides(t, driver, clean); hasFile {
+		t.Errorf("%s: expected not to be conflicted", clean)
+	}
+	want := map[string]string{
+		dfvcs.SideOurs:   `{"side":"ours"}`,
+		dfvcs.SideTheirs: `{"side":"theirs"}`,
+		dfvcs.SideBase:   `{"side":"base"}`,
+	}
+	for _, path := range paths {
+		sides, hasFile := gittest.ReadSides(t, driver, path)
+		if !hasFile {
+			t.Fatalf("%s: expected to be conflicted", path)
+		}
+		if !reflect.DeepEqual(sides, want) {
+			t.Errorf("%s: got sides %q, want %q", path, sides, want)
+		}
+	}
+}
+
+func TestGoGitDriverMatchesGitDriver(t *testing.T) {
+	clean, paths := gittest.ConflictedRepo(t, 3)
+	// A file that's deleted on our side and modified on theirs
+	gittest.Git(t, "merge", "--abort")
+	gittest.Git(t, "rm", "-q", "creatures/c0/index.json")
+	gittest.Git(t, "commit", "-q", "-m", "delete")
+	gittest.GitMayFail(t, "merge", "-q", "other")
+
+	goGitDriver := &GoGitDriver{}
+	gitDriver := &dfgit.GitDriver{}
+	for _, driver := range []dfvcs.SidesDriver{goGitDriver, gitDriver} {
+		if err := driver.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		defer driver.Close()
+	}
+	for _, path := range append(paths, clean, clean+".missing") {
+		got, gotHasFile := gittest.ReadSides(t, goGitDriver, path)
+		want, wantHasFile := gittest.ReadSides(t, gitDriver, path)
+		if gotHasFile != wantHasFile || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v %q, want %v %q from dfgit", path, gotHasFile, got, wantHasFile, want)
+		}
+	}
+}
+
+func TestGoGitDriverDir(t *testing.T) {
+	_, paths := gittest.ConflictedRepo(t, 1)
+	// Opened from a subdirectory of another working directory
+	dir := filepath.Dir(filepath.FromSlash(paths[0]))
+	if err := os.Chdir(os.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	driver := &GoGitDriver{Dir: dir}
+	if err := driver.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+	if _, hasFile := gittest.ReadSides(t, driver, paths[0]); !hasFile {
+		t.Errorf("%s: expected to be conflicted", paths[0])
+	}
+}
+
+// BenchmarkDrivers reads every side of 200 conflicted files, including
+// the time taken by Init to find them
+func BenchmarkDrivers(b *testing.B) {
+	_, paths := gittest.ConflictedRepo(b, 200)
+	drivers := []struct {
+		name   string
+		driver dfvcs.SidesDriver
+	}{
+		{"exec", &dfgit.GitDriver{}},
+		{"go-git", &GoGitDriver{}},
+	}
+	for _, test := range drivers {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := test.driver.Init(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				for _, path := range paths {
+					gittest.ReadSides(b, test.driver, path)
+				}
+				if err := test.driver.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package dfhg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+type HgDriver struct {
+	hgPath            string
+	hgRootPath        string
+	conflictedFileMap map[string]bool
+}
+
+var _ dfvcs.VCSDriver = new(HgDriver)
+
+func (vcs *HgDriver) Init(ctx context.Context) error {
+	// Reset
+	vcs.conflictedFileMap = make(map[string]bool)
+
+	// Check if we have hg
+	{
+		path, err := exec.LookPath("hg")
+		if err != nil {
+			return errors.New("unable to locate \"hg\". Is Mercurial installed?")
+		}
+		vcs.hgPath = path
+	}
+
+	// Get the root directory
+	{
+		rootPath, err := execCommand(ctx, vcs.hgPath, "root")
+		if err != nil {
+			return err
+		}
+		// trim newline from execCommand and normalize paths to use / like Unmarshal
+		rootPath = strings.TrimRight(rootPath, "\r\n")
+		rootPath = strings.ReplaceAll(rootPath, "\\", "/")
+		vcs.hgRootPath = rootPath
+	}
+
+	// Get the files with unresolved conflicts
+	{
+		// Run from the root so paths are relative to it rather than the working directory
+		output, err := execCommand(ctx, vcs.hgPath, "--cwd", vcs.hgRootPath, "resolve", "--list")
+		if err != nil {
+			return err
+		}
+		for _, conflictedFile := range strings.Split(output, "\n") {
+			conflictedFile = strings.TrimRight(conflictedFile, "\r")
+			// "U" is unresolved, "R" is resolved
+			if len(conflictedFile) < 3 || conflictedFile[0] != 'U' {
+				continue
+			}
+			// skip first letter and whitespace, just get relative path
+			conflictedFile = conflictedFile[2:]
+			absPath := vcs.hgRootPath + "/" + strings.ReplaceAll(conflictedFile, "\\", "/")
+			vcs.conflictedFileMap[absPath] = true
+		}
+	}
+	return nil
+}
+
+func (vcs *HgDriver) Close() error {
+	return nil
+}
+
+func (vcs *HgDriver) HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
+	if _, ok := vcs.conflictedFileMap[path]; ok {
+		path = path[len(vcs.hgRootPath)+1:]
+
+		oursData, err := execCommand(ctx, vcs.hgPath, "--cwd", vcs.hgRootPath, "cat", "-r", "p1()", path)
+		if err != nil {
+			return false, err
+		}
+		if _, err := oursBuffer.WriteString(oursData); err != nil {
+			return false, err
+		}
+		theirsData, err := execCommand(ctx, vcs.hgPath, "--cwd", vcs.hgRootPath, "cat", "-r", "p2()", path)
+		if err != nil {
+			return false, err
+		}
+		if _, err := theirsBuffer.WriteString(theirsData); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	// Fallback to default behaviour
+	return false, nil
+}
+
+func execCommand(ctx context.Context, path string, arguments ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, path, arguments...)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	cmdErr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	errOutput, err := io.ReadAll(cmdErr)
+	if err != nil {
+		return "", err
+	}
+	stdOutput, err := io.ReadAll(cmdOut)
+	if err != nil {
+		return "", err
+	}
+	// Wait to release the process, failures are reported on stderr
+	cmd.Wait()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if len(errOutput) > 0 {
+		return "", errors.New(string(errOutput))
+	}
+	return string(stdOutput), nil
+}
@@ -0,0 +1,250 @@
+package dfhg
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setPath puts dir first in PATH until the test ends
+func setPath(t *testing.T, dir string) {
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+	})
+}
+
+// fakeHg puts an hg on PATH that answers as if the repository at root
+// is merging, with resolve as the output of "hg resolve --list" and the
+// files of each side read from data/ours and data/theirs. It returns
+// data, where the arguments of each call are appended to "args".
+func fakeHg(t *testing.T, root, resolve string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script in place of hg")
+	}
+	data := t.TempDir()
+	bin := t.TempDir()
+	writeFile(t, filepath.Join(data, "resolve"), resolve)
+	writeFile(t, filepath.Join(bin, "hg"), `#!/bin/sh
+data='`+data+`'
+echo "$@" >> "$data/args"
+if [ "$1" = root ]; then
+	echo '`+root+`'
+	exit 0
+fi
+if [ "$1" = --cwd ]; then
+	shift 2
+fi
+case "$1" in
+resolve)
+	cat "$data/resolve" ;;
+cat)
+	case "$3" in
+	"p1()") cat "$data/ours/$4" ;;
+	"p2()") cat "$data/theirs/$4" ;;
+	esac ;;
+*)
+	echo "unexpected arguments: $@" >&2 ;;
+esac
+`)
+	if err := os.Chmod(filepath.Join(bin, "hg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setPath(t, bin)
+	return data
+}
+
+func TestHgDriverInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		resolve string
+		want    []string
+	}{
+		{"nothing conflicted", "", nil},
+		{"unresolved and resolved", "U a.json\nR b.json\nU dir/c.json\n", []string{"/repo/a.json", "/repo/dir/c.json"}},
+		{"windows line endings and paths", "U dir\\a.json\r\nR b.json\r\n", []string{"/repo/dir/a.json"}},
+		{"spaces in paths", "U my creature/index.json\n", []string{"/repo/my creature/index.json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeHg(t, "/repo", test.resolve)
+			driver := &HgDriver{}
+			if err := driver.Init(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer driver.Close()
+			var got []string
+			for path := range driver.conflictedFileMap {
+				got = append(got, path)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got conflicted files %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHgDriverInitErrors(t *testing.T) {
+	t.Run("hg not installed", func(t *testing.T) {
+		path := os.Getenv("PATH")
+		os.Setenv("PATH", t.TempDir())
+		defer os.Setenv("PATH", path)
+		driver := &HgDriver{}
+		err := driver.Init(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "unable to locate \"hg\"") {
+			t.Errorf("got error %v, want hg to be missing", err)
+		}
+	})
+	t.Run("hg fails", func(t *testing.T) {
+		data := fakeHg(t, "/repo", "")
+		// "hg resolve" fails, writing why to stderr
+		if err := os.Remove(filepath.Join(data, "resolve")); err != nil {
+			t.Fatal(err)
+		}
+		driver := &HgDriver{}
+		if err := driver.Init(context.Background()); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestHgDriverHandleFile(t *testing.T) {
+	data := fakeHg(t, "/repo", "U creatures/goblin/index.json\n")
+	writeFile(t, filepath.Join(data, "ours", "creatures", "goblin", "index.json"), `{"hp": 10}`)
+	writeFile(t, filepath.Join(data, "theirs", "creatures", "goblin", "index.json"), `{"hp": 15}`)
+	driver := &HgDriver{}
+	if err := driver.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+
+	tests := []struct {
+		path         string
+		hasFile      bool
+		ours, theirs string
+	}{
+		{"/repo/creatures/goblin/index.json", true, `{"hp": 10}`, `{"hp": 15}`},
+		{"/repo/creatures/orc/index.json", false, "", ""},
+		{"/other/creatures/goblin/index.json", false, "", ""},
+	}
+	for _, test := range tests {
+		var ours, theirs bytes.Buffer
+		hasFile, err := driver.HandleFile(context.Background(), test.path, &ours, &theirs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasFile != test.hasFile || ours.String() != test.ours || theirs.String() != test.theirs {
+			t.Errorf("%s: got %v %q %q, want %v %q %q", test.path, hasFile, ours.String(), theirs.String(), test.hasFile, test.ours, test.theirs)
+		}
+	}
+
+	// Files are read relative to the root, from each parent of the merge
+	args, err := os.ReadFile(filepath.Join(data, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "root\n" +
+		"--cwd /repo resolve --list\n" +
+		"--cwd /repo cat -r p1() creatures/goblin/index.json\n" +
+		"--cwd /repo cat -r p2() creatures/goblin/index.json\n"
+	if string(args) != want {
+		t.Errorf("got hg calls:\n%s\nwant:\n%s", args, want)
+	}
+}
+
+// hg runs hg in the working directory and returns its output
+func hg(t *testing.T, arguments ...string) string {
+	t.Helper()
+	output, err := exec.Command("hg", arguments...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("hg %s: %v\n%s", strings.Join(arguments, " "), err, output)
+	}
+	return string(output)
+}
+
+func TestHgDriverRepo(t *testing.T) {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("hg is not installed")
+	}
+	// Ignore the user's configuration
+	for key, value := range map[string]string{"HGPLAIN": "1", "HGRCPATH": "", "HGUSER": "test"} {
+		old, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		defer func(key string) {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		}(key)
+	}
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	hg(t, "init")
+	writeFile(t, filepath.Join(dir, "a.json"), `{"side":"base"}`)
+	writeFile(t, filepath.Join(dir, "b.json"), `{"side":"base"}`)
+	hg(t, "add", "a.json", "b.json")
+	hg(t, "commit", "-m", "base")
+	writeFile(t, filepath.Join(dir, "a.json"), `{"side":"ours"}`)
+	hg(t, "commit", "-m", "ours")
+	hg(t, "update", "-q", "-r", "0")
+	writeFile(t, filepath.Join(dir, "a.json"), `{"side":"theirs"}`)
+	writeFile(t, filepath.Join(dir, "b.json"), `{"side":"theirs"}`)
+	hg(t, "commit", "-q", "-m", "theirs")
+	hg(t, "update", "-q", "-r", "1")
+	// The merge stops with a.json unresolved
+	exec.Command("hg", "merge", "-q", "-r", "2", "--tool", "internal:fail").Run()
+
+	driver := &HgDriver{}
+	if err := driver.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+	root := strings.TrimSpace(hg(t, "root"))
+	root = strings.ReplaceAll(root, "\\", "/")
+
+	var ours, theirs bytes.Buffer
+	hasFile, err := driver.HandleFile(context.Background(), root+"/a.json", &ours, &theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFile || ours.String() != `{"side":"ours"}` || theirs.String() != `{"side":"theirs"}` {
+		t.Errorf("a.json: got %v %q %q, want both sides", hasFile, ours.String(), theirs.String())
+	}
+	// b.json merged cleanly
+	hasFile, err = driver.HandleFile(context.Background(), root+"/b.json", &ours, &theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasFile {
+		t.Error("b.json: expected not to be conflicted")
+	}
+}
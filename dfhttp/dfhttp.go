@@ -0,0 +1,212 @@
+package dfhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS reads files and directory listings from an HTTP server, such as a CDN or
+// a directory served with http.FileServer, so that data can be decoded with
+// dfjson.UnmarshalFS.
+//
+// Directory listings are expected to be HTML pages linking to each entry,
+// with the links of directories ending in a slash, ie. <a href="goblin/">.
+type FS struct {
+	// BaseURL is the URL of the directory that paths are relative to
+	BaseURL string
+
+	// Client is used to make requests, if nil http.DefaultClient is used
+	Client *http.Client
+}
+
+var (
+	_ fs.FS        = new(FS)
+	_ fs.ReadDirFS = new(FS)
+)
+
+// Open fetches the file called name
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	data, isDir, err := fsys.get(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if isDir {
+		return &file{
+			info:    fileInfo{name: path.Base(name), isDir: true},
+			entries: parseListing(data),
+		}, nil
+	}
+	return &file{
+		info:   fileInfo{name: path.Base(name), size: int64(len(data))},
+		reader: bytes.NewReader(data),
+	}, nil
+}
+
+// ReadDir fetches the listing of the directory called name
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	data, _, err := fsys.get(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return parseListing(data), nil
+}
+
+// get fetches name, if asDir is true the directory listing is fetched.
+// isDir is true if the server redirected to the directory listing.
+func (fsys *FS) get(name string, asDir bool) (data []byte, isDir bool, err error) {
+	u := strings.TrimSuffix(fsys.BaseURL, "/") + "/"
+	if name != "." {
+		segments := strings.Split(name, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		u += strings.Join(segments, "/")
+		if asDir {
+			u += "/"
+		}
+	}
+	client := fsys.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		// Read below
+	case http.StatusNotFound:
+		return nil, false, fs.ErrNotExist
+	default:
+		return nil, false, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	data, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	isDir = strings.HasSuffix(res.Request.URL.Path, "/")
+	return data, isDir, nil
+}
+
+var hrefPattern = regexp.MustCompile(`(?i)href="([^"]*)"`)
+
+// parseListing returns the entries linked to from the HTML directory listing
+// in data, links to anything other than an entry within the directory are ignored.
+func parseListing(data []byte) []fs.DirEntry {
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	for _, match := range hrefPattern.FindAllSubmatch(data, -1) {
+		href := html.UnescapeString(string(match[1]))
+		if strings.HasPrefix(href, "./") {
+			// http.FileServer prefixes names containing a colon
+			// so they're not mistaken for a URL scheme
+			href = href[2:]
+		} else if strings.Contains(href, ":") {
+			continue
+		}
+		if strings.ContainsAny(href, "?#") || strings.HasPrefix(href, "/") || strings.HasPrefix(href, "../") {
+			continue
+		}
+		isDir := strings.HasSuffix(href, "/")
+		name, err := url.PathUnescape(strings.TrimSuffix(href, "/"))
+		if err != nil || name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, dirEntry{info: fileInfo{name: name, isDir: isDir}})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// file is a file or directory opened from FS
+type file struct {
+	info   fileInfo
+	reader *bytes.Reader
+	// entries are the entries of a directory not yet returned by ReadDir
+	entries []fs.DirEntry
+}
+
+var _ fs.ReadDirFile = new(file)
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.info.isDir {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	return f.reader.Read(b)
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.name, Err: errors.New("not a directory")}
+	}
+	if n <= 0 || n > len(f.entries) {
+		if n > 0 && len(f.entries) == 0 {
+			return nil, io.EOF
+		}
+		n = len(f.entries)
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type fileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (info fileInfo) Name() string       { return info.name }
+func (info fileInfo) Size() int64        { return info.size }
+func (info fileInfo) ModTime() time.Time { return time.Time{} }
+func (info fileInfo) IsDir() bool        { return info.isDir }
+func (info fileInfo) Sys() interface{}   { return nil }
+
+func (info fileInfo) Mode() fs.FileMode {
+	if info.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type dirEntry struct {
+	info fileInfo
+}
+
+func (entry dirEntry) Name() string               { return entry.info.Name() }
+func (entry dirEntry) IsDir() bool                { return entry.info.IsDir() }
+func (entry dirEntry) Type() fs.FileMode          { return entry.info.Mode().Type() }
+func (entry dirEntry) Info() (fs.FileInfo, error) { return entry.info, nil }
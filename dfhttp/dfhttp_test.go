@@ -0,0 +1,166 @@
+package dfhttp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson"
+)
+
+type testWorld struct {
+	Name      string                   `json:"name"`
+	Creatures map[string]*testCreature `json:"creatures" dfjson:"distributable"`
+}
+
+type testCreature struct {
+	HP int `json:"hp"`
+}
+
+// newTestServer serves the files v is encoded into with http.FileServer
+func newTestServer(t *testing.T, v interface{}) *httptest.Server {
+	t.Helper()
+	root := t.TempDir()
+	if err := dfjson.MarshalTo(root, "index.json", v, dfjson.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestUnmarshalFS(t *testing.T) {
+	in := &testWorld{
+		Name: "world",
+		Creatures: map[string]*testCreature{
+			"goblin":     {HP: 1},
+			"orc archer": {HP: 2},
+			"a:b":        {HP: 3},
+			"50%":        {HP: 4},
+		},
+	}
+	server := newTestServer(t, in)
+	var out testWorld
+	if err := dfjson.UnmarshalFS(&FS{BaseURL: server.URL}, "index.json", &out, dfjson.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&out, in) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestOpenDir(t *testing.T) {
+	server := newTestServer(t, &testWorld{
+		Name:      "world",
+		Creatures: map[string]*testCreature{"goblin": {HP: 1}, "orc": {HP: 2}},
+	})
+	fsys := &FS{BaseURL: server.URL + "/"}
+	f, err := fsys.Open("creatures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		t.Fatalf("got %T, want a fs.ReadDirFile", f)
+	}
+	var names []string
+	for {
+		entries, err := dir.ReadDir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				t.Errorf("%s: got a file, want a directory", entry.Name())
+			}
+			names = append(names, entry.Name())
+		}
+	}
+	if want := []string{"goblin", "orc"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+}
+
+func TestFSErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken.json":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	fsys := &FS{BaseURL: server.URL}
+	tests := []struct {
+		name    string
+		wantErr string
+		isErr   error
+	}{
+		{"missing.json", "open missing.json: file does not exist", fs.ErrNotExist},
+		{"broken.json", "open broken.json: unexpected status: 500 Internal Server Error", nil},
+		{"../escape.json", "open ../escape.json: invalid argument", fs.ErrInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := fsys.Open(test.name)
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+			if test.isErr != nil && !errors.Is(err, test.isErr) {
+				t.Errorf("got error %v, want it to be %v", err, test.isErr)
+			}
+		})
+	}
+}
+
+func TestParseListing(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing string
+		want    []string
+	}{
+		{
+			name:    "file server",
+			listing: `<pre><a href="goblin/">goblin/</a><a href="index.json">index.json</a><a href="./a:b/">a:b/</a></pre>`,
+			want:    []string{"a:b/", "goblin/", "index.json"},
+		},
+		{
+			name:    "escaped names",
+			listing: `<a href="orc%20archer/">orc archer/</a><a href="50%25/">50%/</a><a href="a&amp;b.json">a&amp;b.json</a>`,
+			want:    []string{"50%/", "a&b.json", "orc archer/"},
+		},
+		{
+			name:    "links outside the directory",
+			listing: `<a href="../">..</a><a href="/">root</a><a href="https://example.com/">x</a><a href="?C=N;O=D">Name</a><a href="a/b/">a/b</a><a href="#top">top</a>`,
+		},
+		{
+			name:    "duplicates",
+			listing: `<a href="goblin/"><img></a><a href="goblin/">goblin/</a>`,
+			want:    []string{"goblin/"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, entry := range parseListing([]byte(test.listing)) {
+				name := entry.Name()
+				if entry.IsDir() {
+					name += "/"
+				}
+				got = append(got, name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package dfsvn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// SVNDriver detects files left in conflict by "svn update" or "svn merge"
+// and reads each side from the files that Subversion writes next to them.
+// It's a drop-in alternative to dfgit.GitDriver for Subversion working copies.
+//
+// After "svn update" the sides of "goblin/index.json" are
+//
+//	index.json.mine    our version, as it was before updating
+//	index.json.r<OLD>  the common ancestor, the revision we were at
+//	index.json.r<NEW>  their version, the revision we updated to
+//
+// and after "svn merge" they're index.json.working, index.json.merge-left.r<N>
+// and index.json.merge-right.r<N>.
+type SVNDriver struct {
+	svnPath           string
+	svnTopPath        string
+	conflictedFileMap map[string]bool
+}
+
+var (
+	_ dfvcs.VCSDriver   = new(SVNDriver)
+	_ dfvcs.SidesDriver = new(SVNDriver)
+)
+
+func (vcs *SVNDriver) Init(ctx context.Context) error {
+	// Reset
+	vcs.conflictedFileMap = make(map[string]bool)
+
+	// Check if we have svn
+	{
+		path, err := exec.LookPath("svn")
+		if err != nil {
+			return errors.New("unable to locate \"svn\". Is Subversion installed?")
+		}
+		vcs.svnPath = path
+	}
+
+	// Get the root directory of the working copy
+	{
+		topPath, err := vcs.svn(ctx, "", "info", "--show-item", "wc-root")
+		if err != nil {
+			return err
+		}
+		vcs.svnTopPath = filepath.ToSlash(strings.TrimSpace(string(topPath)))
+	}
+
+	// Get the files in conflict
+	{
+		output, err := vcs.svn(ctx, vcs.svnTopPath, "status")
+		if err != nil {
+			return err
+		}
+		for _, path := range parseStatus(output) {
+			absPath := vcs.svnTopPath + "/" + path
+			vcs.conflictedFileMap[absPath] = true
+		}
+	}
+	return nil
+}
+
+// parseStatus returns the paths of the files with conflicted contents in the
+// output of "svn status", where each line is seven columns of flags followed
+// by a space and the path. The first column is 'C' for conflicted contents.
+func parseStatus(data []byte) []string {
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 9 || line[0] != 'C' {
+			// ie. an unconflicted file or the "Summary of conflicts:"
+			continue
+		}
+		paths = append(paths, filepath.ToSlash(line[8:]))
+	}
+	return paths
+}
+
+func (vcs *SVNDriver) Close() error {
+	return nil
+}
+
+func (vcs *SVNDriver) HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
+	return vcs.HandleFileSides(ctx, path, map[string]*bytes.Buffer{
+		dfvcs.SideOurs:   oursBuffer,
+		dfvcs.SideTheirs: theirsBuffer,
+	})
+}
+
+// HandleFileSides writes our version of a conflicted file into
+// dfvcs.SideOurs, the incoming version into dfvcs.SideTheirs and
+// their common ancestor into dfvcs.SideBase.
+func (vcs *SVNDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	if _, ok := vcs.conflictedFileMap[path]; !ok {
+		// Fallback to default behaviour
+		return false, nil
+	}
+	artifacts, err := conflictArtifacts(path)
+	if err != nil {
+		return false, err
+	}
+	for side, buf := range sides {
+		artifactPath, ok := artifacts[side]
+		if !ok {
+			if side != dfvcs.SideOurs && side != dfvcs.SideTheirs && side != dfvcs.SideBase {
+				return false, errors.New("unsupported side: " + side)
+			}
+			// The file was added or deleted on the other side, so use an
+			// empty object so that the conflict is still decoded
+			buf.WriteString("{}")
+			continue
+		}
+		data, err := os.ReadFile(artifactPath)
+		if err != nil {
+			return false, err
+		}
+		if _, err := buf.Write(data); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// conflictArtifacts returns the path of the file holding each side of the
+// conflicted file at path, as written next to it by Subversion
+func conflictArtifacts(path string) (map[string]string, error) {
+	dir, name := filepath.Split(filepath.FromSlash(path))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	artifacts := make(map[string]string)
+	var revisions []int
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), name+".")
+		if suffix == entry.Name() || entry.IsDir() {
+			continue
+		}
+		artifactPath := filepath.Join(dir, entry.Name())
+		switch {
+		case suffix == "mine", suffix == "working":
+			artifacts[dfvcs.SideOurs] = artifactPath
+		case strings.HasPrefix(suffix, "merge-left.r"):
+			artifacts[dfvcs.SideBase] = artifactPath
+		case strings.HasPrefix(suffix, "merge-right.r"):
+			artifacts[dfvcs.SideTheirs] = artifactPath
+		case strings.HasPrefix(suffix, "r"):
+			if revision, err := strconv.Atoi(suffix[1:]); err == nil {
+				revisions = append(revisions, revision)
+			}
+		}
+	}
+	if _, ok := artifacts[dfvcs.SideOurs]; !ok {
+		return nil, errors.New("unable to find our version of " + path + ", expected a .mine or .working file next to it")
+	}
+	// After an update the older revision is the one we were at
+	// and the newer one is the revision we updated to
+	sort.Ints(revisions)
+	if len(revisions) > 0 {
+		if _, ok := artifacts[dfvcs.SideTheirs]; !ok {
+			artifacts[dfvcs.SideTheirs] = filepath.Join(dir, name+".r"+strconv.Itoa(revisions[len(revisions)-1]))
+		}
+		if _, ok := artifacts[dfvcs.SideBase]; !ok && len(revisions) > 1 {
+			artifacts[dfvcs.SideBase] = filepath.Join(dir, name+".r"+strconv.Itoa(revisions[0]))
+		}
+	}
+	return artifacts, nil
+}
+
+// svn runs svn with arguments in dir, or the working directory if it's
+// empty, and returns what it wrote to stdout
+func (vcs *SVNDriver) svn(ctx context.Context, dir string, arguments ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, vcs.svnPath, arguments...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if stderr.Len() > 0 {
+			return nil, errors.New(strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,218 @@
+package dfsvn
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   []string
+	}{
+		{"nothing changed", "", nil},
+		{
+			name: "after an update",
+			status: "C       creatures/goblin/index.json\n" +
+				"?       creatures/goblin/index.json.mine\n" +
+				"?       creatures/goblin/index.json.r3\n" +
+				"?       creatures/goblin/index.json.r5\n" +
+				"M       index.json\n" +
+				"C       creatures/orc/index.json\n" +
+				"Summary of conflicts:\n" +
+				"  Text conflicts: 2\n",
+			want: []string{"creatures/goblin/index.json", "creatures/orc/index.json"},
+		},
+		{
+			// Only the first column is for the contents of the file
+			name: "property and tree conflicts",
+			status: " C      creatures/goblin/index.json\n" +
+				"      C creatures/orc\n" +
+				"      >   local dir edit, incoming dir delete upon update\n",
+		},
+		{
+			name:   "windows",
+			status: "C       creatures\\goblin\\index.json\r\nC       my creature\\index.json\r\n",
+			want:   []string{filepath.ToSlash("creatures\\goblin\\index.json"), filepath.ToSlash("my creature\\index.json")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseStatus([]byte(test.status)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleFileSides(t *testing.T) {
+	tests := []struct {
+		name string
+		// files are written next to index.json, by their suffix
+		files   map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "update",
+			files: map[string]string{
+				".mine": `{"side":"ours"}`,
+				".r3":   `{"side":"base"}`,
+				".r12":  `{"side":"theirs"}`,
+			},
+			want: map[string]string{
+				dfvcs.SideOurs:   `{"side":"ours"}`,
+				dfvcs.SideBase:   `{"side":"base"}`,
+				dfvcs.SideTheirs: `{"side":"theirs"}`,
+			},
+		},
+		{
+			name: "merge",
+			files: map[string]string{
+				".working":          `{"side":"ours"}`,
+				".merge-left.r4":    `{"side":"base"}`,
+				".merge-right.r9":   `{"side":"theirs"}`,
+				".json.r2":          `{"side":"unrelated"}`,
+				".unrelated.backup": `{}`,
+			},
+			want: map[string]string{
+				dfvcs.SideOurs:   `{"side":"ours"}`,
+				dfvcs.SideBase:   `{"side":"base"}`,
+				dfvcs.SideTheirs: `{"side":"theirs"}`,
+			},
+		},
+		{
+			// The file was added on both sides so there's no ancestor
+			name: "without a base",
+			files: map[string]string{
+				".mine": `{"side":"ours"}`,
+				".r7":   `{"side":"theirs"}`,
+			},
+			want: map[string]string{
+				dfvcs.SideOurs:   `{"side":"ours"}`,
+				dfvcs.SideBase:   `{}`,
+				dfvcs.SideTheirs: `{"side":"theirs"}`,
+			},
+		},
+		{
+			name:    "without our version",
+			files:   map[string]string{".r3": `{}`, ".r5": `{}`},
+			wantErr: "unable to find our version",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "creatures", "goblin", "index.json")
+			writeFile(t, path, "<<<<<<< .mine\n>>>>>>> .r12\n")
+			for suffix, data := range test.files {
+				writeFile(t, path+suffix, data)
+			}
+			// A directory of the same name isn't an artifact
+			if err := os.Mkdir(path+".r99", 0755); err != nil {
+				t.Fatal(err)
+			}
+			slashPath := filepath.ToSlash(path)
+			driver := &SVNDriver{conflictedFileMap: map[string]bool{slashPath: true}}
+
+			sides := map[string]*bytes.Buffer{
+				dfvcs.SideOurs:   new(bytes.Buffer),
+				dfvcs.SideBase:   new(bytes.Buffer),
+				dfvcs.SideTheirs: new(bytes.Buffer),
+			}
+			hasFile, err := driver.HandleFileSides(context.Background(), slashPath, sides)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hasFile {
+				t.Fatal("expected to be conflicted")
+			}
+			got := make(map[string]string, len(sides))
+			for side, buf := range sides {
+				got[side] = buf.String()
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got sides %q, want %q", got, test.want)
+			}
+
+			// HandleFile reads the same sides
+			var ours, theirs bytes.Buffer
+			if _, err := driver.HandleFile(context.Background(), slashPath, &ours, &theirs); err != nil {
+				t.Fatal(err)
+			}
+			if ours.String() != test.want[dfvcs.SideOurs] || theirs.String() != test.want[dfvcs.SideTheirs] {
+				t.Errorf("HandleFile: got %q %q", ours.String(), theirs.String())
+			}
+		})
+	}
+}
+
+func TestHandleFileSidesNotConflicted(t *testing.T) {
+	driver := &SVNDriver{conflictedFileMap: map[string]bool{"/wc/a.json": true}}
+	var ours, theirs bytes.Buffer
+	hasFile, err := driver.HandleFile(context.Background(), "/wc/b.json", &ours, &theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasFile || ours.Len() > 0 || theirs.Len() > 0 {
+		t.Errorf("got %v %q %q, want nothing read", hasFile, ours.String(), theirs.String())
+	}
+}
+
+func TestSVNDriverInit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script in place of svn")
+	}
+	// An svn that answers as if the working copy at wc has conflicts
+	wc := filepath.ToSlash(t.TempDir())
+	bin := t.TempDir()
+	writeFile(t, filepath.Join(bin, "svn"), `#!/bin/sh
+case "$1" in
+info)
+	echo '`+wc+`' ;;
+status)
+	printf 'C       a.json\n?       a.json.mine\nM       b.json\nC       dir/c.json\nSummary of conflicts:\n  Text conflicts: 2\n' ;;
+esac
+`)
+	if err := os.Chmod(filepath.Join(bin, "svn"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	driver := &SVNDriver{}
+	if err := driver.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+	want := map[string]bool{wc + "/a.json": true, wc + "/dir/c.json": true}
+	if !reflect.DeepEqual(driver.conflictedFileMap, want) {
+		t.Errorf("got conflicted files %v, want %v", driver.conflictedFileMap, want)
+	}
+}
@@ -1,8 +1,66 @@
 package dfvcs
 
-import "bytes"
+import (
+	"bytes"
+	"context"
+)
 
+// Names of the sides of a conflicted file
+const (
+	SideBase   = "base"
+	SideOurs   = "ours"
+	SideTheirs = "theirs"
+)
+
+// VCSDriver detects conflicted files and populates their ours and theirs sides.
+//
+// The context given to Init and HandleFile is the one decoding was started
+// with, ie. by dfjson.UnmarshalContext. Drivers that run subprocesses or do
+// slow I/O should stop once it's cancelled, others can ignore it.
 type VCSDriver interface {
-	Init() error
-	HandleFile(path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error)
+	Init(ctx context.Context) error
+	HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error)
+	// Close releases anything held since Init, ie. a long-lived process.
+	// It's called once decoding is done, even if it or Init failed.
+	Close() error
+}
+
+// SidesDriver is like VCSDriver but can populate any number of named sides of
+// a conflicted file, ie. SideBase, SideOurs and SideTheirs.
+//
+// HandleFileSides must write the file into every buffer in sides if it
+// returns true.
+type SidesDriver interface {
+	Init(ctx context.Context) error
+	HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error)
+	// Close releases anything held since Init, see VCSDriver.
+	Close() error
+}
+
+// SidesFromVCSDriver allows using a VCSDriver where a SidesDriver is expected.
+// It populates SideOurs and SideTheirs, any other side gets a copy of SideOurs.
+func SidesFromVCSDriver(driver VCSDriver) SidesDriver {
+	return &twoSidedDriver{VCSDriver: driver}
+}
+
+type twoSidedDriver struct {
+	VCSDriver
+}
+
+func (driver *twoSidedDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	var ours, theirs bytes.Buffer
+	ok, err := driver.HandleFile(ctx, path, &ours, &theirs)
+	if err != nil || !ok {
+		return ok, err
+	}
+	for side, buf := range sides {
+		data := ours.Bytes()
+		if side == SideTheirs {
+			data = theirs.Bytes()
+		}
+		if _, err := buf.Write(data); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 }
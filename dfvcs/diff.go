@@ -0,0 +1,184 @@
+package dfvcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change
+const diffContextLines = 3
+
+// DiffDriver wraps a SidesDriver and records a unified diff between
+// SideOurs and SideTheirs of each conflicted file, so that a merge UI
+// can preview the conflicts.
+type DiffDriver struct {
+	SidesDriver
+
+	// Diffs maps the path of each conflicted file to its unified diff,
+	// files whose sides are identical are left out.
+	Diffs map[string]string
+}
+
+// NewDiffDriver returns a DiffDriver that records the conflicts handled by driver
+func NewDiffDriver(driver SidesDriver) *DiffDriver {
+	return &DiffDriver{
+		SidesDriver: driver,
+		Diffs:       make(map[string]string),
+	}
+}
+
+func (driver *DiffDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	ours, theirs := sides[SideOurs], sides[SideTheirs]
+	oursStart, theirsStart := 0, 0
+	if ours != nil && theirs != nil {
+		oursStart, theirsStart = ours.Len(), theirs.Len()
+	}
+	ok, err := driver.SidesDriver.HandleFileSides(ctx, path, sides)
+	if err != nil || !ok {
+		return ok, err
+	}
+	if ours == nil || theirs == nil {
+		return true, nil
+	}
+	if diff := UnifiedDiff(path, ours.Bytes()[oursStart:], theirs.Bytes()[theirsStart:]); diff != "" {
+		driver.Diffs[path] = diff
+	}
+	return true, nil
+}
+
+// UnifiedDiff returns a line-based unified diff from ours to theirs,
+// or the empty string if they are the same.
+func UnifiedDiff(path string, ours, theirs []byte) string {
+	a, b := splitLines(ours), splitLines(theirs)
+	ops := diffLines(a, b)
+
+	var out strings.Builder
+	for i := 0; i < len(ops); {
+		// Find the next change
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk until there are enough unchanged lines
+		// after a change that they'd not be shared with the next hunk
+		end := i
+		for unchanged := 0; end < len(ops) && unchanged <= 2*diffContextLines; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && ops[end-1].kind == ' ' {
+			end--
+		}
+		end += diffContextLines
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s/%s\n+++ %s/%s\n", SideOurs, path, SideTheirs, path)
+		}
+		aStart, bStart := ops[start].aLine, ops[start].bLine
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.text)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// diffOp is a line that is unchanged (' '), removed ('-') or added ('+').
+// aLine and bLine are the indexes of the line in ours and theirs that the
+// operation is at.
+type diffOp struct {
+	kind         byte
+	text         string
+	aLine, bLine int
+}
+
+// diffLines returns the operations that turn a into b, found
+// using the longest common subsequence of lines.
+func diffLines(a, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := make([]diffOp, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', text: a[i], aLine: i, bLine: j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{kind: '-', text: a[i], aLine: i, bLine: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', text: b[j], aLine: i, bLine: j})
+			j++
+		}
+	}
+	return ops
+}
+
+// hunkRange formats the 0-based start line and line count of a hunk
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// An empty range refers to the line before it
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits data into lines, a trailing newline does not start another line
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	lines := strings.Split(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
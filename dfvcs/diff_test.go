@@ -0,0 +1,98 @@
+package dfvcs
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns the lines 1 to n, with the replacements applied
+func numberedLines(n int, replace map[int]string) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		line, ok := replace[i]
+		if !ok {
+			line = strconv.Itoa(i)
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		ours   string
+		theirs string
+		want   string
+	}{
+		{
+			name:   "same",
+			ours:   "{\n\t\"hp\": 10\n}\n",
+			theirs: "{\n\t\"hp\": 10\n}",
+		},
+		{
+			name:   "changed value",
+			ours:   "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 10,\n\t\"speed\": 1\n}\n",
+			theirs: "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 20,\n\t\"speed\": 1\n}\n",
+			want: "--- ours/goblin/index.json\n+++ theirs/goblin/index.json\n" +
+				"@@ -1,5 +1,5 @@\n {\n \t\"name\": \"Goblin\",\n-\t\"hp\": 10,\n+\t\"hp\": 20,\n \t\"speed\": 1\n }\n",
+		},
+		{
+			name:   "separate hunks",
+			ours:   numberedLines(20, nil),
+			theirs: numberedLines(20, map[int]string{2: "two", 18: "eighteen"}),
+			want: "--- ours/goblin/index.json\n+++ theirs/goblin/index.json\n" +
+				"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20\n",
+		},
+		{
+			name:   "added",
+			theirs: "a\n",
+			want:   "--- ours/goblin/index.json\n+++ theirs/goblin/index.json\n@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name: "removed",
+			ours: "a\n",
+			want: "--- ours/goblin/index.json\n+++ theirs/goblin/index.json\n@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name:   "line endings",
+			ours:   "a\r\nb\r\n",
+			theirs: "a\nb\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := UnifiedDiff("goblin/index.json", []byte(test.ours), []byte(test.theirs)); got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiffDriver(t *testing.T) {
+	mock := NewMockDriver()
+	mock.Add("/data/goblin/index.json", []byte("{\"hp\": 10}\n"), []byte("{\"hp\": 20}\n"))
+	mock.Add("/data/orc/index.json", []byte("{\"hp\": 5}\n"), []byte("{\"hp\": 5}\n"))
+	driver := NewDiffDriver(mock)
+	for _, path := range []string{"/data/goblin/index.json", "/data/orc/index.json", "/data/troll/index.json"} {
+		// The buffers already hold data from previous files
+		sides := map[string]*bytes.Buffer{
+			SideOurs:   bytes.NewBufferString(`{"a":`),
+			SideTheirs: bytes.NewBufferString(`{"b":`),
+		}
+		if _, err := driver.HandleFileSides(context.Background(), path, sides); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{
+		"/data/goblin/index.json": "--- ours//data/goblin/index.json\n+++ theirs//data/goblin/index.json\n@@ -1 +1 @@\n-{\"hp\": 10}\n+{\"hp\": 20}\n",
+	}
+	if !reflect.DeepEqual(driver.Diffs, want) {
+		t.Errorf("got %q, want %q", driver.Diffs, want)
+	}
+}
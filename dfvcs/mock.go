@@ -0,0 +1,87 @@
+package dfvcs
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+)
+
+// MockDriver is an in-memory driver for testing how conflicts are decoded
+// without a repository in the middle of a merge. Files that haven't been
+// added with Add or AddSides aren't conflicted and are read from disk as usual.
+//
+//	driver := dfvcs.NewMockDriver()
+//	driver.Add("data/goblin/index.json", []byte(`{"HP":10}`), []byte(`{"HP":20}`))
+//	hasMergeConflict, err := dfjson.Unmarshal("data/index.json", &ours, &theirs, driver)
+type MockDriver struct {
+	files map[string]map[string][]byte
+}
+
+var (
+	_ VCSDriver   = new(MockDriver)
+	_ SidesDriver = new(MockDriver)
+)
+
+// NewMockDriver returns a MockDriver without any conflicted files
+func NewMockDriver() *MockDriver {
+	return &MockDriver{
+		files: make(map[string]map[string][]byte),
+	}
+}
+
+// Add registers the file at path as conflicted with the given contents on
+// each side. Relative paths are resolved against the working directory.
+func (driver *MockDriver) Add(path string, ours, theirs []byte) {
+	driver.AddSides(path, map[string][]byte{
+		SideOurs:   ours,
+		SideTheirs: theirs,
+	})
+}
+
+// AddSides is like Add but sets the contents of any named side, ie. SideBase.
+// Sides that aren't given get the contents of SideOurs.
+func (driver *MockDriver) AddSides(path string, sides map[string][]byte) {
+	driver.files[mockPath(path)] = sides
+}
+
+func (driver *MockDriver) Init(ctx context.Context) error {
+	return nil
+}
+
+func (driver *MockDriver) Close() error {
+	return nil
+}
+
+func (driver *MockDriver) HandleFile(ctx context.Context, path string, oursBuffer *bytes.Buffer, theirsBuffer *bytes.Buffer) (bool, error) {
+	return driver.HandleFileSides(ctx, path, map[string]*bytes.Buffer{
+		SideOurs:   oursBuffer,
+		SideTheirs: theirsBuffer,
+	})
+}
+
+func (driver *MockDriver) HandleFileSides(ctx context.Context, path string, sides map[string]*bytes.Buffer) (bool, error) {
+	file, ok := driver.files[mockPath(path)]
+	if !ok {
+		return false, nil
+	}
+	for side, buf := range sides {
+		data, ok := file[side]
+		if !ok {
+			data = file[SideOurs]
+		}
+		if _, err := buf.Write(data); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// mockPath returns path as an absolute path using / as the separator,
+// which is how dfjson passes paths to drivers
+func mockPath(path string) string {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	return strings.ReplaceAll(path, "\\", "/")
+}
@@ -0,0 +1,71 @@
+package dfvcs
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestMockDriver(t *testing.T) {
+	driver := NewMockDriver()
+	driver.Add("data/goblin/index.json", []byte(`{"hp":1}`), []byte(`{"hp":2}`))
+	driver.AddSides("data/orc/index.json", map[string][]byte{
+		SideOurs: []byte(`{"hp":3}`),
+		SideBase: []byte(`{"hp":4}`),
+	})
+	absGoblin, err := filepath.Abs(filepath.Join("data", "goblin", "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		path        string
+		wantHasFile bool
+		want        map[string]string
+	}{
+		{
+			name:        "relative path",
+			path:        "data/goblin/index.json",
+			wantHasFile: true,
+			want:        map[string]string{SideOurs: `{"hp":1}`, SideTheirs: `{"hp":2}`, SideBase: `{"hp":1}`},
+		},
+		{
+			name:        "absolute path",
+			path:        absGoblin,
+			wantHasFile: true,
+			want:        map[string]string{SideOurs: `{"hp":1}`, SideTheirs: `{"hp":2}`, SideBase: `{"hp":1}`},
+		},
+		{
+			name:        "missing sides are ours",
+			path:        "data/orc/index.json",
+			wantHasFile: true,
+			want:        map[string]string{SideOurs: `{"hp":3}`, SideTheirs: `{"hp":3}`, SideBase: `{"hp":4}`},
+		},
+		{
+			name: "not conflicted",
+			path: "data/troll/index.json",
+			want: map[string]string{SideOurs: "", SideTheirs: "", SideBase: ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sides := make(map[string]*bytes.Buffer, len(test.want))
+			for side := range test.want {
+				sides[side] = new(bytes.Buffer)
+			}
+			hasFile, err := driver.HandleFileSides(context.Background(), test.path, sides)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasFile != test.wantHasFile {
+				t.Errorf("got hasFile %v, want %v", hasFile, test.wantHasFile)
+			}
+			for side, want := range test.want {
+				if got := sides[side].String(); got != want {
+					t.Errorf("%s: got %q, want %q", side, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package dfjson
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// ChangeKind is how a file on disk differs from the output of Marshal
+type ChangeKind int
+
+const (
+	// Unchanged files hold the same JSON on disk, ignoring formatting
+	Unchanged ChangeKind = iota
+	// Added files don't exist on disk yet
+	Added
+	// Modified files exist on disk but hold different data
+	Modified
+	// Deleted files exist on disk but are no longer part of the output,
+	// ie. the file of a map key that has been removed
+	Deleted
+)
+
+func (kind ChangeKind) String() string {
+	switch kind {
+	case Unchanged:
+		return "unchanged"
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// FileChange is a file that Diff compared
+type FileChange struct {
+	// Path is slash-separated and relative to root, like JSONFile.Path
+	Path string
+	Kind ChangeKind
+}
+
+// Diff reports how writing v with MarshalToDir would change the files in the
+// root directory, without writing anything. The files of v are listed in the
+// order that Marshal returns them, followed by the files that would be removed
+// with Options.RemoveStale set, as Deleted.
+func Diff(root string, entryFilename string, v interface{}) ([]FileChange, error) {
+	return DiffWithOptions(root, entryFilename, v, Options{})
+}
+
+// DiffWithOptions is like Diff but encodes v with MarshalWithOptions.
+func DiffWithOptions(root string, entryFilename string, v interface{}, opts Options) ([]FileChange, error) {
+	files, err := MarshalWithOptions(entryFilename, v, opts)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]FileChange, 0, len(files))
+	for _, file := range files {
+		path := longPath(filepath.Join(root, filepath.FromSlash(file.Path)))
+		kind := Unchanged
+		existing, err := os.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+			kind = Added
+		case err != nil:
+			return nil, err
+		case !jsonEqual(existing, file.Data):
+			kind = Modified
+		}
+		changes = append(changes, FileChange{Path: file.Path, Kind: kind})
+	}
+	if _, err := os.Stat(longPath(filepath.Join(root, filepath.FromSlash(dirOf(entryFilename))))); os.IsNotExist(err) {
+		// Nothing has been written yet, so there's nothing to delete
+		return changes, nil
+	}
+	if err := walkStale(root, entryFilename, reflect.TypeOf(v), files, &opts, func(path string, isDir bool) error {
+		if isDir {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, FileChange{Path: filepath.ToSlash(rel), Kind: Deleted})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
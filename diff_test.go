@@ -0,0 +1,137 @@
+package dfjson
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	written := func() *encodeTestWorld {
+		return &encodeTestWorld{Name: "world", Creatures: map[string]*encodeTestCreature{
+			"goblin": {Name: "Goblin", HP: 10},
+			"orc":    {Name: "Orc", HP: 20},
+		}}
+	}
+	tests := []struct {
+		name    string
+		v       *encodeTestWorld
+		compact bool
+		noFiles bool
+		want    []FileChange
+	}{
+		{
+			name: "unchanged",
+			v:    written(),
+			want: []FileChange{
+				{"creatures/goblin/index.json", Unchanged},
+				{"creatures/orc/index.json", Unchanged},
+				{"index.json", Unchanged},
+			},
+		},
+		{
+			name:    "formatting is ignored",
+			v:       written(),
+			compact: true,
+			want: []FileChange{
+				{"creatures/goblin/index.json", Unchanged},
+				{"creatures/orc/index.json", Unchanged},
+				{"index.json", Unchanged},
+			},
+		},
+		{
+			name: "modified",
+			v: func() *encodeTestWorld {
+				v := written()
+				v.Name = "renamed"
+				v.Creatures["orc"].HP = 21
+				return v
+			}(),
+			want: []FileChange{
+				{"creatures/goblin/index.json", Unchanged},
+				{"creatures/orc/index.json", Modified},
+				{"index.json", Modified},
+			},
+		},
+		{
+			name: "added",
+			v: func() *encodeTestWorld {
+				v := written()
+				v.Creatures["bat"] = &encodeTestCreature{Name: "Bat"}
+				return v
+			}(),
+			want: []FileChange{
+				{"creatures/bat/index.json", Added},
+				{"creatures/goblin/index.json", Unchanged},
+				{"creatures/orc/index.json", Unchanged},
+				{"index.json", Unchanged},
+			},
+		},
+		{
+			name: "removed map key",
+			v: func() *encodeTestWorld {
+				v := written()
+				delete(v.Creatures, "goblin")
+				return v
+			}(),
+			want: []FileChange{
+				{"creatures/orc/index.json", Unchanged},
+				{"index.json", Unchanged},
+				{"creatures/goblin/index.json", Deleted},
+			},
+		},
+		{
+			name: "removed field",
+			v:    &encodeTestWorld{Name: "world"},
+			want: []FileChange{
+				{"index.json", Unchanged},
+				{"creatures/goblin/index.json", Deleted},
+				{"creatures/orc/index.json", Deleted},
+			},
+		},
+		{
+			name:    "nothing written",
+			v:       written(),
+			noFiles: true,
+			want: []FileChange{
+				{"creatures/goblin/index.json", Added},
+				{"creatures/orc/index.json", Added},
+				{"index.json", Added},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			if !test.noFiles {
+				if err := MarshalTo(root, "index.json", written(), Options{Compact: test.compact}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := readTree(t, root)
+			got, err := Diff(root, "index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			// Nothing is written
+			if after := readTree(t, root); !reflect.DeepEqual(after, before) {
+				t.Errorf("got files %q after Diff, want %q", after, before)
+			}
+		})
+	}
+}
+
+func TestDiffUnreadableFile(t *testing.T) {
+	root := t.TempDir()
+	// A directory where the entry file should be can't be read
+	if err := os.MkdirAll(filepath.Join(root, "index.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Diff(root, "index.json", newEncodeTestWorld()); err == nil {
+		t.Error("expected an error")
+	}
+}
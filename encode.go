@@ -2,12 +2,16 @@ package dfjson
 
 import (
 	"bytes"
+	"context"
 	"encoding"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // JSONFile is data structure returned from Marshal
@@ -19,6 +23,54 @@ type JSONFile struct {
 type encodeState struct {
 	Directory string
 	Paths     []JSONFile
+	opts      Options
+
+	// ctx is checked before encoding each file so that
+	// encoding stops once it's cancelled
+	ctx context.Context
+
+	// fieldStack holds the JSON field names and map keys leading
+	// to the value currently being encoded
+	fieldStack []string
+	omitFields map[string]bool
+
+	// sourceStack holds the Go expression leading to the value
+	// currently being encoded, ie. `main.World`, `.Creatures`, `["goblin"]`
+	sourceStack []string
+
+	// entryDepth is the number of directories in the path of the entry file
+	entryDepth int
+
+	// visiting holds the pointers, maps and slices currently being
+	// encoded so that self-referential data is detected
+	visiting map[visitKey]bool
+
+	// format is the format of the subtree currently being
+	// encoded, as set by the format option of a field
+	format string
+
+	// emit is called with each file as it's encoded rather than
+	// adding it to Paths, if set
+	emit func(file JSONFile) error
+
+	// planOnly skips encoding the data of files, see PlanLayout
+	planOnly bool
+
+	// indent, if set, is written for each level of nesting as files are
+	// encoded, so that they don't need to be indented afterwards
+	indent string
+
+	// valueEnc encodes the values nested within files into valueBuf,
+	// it's reused so that its buffers are only allocated once
+	valueEnc *json.Encoder
+	valueBuf bytes.Buffer
+}
+
+// visitKey identifies a pointer, map or slice by what it points to
+type visitKey struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
 }
 
 // Marshal returns the JSON encoding of v but differs from the standard library encoding/json
@@ -30,447 +82,781 @@ type encodeState struct {
 //
 // Data in production should not be written or read this way.
 func Marshal(entryFilename string, v interface{}) ([]JSONFile, error) {
-	list, err := marshalIndent(entryFilename, v, "", "\t")
-	return list, err
+	return NewEncoder().Encode(entryFilename, v)
+}
+
+// MarshalContext is like Marshal but stops encoding and
+// returns ctx.Err() once ctx is cancelled.
+func MarshalContext(ctx context.Context, entryFilename string, v interface{}) ([]JSONFile, error) {
+	return NewEncoder().EncodeContext(ctx, entryFilename, v)
+}
+
+// MarshalWithOptions is like Marshal but allows configuring the encoding behaviour.
+func MarshalWithOptions(entryFilename string, v interface{}, opts Options) ([]JSONFile, error) {
+	return NewEncoder(WithOptions(opts)).Encode(entryFilename, v)
+}
+
+// MarshalCompact is like Marshal but files are written without any
+// indentation, see Options.Compact.
+func MarshalCompact(entryFilename string, v interface{}) ([]JSONFile, error) {
+	return MarshalWithOptions(entryFilename, v, Options{Compact: true})
+}
+
+// Encoder encodes values into files like Marshal, with the configuration
+// it was created with.
+type Encoder struct {
+	opts Options
+}
+
+// NewEncoder returns an Encoder configured by opts
+func NewEncoder(opts ...Option) *Encoder {
+	enc := &Encoder{}
+	for _, opt := range opts {
+		opt(&enc.opts)
+	}
+	return enc
 }
 
-func marshal(entryFilename string, v interface{}) ([]JSONFile, error) {
-	var state encodeState
-	if err := state.encode(entryFilename, v); err != nil {
+// Encode returns the files that v is encoded into, see Marshal.
+func (enc *Encoder) Encode(entryFilename string, v interface{}) ([]JSONFile, error) {
+	return enc.EncodeContext(context.Background(), entryFilename, v)
+}
+
+// EncodeContext is like Encode but stops encoding and
+// returns ctx.Err() once ctx is cancelled.
+func (enc *Encoder) EncodeContext(ctx context.Context, entryFilename string, v interface{}) ([]JSONFile, error) {
+	var list []JSONFile
+	if err := enc.encodeFunc(ctx, entryFilename, v, func(file JSONFile) error {
+		list = append(list, file)
+		return nil
+	}); err != nil {
 		return nil, err
 	}
-	return state.Paths, nil
+	return list, nil
 }
 
-// marshalIndent applies Indent to format the output of each JSON file.
-// Each JSON element in the output will begin on a new line beginning with prefix
-// followed by one or more copies of indent according to the indentation nesting.
-func marshalIndent(entryFilename string, v interface{}, prefix, indent string) ([]JSONFile, error) {
-	list, err := marshal(entryFilename, v)
-	if err != nil {
+// encodeFunc encodes v and calls fn with each file as soon as it's finished,
+// stopping at the first error returned by fn.
+func (enc *Encoder) encodeFunc(ctx context.Context, entryFilename string, v interface{}, fn func(file JSONFile) error) error {
+	opts := enc.opts
+	formatter := opts.Formatter
+	// encodeIndent is set if files are indented as they're encoded, which
+	// saves a second pass over each of them when using the default formatter
+	var encodeIndent string
+	// isCompact is set if files are written as encoded, without any whitespace
+	isCompact := formatter == nil && opts.Compact
+	if formatter == nil && !isCompact {
+		indent := opts.Indent
+		if indent == "" {
+			indent = "\t"
+		}
+		formatter = indentFormatter("", indent, opts.CompactArrayWidth, opts.AlignObjectArrays)
+		if opts.CompactArrayWidth <= 0 && !opts.AlignObjectArrays {
+			encodeIndent = indent
+		}
+	}
+	finishFile := func(file JSONFile) error {
+		isIndented := encodeIndent != ""
+		if opts.WrapKey != "" && file.Path == entryFilename {
+			data, err := wrapKey(file.Data, opts.WrapKey, !opts.DisableHTMLEscaping)
+			if err != nil {
+				return err
+			}
+			file.Data = data
+			isIndented = false
+		}
+		if format := opts.fileFormat(file.Path); format != "" {
+			codec, err := opts.codec(format)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.Path, err)
+			}
+			data, err := codec.FromJSON(file.Data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.Path, err)
+			}
+			file.Data = data
+		} else if !isIndented && !isCompact {
+			data, err := formatter(file.Data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.Path, err)
+			}
+			file.Data = data
+		}
+		if opts.TrailingNewline && !bytes.HasSuffix(file.Data, []byte("\n")) {
+			file.Data = append(file.Data, '\n')
+		}
+		if opts.PathTransform != nil {
+			file.Path = transformPath(entryFilename, file.Path, opts.PathTransform)
+		}
+		return fn(file)
+	}
+	if err := marshalFunc(ctx, entryFilename, v, opts, encodeIndent, finishFile); err != nil {
+		return err
+	}
+	if opts.ExtraFiles != nil {
+		extraFiles, err := opts.ExtraFiles(v)
+		if err != nil {
+			return err
+		}
+		entryDir := dirOf(entryFilename)
+		for _, file := range extraFiles {
+			path := cleanPath(file.Path)
+			if path == ".." || strings.HasPrefix(path, "../") || strings.HasPrefix(path, "/") {
+				return fmt.Errorf("extra file %q is outside of the entry directory", file.Path)
+			}
+			file.Path = joinDir(entryDir, path)
+			if err := fn(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func marshal(entryFilename string, v interface{}, opts Options) ([]JSONFile, error) {
+	var list []JSONFile
+	if err := marshalFunc(context.Background(), entryFilename, v, opts, "", func(file JSONFile) error {
+		list = append(list, file)
+		return nil
+	}); err != nil {
 		return nil, err
 	}
-	for i := 0; i < len(list); i++ {
-		buf := bytes.Buffer{}
-		item := &list[i]
-		if err := json.Indent(&buf, item.Data, prefix, indent); err != nil {
+	return list, nil
+}
+
+// marshalFunc is like marshal but calls emit with each file as it's encoded,
+// indenting them with indent if it's set
+func marshalFunc(ctx context.Context, entryFilename string, v interface{}, opts Options, indent string, emit func(file JSONFile) error) error {
+	state := encodeState{
+		ctx:    ctx,
+		opts:   opts.withDefaults(),
+		emit:   emit,
+		indent: indent,
+	}
+	return state.marshal(entryFilename, v)
+}
+
+// marshal encodes v into files, starting with the entry file
+func (state *encodeState) marshal(entryFilename string, v interface{}) error {
+	if len(state.opts.OmitFields) > 0 {
+		state.omitFields = make(map[string]bool, len(state.opts.OmitFields))
+		for _, name := range state.opts.OmitFields {
+			state.omitFields[name] = true
+		}
+	}
+	rootType := reflect.TypeOf(v)
+	if rootType.Kind() == reflect.Ptr {
+		rootType = rootType.Elem()
+	}
+	state.sourceStack = append(state.sourceStack, rootType.String())
+	state.entryDepth = pathDepth(entryFilename)
+	return state.encode(entryFilename, v)
+}
+
+// marshalValue returns the JSON encoding of v,
+// or nothing if only the paths of files are wanted
+func (state *encodeState) marshalValue(v interface{}) ([]byte, error) {
+	if state.planOnly {
+		return nil, nil
+	}
+	data, err := marshalJSON(v, !state.opts.DisableHTMLEscaping)
+	if err != nil || state.indent == "" {
+		return data, err
+	}
+	var buf bytes.Buffer
+	indentCompact(&buf, data, "", state.indent, 0, false)
+	return buf.Bytes(), nil
+}
+
+// marshalJSON is json.Marshal but <, > and & in strings
+// are only escaped if escapeHTML is set
+func marshalJSON(v interface{}, escapeHTML bool) ([]byte, error) {
+	if escapeHTML {
+		return json.Marshal(v)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	// Leave out the newline that the encoder ends each value with
+	return buf.Bytes()[:buf.Len()-1], nil
+}
+
+// writeValue writes the JSON encoding of v to buf as an element nested
+// one level within the object or array being written to it
+func (state *encodeState) writeValue(buf *bytes.Buffer, v interface{}) error {
+	if state.planOnly {
+		return nil
+	}
+	if state.valueEnc == nil {
+		state.valueEnc = json.NewEncoder(&state.valueBuf)
+		state.valueEnc.SetEscapeHTML(!state.opts.DisableHTMLEscaping)
+	}
+	state.valueBuf.Reset()
+	if err := state.valueEnc.Encode(v); err != nil {
+		return err
+	}
+	// Leave out the newline that the encoder ends each value with
+	data := state.valueBuf.Bytes()
+	data = data[:len(data)-1]
+	if state.indent == "" {
+		buf.Write(data)
+		return nil
+	}
+	indentCompact(buf, data, state.indent, state.indent, 0, false)
+	return nil
+}
+
+// writeElementStart writes what comes before an element of the object or
+// array being written to buf, first is set if it's the first element
+func (state *encodeState) writeElementStart(buf *bytes.Buffer, first bool) {
+	if !first {
+		buf.WriteByte(',')
+	}
+	if state.indent != "" {
+		buf.WriteByte('\n')
+		buf.WriteString(state.indent)
+	}
+}
+
+// writeEnd closes the object or array being written to buf
+// with end, hasElements is set if anything was written to it
+func (state *encodeState) writeEnd(buf *bytes.Buffer, end byte, hasElements bool) {
+	if hasElements && state.indent != "" {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte(end)
+}
+
+// addFile adds file to the output, passing it to emit if it's set
+func (state *encodeState) addFile(file JSONFile) error {
+	if state.emit != nil {
+		return state.emit(file)
+	}
+	state.Paths = append(state.Paths, file)
+	return nil
+}
+
+// bufferPool holds the buffers that files are built up in while encoding,
+// so that encoding many files doesn't allocate and grow a buffer for each
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooledBufferSize is the capacity above which buffers aren't put back into
+// bufferPool, so that a single large file doesn't keep its memory around
+const maxPooledBufferSize = 64 << 10
+
+// getBuffer returns an empty buffer from bufferPool, it should be
+// given back with putBuffer once its bytes are no longer used
+func (state *encodeState) getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	if state.opts.InitialBufferSize > 0 {
+		buf.Grow(state.opts.InitialBufferSize)
+	}
+	return buf
+}
+
+// putBuffer resets buf and puts it back into bufferPool
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// copyBytes returns a copy of data, for keeping the bytes
+// of a buffer that's put back into bufferPool
+func copyBytes(data []byte) []byte {
+	return append([]byte(nil), data...)
+}
+
+// indentFormatter returns a formatter that applies Indent to the output of each JSON file.
+// Each JSON element in the output will begin on a new line beginning with prefix
+// followed by one or more copies of indent according to the indentation nesting.
+//
+// If compactArrayWidth is above 0, arrays of scalars that fit within that many
+// bytes are kept on a single line.
+func indentFormatter(prefix, indent string, compactArrayWidth int, alignObjectArrays bool) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		buf := bufferPool.Get().(*bytes.Buffer)
+		defer putBuffer(buf)
+		if compactArrayWidth > 0 || alignObjectArrays {
+			if err := indentCompactArrays(buf, data, prefix, indent, compactArrayWidth, alignObjectArrays); err != nil {
+				return nil, err
+			}
+			return copyBytes(buf.Bytes()), nil
+		}
+		if err := json.Indent(buf, data, prefix, indent); err != nil {
 			return nil, err
 		}
-		item.Data = buf.Bytes()
+		return copyBytes(buf.Bytes()), nil
 	}
-	return list, nil
 }
 
 func (state *encodeState) encode(path string, value interface{}) error {
+	if err := state.ctx.Err(); err != nil {
+		return err
+	}
+	if err := state.opts.checkDepth(path, state.entryDepth); err != nil {
+		return err
+	}
+	if rv := reflect.ValueOf(value); rv.IsValid() && !isNilValue(rv) {
+		switch rv.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice:
+			key := visitKey{ptr: rv.Pointer(), typ: rv.Type()}
+			if rv.Kind() == reflect.Slice {
+				key.len = rv.Len()
+			}
+			if state.visiting[key] {
+				return fmt.Errorf("%s: encountered a cycle via %s", dirOf(path), strings.Join(state.fieldStack, "."))
+			}
+			if state.visiting == nil {
+				state.visiting = make(map[visitKey]bool)
+			}
+			state.visiting[key] = true
+			defer delete(state.visiting, key)
+		}
+	}
+	if rv := reflect.ValueOf(value); !rv.IsValid() || isNilValue(rv) {
+		// Keep the key around, ie. for a map holding a nil value
+		return state.addFile(JSONFile{
+			Path: path,
+			Data: []byte("null"),
+		})
+	}
+	if isCustomMarshaler(value) || state.opts.isCombined(path, state.entryDepth) {
+		// Types that marshal themselves are written as-is to a single
+		// file rather than having their fields distributed, as is
+		// everything below the level set by Options.Granularity
+		data, err := state.marshalValue(value)
+		if err != nil {
+			return err
+		}
+		return state.addFile(JSONFile{
+			Path: path,
+			Data: data,
+		})
+	}
 	switch kind := reflect.TypeOf(value).Kind(); kind {
 	case reflect.Struct:
 		panic("Unexpected error. Must transform struct to pointer before calling encode")
 	case reflect.Map:
 		//mapType := reflect.TypeOf(value).Elem()
 		topMapValue := reflect.ValueOf(value)
-		for _, mapKey := range topMapValue.MapKeys() {
-			mapValue := topMapValue.MapIndex(mapKey)
-			var keyStringValue string
-			if m, ok := mapKey.Interface().(encoding.TextMarshaler); ok {
-				marshalText, err := m.MarshalText()
-				if err != nil {
-					return err
-				}
-				//keyStringValue = stringBytes(marshalText, true)
-				keyStringValue = string(marshalText)
-			} else {
-				keyStringValue = fmt.Sprintf("%v", mapKey.Interface())
+		mapKeys := topMapValue.MapKeys()
+		if len(mapKeys) == 0 {
+			// There are no keys to create directories for, so write
+			// the empty object so that it doesn't decode as nil
+			return state.addFile(JSONFile{
+				Path: path,
+				Data: []byte("{}"),
+			})
+		}
+		keyStrings := make([]string, len(mapKeys))
+		for i, mapKey := range mapKeys {
+			keyStringValue, err := mapKeyString(mapKey)
+			if err != nil {
+				return fmt.Errorf("%s: %w", dirOf(path), err)
 			}
-			var data interface{}
-			if mapValue.Kind() == reflect.Struct {
-				data = mapValue.Addr().Interface()
-			} else {
-				data = mapValue.Interface()
+			keyStrings[i] = keyStringValue
+		}
+		// Map iteration order is random, so sort the keys to keep
+		// the order of the files we return stable
+		if !state.opts.UnsortedMapKeys || state.opts.isRenamingKeys() {
+			sort.Sort(mapKeySorter{keys: mapKeys, keyStrings: keyStrings, numeric: isIntegerKeyType(topMapValue.Type().Key())})
+		}
+		escapedKeys := keyStrings
+		if state.opts.KeyEscaper != nil {
+			escapedKeys = make([]string, len(keyStrings))
+			for i, key := range keyStrings {
+				escapedKeys[i] = state.opts.KeyEscaper.EscapeKey(key)
+			}
+		}
+		dirNames, err := state.mapDirNames(escapedKeys)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dirOf(path), err)
+		}
+		renamedKeys := make(map[string]string)
+		for i, mapKey := range mapKeys {
+			data := encodableValue(topMapValue.MapIndex(mapKey))
+			dirName := dirNames[i]
+			if dirName != escapedKeys[i] {
+				renamedKeys[dirName] = keyStrings[i]
 			}
-			dir := strings.ReplaceAll(filepath.Dir(path), "\\", "/")
-			if err := state.encode(dir+"/"+keyStringValue+"/index.json", data); err != nil {
+			state.fieldStack = append(state.fieldStack, keyStrings[i])
+			state.sourceStack = append(state.sourceStack, "["+strconv.Quote(keyStrings[i])+"]")
+			if err := state.encode(state.childPath(path, dirName), data); err != nil {
+				return err
+			}
+			state.fieldStack = state.fieldStack[:len(state.fieldStack)-1]
+			state.sourceStack = state.sourceStack[:len(state.sourceStack)-1]
+		}
+		if len(renamedKeys) > 0 {
+			// Record the original keys so decode can reverse the renaming
+			data, err := state.marshalValue(renamedKeys)
+			if err != nil {
+				return err
+			}
+			if err := state.addFile(JSONFile{
+				Path: joinDir(dirOf(path), keysFilename),
+				Data: data,
+			}); err != nil {
 				return err
 			}
 		}
 		return nil
 	case reflect.Ptr:
-		buf := bytes.Buffer{}
+		if el := reflect.ValueOf(value).Elem(); el.Kind() != reflect.Struct {
+			// ie. a pointer to a map or slice
+			return state.encode(path, encodableValue(el))
+		}
+		buf := state.getBuffer()
+		defer putBuffer(buf)
 		buf.WriteRune('{')
+		keySeparator := ":"
+		if state.indent != "" {
+			keySeparator = ": "
+		}
 		hasWrittenFirstField := false
+		if state.opts.Provenance {
+			state.writeElementStart(buf, true)
+			buf.WriteString("\"" + sourceKey + "\"" + keySeparator)
+			if err := state.writeValue(buf, strings.Join(state.sourceStack, "")); err != nil {
+				return err
+			}
+			hasWrittenFirstField = true
+		}
 
 		el := reflect.ValueOf(value).Elem()
-		for i := 0; i < el.NumField(); i++ {
-			field := el.Field(i)
-			fieldType := el.Type().Field(i)
-
-			// Ignore unexported field
-			// (copy-pasted out of encoder/json package)
-			{
-				isUnexported := fieldType.PkgPath != ""
-				if fieldType.Anonymous {
-					t := fieldType.Type
-					if t.Kind() == reflect.Ptr {
-						t = t.Elem()
-					}
-					if isUnexported && t.Kind() != reflect.Struct {
-						// Ignore embedded fields of unexported non-struct types.
-						continue
-					}
-					// Do not ignore embedded fields of unexported struct types
-					// since they may have exported fields.
-				} else if isUnexported {
-					// Ignore unexported non-embedded fields.
-					continue
-				}
-			}
-			tag := fieldType.Tag.Get("json")
-			if tag == "-" {
+		fields := typeFields(el.Type())
+		if err := checkFieldCollisions(el.Type()); err != nil {
+			return err
+		}
+		for _, f := range fields {
+			field, ok := fieldByIndex(el, f.index)
+			if !ok {
+				// Promoted through a nil embedded pointer, as with encoding/json
 				continue
 			}
-			var jsonOptions string
-			jsonFieldName := tag
-			if idx := strings.Index(tag, ","); idx != -1 {
-				jsonFieldName = tag[:idx]
-				jsonOptions = tag[idx+1:]
-			}
-			if jsonFieldName == "" {
-				// Default to Golang struct field name
-				jsonFieldName = fieldType.Name
-			}
+			jsonFieldName := f.name
 
-			// NOTE(Jae): 2020-01-06
-			// "encoder/json" does a more robust job here checking for a ","
-			// but we don't bother
-			if strings.Contains(jsonOptions, "omitempty") {
+			if state.isOmittedField(jsonFieldName) {
 				continue
 			}
-			if strings.Contains(jsonOptions, "string") {
-				// todo(Jae): 2020-01-06
-				// add support for quoting non-string values with "string" option
-				// as its supported by the encoder/json package
-				panic("No support for \"string\" in DFJSON.")
+			if isOrderField(fields, f.goName) {
+				// Written to the order file of the map instead
+				continue
 			}
-			if tagValue, ok := fieldType.Tag.Lookup("dfjson"); ok && tagValue == "distributable" {
-				var data interface{}
-				if field.Kind() == reflect.Struct {
-					data = field.Addr().Interface()
-				} else {
-					data = field.Interface()
+			if f.opts.Contains("omitempty") && isEmptyValue(field) {
+				// Distributable fields get no directory at all, so
+				// decoding leaves them as their zero value
+				continue
+			}
+			if f.distributable {
+				if isNilValue(field) || (field.Kind() == reflect.Interface && isNilValue(field.Elem())) {
+					// Write nothing so that there is no directory and
+					// decoding leaves the field as nil, including for an
+					// interface holding a nil pointer
+					continue
+				}
+				data := encodableValue(field)
+				state.fieldStack = append(state.fieldStack, jsonFieldName)
+				state.sourceStack = append(state.sourceStack, "."+f.goName)
+				dirName := jsonFieldName
+				if f.group != "" {
+					dirName = f.group + "/" + jsonFieldName
 				}
-				if err := state.encode(filepath.Dir(path)+"/"+jsonFieldName+"/", data); err != nil {
+				parentFormat := state.format
+				state.format = fieldFormat(f, parentFormat)
+				if f.chunkSize != 0 && f.format != "" {
+					return fmt.Errorf("%s.%s: chunk and format options can't be used together", el.Type().String(), f.goName)
+				}
+				if f.chunkSize != 0 && !state.opts.isCombined(state.childPath(path, dirName), state.entryDepth) {
+					if f.chunkSize < 0 {
+						return fmt.Errorf("%s.%s: chunk option must be a positive number", el.Type().String(), f.goName)
+					}
+					if err := state.encodeChunks(state.childPath(path, dirName), field, f.chunkSize); err != nil {
+						return err
+					}
+				} else if err := state.encode(state.childPath(path, dirName), data); err != nil {
 					return err
 				}
+				if f.orderField != "" {
+					if err := state.encodeOrder(state.childPath(path, dirName), el, fields, f); err != nil {
+						return err
+					}
+				}
+				state.format = parentFormat
+				state.fieldStack = state.fieldStack[:len(state.fieldStack)-1]
+				state.sourceStack = state.sourceStack[:len(state.sourceStack)-1]
 				continue
 			}
-			fieldValue, err := json.Marshal(field.Interface())
+			fieldValue := field.Interface()
+			if f.opts.Contains("string") {
+				var err error
+				if fieldValue, err = quotedValue(field, !state.opts.DisableHTMLEscaping); err != nil {
+					return fmt.Errorf("%s.%s: %w", el.Type().String(), f.goName, err)
+				}
+			}
+			state.writeElementStart(buf, !hasWrittenFirstField)
+			buf.WriteString("\"" + jsonFieldName + "\"" + keySeparator)
+			if err := state.writeValue(buf, fieldValue); err != nil {
+				return err
+			}
+			hasWrittenFirstField = true
+		}
+		state.writeEnd(buf, '}', hasWrittenFirstField)
+		if err := state.addFile(JSONFile{
+			Path: path,
+			Data: copyBytes(buf.Bytes()),
+		}); err != nil {
+			return err
+		}
+	case reflect.Slice, reflect.Array:
+		sliceValue := reflect.ValueOf(value)
+		if kind == reflect.Slice && sliceValue.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded as a base64 string by encoding/json
+			data, err := state.marshalValue(value)
 			if err != nil {
 				return err
 			}
-			if hasWrittenFirstField {
-				buf.WriteString(",")
+			return state.addFile(JSONFile{
+				Path: path,
+				Data: data,
+			})
+		}
+		if sliceValue.Len() == 0 {
+			// There are no elements to create directories for, so write
+			// the empty array so that it doesn't decode as nil
+			return state.addFile(JSONFile{
+				Path: path,
+				Data: []byte("[]"),
+			})
+		}
+		// Each element is written to a directory named by its index
+		for i := 0; i < sliceValue.Len(); i++ {
+			index := strconv.Itoa(i)
+			state.fieldStack = append(state.fieldStack, index)
+			state.sourceStack = append(state.sourceStack, "["+index+"]")
+			if err := state.encode(state.childPath(path, index), encodableValue(sliceValue.Index(i))); err != nil {
+				return err
 			}
-			buf.WriteString("\"" + jsonFieldName + "\":")
-			buf.Write(fieldValue)
-			hasWrittenFirstField = true
+			state.fieldStack = state.fieldStack[:len(state.fieldStack)-1]
+			state.sourceStack = state.sourceStack[:len(state.sourceStack)-1]
 		}
-		if hasWrittenFirstField {
-			buf.WriteRune('}')
+	default:
+		// Scalar values, ie. the elements of a []int, are written
+		// to their own file as there's nothing to distribute
+		data, err := state.marshalValue(value)
+		if err != nil {
+			return err
 		}
-		state.Paths = append(state.Paths, JSONFile{
+		if err := state.addFile(JSONFile{
 			Path: path,
-			Data: buf.Bytes(),
-		})
-	default:
-		panic("Unhandled kind: " + kind.String())
+			Data: data,
+		}); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// stringBytes was copied from json encoder in standard lib
-// It's used to encode MarshalText properly for JSON
-/* func stringBytes(s []byte, escapeHTML bool) string {
-	e := bytes.Buffer{}
-	e.WriteByte('"')
-	start := 0
-	for i := 0; i < len(s); {
-		if b := s[i]; b < utf8.RuneSelf {
-			if htmlSafeSet[b] || (!escapeHTML && safeSet[b]) {
-				i++
-				continue
-			}
-			if start < i {
-				e.Write(s[start:i])
-			}
-			e.WriteByte('\\')
-			switch b {
-			case '\\', '"':
-				e.WriteByte(b)
-			case '\n':
-				e.WriteByte('n')
-			case '\r':
-				e.WriteByte('r')
-			case '\t':
-				e.WriteByte('t')
-			default:
-				// This encodes bytes < 0x20 except for \t, \n and \r.
-				// If escapeHTML is set, it also escapes <, >, and &
-				// because they can lead to security holes when
-				// user-controlled strings are rendered into JSON
-				// and served to some browsers.
-				e.WriteString(`u00`)
-				e.WriteByte(hex[b>>4])
-				e.WriteByte(hex[b&0xF])
-			}
-			i++
-			start = i
-			continue
-		}
-		c, size := utf8.DecodeRune(s[i:])
-		if c == utf8.RuneError && size == 1 {
-			if start < i {
-				e.Write(s[start:i])
-			}
-			e.WriteString(`\ufffd`)
-			i += size
-			start = i
-			continue
-		}
-		// U+2028 is LINE SEPARATOR.
-		// U+2029 is PARAGRAPH SEPARATOR.
-		// They are both technically valid characters in JSON strings,
-		// but don't work in JSONP, which has to be evaluated as JavaScript,
-		// and can lead to security holes there. It is valid JSON to
-		// escape them, so we do so unconditionally.
-		// See http://timelessrepo.com/json-isnt-a-javascript-subset for discussion.
-		if c == '\u2028' || c == '\u2029' {
-			if start < i {
-				e.Write(s[start:i])
-			}
-			e.WriteString(`\u202`)
-			e.WriteByte(hex[c&0xF])
-			i += size
-			start = i
-			continue
+// childPath returns the path of the file that the value stored under name,
+// ie. a distributable field or map key, of the value at path is written to
+func (state *encodeState) childPath(path string, name string) string {
+	return joinDir(dirOf(path), name+"/"+state.opts.formatFilename(state.format))
+}
+
+// isNilValue reports whether v is a nil pointer, map, slice or interface
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// isOmittedField reports whether a field of the value currently being encoded
+// was listed in Options.OmitFields, either by its JSON name or by its dotted path.
+func (state *encodeState) isOmittedField(name string) bool {
+	if len(state.omitFields) == 0 {
+		return false
+	}
+	if state.omitFields[name] {
+		return true
+	}
+	return state.omitFields[strings.Join(append(state.fieldStack, name), ".")]
+}
+
+// mapKeySorter sorts map keys by their string representation, or by
+// their value if numeric is set so that the files of integer keys are
+// in order, ie. "2" before "10"
+type mapKeySorter struct {
+	keys       []reflect.Value
+	keyStrings []string
+	numeric    bool
+}
+
+func (s mapKeySorter) Len() int { return len(s.keys) }
+func (s mapKeySorter) Less(i, j int) bool {
+	if s.numeric {
+		switch s.keys[i].Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return s.keys[i].Int() < s.keys[j].Int()
+		default:
+			return s.keys[i].Uint() < s.keys[j].Uint()
+		}
+	}
+	return s.keyStrings[i] < s.keyStrings[j]
+}
+func (s mapKeySorter) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.keyStrings[i], s.keyStrings[j] = s.keyStrings[j], s.keyStrings[i]
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// encodableValue returns v in the form that encode expects. Values held by
+// interfaces are unwrapped to their concrete value, and structs or types with
+// pointer receiver marshalers are given as a pointer, copying them first if v
+// isn't addressable (ie. a map value).
+func encodableValue(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
 		}
-		i += size
+		v = v.Elem()
 	}
-	if start < len(s) {
-		e.Write(s[start:])
+	ptrType := reflect.PtrTo(v.Type())
+	if v.Kind() != reflect.Struct &&
+		!ptrType.Implements(marshalerType) &&
+		!ptrType.Implements(textMarshalerType) {
+		return v.Interface()
 	}
-	e.WriteByte('"')
-	return e.String()
+	if !v.CanAddr() {
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		v = copied
+	}
+	return v.Addr().Interface()
 }
 
-var hex = "0123456789abcdef"
+// isCustomMarshaler reports whether value implements json.Marshaler
+// or encoding.TextMarshaler
+func isCustomMarshaler(value interface{}) bool {
+	switch value.(type) {
+	case json.Marshaler, encoding.TextMarshaler:
+		return true
+	}
+	return false
+}
 
-// safeSet holds the value true if the ASCII character with the given array
-// position can be represented inside a JSON string without any further
-// escaping.
-//
-// All values are true except for the ASCII control characters (0-31), the
-// double quote ("), and the backslash character ("\").
-var safeSet = [utf8.RuneSelf]bool{
-	' ':      true,
-	'!':      true,
-	'"':      false,
-	'#':      true,
-	'$':      true,
-	'%':      true,
-	'&':      true,
-	'\'':     true,
-	'(':      true,
-	')':      true,
-	'*':      true,
-	'+':      true,
-	',':      true,
-	'-':      true,
-	'.':      true,
-	'/':      true,
-	'0':      true,
-	'1':      true,
-	'2':      true,
-	'3':      true,
-	'4':      true,
-	'5':      true,
-	'6':      true,
-	'7':      true,
-	'8':      true,
-	'9':      true,
-	':':      true,
-	';':      true,
-	'<':      true,
-	'=':      true,
-	'>':      true,
-	'?':      true,
-	'@':      true,
-	'A':      true,
-	'B':      true,
-	'C':      true,
-	'D':      true,
-	'E':      true,
-	'F':      true,
-	'G':      true,
-	'H':      true,
-	'I':      true,
-	'J':      true,
-	'K':      true,
-	'L':      true,
-	'M':      true,
-	'N':      true,
-	'O':      true,
-	'P':      true,
-	'Q':      true,
-	'R':      true,
-	'S':      true,
-	'T':      true,
-	'U':      true,
-	'V':      true,
-	'W':      true,
-	'X':      true,
-	'Y':      true,
-	'Z':      true,
-	'[':      true,
-	'\\':     false,
-	']':      true,
-	'^':      true,
-	'_':      true,
-	'`':      true,
-	'a':      true,
-	'b':      true,
-	'c':      true,
-	'd':      true,
-	'e':      true,
-	'f':      true,
-	'g':      true,
-	'h':      true,
-	'i':      true,
-	'j':      true,
-	'k':      true,
-	'l':      true,
-	'm':      true,
-	'n':      true,
-	'o':      true,
-	'p':      true,
-	'q':      true,
-	'r':      true,
-	's':      true,
-	't':      true,
-	'u':      true,
-	'v':      true,
-	'w':      true,
-	'x':      true,
-	'y':      true,
-	'z':      true,
-	'{':      true,
-	'|':      true,
-	'}':      true,
-	'~':      true,
-	'\u007f': true,
-}
-
-// htmlSafeSet holds the value true if the ASCII character with the given
-// array position can be safely represented inside a JSON string, embedded
-// inside of HTML <script> tags, without any additional escaping.
+// quotedValue returns the value of a field with the "string" option. As with
+// encoding/json, strings, numbers and bools, or pointers to them, are written
+// as a JSON string holding their encoding and other values are left as is.
+func quotedValue(field reflect.Value, escapeHTML bool) (interface{}, error) {
+	v := field
+	if v.Kind() == reflect.Ptr && v.Type().Name() == "" {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.String:
+		data, err := marshalJSON(v.Interface(), escapeHTML)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+	return field.Interface(), nil
+}
+
+// isEmptyValue reports whether v is empty and should be skipped
+// by the "omitempty" option.
+// (copy-pasted out of encoder/json package)
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// dirOf returns the directory of path using / as the separator on every OS
+func dirOf(path string) string {
+	return strings.ReplaceAll(filepath.Dir(path), "\\", "/")
+}
+
+// joinDir joins a slash-separated directory and name, leaving
+// out the directory if it's the current directory
+func joinDir(dir, name string) string {
+	if dir == "." || dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// isIntegerKeyType reports whether map keys of type t are
+// written as integers rather than with encoding.TextMarshaler
+func isIntegerKeyType(t reflect.Type) bool {
+	if t.Implements(textMarshalerType) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// mapKeyString returns the string used for a map key when it
+// becomes a directory name.
 //
-// All values are true except for the ASCII control characters (0-31), the
-// double quote ("), the backslash character ("\"), HTML opening and closing
-// tags ("<" and ">"), and the ampersand ("&").
-var htmlSafeSet = [utf8.RuneSelf]bool{
-	' ':      true,
-	'!':      true,
-	'"':      false,
-	'#':      true,
-	'$':      true,
-	'%':      true,
-	'&':      false,
-	'\'':     true,
-	'(':      true,
-	')':      true,
-	'*':      true,
-	'+':      true,
-	',':      true,
-	'-':      true,
-	'.':      true,
-	'/':      true,
-	'0':      true,
-	'1':      true,
-	'2':      true,
-	'3':      true,
-	'4':      true,
-	'5':      true,
-	'6':      true,
-	'7':      true,
-	'8':      true,
-	'9':      true,
-	':':      true,
-	';':      true,
-	'<':      false,
-	'=':      true,
-	'>':      false,
-	'?':      true,
-	'@':      true,
-	'A':      true,
-	'B':      true,
-	'C':      true,
-	'D':      true,
-	'E':      true,
-	'F':      true,
-	'G':      true,
-	'H':      true,
-	'I':      true,
-	'J':      true,
-	'K':      true,
-	'L':      true,
-	'M':      true,
-	'N':      true,
-	'O':      true,
-	'P':      true,
-	'Q':      true,
-	'R':      true,
-	'S':      true,
-	'T':      true,
-	'U':      true,
-	'V':      true,
-	'W':      true,
-	'X':      true,
-	'Y':      true,
-	'Z':      true,
-	'[':      true,
-	'\\':     false,
-	']':      true,
-	'^':      true,
-	'_':      true,
-	'`':      true,
-	'a':      true,
-	'b':      true,
-	'c':      true,
-	'd':      true,
-	'e':      true,
-	'f':      true,
-	'g':      true,
-	'h':      true,
-	'i':      true,
-	'j':      true,
-	'k':      true,
-	'l':      true,
-	'm':      true,
-	'n':      true,
-	'o':      true,
-	'p':      true,
-	'q':      true,
-	'r':      true,
-	's':      true,
-	't':      true,
-	'u':      true,
-	'v':      true,
-	'w':      true,
-	'x':      true,
-	'y':      true,
-	'z':      true,
-	'{':      true,
-	'|':      true,
-	'}':      true,
-	'~':      true,
-	'\u007f': true,
-}
-*/
+// Keys are written as encoding/json writes them so that they decode into
+// the same key, the key types it supports are strings, integers and types
+// implementing encoding.TextMarshaler, which is preferred as decoding
+// prefers encoding.TextUnmarshaler.
+func mapKeyString(mapKey reflect.Value) (string, error) {
+	if m, ok := mapKey.Interface().(encoding.TextMarshaler); ok {
+		marshalText, err := m.MarshalText()
+		if err != nil {
+			return "", err
+		}
+		return string(marshalText), nil
+	}
+	switch mapKey.Kind() {
+	case reflect.String:
+		return mapKey.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(mapKey.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(mapKey.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", mapKey.Type().String())
+}
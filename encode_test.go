@@ -0,0 +1,1734 @@
+package dfjson
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+type encodeTestWorld struct {
+	Name      string                         `json:"name"`
+	Creatures map[string]*encodeTestCreature `json:"creatures" dfjson:"distributable"`
+}
+
+type encodeTestCreature struct {
+	Name string `json:"name"`
+	HP   int    `json:"hp"`
+}
+
+func newEncodeTestWorld() *encodeTestWorld {
+	return &encodeTestWorld{
+		Name: "world",
+		Creatures: map[string]*encodeTestCreature{
+			"goblin": {Name: "Goblin", HP: 12},
+			"orc":    {Name: "Orc", HP: 30},
+		},
+	}
+}
+
+// fileData returns the data of each file by path
+func fileData(files []JSONFile) map[string]string {
+	data := make(map[string]string, len(files))
+	for _, file := range files {
+		data[file.Path] = string(file.Data)
+	}
+	return data
+}
+
+func TestFormatter(t *testing.T) {
+	keyPattern := regexp.MustCompile(`"(\w+)":`)
+	var calls int
+	upperKeys := func(data []byte) ([]byte, error) {
+		calls++
+		return keyPattern.ReplaceAllFunc(data, func(key []byte) []byte {
+			return []byte(strings.ToUpper(string(key)))
+		}), nil
+	}
+	tests := []struct {
+		name      string
+		formatter func(data []byte) ([]byte, error)
+		want      map[string]string
+		wantCalls int
+		wantErr   string
+	}{
+		{
+			name: "default",
+			want: map[string]string{
+				"index.json":                  "{\n\t\"name\": \"world\"\n}",
+				"creatures/goblin/index.json": "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}",
+				"creatures/orc/index.json":    "{\n\t\"name\": \"Orc\",\n\t\"hp\": 30\n}",
+			},
+		},
+		{
+			name:      "uppercase keys",
+			formatter: upperKeys,
+			want: map[string]string{
+				"index.json":                  `{"NAME":"world"}`,
+				"creatures/goblin/index.json": `{"NAME":"Goblin","HP":12}`,
+				"creatures/orc/index.json":    `{"NAME":"Orc","HP":30}`,
+			},
+			wantCalls: 3,
+		},
+		{
+			name: "error",
+			formatter: func(data []byte) ([]byte, error) {
+				return nil, errors.New("formatter failed")
+			},
+			wantErr: "creatures/goblin/index.json: formatter failed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls = 0
+			files, err := MarshalWithOptions("index.json", newEncodeTestWorld(), Options{Formatter: test.formatter})
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fileData(files)
+			for path, want := range test.want {
+				if got[path] != want {
+					t.Errorf("%s: got %q, want %q", path, got[path], want)
+				}
+			}
+			if len(got) != len(test.want) {
+				t.Errorf("got %d files, want %d", len(got), len(test.want))
+			}
+			if calls != test.wantCalls {
+				t.Errorf("formatter was called %d times, want %d", calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+type encodeTestNotes struct {
+	Name      string                              `json:"name"`
+	Notes     string                              `json:"notes"`
+	Creatures map[string]*encodeTestCreatureNotes `json:"creatures" dfjson:"distributable"`
+	Secret    *encodeTestCreatureNotes            `json:"secret" dfjson:"distributable"`
+}
+
+type encodeTestCreatureNotes struct {
+	HP    int    `json:"hp"`
+	Notes string `json:"notes"`
+}
+
+func TestOmitFields(t *testing.T) {
+	in := &encodeTestNotes{
+		Name:      "world",
+		Notes:     "top",
+		Creatures: map[string]*encodeTestCreatureNotes{"goblin": {HP: 1, Notes: "gob"}},
+		Secret:    &encodeTestCreatureNotes{HP: 2},
+	}
+	tests := []struct {
+		name       string
+		omitFields []string
+		want       map[string]string
+	}{
+		{
+			name: "none",
+			want: map[string]string{
+				"index.json":                  "{\n\t\"name\": \"world\",\n\t\"notes\": \"top\"\n}",
+				"creatures/goblin/index.json": "{\n\t\"hp\": 1,\n\t\"notes\": \"gob\"\n}",
+				"secret/index.json":           "{\n\t\"hp\": 2,\n\t\"notes\": \"\"\n}",
+			},
+		},
+		{
+			name:       "by name",
+			omitFields: []string{"notes"},
+			want: map[string]string{
+				"index.json":                  "{\n\t\"name\": \"world\"\n}",
+				"creatures/goblin/index.json": "{\n\t\"hp\": 1\n}",
+				"secret/index.json":           "{\n\t\"hp\": 2\n}",
+			},
+		},
+		{
+			name:       "by path",
+			omitFields: []string{"creatures.goblin.notes"},
+			want: map[string]string{
+				"index.json":                  "{\n\t\"name\": \"world\",\n\t\"notes\": \"top\"\n}",
+				"creatures/goblin/index.json": "{\n\t\"hp\": 1\n}",
+				"secret/index.json":           "{\n\t\"hp\": 2,\n\t\"notes\": \"\"\n}",
+			},
+		},
+		{
+			name:       "distributable field",
+			omitFields: []string{"secret"},
+			want: map[string]string{
+				"index.json":                  "{\n\t\"name\": \"world\",\n\t\"notes\": \"top\"\n}",
+				"creatures/goblin/index.json": "{\n\t\"hp\": 1,\n\t\"notes\": \"gob\"\n}",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := MarshalWithOptions("index.json", in, Options{OmitFields: test.omitFields})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileData(files); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+type encodeTestOmitEmpty struct {
+	String    string                         `json:"string,omitempty"`
+	Int       int                            `json:"int,omitempty"`
+	Uint      uint8                          `json:"uint,omitempty"`
+	Float     float64                        `json:"float,omitempty"`
+	Bool      bool                           `json:"bool,omitempty"`
+	Pointer   *int                           `json:"pointer,omitempty"`
+	Interface interface{}                    `json:"interface,omitempty"`
+	Slice     []int                          `json:"slice,omitempty"`
+	Map       map[string]int                 `json:"map,omitempty"`
+	Array     [0]int                         `json:"array,omitempty"`
+	Kept      int                            `json:"kept"`
+	Creatures map[string]*encodeTestCreature `json:"creatures,omitempty" dfjson:"distributable"`
+	Boss      *encodeTestCreature            `json:"boss,omitempty" dfjson:"distributable"`
+}
+
+func TestOmitEmpty(t *testing.T) {
+	one := 1
+	tests := []struct {
+		name string
+		in   encodeTestOmitEmpty
+		want map[string]string
+	}{
+		{
+			name: "all empty",
+			in:   encodeTestOmitEmpty{Slice: []int{}, Map: map[string]int{}, Creatures: map[string]*encodeTestCreature{}},
+			want: map[string]string{
+				"index.json": "{\n\t\"kept\": 0\n}",
+			},
+		},
+		{
+			name: "some populated",
+			in: encodeTestOmitEmpty{
+				String:    "s",
+				Uint:      2,
+				Bool:      true,
+				Pointer:   &one,
+				Interface: 0,
+				Map:       map[string]int{"a": 0},
+				Kept:      3,
+				Boss:      &encodeTestCreature{Name: "Boss"},
+			},
+			want: map[string]string{
+				"index.json":      "{\n\t\"string\": \"s\",\n\t\"uint\": 2,\n\t\"bool\": true,\n\t\"pointer\": 1,\n\t\"interface\": 0,\n\t\"map\": {\n\t\t\"a\": 0\n\t},\n\t\"kept\": 3\n}",
+				"boss/index.json": "{\n\t\"name\": \"Boss\",\n\t\"hp\": 0\n}",
+			},
+		},
+		{
+			name: "all populated",
+			in: encodeTestOmitEmpty{
+				String:    "s",
+				Int:       -1,
+				Uint:      2,
+				Float:     0.5,
+				Bool:      true,
+				Pointer:   new(int),
+				Interface: "",
+				Slice:     []int{0},
+				Map:       map[string]int{"a": 0},
+				Kept:      3,
+				Creatures: map[string]*encodeTestCreature{"goblin": {Name: "Goblin", HP: 12}},
+				Boss:      &encodeTestCreature{},
+			},
+			want: map[string]string{
+				"index.json":                  "{\n\t\"string\": \"s\",\n\t\"int\": -1,\n\t\"uint\": 2,\n\t\"float\": 0.5,\n\t\"bool\": true,\n\t\"pointer\": 0,\n\t\"interface\": \"\",\n\t\"slice\": [\n\t\t0\n\t],\n\t\"map\": {\n\t\t\"a\": 0\n\t},\n\t\"kept\": 3\n}",
+				"creatures/goblin/index.json": "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}",
+				"boss/index.json":             "{\n\t\"name\": \"\",\n\t\"hp\": 0\n}",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", &test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileData(files); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// encodeTestValueMarshaler implements json.Marshaler with a value receiver
+type encodeTestValueMarshaler struct {
+	X, Y int
+}
+
+func (v encodeTestValueMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("[%d,%d]", v.X, v.Y)), nil
+}
+
+func (v *encodeTestValueMarshaler) UnmarshalJSON(data []byte) error {
+	var xy [2]int
+	if err := json.Unmarshal(data, &xy); err != nil {
+		return err
+	}
+	v.X, v.Y = xy[0], xy[1]
+	return nil
+}
+
+// encodeTestPointerMarshaler implements json.Marshaler with a pointer receiver
+type encodeTestPointerMarshaler struct {
+	Values map[string]int
+}
+
+func (v *encodeTestPointerMarshaler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.Values)
+}
+
+func (v *encodeTestPointerMarshaler) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &v.Values)
+}
+
+// encodeTestTextMarshaler implements encoding.TextMarshaler
+type encodeTestTextMarshaler struct {
+	Name string
+}
+
+func (v encodeTestTextMarshaler) MarshalText() ([]byte, error) {
+	return []byte("name=" + v.Name), nil
+}
+
+func (v *encodeTestTextMarshaler) UnmarshalText(text []byte) error {
+	v.Name = strings.TrimPrefix(string(text), "name=")
+	return nil
+}
+
+type encodeTestMarshalers struct {
+	Value        encodeTestValueMarshaler              `json:"value" dfjson:"distributable"`
+	ValuePointer *encodeTestValueMarshaler             `json:"valuePointer" dfjson:"distributable"`
+	Pointer      encodeTestPointerMarshaler            `json:"pointer" dfjson:"distributable"`
+	Text         encodeTestTextMarshaler               `json:"text" dfjson:"distributable"`
+	Map          map[string]encodeTestValueMarshaler   `json:"map" dfjson:"distributable"`
+	PointerMap   map[string]encodeTestPointerMarshaler `json:"pointerMap" dfjson:"distributable"`
+}
+
+func TestDistributableMarshalers(t *testing.T) {
+	tests := []struct {
+		name string
+		in   encodeTestMarshalers
+		want map[string]string
+	}{
+		{
+			name: "receivers",
+			in: encodeTestMarshalers{
+				Value:        encodeTestValueMarshaler{1, 2},
+				ValuePointer: &encodeTestValueMarshaler{3, 4},
+				Pointer:      encodeTestPointerMarshaler{map[string]int{"a": 1}},
+				Text:         encodeTestTextMarshaler{"goblin"},
+			},
+			want: map[string]string{
+				"index.json":              "{}",
+				"value/index.json":        "[\n\t1,\n\t2\n]",
+				"valuePointer/index.json": "[\n\t3,\n\t4\n]",
+				"pointer/index.json":      "{\n\t\"a\": 1\n}",
+				"text/index.json":         "\"name=goblin\"",
+			},
+		},
+		{
+			name: "map values",
+			in: encodeTestMarshalers{
+				Map:        map[string]encodeTestValueMarshaler{"k": {5, 6}},
+				PointerMap: map[string]encodeTestPointerMarshaler{"k": {map[string]int{"b": 2}}},
+			},
+			want: map[string]string{
+				"index.json":              "{}",
+				"value/index.json":        "[\n\t0,\n\t0\n]",
+				"pointer/index.json":      "null",
+				"text/index.json":         "\"name=\"",
+				"map/k/index.json":        "[\n\t5,\n\t6\n]",
+				"pointerMap/k/index.json": "{\n\t\"b\": 2\n}",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", &test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileData(files); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			var out encodeTestMarshalers
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, test.in) {
+				t.Errorf("decoded %+v, want %+v", out, test.in)
+			}
+		})
+	}
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	tests := []struct {
+		name      string
+		v         interface{}
+		wantPaths []string
+	}{
+		{
+			name: "string keys",
+			v: &encodeTestWorld{Creatures: map[string]*encodeTestCreature{
+				"orc": {}, "goblin": {}, "c10": {}, "c2": {}, "Troll": {},
+			}},
+			wantPaths: []string{
+				"creatures/Troll/index.json",
+				"creatures/c10/index.json",
+				"creatures/c2/index.json",
+				"creatures/goblin/index.json",
+				"creatures/orc/index.json",
+				"index.json",
+			},
+		},
+		{
+			name: "integer keys",
+			v: &struct {
+				Items map[int]int `dfjson:"distributable"`
+			}{Items: map[int]int{-5: 1, 0: 2, 3: 3, 20: 4, 100: 5, 7: 6}},
+			wantPaths: []string{
+				"Items/-5/index.json",
+				"Items/0/index.json",
+				"Items/3/index.json",
+				"Items/7/index.json",
+				"Items/20/index.json",
+				"Items/100/index.json",
+				"index.json",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				files, err := Marshal("index.json", test.v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := filePaths(files); !reflect.DeepEqual(got, test.wantPaths) {
+					t.Fatalf("marshal %d returned %q, want %q", i, got, test.wantPaths)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalInterfaceMap(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"struct", encodeTestCreature{Name: "Goblin", HP: 12}, "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}"},
+		{"struct pointer", &encodeTestCreature{Name: "Orc", HP: 30}, "{\n\t\"name\": \"Orc\",\n\t\"hp\": 30\n}"},
+		{"nil struct pointer", (*encodeTestCreature)(nil), "null"},
+		{"value marshaler", encodeTestValueMarshaler{1, 2}, "[\n\t1,\n\t2\n]"},
+		{"pointer marshaler", encodeTestPointerMarshaler{map[string]int{"a": 1}}, "{\n\t\"a\": 1\n}"},
+		{"number", 5, "5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := &struct {
+				Values map[string]interface{} `dfjson:"distributable"`
+			}{Values: map[string]interface{}{"k": test.value}}
+			files, err := Marshal("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileData(files)["Values/k/index.json"]; got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// newBenchmarkWorld returns a world holding n creatures
+func newBenchmarkWorld(n int) *encodeTestWorld {
+	world := &encodeTestWorld{Name: "world", Creatures: make(map[string]*encodeTestCreature, n)}
+	for i := 0; i < n; i++ {
+		name := "creature" + strconv.Itoa(i)
+		world.Creatures[name] = &encodeTestCreature{Name: name, HP: i}
+	}
+	return world
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	world := newBenchmarkWorld(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal("index.json", world); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// encodeTestWideItem has enough fields that indenting its file is
+// a noticeable part of encoding it
+type encodeTestWideItem struct {
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Tags        []string             `json:"tags"`
+	Position    [3]float64           `json:"position"`
+	HP          int                  `json:"hp"`
+	MP          int                  `json:"mp"`
+	Strength    int                  `json:"strength"`
+	Agility     int                  `json:"agility"`
+	Intellect   int                  `json:"intellect"`
+	Flags       map[string]bool      `json:"flags"`
+	Loot        []encodeTestCreature `json:"loot"`
+	Boss        *encodeTestCreature  `json:"boss"`
+}
+
+type encodeTestWideWorld struct {
+	Name  string                         `json:"name"`
+	Items map[string]*encodeTestWideItem `json:"items" dfjson:"distributable"`
+}
+
+// newWideWorld returns a world holding n items with many fields each
+func newWideWorld(n int) *encodeTestWideWorld {
+	world := &encodeTestWideWorld{Name: "world", Items: make(map[string]*encodeTestWideItem, n)}
+	for i := 0; i < n; i++ {
+		name := "item" + strconv.Itoa(i)
+		world.Items[name] = &encodeTestWideItem{
+			Name:        name,
+			Description: "An item with \"quotes\", <html> & a newline\n",
+			Tags:        []string{"weapon", "rare", strconv.Itoa(i)},
+			Position:    [3]float64{float64(i), 0.5, -1e21},
+			HP:          i,
+			MP:          i * 2,
+			Strength:    3,
+			Agility:     4,
+			Intellect:   5,
+			Flags:       map[string]bool{"cursed": i%2 == 0, "sold": false},
+			Loot:        []encodeTestCreature{{Name: "gold", HP: i}, {Name: "gem"}},
+		}
+	}
+	return world
+}
+
+func TestMarshalIndent(t *testing.T) {
+	in := newWideWorld(20)
+	in.Items["empty"] = &encodeTestWideItem{Tags: []string{}, Flags: map[string]bool{}}
+	in.Items["boss"] = &encodeTestWideItem{Boss: &encodeTestCreature{Name: "dragon"}}
+	files, err := Marshal("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := fileData(files)
+	// Files are indented as they're encoded, the same as encoding/json would
+	for key, item := range in.Items {
+		want, err := json.MarshalIndent(item, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := data["items/"+key+"/index.json"]; got != string(want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if got, want := data["index.json"], "{\n\t\"name\": \"world\"\n}"; got != want {
+		t.Errorf("got index.json %q, want %q", got, want)
+	}
+}
+
+// BenchmarkMarshalWide encodes a map of structs with many fields, where the
+// most time goes to indenting the files
+func BenchmarkMarshalWide(b *testing.B) {
+	world := newWideWorld(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal("index.json", world); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalOwnsData(t *testing.T) {
+	values := []interface{}{
+		newEncodeTestWorld(),
+		newWideWorld(50),
+		&chunkTestWorld{Values: []int{1, 2, 3, 4, 5, 6, 7}},
+		// Larger than the buffers that are pooled
+		&encodeTestWorld{Name: strings.Repeat("a", maxPooledBufferSize+1)},
+	}
+	copyFiles := func(files []JSONFile) []JSONFile {
+		copied := make([]JSONFile, len(files))
+		for i, file := range files {
+			copied[i] = JSONFile{Path: file.Path, Data: append([]byte(nil), file.Data...)}
+		}
+		return copied
+	}
+	var kept [][]JSONFile
+	for _, v := range values {
+		files, err := Marshal("index.json", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, files)
+	}
+	want := make([][]JSONFile, len(kept))
+	for i, files := range kept {
+		want[i] = copyFiles(files)
+	}
+
+	// Encoding again reuses the pooled buffers, which mustn't be
+	// the ones that files from earlier calls hold
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, v := range values {
+				if _, err := Marshal("index.json", v); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range kept {
+		if !reflect.DeepEqual(kept[i], want[i]) {
+			t.Errorf("files of value %d changed after encoding again", i)
+		}
+	}
+
+	// Appending to the data of a file doesn't write into another
+	for i := range kept {
+		for j := range kept[i] {
+			kept[i][j].Data = append(kept[i][j].Data, "appended"...)
+		}
+		for j := range kept[i] {
+			if got := kept[i][j].Data; string(got) != string(want[i][j].Data)+"appended" {
+				t.Errorf("got %s, want %s with one append", got, want[i][j].Data)
+			}
+		}
+	}
+}
+
+// encodeTestCancelCounter cancels encoding once cancelAfter
+// values were marshaled
+type encodeTestCancelCounter struct {
+	cancel      context.CancelFunc
+	cancelAfter int
+	marshaled   int
+}
+
+type encodeTestCancelValue struct {
+	counter *encodeTestCancelCounter
+}
+
+func (v encodeTestCancelValue) MarshalJSON() ([]byte, error) {
+	v.counter.marshaled++
+	if v.counter.marshaled == v.counter.cancelAfter {
+		v.counter.cancel()
+	}
+	return []byte(`{}`), nil
+}
+
+func TestMarshalContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	counter := &encodeTestCancelCounter{cancel: cancel, cancelAfter: 100}
+	in := &struct {
+		Values map[string]encodeTestCancelValue `json:"values" dfjson:"distributable"`
+	}{make(map[string]encodeTestCancelValue)}
+	for i := 0; i < 2000; i++ {
+		in.Values[strconv.Itoa(i)] = encodeTestCancelValue{counter}
+	}
+	files, err := MarshalContext(ctx, "index.json", in)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if files != nil {
+		t.Errorf("got %d files, want none", len(files))
+	}
+	// Encoding stops at the next directory rather than encoding the rest of the map
+	if counter.marshaled != counter.cancelAfter {
+		t.Errorf("marshaled %d values, want %d", counter.marshaled, counter.cancelAfter)
+	}
+
+	if _, err := MarshalContext(ctx, "index.json", newEncodeTestWorld()); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v with a cancelled context, want %v", err, context.Canceled)
+	}
+}
+
+type encodeTestQuoted struct {
+	Int     int     `json:"int,string"`
+	Int64   int64   `json:"int64,string"`
+	Uint    uint    `json:"uint,string"`
+	Float   float64 `json:"float,string"`
+	Bool    bool    `json:"bool,string"`
+	Pointer *int    `json:"pointer,string"`
+	Name    string  `json:"name"`
+}
+
+type encodeTestQuotedWorld struct {
+	Level  int                          `json:"level,string"`
+	Values map[string]*encodeTestQuoted `json:"values" dfjson:"distributable"`
+}
+
+func TestStringOption(t *testing.T) {
+	seven := -7
+	tests := []struct {
+		name  string
+		value *encodeTestQuoted
+	}{
+		{"zero", &encodeTestQuoted{}},
+		{"negative", &encodeTestQuoted{Int: -5, Int64: math.MinInt64, Float: -0.5, Pointer: &seven}},
+		{"large", &encodeTestQuoted{Int64: math.MaxInt64, Uint: math.MaxUint32, Float: 1e10, Bool: true}},
+		{"exponent", &encodeTestQuoted{Float: 1e21}},
+		{"fraction", &encodeTestQuoted{Float: 3.14159, Name: "pi"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := &encodeTestQuotedWorld{Level: -3, Values: map[string]*encodeTestQuoted{"a": test.value}}
+			files, err := Marshal("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Fields are quoted the same as encoding/json would
+			want, err := json.MarshalIndent(test.value, "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := fileData(files)
+			if got := data["values/a/index.json"]; got != string(want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+			if got, want := data["index.json"], "{\n\t\"level\": \"-3\"\n}"; got != want {
+				t.Errorf("got index.json %q, want %q", got, want)
+			}
+			var out encodeTestQuotedWorld
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out.Values["a"], test.value)
+			}
+		})
+	}
+}
+
+type encodeTestOmitEmptyDistributable struct {
+	Name     string                         `json:"name"`
+	Map      map[string]*encodeTestCreature `json:"map,omitempty" dfjson:"distributable"`
+	Pointer  *encodeTestCreature            `json:"pointer,omitempty" dfjson:"distributable"`
+	Slice    []encodeTestCreature           `json:"slice,omitempty" dfjson:"distributable"`
+	KeptMap  map[string]int                 `json:"keptMap" dfjson:"distributable"`
+	KeptList []int                          `json:"keptList" dfjson:"distributable"`
+}
+
+func TestOmitEmptyDistributable(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        *encodeTestOmitEmptyDistributable
+		wantFiles []string
+		want      *encodeTestOmitEmptyDistributable
+	}{
+		{
+			name:      "nil",
+			in:        &encodeTestOmitEmptyDistributable{Name: "a"},
+			wantFiles: []string{"index.json"},
+			want:      &encodeTestOmitEmptyDistributable{Name: "a"},
+		},
+		{
+			name: "empty",
+			in: &encodeTestOmitEmptyDistributable{
+				Name:     "a",
+				Map:      map[string]*encodeTestCreature{},
+				Slice:    []encodeTestCreature{},
+				KeptMap:  map[string]int{},
+				KeptList: []int{},
+			},
+			// Only fields without omitempty get a directory
+			wantFiles: []string{"keptMap/index.json", "keptList/index.json", "index.json"},
+			want: &encodeTestOmitEmptyDistributable{
+				Name:     "a",
+				KeptMap:  map[string]int{},
+				KeptList: []int{},
+			},
+		},
+		{
+			name: "not empty",
+			in: &encodeTestOmitEmptyDistributable{
+				Name:    "a",
+				Map:     map[string]*encodeTestCreature{"goblin": {Name: "Goblin"}},
+				Pointer: &encodeTestCreature{Name: "Boss"},
+				Slice:   []encodeTestCreature{{Name: "first"}},
+			},
+			wantFiles: []string{"map/goblin/index.json", "pointer/index.json", "slice/0/index.json", "index.json"},
+			want: &encodeTestOmitEmptyDistributable{
+				Name:    "a",
+				Map:     map[string]*encodeTestCreature{"goblin": {Name: "Goblin"}},
+				Pointer: &encodeTestCreature{Name: "Boss"},
+				Slice:   []encodeTestCreature{{Name: "first"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filePaths(files); !reflect.DeepEqual(got, test.wantFiles) {
+				t.Errorf("got files %q, want %q", got, test.wantFiles)
+			}
+			// No directory is created for the omitted fields
+			root := t.TempDir()
+			if err := MarshalTo(root, "index.json", test.in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dirs []string
+			for _, entry := range entries {
+				if entry.IsDir() {
+					dirs = append(dirs, entry.Name())
+				}
+			}
+			var wantDirs []string
+			for _, path := range test.wantFiles {
+				if i := strings.IndexByte(path, '/'); i != -1 {
+					wantDirs = append(wantDirs, path[:i])
+				}
+			}
+			sort.Strings(wantDirs)
+			if !reflect.DeepEqual(dirs, wantDirs) {
+				t.Errorf("got directories %q, want %q", dirs, wantDirs)
+			}
+			// Missing directories leave the zero value
+			var out encodeTestOmitEmptyDistributable
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, test.want) {
+				t.Errorf("got %+v, want %+v", out, test.want)
+			}
+		})
+	}
+}
+
+type encodeTestNilFields struct {
+	Name    string                         `json:"name"`
+	Boss    *encodeTestCreature            `json:"boss" dfjson:"distributable"`
+	World   *encodeTestWorld               `json:"world" dfjson:"distributable"`
+	Any     interface{}                    `json:"any" dfjson:"distributable"`
+	Spawns  map[string]*encodeTestCreature `json:"spawns" dfjson:"distributable"`
+	Waves   []*encodeTestCreature          `json:"waves" dfjson:"distributable"`
+	Pointer **encodeTestCreature           `json:"pointer" dfjson:"distributable"`
+}
+
+func TestMarshalNilDistributable(t *testing.T) {
+	var nilCreature *encodeTestCreature
+	tests := []struct {
+		name string
+		in   *encodeTestNilFields
+		want map[string]string
+	}{
+		{
+			// Nil pointers and interfaces get no directory, as if they were omitted
+			name: "nil fields",
+			in:   &encodeTestNilFields{Name: "a"},
+			want: map[string]string{"index.json": "{\n\t\"name\": \"a\"\n}"},
+		},
+		{
+			// The outer pointer isn't nil, so its directory holds null
+			name: "pointer to a nil pointer",
+			in:   &encodeTestNilFields{Name: "a", Pointer: &nilCreature},
+			want: map[string]string{
+				"index.json":         "{\n\t\"name\": \"a\"\n}",
+				"pointer/index.json": "null",
+			},
+		},
+		{
+			// Nil elements are kept so that keys and indexes survive
+			name: "nil elements",
+			in: &encodeTestNilFields{
+				Name:   "a",
+				Spawns: map[string]*encodeTestCreature{"empty": nil},
+				Waves:  []*encodeTestCreature{nil, {Name: "b"}},
+			},
+			want: map[string]string{
+				"index.json":              "{\n\t\"name\": \"a\"\n}",
+				"spawns/empty/index.json": "null",
+				"waves/0/index.json":      "null",
+				"waves/1/index.json":      "{\n\t\"name\": \"b\",\n\t\"hp\": 0\n}",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileData(files); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			var out encodeTestNilFields
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			want := *test.in
+			// encoding/json decodes null into a nil pointer rather than a pointer to one
+			want.Pointer = nil
+			if !reflect.DeepEqual(out, want) {
+				t.Errorf("got %+v, want %+v", out, want)
+			}
+		})
+	}
+}
+
+func TestTrailingNewline(t *testing.T) {
+	in := &encodeTestGroups{
+		HP:    &encodeTestCreature{Name: "hp"},
+		MP:    map[string]int{"fire": 3},
+		Items: []encodeTestCreature{{Name: "sword"}},
+	}
+	tests := []struct {
+		name        string
+		opts        []Option
+		wantNewline bool
+	}{
+		{"default", nil, false},
+		{"enabled", []Option{WithTrailingNewline(true)}, true},
+		{"enabled and compact", []Option{WithOptions(Options{Compact: true, TrailingNewline: true})}, true},
+		{"disabled", []Option{WithTrailingNewline(false)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := NewEncoder(test.opts...).Encode("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range files {
+				data := string(file.Data)
+				hasNewline := strings.HasSuffix(data, "\n")
+				if hasNewline != test.wantNewline {
+					t.Errorf("%s: got %q, want a trailing newline %v", file.Path, data, test.wantNewline)
+				}
+				if strings.HasSuffix(data, "\n\n") || strings.HasSuffix(strings.TrimSuffix(data, "\n"), " ") {
+					t.Errorf("%s: got %q, want a single newline", file.Path, data)
+				}
+			}
+			var out encodeTestGroups
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+type encodeTestHTML struct {
+	Text   string            `json:"text"`
+	Tags   []string          `json:"tags"`
+	Labels map[string]string `json:"labels"`
+	Raw    json.RawMessage   `json:"raw"`
+}
+
+type encodeTestHTMLWorld struct {
+	Title string                     `json:"title"`
+	Pages map[string]*encodeTestHTML `json:"pages" dfjson:"distributable"`
+}
+
+func TestEscapeHTML(t *testing.T) {
+	page := &encodeTestHTML{
+		Text:   "<b>Tom & Jerry</b> \u2028",
+		Tags:   []string{"a<b", "c>d"},
+		Labels: map[string]string{"<key>": "&amp;"},
+		Raw:    json.RawMessage(`{"html":"<i>"}`),
+	}
+	in := &encodeTestHTMLWorld{Title: "<title>", Pages: map[string]*encodeTestHTML{"home": page}}
+	for _, escape := range []bool{true, false} {
+		t.Run("escape="+strconv.FormatBool(escape), func(t *testing.T) {
+			files, err := NewEncoder(WithEscapeHTML(escape)).Encode("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Each file is what a json.Encoder with the same setting writes
+			encodeWant := func(v interface{}) string {
+				var buf bytes.Buffer
+				enc := json.NewEncoder(&buf)
+				enc.SetEscapeHTML(escape)
+				enc.SetIndent("", "\t")
+				if err := enc.Encode(v); err != nil {
+					t.Fatal(err)
+				}
+				return strings.TrimSuffix(buf.String(), "\n")
+			}
+			data := fileData(files)
+			if got, want := data["pages/home/index.json"], encodeWant(page); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+			if got, want := data["index.json"], encodeWant(map[string]string{"title": in.Title}); got != want {
+				t.Errorf("got index.json %s, want %s", got, want)
+			}
+			for path, data := range data {
+				if hasEscapes := strings.Contains(data, "\\u003c"); hasEscapes != escape {
+					t.Errorf("%s: got %s, want HTML escaped %v", path, data, escape)
+				}
+				// U+2028 is always escaped, as encoding/json does
+				if strings.ContainsRune(data, '\u2028') {
+					t.Errorf("%s: got an unescaped line separator", path)
+				}
+			}
+			var out encodeTestHTMLWorld
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			// The raw message keeps the indentation of the file
+			gotPage := *out.Pages["home"]
+			if !jsonEqual(gotPage.Raw, page.Raw) {
+				t.Errorf("got raw %s, want %s", gotPage.Raw, page.Raw)
+			}
+			gotPage.Raw = page.Raw
+			if !reflect.DeepEqual(&gotPage, page) || out.Title != in.Title {
+				t.Errorf("got %+v, want %+v", gotPage, page)
+			}
+		})
+	}
+}
+
+func TestEncoderOptions(t *testing.T) {
+	in := &encodeTestHTMLWorld{Title: "<title>", Pages: make(map[string]*encodeTestHTML)}
+	for i := 0; i < 50; i++ {
+		in.Pages[fmt.Sprintf("p%02d", i)] = &encodeTestHTML{Text: "Tom & Jerry", Raw: json.RawMessage(`{}`)}
+	}
+	defaultFiles, err := NewEncoder().Encode("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts []Option
+		// check reports whether the files were written as the options ask,
+		// nil if they're the same as without any options
+		check func(data map[string]string, paths []string) bool
+	}{
+		{"indent", []Option{WithIndent("  ")}, func(data map[string]string, paths []string) bool {
+			return strings.HasPrefix(data["index.json"], "{\n  \"title\"")
+		}},
+		{"trailing newline", []Option{WithTrailingNewline(true)}, func(data map[string]string, paths []string) bool {
+			return strings.HasSuffix(data["index.json"], "}\n") && strings.HasSuffix(data["pages/p00/index.json"], "}\n")
+		}},
+		{"unescaped HTML", []Option{WithEscapeHTML(false)}, func(data map[string]string, paths []string) bool {
+			return strings.Contains(data["index.json"], `"<title>"`) && strings.Contains(data["pages/p00/index.json"], `"Tom & Jerry"`)
+		}},
+		{"unsorted map keys", []Option{WithSortedMapKeys(false)}, func(data map[string]string, paths []string) bool {
+			// The files of 50 map keys are all but certain to be out of order,
+			// the entry file is always written last
+			return !sort.StringsAreSorted(paths[:len(paths)-1])
+		}},
+		{"index filename", []Option{WithIndexFilename("data.json")}, func(data map[string]string, paths []string) bool {
+			_, ok := data["pages/p00/data.json"]
+			return ok && data["pages/p00/index.json"] == ""
+		}},
+		{"options", []Option{WithOptions(Options{Compact: true})}, func(data map[string]string, paths []string) bool {
+			return !strings.Contains(data["index.json"], "\n")
+		}},
+		{"options replace earlier options", []Option{WithIndent("  "), WithOptions(Options{})}, nil},
+		{"later options override earlier ones", []Option{WithEscapeHTML(false), WithEscapeHTML(true)}, nil},
+		// Only used when decoding
+		{"dir filter", []Option{WithDirFilter(func(string) bool { return true })}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := NewEncoder(test.opts...).Encode("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := fileData(files)
+			if test.check == nil {
+				if !reflect.DeepEqual(files, defaultFiles) {
+					t.Errorf("got %q, want the same files as without options", data)
+				}
+			} else {
+				if test.check(fileData(defaultFiles), filePaths(defaultFiles)) {
+					t.Fatal("the files written without options already pass the check")
+				}
+				if !test.check(data, filePaths(files)) {
+					t.Errorf("got %q, want them written with %s", data, test.name)
+				}
+			}
+			var out encodeTestHTMLWorld
+			if err := NewDecoder(test.opts...).DecodeFS(filesFS(files), "index.json", &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+func TestMarshalCompact(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"map", newEncodeTestWorld()},
+		{"wide structs", newWideWorld(5)},
+		{"groups", &encodeTestGroups{
+			HP:    &encodeTestCreature{Name: "hp"},
+			MP:    map[string]int{"fire": 3},
+			Items: []encodeTestCreature{{Name: "sword"}},
+		}},
+		{"chunks", &chunkTestWorld{Values: []int{1, 2, 3, 4, 5}}},
+		{"order", &orderTestMenu{Items: map[string]*encodeTestCreature{"b": {}, "a": {}}, ItemOrder: []string{"b", "a"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := MarshalCompact("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			indented, err := Marshal("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := filePaths(files), filePaths(indented); !reflect.DeepEqual(got, want) {
+				t.Errorf("got files %q, want the same files as Marshal %q", got, want)
+			}
+			for i, file := range files {
+				var compacted bytes.Buffer
+				if err := json.Compact(&compacted, file.Data); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(file.Data, compacted.Bytes()) {
+					t.Errorf("%s: got %s, want no whitespace", file.Path, file.Data)
+				}
+				if !jsonEqual(file.Data, indented[i].Data) {
+					t.Errorf("%s: got %s, want the same JSON as %s", file.Path, file.Data, indented[i].Data)
+				}
+			}
+
+			root := t.TempDir()
+			if err := WriteFiles(root, files, 0644); err != nil {
+				t.Fatal(err)
+			}
+			out := reflect.New(reflect.TypeOf(test.v).Elem())
+			if _, err := Unmarshal(filepath.Join(root, "index.json"), out.Interface(), nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Interface(), test.v) {
+				t.Errorf("got %+v, want %+v", out.Elem(), reflect.ValueOf(test.v).Elem())
+			}
+		})
+	}
+}
+
+func TestIndexFilename(t *testing.T) {
+	in := &stitchTestWorld{
+		Name:      "world",
+		Creatures: map[string]*encodeTestCreature{"goblin": {Name: "Goblin", HP: 12}},
+		Waves:     []stitchTestWave{{Spawns: []string{"goblin"}}},
+		Boss:      &encodeTestCreature{Name: "Boss"},
+	}
+	tests := []struct {
+		name      string
+		opts      []Option
+		entry     string
+		wantPaths []string
+	}{
+		{
+			name:  "default",
+			entry: "data/index.json",
+			wantPaths: []string{
+				"data/boss/index.json",
+				"data/creatures/goblin/index.json",
+				"data/waves/0/index.json",
+				"data/index.json",
+			},
+		},
+		{
+			name:  "custom",
+			opts:  []Option{WithIndexFilename("_entry.json")},
+			entry: "data/_entry.json",
+			wantPaths: []string{
+				"data/boss/_entry.json",
+				"data/creatures/goblin/_entry.json",
+				"data/waves/0/_entry.json",
+				"data/_entry.json",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := NewEncoder(test.opts...).Encode(test.entry, in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := filePaths(files)
+			sort.Strings(got)
+			want := append([]string(nil), test.wantPaths...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+			var out stitchTestWorld
+			if err := NewDecoder(test.opts...).DecodeFS(filesFS(files), test.entry, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+type encodeTestLevels struct {
+	Levels []encodeTestCreature `json:"levels" dfjson:"distributable"`
+}
+
+func TestDistributableSlices(t *testing.T) {
+	many := make([]encodeTestCreature, 12)
+	for i := range many {
+		many[i].HP = i
+	}
+	tests := []struct {
+		name      string
+		in        encodeTestLevels
+		wantPaths []string
+		wantIndex string
+	}{
+		{
+			name:      "nil",
+			wantPaths: []string{"index.json"},
+			wantIndex: "{}",
+		},
+		{
+			name:      "empty",
+			in:        encodeTestLevels{Levels: []encodeTestCreature{}},
+			wantPaths: []string{"levels/index.json", "index.json"},
+			wantIndex: "{}",
+		},
+		{
+			name: "elements",
+			in:   encodeTestLevels{Levels: []encodeTestCreature{{Name: "a"}, {Name: "b"}}},
+			wantPaths: []string{
+				"levels/0/index.json",
+				"levels/1/index.json",
+				"index.json",
+			},
+			wantIndex: "{}",
+		},
+		{
+			name: "decoded in index order",
+			in:   encodeTestLevels{Levels: many},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", &test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantPaths != nil {
+				if got := filePaths(files); !reflect.DeepEqual(got, test.wantPaths) {
+					t.Errorf("got %q, want %q", got, test.wantPaths)
+				}
+				if got := fileData(files)["index.json"]; got != test.wantIndex {
+					t.Errorf("index.json: got %q, want %q", got, test.wantIndex)
+				}
+			}
+			var out encodeTestLevels
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, test.in) {
+				t.Errorf("decoded %+v, want %+v", out, test.in)
+			}
+		})
+	}
+}
+
+type encodeTestGroups struct {
+	Name  string               `json:"name"`
+	HP    *encodeTestCreature  `json:"hp" dfjson:"distributable,group=stats"`
+	MP    map[string]int       `json:"mp" dfjson:"distributable,group=stats"`
+	Items []encodeTestCreature `json:"items" dfjson:"distributable"`
+}
+
+func TestGroups(t *testing.T) {
+	in := &encodeTestGroups{
+		Name:  "player",
+		HP:    &encodeTestCreature{Name: "hp", HP: 10},
+		MP:    map[string]int{"fire": 3},
+		Items: []encodeTestCreature{{Name: "sword"}},
+	}
+	files, err := Marshal("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPaths := []string{
+		"index.json",
+		"items/0/index.json",
+		"stats/hp/index.json",
+		"stats/mp/fire/index.json",
+	}
+	gotPaths := filePaths(files)
+	sort.Strings(gotPaths)
+	if !reflect.DeepEqual(gotPaths, wantPaths) {
+		t.Fatalf("got %q, want %q", gotPaths, wantPaths)
+	}
+	var out encodeTestGroups
+	if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&out, in) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestExtraFiles(t *testing.T) {
+	summary := func(v interface{}) ([]JSONFile, error) {
+		world := v.(*encodeTestWorld)
+		data, err := json.Marshal(len(world.Creatures))
+		if err != nil {
+			return nil, err
+		}
+		return []JSONFile{
+			{Path: "creatures/_summary/index.json", Data: data},
+			{Path: "summary.json", Data: data},
+		}, nil
+	}
+	in := newEncodeTestWorld()
+	files, err := MarshalWithOptions("data/index.json", in, Options{ExtraFiles: summary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fileData(files)
+	for _, path := range []string{"data/creatures/_summary/index.json", "data/summary.json"} {
+		if got[path] != "2" {
+			t.Errorf("%s: got %q, want %q", path, got[path], "2")
+		}
+	}
+
+	var out encodeTestWorld
+	opts := Options{IgnoreExtra: []string{"creatures/_summary", "summary.json"}}
+	if err := UnmarshalFS(filesFS(files), "data/index.json", &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&out, in) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+
+	// Without IgnoreExtra the summary is decoded as a creature
+	if err := UnmarshalFS(filesFS(files), "data/index.json", &out, Options{}); err == nil {
+		t.Errorf("got no error decoding the summary as a creature")
+	}
+
+	_, err = MarshalWithOptions("data/index.json", in, Options{ExtraFiles: func(v interface{}) ([]JSONFile, error) {
+		return []JSONFile{{Path: "../outside.json"}}, nil
+	}})
+	if want := `extra file "../outside.json" is outside of the entry directory`; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+type encodeTestListNode struct {
+	Name string              `json:"name"`
+	Next *encodeTestListNode `json:"next,omitempty" dfjson:"distributable"`
+	Prev *encodeTestListNode `json:"prev,omitempty" dfjson:"distributable"`
+}
+
+type encodeTestGraph struct {
+	Nodes map[string]*encodeTestGraph `json:"nodes" dfjson:"distributable"`
+}
+
+func TestMarshalCycles(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       func() interface{}
+		wantErr string
+	}{
+		{
+			name: "doubly linked list",
+			v: func() interface{} {
+				a := &encodeTestListNode{Name: "a"}
+				b := &encodeTestListNode{Name: "b", Prev: a}
+				a.Next = b
+				return a
+			},
+			wantErr: "next/prev: encountered a cycle via next.prev",
+		},
+		{
+			name: "map holding its parent",
+			v: func() interface{} {
+				root := &encodeTestGraph{Nodes: map[string]*encodeTestGraph{}}
+				root.Nodes["child"] = &encodeTestGraph{Nodes: map[string]*encodeTestGraph{"root": root}}
+				return root
+			},
+			wantErr: "nodes/child/nodes/root: encountered a cycle via nodes.child.nodes.root",
+		},
+		{
+			name: "shared pointer without a cycle",
+			v: func() interface{} {
+				shared := &encodeTestGraph{}
+				return &encodeTestGraph{Nodes: map[string]*encodeTestGraph{"a": shared, "b": shared}}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Marshal("index.json", test.v())
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+type encodeTestGranularity struct {
+	Name  string                       `json:"name"`
+	Zones map[string]*encodeTestLevels `json:"zones" dfjson:"distributable"`
+	Items map[string]int               `json:"items" dfjson:"distributable"`
+	Boss  *encodeTestCreature          `json:"boss" dfjson:"distributable"`
+}
+
+func TestGranularity(t *testing.T) {
+	in := &encodeTestGranularity{
+		Name: "world",
+		Zones: map[string]*encodeTestLevels{
+			"cave":   {Levels: []encodeTestCreature{{Name: "bat"}, {Name: "spider"}}},
+			"forest": {Levels: []encodeTestCreature{{Name: "wolf"}}},
+		},
+		Items: map[string]int{"sword": 1, "shield": 2},
+		Boss:  &encodeTestCreature{Name: "Dragon", HP: 500},
+	}
+	tests := []struct {
+		name        string
+		entry       string
+		granularity Granularity
+		wantPaths   []string
+	}{
+		{
+			name:        "per field",
+			entry:       "index.json",
+			granularity: GranularityPerField,
+			wantPaths: []string{
+				"boss/index.json",
+				"index.json",
+				"items/shield/index.json",
+				"items/sword/index.json",
+				"zones/cave/index.json",
+				"zones/cave/levels/0/index.json",
+				"zones/cave/levels/1/index.json",
+				"zones/forest/index.json",
+				"zones/forest/levels/0/index.json",
+			},
+		},
+		{
+			name:        "per top level",
+			entry:       "index.json",
+			granularity: GranularityPerTopLevel,
+			// A file for each of the 3 top-level subtrees
+			wantPaths: []string{"boss/index.json", "index.json", "items/index.json", "zones/index.json"},
+		},
+		{
+			name:        "per top level in a subdirectory",
+			entry:       "data/world/index.json",
+			granularity: GranularityPerTopLevel,
+			wantPaths:   []string{"data/world/boss/index.json", "data/world/index.json", "data/world/items/index.json", "data/world/zones/index.json"},
+		},
+		{
+			name:        "single",
+			entry:       "index.json",
+			granularity: GranularitySingle,
+			wantPaths:   []string{"index.json"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := Options{Granularity: test.granularity}
+			files, err := MarshalWithOptions(test.entry, in, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := filePaths(files)
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.wantPaths) {
+				t.Errorf("got %q, want %q", paths, test.wantPaths)
+			}
+			var out encodeTestGranularity
+			if err := UnmarshalFS(filesFS(files), test.entry, &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+
+	// Each top-level file holds the whole subtree
+	files, err := MarshalWithOptions("index.json", in, Options{Granularity: GranularityPerTopLevel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n\t\"shield\": 2,\n\t\"sword\": 1\n}"
+	if got := fileData(files)["items/index.json"]; got != want {
+		t.Errorf("items/index.json: got %q, want %q", got, want)
+	}
+}
+
+// encodeTestID is a map key encoded with encoding.TextMarshaler
+type encodeTestID struct {
+	Zone string
+	N    int
+}
+
+func (id encodeTestID) MarshalText() ([]byte, error) {
+	return []byte(id.Zone + "-" + strconv.Itoa(id.N)), nil
+}
+
+func (id *encodeTestID) UnmarshalText(text []byte) error {
+	i := strings.LastIndexByte(string(text), '-')
+	if i == -1 {
+		return fmt.Errorf("invalid id %q", text)
+	}
+	n, err := strconv.Atoi(string(text[i+1:]))
+	if err != nil {
+		return err
+	}
+	*id = encodeTestID{Zone: string(text[:i]), N: n}
+	return nil
+}
+
+// encodeTestLevel is an integer map key that encoding/json
+// encodes with encoding.TextMarshaler rather than as a number
+type encodeTestLevel int
+
+func (level encodeTestLevel) MarshalText() ([]byte, error) {
+	return []byte("level" + strconv.Itoa(int(level))), nil
+}
+
+func (level *encodeTestLevel) UnmarshalText(text []byte) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(string(text), "level"))
+	*level = encodeTestLevel(n)
+	return err
+}
+
+func TestTextMarshalerKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		dirs []string
+	}{
+		{
+			name: "struct key",
+			v: &struct {
+				Spawns map[encodeTestID]*encodeTestCreature `json:"spawns" dfjson:"distributable"`
+			}{map[encodeTestID]*encodeTestCreature{
+				{"cave", 1}:  {Name: "bat"},
+				{"cave", 10}: {Name: "spider"},
+				{"lake", 2}:  {Name: "frog"},
+			}},
+			dirs: []string{"cave-1", "cave-10", "lake-2"},
+		},
+		{
+			name: "integer TextMarshaler key",
+			v: &struct {
+				Levels map[encodeTestLevel]int `json:"levels" dfjson:"distributable"`
+			}{map[encodeTestLevel]int{1: 10, 2: 20}},
+			dirs: []string{"level1", "level2"},
+		},
+		{
+			name: "integer key",
+			v: &struct {
+				Levels map[int]string `json:"levels" dfjson:"distributable"`
+			}{map[int]string{1: "a", 20: "b"}},
+			dirs: []string{"1", "20"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := fileData(files)
+			for _, dir := range test.dirs {
+				found := false
+				for path := range data {
+					if strings.HasSuffix(path, "/"+dir+"/index.json") {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("missing directory %q in %q", dir, filePaths(files))
+				}
+			}
+			out := reflect.New(reflect.TypeOf(test.v).Elem())
+			if err := UnmarshalFS(filesFS(files), "index.json", out.Interface(), Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Interface(), test.v) {
+				t.Errorf("got %+v, want %+v", out.Elem(), reflect.ValueOf(test.v).Elem())
+			}
+			// The keys match those of encoding/json
+			stitched, err := MarshalStitched("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(stitched, want) {
+				t.Errorf("got stitched %s, want %s", stitched, want)
+			}
+		})
+	}
+}
+
+func TestIntegerKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		v     interface{}
+		paths []string
+	}{
+		{
+			name: "int",
+			v: &struct {
+				Values map[int]string `json:"values" dfjson:"distributable"`
+			}{map[int]string{10: "a", -1: "b", 2: "c", -10: "d", 0: "e"}},
+			paths: []string{"values/-10/index.json", "values/-1/index.json", "values/0/index.json", "values/2/index.json", "values/10/index.json", "index.json"},
+		},
+		{
+			name: "int64",
+			v: &struct {
+				Values map[int64]string `json:"values" dfjson:"distributable"`
+			}{map[int64]string{math.MaxInt64: "a", math.MinInt64: "b", -1: "c", 1 << 40: "d"}},
+			paths: []string{"values/-9223372036854775808/index.json", "values/-1/index.json", "values/1099511627776/index.json", "values/9223372036854775807/index.json", "index.json"},
+		},
+		{
+			name: "uint64",
+			v: &struct {
+				Values map[uint64]string `json:"values" dfjson:"distributable"`
+			}{map[uint64]string{math.MaxUint64: "a", 9: "b", 10: "c"}},
+			paths: []string{"values/9/index.json", "values/10/index.json", "values/18446744073709551615/index.json", "index.json"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Keys are sorted numerically rather than as strings
+			if got := filePaths(files); !reflect.DeepEqual(got, test.paths) {
+				t.Errorf("got %q, want %q", got, test.paths)
+			}
+			out := reflect.New(reflect.TypeOf(test.v).Elem())
+			if err := UnmarshalFS(filesFS(files), "index.json", out.Interface(), Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Interface(), test.v) {
+				t.Errorf("got %+v, want %+v", out.Elem(), reflect.ValueOf(test.v).Elem())
+			}
+			// The stitched document can be decoded by encoding/json
+			stitched, err := MarshalStitched("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jsonOut := reflect.New(reflect.TypeOf(test.v).Elem())
+			if err := json.Unmarshal(stitched, jsonOut.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(jsonOut.Interface(), test.v) {
+				t.Errorf("got %+v from encoding/json, want %+v", jsonOut.Elem(), reflect.ValueOf(test.v).Elem())
+			}
+		})
+	}
+}
+
+func TestIntegerKeyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     string
+		v       interface{}
+		wantErr string
+	}{
+		{
+			name: "not a number",
+			dir:  "goblin",
+			v: &struct {
+				Values map[int]int `json:"values" dfjson:"distributable"`
+			}{},
+			wantErr: `directory "goblin": "goblin" is not a valid int map key`,
+		},
+		{
+			name: "overflow",
+			dir:  "128",
+			v: &struct {
+				Values map[int8]int `json:"values" dfjson:"distributable"`
+			}{},
+			wantErr: `directory "128": "128" is not a valid int8 map key`,
+		},
+		{
+			name: "int64 overflow",
+			dir:  "9223372036854775808",
+			v: &struct {
+				Values map[int64]int `json:"values" dfjson:"distributable"`
+			}{},
+			wantErr: `directory "9223372036854775808": "9223372036854775808" is not a valid int64 map key`,
+		},
+		{
+			name: "negative unsigned",
+			dir:  "-1",
+			v: &struct {
+				Values map[uint]int `json:"values" dfjson:"distributable"`
+			}{},
+			wantErr: `directory "-1": "-1" is not a valid uint map key`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"index.json":                         {Data: []byte(`{}`)},
+				"values/" + test.dir + "/index.json": {Data: []byte(`1`)},
+			}
+			err := UnmarshalFS(fsys, "index.json", test.v, Options{})
+			if err == nil || !strings.HasSuffix(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package dfjson
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// KeyEscaper converts map keys into directory names and back, so that keys
+// that aren't valid directory names, ie. "a/b", can round-trip without being
+// recorded in a "_keys.json" file. It's set with Options.KeyEscaper.
+type KeyEscaper interface {
+	// EscapeKey returns the name of the directory that key is written to
+	EscapeKey(key string) string
+
+	// UnescapeKey returns the key that was escaped into dirName
+	UnescapeKey(dirName string) (string, error)
+}
+
+// PercentKeyEscaper percent-encodes the characters of map keys that are
+// unsafe in directory names on common filesystems, ie. "a/b" becomes
+// "a%2Fb". Path separators, characters reserved on Windows (:*?"<>|),
+// control characters, invalid UTF-8 and "%" itself are escaped, as are a
+// leading "." and a trailing "." or space. Other Unicode is kept as-is.
+var PercentKeyEscaper KeyEscaper = percentKeyEscaper{}
+
+type percentKeyEscaper struct{}
+
+func (percentKeyEscaper) EscapeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); {
+		r, size := utf8.DecodeRuneInString(key[i:])
+		isLast := i+size == len(key)
+		switch {
+		case r == utf8.RuneError && size == 1,
+			r < 0x20, r == 0x7F,
+			strings.ContainsRune("/\\:*?\"<>|%", r),
+			i == 0 && r == '.',
+			isLast && (r == '.' || r == ' '):
+			fmt.Fprintf(&b, "%%%02X", key[i])
+		default:
+			b.WriteString(key[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+func (percentKeyEscaper) UnescapeKey(dirName string) (string, error) {
+	if !strings.Contains(dirName, "%") {
+		return dirName, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(dirName); i++ {
+		if dirName[i] != '%' {
+			b.WriteByte(dirName[i])
+			continue
+		}
+		if i+2 >= len(dirName) || !isHex(dirName[i+1]) || !isHex(dirName[i+2]) {
+			return "", errors.New("invalid percent-encoding in " + dirName)
+		}
+		b.WriteByte(unhex(dirName[i+1])<<4 | unhex(dirName[i+2]))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
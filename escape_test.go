@@ -0,0 +1,50 @@
+package dfjson
+
+import "testing"
+
+func TestPercentKeyEscaper(t *testing.T) {
+	tests := []struct {
+		key, dir string
+	}{
+		{"goblin", "goblin"},
+		{"", ""},
+		{"a/b", "a%2Fb"},
+		{`a\b`, "a%5Cb"},
+		{"x:y", "x%3Ay"},
+		{`?*"<>|`, "%3F%2A%22%3C%3E%7C"},
+		{"100%", "100%25"},
+		{"tab\there", "tab%09here"},
+		{"del\x7f", "del%7F"},
+		{"invalid\xff", "invalid%FF"},
+		{".hidden", "%2Ehidden"},
+		{"a.b", "a.b"},
+		{"end.", "end%2E"},
+		{"end ", "end%20"},
+		{" start", " start"},
+		{"日本語", "日本語"},
+		{"café/crème", "café%2Fcrème"},
+		{"🐉:fire", "🐉%3Afire"},
+	}
+	for _, test := range tests {
+		dir := PercentKeyEscaper.EscapeKey(test.key)
+		if dir != test.dir {
+			t.Errorf("EscapeKey(%q) = %q, want %q", test.key, dir, test.dir)
+		}
+		key, err := PercentKeyEscaper.UnescapeKey(dir)
+		if err != nil {
+			t.Errorf("UnescapeKey(%q): %v", dir, err)
+			continue
+		}
+		if key != test.key {
+			t.Errorf("UnescapeKey(%q) = %q, want %q", dir, key, test.key)
+		}
+	}
+}
+
+func TestPercentKeyEscaperErrors(t *testing.T) {
+	for _, dir := range []string{"%", "a%2", "%zz", "%2G"} {
+		if _, err := PercentKeyEscaper.UnescapeKey(dir); err == nil {
+			t.Errorf("UnescapeKey(%q): expected an error", dir)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package dfjson
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// field is an exported struct field as seen by encoding/json
+type field struct {
+	name   string // JSON key
+	goName string
+	// index is the index sequence of the field, with more than one
+	// element if it's promoted from an embedded struct
+	index []int
+	typ   reflect.Type
+	tag   reflect.StructTag
+	opts  tagOptions
+
+	// tagged is true if the name was set by the "json" tag
+	tagged bool
+
+	// distributable is true if the field is tagged with "dfjson:distributable"
+	// and so is written to its own directory rather than inline.
+	distributable bool
+
+	// group is the directory that the directory of a distributable field is
+	// placed in, set with "dfjson:distributable,group=stats"
+	group string
+
+	// required is true if the directory of a distributable field must exist
+	// when decoding, set with `required:"true"`
+	required bool
+
+	// chunkSize is the number of elements of a distributable slice field that
+	// are written to each chunk file, set with "dfjson:distributable,chunk=1000".
+	// It's -1 if the option isn't a positive number.
+	chunkSize int
+
+	// requiredKeys are the keys of a distributable map field whose directories
+	// must exist when decoding, set with `requiredKeys:"goblin,orc"`
+	requiredKeys []string
+
+	// format is the name of the Codec that the subtree of a distributable
+	// field is written with, set with "dfjson:distributable,format=yaml"
+	format string
+
+	// orderField is the Go name of the []string field that holds the order
+	// of the keys of a distributable map field, set with
+	// "dfjson:distributable,order=MenuOrder"
+	orderField string
+
+	// validate is the range set with `validate:"min=0,max=100"`, or nil.
+	// validateErr is set instead if the tag can't be parsed.
+	validate    *numberRange
+	validateErr error
+}
+
+// typeFields returns the fields of struct type t that encoding/json would
+// encode, in declaration order. The fields of embedded structs are promoted
+// into t by the same rules as encoding/json, so a field of t shadows one of
+// the same name in an embedded struct, and fields of the same name at the
+// same depth within embedded structs are left out unless exactly one of
+// them has a JSON tag name.
+// (adapted from the encoder/json package)
+//
+// The result is cached per type and must not be modified.
+func typeFields(t reflect.Type) []field {
+	return cachedTypeFields(t).fields
+}
+
+// ambiguousFields returns the fields of struct type t that typeFields leaves
+// out for another field of the same name at the same depth, if any of them is
+// distributable, so that checkFieldCollisions can report them rather than a
+// distributable field or its inline counterpart silently going missing.
+func ambiguousFields(t reflect.Type) []field {
+	return cachedTypeFields(t).ambiguous
+}
+
+// structFields is the cached result of typeFields, ambiguousFields
+// and checkFieldCollisions
+type structFields struct {
+	fields       []field
+	ambiguous    []field
+	collisionErr error
+}
+
+func cachedTypeFields(t reflect.Type) structFields {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(structFields)
+	}
+	fields, _ := fieldCache.LoadOrStore(t, computeTypeFields(t))
+	return fields.(structFields)
+}
+
+// fieldCache maps a struct type to its structFields
+var fieldCache sync.Map
+
+func computeTypeFields(t reflect.Type) structFields {
+	var list []field
+	current := []embeddedStruct{}
+	next := []embeddedStruct{{typ: t}}
+	var count, nextCount map[reflect.Type]int
+	var visited map[reflect.Type]bool
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, nil
+		for _, embedded := range current {
+			if visited[embedded.typ] {
+				continue
+			}
+			if visited == nil {
+				visited = make(map[reflect.Type]bool)
+			}
+			visited[embedded.typ] = true
+			for i := 0; i < embedded.typ.NumField(); i++ {
+				fieldType := embedded.typ.Field(i)
+
+				// Ignore unexported field
+				// (copy-pasted out of encoder/json package)
+				{
+					isUnexported := fieldType.PkgPath != ""
+					if fieldType.Anonymous {
+						t := fieldType.Type
+						if t.Kind() == reflect.Ptr {
+							t = t.Elem()
+						}
+						if isUnexported && t.Kind() != reflect.Struct {
+							// Ignore embedded fields of unexported non-struct types.
+							continue
+						}
+						// Do not ignore embedded fields of unexported struct types
+						// since they may have exported fields.
+					} else if isUnexported {
+						// Ignore unexported non-embedded fields.
+						continue
+					}
+				}
+				tag := fieldType.Tag.Get("json")
+				if tag == "-" || isParentField(fieldType) {
+					continue
+				}
+				name, opts := parseTag(tag)
+				index := make([]int, len(embedded.index)+1)
+				copy(index, embedded.index)
+				index[len(embedded.index)] = i
+
+				ft := fieldType.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if name == "" && fieldType.Anonymous && ft.Kind() == reflect.Struct {
+					// Promote the fields of the embedded struct on the next pass
+					if nextCount == nil {
+						nextCount = make(map[reflect.Type]int)
+					}
+					nextCount[ft]++
+					if nextCount[ft] == 1 {
+						next = append(next, embeddedStruct{typ: ft, index: index})
+					}
+					continue
+				}
+				f := newField(fieldType, name, opts, index)
+				list = append(list, f)
+				if count[embedded.typ] > 1 {
+					// The struct was embedded more than once at this depth, so
+					// add the field twice for dominantFields to leave it out
+					list = append(list, f)
+				}
+			}
+		}
+	}
+	fields, ambiguous := dominantFields(list)
+	return structFields{
+		fields:       fields,
+		ambiguous:    ambiguous,
+		collisionErr: fieldCollisions(t, append(fields[:len(fields):len(fields)], ambiguous...)),
+	}
+}
+
+// embeddedStruct is a struct type whose fields are promoted by typeFields,
+// with index being the index sequence of where it's embedded
+type embeddedStruct struct {
+	typ   reflect.Type
+	index []int
+}
+
+// newField returns the field for a struct field called name in JSON
+func newField(fieldType reflect.StructField, name string, opts tagOptions, index []int) field {
+	tagged := name != ""
+	if name == "" {
+		// Default to Golang struct field name
+		name = fieldType.Name
+	}
+	dfjsonTag, dfjsonOpts := parseTag(fieldType.Tag.Get("dfjson"))
+	distributable := dfjsonTag == "distributable"
+	group := ""
+	required := false
+	chunkSize := 0
+	var requiredKeys []string
+	format := ""
+	orderField := ""
+	if distributable {
+		group = dfjsonOpts.Value("group")
+		format = dfjsonOpts.Value("format")
+		orderField = dfjsonOpts.Value("order")
+		if chunk := dfjsonOpts.Value("chunk"); chunk != "" {
+			chunkSize = -1
+			if n, err := strconv.Atoi(chunk); err == nil && n > 0 {
+				chunkSize = n
+			}
+		}
+		required = fieldType.Tag.Get("required") == "true"
+		if keys := fieldType.Tag.Get("requiredKeys"); keys != "" {
+			requiredKeys = strings.Split(keys, ",")
+		}
+	}
+	var validate *numberRange
+	var validateErr error
+	if tag, ok := fieldType.Tag.Lookup("validate"); ok {
+		r, err := parseRangeTag(tag)
+		validate, validateErr = &r, err
+	}
+	return field{
+		name:          name,
+		goName:        fieldType.Name,
+		index:         index,
+		typ:           fieldType.Type,
+		tag:           fieldType.Tag,
+		tagged:        tagged,
+		opts:          opts,
+		distributable: distributable,
+		group:         group,
+		chunkSize:     chunkSize,
+		required:      required,
+		requiredKeys:  requiredKeys,
+		format:        format,
+		orderField:    orderField,
+		validate:      validate,
+		validateErr:   validateErr,
+	}
+}
+
+// containsField reports whether a value of type t can hold a struct field
+// that match returns true for, the result is cached in cache. Types that
+// hold an interface are assumed to, as any value could be stored in it.
+func containsField(cache *sync.Map, t reflect.Type, match func(f reflect.StructField) bool) bool {
+	if has, ok := cache.Load(t); ok {
+		return has.(bool)
+	}
+	has := typeContainsField(t, match, make(map[reflect.Type]bool))
+	cache.Store(t, has)
+	return has
+}
+
+func typeContainsField(t reflect.Type, match func(f reflect.StructField) bool, visited map[reflect.Type]bool) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return typeContainsField(t.Elem(), match, visited)
+	case reflect.Struct:
+		if visited[t] {
+			// Self-referential types are answered by the first visit
+			return false
+		}
+		visited[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if match(f) || typeContainsField(f.Type, match, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dominantFields returns list without the fields that are shadowed by
+// another field of the same name, sorted into declaration order. Fields of
+// the same name at the same depth are all left out unless exactly one of them
+// is tagged, if any of them is distributable those left out are returned as
+// ambiguous.
+// (adapted from the encoder/json package)
+func dominantFields(list []field) (fields []field, ambiguous []field) {
+	if len(list) < 2 {
+		return list, nil
+	}
+	// Sort by name, breaking ties with depth, then whether the
+	// name came from a tag, then the index sequence
+	sort.Slice(list, func(i, j int) bool {
+		x := list
+		if x[i].name != x[j].name {
+			return x[i].name < x[j].name
+		}
+		if len(x[i].index) != len(x[j].index) {
+			return len(x[i].index) < len(x[j].index)
+		}
+		if x[i].tagged != x[j].tagged {
+			return x[i].tagged
+		}
+		return indexLess(x[i].index, x[j].index)
+	})
+	out := list[:0]
+	for advance, i := 0, 0; i < len(list); i += advance {
+		name := list[i].name
+		for advance = 1; i+advance < len(list); advance++ {
+			if list[i+advance].name != name {
+				break
+			}
+		}
+		named := list[i : i+advance]
+		sameDepth := 1
+		for sameDepth < len(named) && len(named[sameDepth].index) == len(named[0].index) {
+			sameDepth++
+		}
+		dropped := named[1:sameDepth]
+		if sameDepth > 1 && named[0].tagged == named[1].tagged {
+			// Neither field dominates, so both are left out
+			dropped = named[:sameDepth]
+		}
+		for _, f := range named[:sameDepth] {
+			if f.distributable {
+				ambiguous = append(ambiguous, dropped...)
+				break
+			}
+		}
+		if len(dropped) < sameDepth {
+			out = append(out, named[0])
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return indexLess(out[i].index, out[j].index)
+	})
+	return out, ambiguous
+}
+
+// indexLess reports whether the field at index sequence a
+// is declared before the one at b
+func indexLess(a, b []int) bool {
+	for k, x := range a {
+		if k >= len(b) {
+			return false
+		}
+		if x != b[k] {
+			return x < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// fieldByIndex returns the field of struct v at the index sequence of a
+// field returned by typeFields. It returns false if the field is promoted
+// through an embedded pointer that is nil.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// settableFieldByIndex is like fieldByIndex but allocates embedded pointers
+// that are nil so that the field can be set.
+func settableFieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot set embedded pointer to unexported struct %s", v.Type().Elem().String())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// checkFieldCollisions returns an error if a distributable field shares its
+// name with an inline field of struct type t, as both would end up under the
+// same key once the files are stitched back together, if a group shares
+// its name with a field or if two distributable fields would be written to
+// the same directory, which includes names that only differ by case as they
+// share a directory on case-insensitive filesystems.
+//
+// The result is cached per type, as it's checked for every struct encoded.
+func checkFieldCollisions(t reflect.Type) error {
+	return cachedTypeFields(t).collisionErr
+}
+
+// fieldCollisions returns the error of checkFieldCollisions for the
+// fields of t, including those that typeFields leaves out
+func fieldCollisions(t reflect.Type, fields []field) error {
+	inlineFields := make(map[string]string, len(fields))
+	allFields := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if !f.distributable {
+			inlineFields[f.name] = f.goName
+		}
+		allFields[f.name] = f.goName
+	}
+	dirFields := make(map[string]string, len(fields))
+	distributableFields := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if !f.distributable {
+			continue
+		}
+		dirName := f.name
+		if f.group != "" {
+			dirName = f.group + "/" + f.name
+		}
+		if goName, ok := dirFields[strings.ToLower(dirName)]; ok {
+			return fmt.Errorf("%s: distributable fields %s and %s are both written to the directory %q", t.String(), goName, f.goName, dirName)
+		}
+		dirFields[strings.ToLower(dirName)] = f.goName
+		if goName, ok := distributableFields[f.name]; ok {
+			return fmt.Errorf("%s: distributable fields %s and %s both use the name %q", t.String(), goName, f.goName, f.name)
+		}
+		distributableFields[f.name] = f.goName
+		if goName, ok := inlineFields[f.name]; ok {
+			return fmt.Errorf("%s: distributable field %s and field %s both use the name %q", t.String(), f.goName, goName, f.name)
+		}
+		if goName, ok := allFields[f.group]; ok {
+			return fmt.Errorf("%s: group of distributable field %s and field %s both use the name %q", t.String(), f.goName, goName, f.group)
+		}
+	}
+	return nil
+}
+
+// groupFields returns the distributable fields of struct type t that are
+// placed in the group directory called name, or nil if there are none.
+func groupFields(t reflect.Type, name string) map[string]field {
+	t = derefType(t)
+	if t == nil || t.Kind() != reflect.Struct || name == "" {
+		return nil
+	}
+	var fields map[string]field
+	for _, f := range typeFields(t) {
+		if f.group != name {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]field)
+		}
+		fields[f.name] = f
+	}
+	return fields
+}
+
+// tagOptions is the string following a comma in a struct field's "json"
+// tag, or the empty string. It does not include the leading comma.
+// (copy-pasted out of encoder/json package)
+type tagOptions string
+
+// parseTag splits a struct field's json tag into its name and
+// comma-separated options.
+func parseTag(tag string) (string, tagOptions) {
+	if idx := strings.Index(tag, ","); idx != -1 {
+		return tag[:idx], tagOptions(tag[idx+1:])
+	}
+	return tag, tagOptions("")
+}
+
+// Value returns the value of an option in the form "name=value",
+// or the empty string if there is no such option.
+func (o tagOptions) Value(optionName string) string {
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if strings.HasPrefix(s, optionName+"=") {
+			return s[len(optionName)+1:]
+		}
+		s = next
+	}
+	return ""
+}
+
+// Contains reports whether a comma-separated list of options
+// contains a particular substr flag. substr must be surrounded by a
+// string boundary or commas.
+func (o tagOptions) Contains(optionName string) bool {
+	if len(o) == 0 {
+		return false
+	}
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == optionName {
+			return true
+		}
+		s = next
+	}
+	return false
+}
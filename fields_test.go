@@ -0,0 +1,208 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fieldsTestA struct {
+	ID   string
+	Name string
+}
+
+type fieldsTestB struct {
+	Name  string
+	Extra int
+}
+
+type fieldsTestTagged struct {
+	Label string `json:"Name"`
+}
+
+type fieldsTestItems struct {
+	Items map[string]int `dfjson:"distributable"`
+}
+
+type fieldsTestInlineItems struct {
+	Items int
+}
+
+type fieldsTestHidden struct {
+	Hidden int
+}
+
+type fieldsTestAmbiguous struct {
+	fieldsTestA
+	fieldsTestB
+	Own int
+}
+
+type fieldsTestDominant struct {
+	fieldsTestA
+	fieldsTestTagged
+}
+
+type fieldsTestShadowed struct {
+	fieldsTestA
+	Name string
+}
+
+type fieldsTestSameDepth struct {
+	Name  string
+	Label string `json:"Name"`
+}
+
+type fieldsTestUnexported struct {
+	fieldsTestHidden
+	*fieldsTestB
+	Own int
+}
+
+type fieldsTestDistributableAmbiguous struct {
+	fieldsTestItems
+	fieldsTestInlineItems
+}
+
+func TestTypeFields(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []string
+	}{
+		{"ambiguous embedded fields are left out", fieldsTestAmbiguous{}, []string{"ID", "Extra", "Own"}},
+		{"tagged embedded field dominates", fieldsTestDominant{}, []string{"ID", "Name"}},
+		{"outer field shadows embedded field", fieldsTestShadowed{}, []string{"ID", "Name"}},
+		{"tagged field dominates at same depth", fieldsTestSameDepth{}, []string{"Name"}},
+		{"unexported embedded structs", fieldsTestUnexported{}, []string{"Hidden", "Name", "Extra", "Own"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var names []string
+			for _, f := range typeFields(reflect.TypeOf(test.v)) {
+				names = append(names, f.name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("got %q, want %q", names, test.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedFieldsMatchEncodingJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"ambiguous", &fieldsTestAmbiguous{fieldsTestA{"1", "a"}, fieldsTestB{"b", 2}, 3}},
+		{"dominant", &fieldsTestDominant{fieldsTestA{"1", "a"}, fieldsTestTagged{"b"}}},
+		{"same depth", &fieldsTestSameDepth{"a", "b"}},
+		{"unexported", &fieldsTestUnexported{fieldsTestHidden{1}, &fieldsTestB{"b", 2}, 3}},
+		{"nil embedded pointer", &fieldsTestUnexported{Own: 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.MarshalIndent(test.v, "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(files[0].Data); got != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedFieldErrors(t *testing.T) {
+	_, err := Marshal("index.json", &fieldsTestDistributableAmbiguous{})
+	if want := `both use the name "Items"`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+
+	files := filesFS([]JSONFile{{Path: "index.json", Data: []byte(`{"Name": "b"}`)}})
+	var out fieldsTestUnexported
+	err = UnmarshalFS(files, "index.json", &out, Options{})
+	if want := "cannot set embedded pointer to unexported struct"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+type fieldsTestInlineAndDistributable struct {
+	Items   []int
+	ItemDir map[string]int `json:"Items" dfjson:"distributable"`
+}
+
+func TestFieldCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		wantErr string
+	}{
+		{
+			name:    "inline and distributable",
+			v:       &fieldsTestInlineAndDistributable{},
+			wantErr: `dfjson.fieldsTestInlineAndDistributable: distributable field ItemDir and field Items both use the name "Items"`,
+		},
+		{
+			name: "group and field",
+			v: &struct {
+				Stats int            `json:"stats"`
+				HP    map[string]int `json:"hp" dfjson:"distributable,group=stats"`
+			}{},
+			wantErr: `struct { Stats int "json:\"stats\""; HP map[string]int "json:\"hp\" dfjson:\"distributable,group=stats\"" }: group of distributable field HP and field Stats both use the name "stats"`,
+		},
+		{
+			name: "distributable fields differing by case",
+			v: &struct {
+				Lower map[string]int `json:"items" dfjson:"distributable"`
+				Upper map[string]int `json:"Items" dfjson:"distributable"`
+			}{},
+			wantErr: `struct { Lower map[string]int "json:\"items\" dfjson:\"distributable\""; Upper map[string]int "json:\"Items\" dfjson:\"distributable\"" }: distributable fields Lower and Upper are both written to the directory "Items"`,
+		},
+		{
+			name: "distributable fields within a group",
+			v: &struct {
+				HP    *encodeTestCreature `json:"hp" dfjson:"distributable,group=stats"`
+				MaxHP *encodeTestCreature `json:"HP" dfjson:"distributable,group=stats"`
+			}{},
+			wantErr: `distributable fields HP and MaxHP are both written to the directory "stats/HP"`,
+		},
+		{
+			name: "same name in different groups",
+			v: &struct {
+				HP    *encodeTestCreature `json:"hp" dfjson:"distributable,group=stats"`
+				MaxHP *encodeTestCreature `json:"HP" dfjson:"distributable,group=limits"`
+			}{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Marshal("index.json", test.v)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFieldCollisionsCached(t *testing.T) {
+	typ := reflect.TypeOf(encodeTestGroups{})
+	checkFieldCollisions(typ)
+	// Checked for every struct encoded, so it mustn't allocate
+	if allocs := testing.AllocsPerRun(100, func() {
+		checkFieldCollisions(typ)
+	}); allocs != 0 {
+		t.Errorf("got %v allocations, want 0", allocs)
+	}
+}
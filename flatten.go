@@ -0,0 +1,374 @@
+package dfjson
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FlatRow is a single dotted-path and value pair produced by Flatten.
+type FlatRow = struct {
+	Path  string
+	Value string
+}
+
+// Flatten walks v and returns a row for every scalar value it contains,
+// keyed by a dotted path made of JSON field names, map keys and slice indexes,
+// ie. "creatures.goblin.hp" = "12". A "." or "\" within a segment is escaped
+// with a backslash, so a map key of "v1.2" becomes "versions.v1\.2", and
+// Unflatten reverses it.
+//
+// An error is returned if v refers back to itself.
+//
+// This is a read-only view of the data intended for exporting to a spreadsheet
+// or CSV file so designers can review everything at once.
+func Flatten(v interface{}) ([]FlatRow, error) {
+	var f flattener
+	if err := f.flatten("", reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return f.rows, nil
+}
+
+type flattener struct {
+	rows []FlatRow
+
+	// visiting holds the pointers, maps and slices being flattened
+	// so values that refer back to themselves are detected
+	visiting map[visitKey]bool
+}
+
+func (f *flattener) flatten(path string, v reflect.Value) error {
+	if !v.IsValid() {
+		return nil
+	}
+	if !v.CanInterface() {
+		return nil
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil
+		}
+		text, err := m.MarshalText()
+		if err != nil {
+			return err
+		}
+		f.rows = append(f.rows, FlatRow{Path: path, Value: string(text)})
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			break
+		}
+		key := visitKey{ptr: v.Pointer(), typ: v.Type()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if f.visiting[key] {
+			return fmt.Errorf("unable to flatten %q: encountered a cycle", path)
+		}
+		if f.visiting == nil {
+			f.visiting = make(map[visitKey]bool)
+		}
+		f.visiting[key] = true
+		defer delete(f.visiting, key)
+	}
+	switch kind := v.Kind(); kind {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return f.flatten(path, v.Elem())
+	case reflect.Struct:
+		for _, field := range typeFields(v.Type()) {
+			fieldValue, ok := fieldByIndex(v, field.index)
+			if !ok {
+				continue
+			}
+			if err := f.flatten(joinPath(path, escapePathSegment(field.name)), fieldValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		keys := v.MapKeys()
+		keyStrings := make([]string, len(keys))
+		for i, key := range keys {
+			keyString, err := mapKeyString(key)
+			if err != nil {
+				return err
+			}
+			keyStrings[i] = keyString
+		}
+		sort.Sort(mapKeySorter{keys: keys, keyStrings: keyStrings, numeric: isIntegerKeyType(v.Type().Key())})
+		for i, key := range keys {
+			if err := f.flatten(joinPath(path, escapePathSegment(keyStrings[i])), v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := f.flatten(joinPath(path, strconv.Itoa(i)), v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.String:
+		f.rows = append(f.rows, FlatRow{Path: path, Value: v.String()})
+		return nil
+	case reflect.Bool:
+		f.rows = append(f.rows, FlatRow{Path: path, Value: strconv.FormatBool(v.Bool())})
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.rows = append(f.rows, FlatRow{Path: path, Value: strconv.FormatInt(v.Int(), 10)})
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f.rows = append(f.rows, FlatRow{Path: path, Value: strconv.FormatUint(v.Uint(), 10)})
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f.rows = append(f.rows, FlatRow{Path: path, Value: strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())})
+		return nil
+	default:
+		return fmt.Errorf("unable to flatten %q, unsupported kind: %s", path, kind.String())
+	}
+}
+
+// Unflatten applies rows produced by Flatten (and then edited, ie. in a spreadsheet)
+// back onto the value pointed to by v. Scalar values are parsed according to the
+// type of the field they're applied to and an error is returned if a value can't be
+// parsed or a path does not exist.
+//
+// Nil pointers, maps and slices along a path are allocated as needed.
+func Unflatten(rows []FlatRow, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Must provide non-nil pointer value")
+	}
+	for _, row := range rows {
+		segments, err := splitPath(row.Path)
+		if err != nil {
+			return fmt.Errorf("unable to unflatten %q: %v", row.Path, err)
+		}
+		if err := unflatten(rv.Elem(), segments, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unflattenField sets the value of row at the remaining segments within
+// the field f of struct v
+func unflattenField(v reflect.Value, f field, segments []string, row FlatRow) error {
+	fieldValue, err := settableFieldByIndex(v, f.index)
+	if err != nil {
+		return fmt.Errorf("unable to unflatten %q: %v", row.Path, err)
+	}
+	return unflatten(fieldValue, segments, row)
+}
+
+func unflatten(v reflect.Value, segments []string, row FlatRow) error {
+	if len(segments) == 0 {
+		if err := setScalar(v, row.Value); err != nil {
+			return fmt.Errorf("unable to unflatten %q: %v", row.Path, err)
+		}
+		return nil
+	}
+	segment := segments[0]
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unflatten(v.Elem(), segments, row)
+	case reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("unable to unflatten %q: cannot set %q on nil interface", row.Path, segment)
+		}
+		// Values held by an interface are not settable, so
+		// copy them out, modify the copy and put it back.
+		elem := v.Elem()
+		copied := reflect.New(elem.Type()).Elem()
+		copied.Set(elem)
+		if err := unflatten(copied, segments, row); err != nil {
+			return err
+		}
+		v.Set(copied)
+		return nil
+	case reflect.Struct:
+		fields := typeFields(v.Type())
+		for _, f := range fields {
+			if f.name == segment {
+				return unflattenField(v, f, segments[1:], row)
+			}
+		}
+		// Fallback to case-insensitive match like encoding/json
+		for _, f := range fields {
+			if strings.EqualFold(f.name, segment) {
+				return unflattenField(v, f, segments[1:], row)
+			}
+		}
+		return fmt.Errorf("unable to unflatten %q: no field named %q on %s", row.Path, segment, v.Type().String())
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key, err := mapKeyFromString(v.Type().Key(), segment)
+		if err != nil {
+			return fmt.Errorf("unable to unflatten %q: %v", row.Path, err)
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
+		}
+		if err := unflatten(elem, segments[1:], row); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	case reflect.Slice, reflect.Array:
+		i, err := strconv.Atoi(segment)
+		if err != nil || i < 0 {
+			return fmt.Errorf("unable to unflatten %q: invalid index %q", row.Path, segment)
+		}
+		if i >= v.Len() {
+			if v.Kind() == reflect.Array {
+				return fmt.Errorf("unable to unflatten %q: index %d out of range for %s", row.Path, i, v.Type().String())
+			}
+			grown := reflect.MakeSlice(v.Type(), i+1, i+1)
+			reflect.Copy(grown, v)
+			v.Set(grown)
+		}
+		return unflatten(v.Index(i), segments[1:], row)
+	default:
+		return fmt.Errorf("unable to unflatten %q: %s has no field %q", row.Path, v.Type().String(), segment)
+	}
+}
+
+// setScalar parses s according to the kind of v and stores the result in v
+func setScalar(v reflect.Value, s string) error {
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(s))
+		}
+	}
+	switch kind := v.Kind(); kind {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setScalar(v.Elem(), s)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("cannot set value on non-empty interface %s", v.Type().String())
+		}
+		v.Set(reflect.ValueOf(s))
+	default:
+		return fmt.Errorf("cannot set value on unsupported kind: %s", kind.String())
+	}
+	return nil
+}
+
+// mapKeyFromString converts a string back into a map key of type keyType.
+// It is the reverse of mapKeyString.
+func mapKeyFromString(keyType reflect.Type, s string) (reflect.Value, error) {
+	if reflect.PtrTo(keyType).Implements(reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()) {
+		key := reflect.New(keyType)
+		if err := key.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+			return reflect.Value{}, err
+		}
+		return key.Elem(), nil
+	}
+	key := reflect.New(keyType).Elem()
+	switch keyType.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if err := setScalar(key, s); err != nil {
+			return reflect.Value{}, err
+		}
+		return key, nil
+	}
+	return reflect.Value{}, fmt.Errorf("unsupported map key type: %s", keyType.String())
+}
+
+// joinPath appends name to a dotted path
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// escapePathSegment escapes the dots and backslashes in a segment of a
+// flattened path so it can be split back out by splitPath
+func escapePathSegment(segment string) string {
+	if !strings.ContainsAny(segment, ".\\") {
+		return segment
+	}
+	var b strings.Builder
+	for i := 0; i < len(segment); i++ {
+		if c := segment[i]; c == '.' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(segment[i])
+	}
+	return b.String()
+}
+
+// splitPath splits a flattened path on its unescaped dots and
+// unescapes each segment. It is the reverse of joining segments
+// escaped by escapePathSegment.
+func splitPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	var segments []string
+	var segment strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '.':
+			segments = append(segments, segment.String())
+			segment.Reset()
+		case '\\':
+			i++
+			if i == len(path) || (path[i] != '.' && path[i] != '\\') {
+				return nil, fmt.Errorf("invalid escape at offset %d", i-1)
+			}
+			segment.WriteByte(path[i])
+		default:
+			segment.WriteByte(c)
+		}
+	}
+	return append(segments, segment.String()), nil
+}
@@ -0,0 +1,203 @@
+package dfjson
+
+import (
+	"reflect"
+	"testing"
+)
+
+type flattenTestCreature struct {
+	Name string `json:"name"`
+	HP   int    `json:"hp"`
+}
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []FlatRow
+	}{
+		{
+			name: "integer keys are sorted numerically",
+			v:    map[int]int{10: 3, 2: 2, -1: 1},
+			want: []FlatRow{{"-1", "1"}, {"2", "2"}, {"10", "3"}},
+		},
+		{
+			name: "unsigned keys are sorted numerically",
+			v:    map[uint8]string{100: "c", 9: "b", 0: "a"},
+			want: []FlatRow{{"0", "a"}, {"9", "b"}, {"100", "c"}},
+		},
+		{
+			name: "string keys are sorted",
+			v:    map[string]int{"b": 2, "a": 1, "10": 0},
+			want: []FlatRow{{"10", "0"}, {"a", "1"}, {"b", "2"}},
+		},
+		{
+			name: "nested values",
+			v: map[string][]flattenTestCreature{
+				"goblins": {{"gob", 12}},
+			},
+			want: []FlatRow{{"goblins.0.name", "gob"}, {"goblins.0.hp", "12"}},
+		},
+		{
+			name: "dots and backslashes in keys are escaped",
+			v: map[string]map[string]int{
+				"v1.2":  {`a\b`: 1, "c.": 2},
+				`\.`:    {".": 3},
+				"plain": {"": 4},
+			},
+			want: []FlatRow{{`\\\..\.`, "3"}, {"plain.", "4"}, {`v1\.2.a\\b`, "1"}, {`v1\.2.c\.`, "2"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, err := Flatten(test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rows, test.want) {
+				t.Fatalf("got %v, want %v", rows, test.want)
+			}
+			out := reflect.New(reflect.TypeOf(test.v))
+			if err := Unflatten(rows, out.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Elem().Interface(), test.v) {
+				t.Errorf("got %v, want %v", out.Elem().Interface(), test.v)
+			}
+		})
+	}
+}
+
+type unflattenTestWorld struct {
+	Creatures map[string]*flattenTestCreature `json:"creatures"`
+	Speeds    []float64                       `json:"speeds"`
+	Enabled   bool                            `json:"enabled"`
+	Counts    [2]uint8                        `json:"counts"`
+}
+
+func TestUnflatten(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    []FlatRow
+		want    unflattenTestWorld
+		wantErr string
+	}{
+		{
+			name: "edited rows",
+			rows: []FlatRow{{"creatures.goblin.hp", "15"}, {"creatures.goblin.name", "Goblin"}, {"enabled", "true"}},
+			want: unflattenTestWorld{
+				Creatures: map[string]*flattenTestCreature{"goblin": {Name: "Goblin", HP: 15}, "orc": {Name: "orc", HP: 30}},
+				Speeds:    []float64{1.5},
+				Enabled:   true,
+			},
+		},
+		{
+			name: "allocates maps and grows slices",
+			rows: []FlatRow{{"creatures.troll.hp", "-3"}, {"speeds.2", "2.25"}, {"counts.1", "255"}},
+			want: unflattenTestWorld{
+				Creatures: map[string]*flattenTestCreature{"goblin": {Name: "goblin", HP: 12}, "orc": {Name: "orc", HP: 30}, "troll": {HP: -3}},
+				Speeds:    []float64{1.5, 0, 2.25},
+				Counts:    [2]uint8{0, 255},
+			},
+		},
+		{
+			name:    "malformed int",
+			rows:    []FlatRow{{"creatures.goblin.hp", "twelve"}},
+			wantErr: `unable to unflatten "creatures.goblin.hp": strconv.ParseInt: parsing "twelve": invalid syntax`,
+		},
+		{
+			name:    "malformed bool",
+			rows:    []FlatRow{{"enabled", "yes"}},
+			wantErr: `unable to unflatten "enabled": strconv.ParseBool: parsing "yes": invalid syntax`,
+		},
+		{
+			name:    "out of range uint",
+			rows:    []FlatRow{{"counts.0", "256"}},
+			wantErr: `unable to unflatten "counts.0": strconv.ParseUint: parsing "256": value out of range`,
+		},
+		{
+			name:    "array index out of range",
+			rows:    []FlatRow{{"counts.2", "1"}},
+			wantErr: `unable to unflatten "counts.2": index 2 out of range for [2]uint8`,
+		},
+		{
+			name:    "unknown field",
+			rows:    []FlatRow{{"creatures.goblin.mana", "1"}},
+			wantErr: `unable to unflatten "creatures.goblin.mana": no field named "mana" on dfjson.flattenTestCreature`,
+		},
+		{
+			name:    "invalid escape",
+			rows:    []FlatRow{{`creatures.gob\lin.hp`, "1"}},
+			wantErr: `unable to unflatten "creatures.gob\\lin.hp": invalid escape at offset 13`,
+		},
+		{
+			name:    "trailing escape",
+			rows:    []FlatRow{{`creatures.goblin\`, "1"}},
+			wantErr: `unable to unflatten "creatures.goblin\\": invalid escape at offset 16`,
+		},
+		{
+			name:    "invalid index",
+			rows:    []FlatRow{{"speeds.first", "1"}},
+			wantErr: `unable to unflatten "speeds.first": invalid index "first"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := unflattenTestWorld{
+				Creatures: map[string]*flattenTestCreature{"goblin": {"goblin", 12}, "orc": {"orc", 30}},
+				Speeds:    []float64{1.5},
+			}
+			err := Unflatten(test.rows, &v)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, test.want) {
+				t.Errorf("got %+v, want %+v", v, test.want)
+			}
+		})
+	}
+}
+
+type flattenTestNode struct {
+	Name string           `json:"name"`
+	Next *flattenTestNode `json:"next"`
+}
+
+func TestFlattenCycle(t *testing.T) {
+	node := &flattenTestNode{Name: "a", Next: &flattenTestNode{Name: "b"}}
+	node.Next.Next = node
+	looped := map[string]interface{}{}
+	looped["self"] = looped
+	tests := []struct {
+		name    string
+		v       interface{}
+		wantErr string
+	}{
+		{"pointer", node, `unable to flatten "next.next": encountered a cycle`},
+		{"map", looped, `unable to flatten "self": encountered a cycle`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Flatten(test.v)
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+
+	// The same value can be reached more than once without a cycle
+	shared := &flattenTestCreature{Name: "gob", HP: 12}
+	rows, err := Flatten(map[string]*flattenTestCreature{"a": shared, "b": shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Errorf("got %v, want both creatures", rows)
+	}
+}
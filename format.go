@@ -0,0 +1,122 @@
+package dfjson
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path"
+	"strings"
+)
+
+// detectFormat returns opts configured for the format of the data, as given by
+// the extension of entryFilename, unless Options.DisableFormatDetection is set.
+//
+//   - ".jsonc" and ".json5" set AllowComments
+//   - ".gz", ie. "index.json.gz", sets Gzip
+//
+// If IndexFilename isn't set, the files of distributed data are expected to
+// have the same extension, ie. "index.jsonc".
+func detectFormat(entryFilename string, opts Options) Options {
+	if opts.DisableFormatDetection {
+		return opts
+	}
+	name := strings.ToLower(path.Base(cleanPath(entryFilename)))
+	ext := ""
+	if strings.HasSuffix(name, ".gz") {
+		opts.Gzip = true
+		name = strings.TrimSuffix(name, ".gz")
+		ext = ".gz"
+	}
+	switch formatExt := path.Ext(name); formatExt {
+	case ".jsonc", ".json5":
+		opts.AllowComments = true
+		ext = formatExt + ext
+	case ".json":
+		ext = formatExt + ext
+	default:
+		return opts
+	}
+	if opts.IndexFilename == "" {
+		opts.IndexFilename = "index" + ext
+	}
+	return opts
+}
+
+// gunzip returns the decompressed contents of the gzip data
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// stripComments returns data with // and /* */ comments and trailing commas
+// removed, turning JSONC into JSON.
+func stripComments(data []byte) []byte {
+	stripped := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(data) && data[end] != '"' {
+				if data[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(data) {
+				end++
+			}
+			stripped = append(stripped, data[i:end]...)
+			i = end - 1
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			// Keep the newline so line numbers stay the same
+			if i < len(data) {
+				stripped = append(stripped, '\n')
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end == -1 {
+				// Leave it to encoding/json to report the error
+				stripped = append(stripped, data[i:]...)
+				return stripped
+			}
+			i += 2 + end + 1
+		case c == ',' && isTrailingComma(data[i+1:]):
+			// Drop it
+		default:
+			stripped = append(stripped, c)
+		}
+	}
+	return stripped
+}
+
+// isTrailingComma reports whether the comma before data is followed by the
+// end of an object or array, ignoring whitespace and comments.
+func isTrailingComma(data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			continue
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end == -1 {
+				return false
+			}
+			i += 2 + end + 1
+		default:
+			return c == '}' || c == ']'
+		}
+	}
+	return false
+}
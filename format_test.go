@@ -0,0 +1,113 @@
+package dfjson
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// gzipData returns data compressed with gzip
+func gzipData(t testing.TB, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		entryFilename string
+		opts          Options
+		want          Options
+	}{
+		{"data/index.json", Options{}, Options{IndexFilename: "index.json"}},
+		{"data/index.jsonc", Options{}, Options{AllowComments: true, IndexFilename: "index.jsonc"}},
+		{"data/World.JSON5", Options{}, Options{AllowComments: true, IndexFilename: "index.json5"}},
+		{"data/index.json.gz", Options{}, Options{Gzip: true, IndexFilename: "index.json.gz"}},
+		{"data/index.jsonc.gz", Options{}, Options{AllowComments: true, Gzip: true, IndexFilename: "index.jsonc.gz"}},
+		{"data/index.jsonc", Options{IndexFilename: "entry.json"}, Options{AllowComments: true, IndexFilename: "entry.json"}},
+		{"data/index.jsonc", Options{DisableFormatDetection: true}, Options{DisableFormatDetection: true}},
+		{"data/index.yaml", Options{}, Options{}},
+	}
+	for _, test := range tests {
+		if got := detectFormat(test.entryFilename, test.opts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.entryFilename, got, test.want)
+		}
+	}
+}
+
+func TestUnmarshalDetectedFormat(t *testing.T) {
+	const (
+		world  = "{\n\t// The name of the world\n\t\"name\": \"world\",\n}"
+		goblin = "{\"hp\": 1 /* full health */}"
+	)
+	want := decodeTestWorld{Name: "world", Creatures: map[string]*decodeTestCreature{"goblin": {HP: 1}}}
+	tests := []struct {
+		name          string
+		entryFilename string
+		fsys          fstest.MapFS
+		opts          Options
+		wantErr       string
+	}{
+		{
+			name:          "jsonc",
+			entryFilename: "index.jsonc",
+			fsys: fstest.MapFS{
+				"index.jsonc":                  {Data: []byte(world)},
+				"creatures/goblin/index.jsonc": {Data: []byte(goblin)},
+			},
+		},
+		{
+			name:          "gz",
+			entryFilename: "index.json.gz",
+			fsys: fstest.MapFS{
+				"index.json.gz":                  {Data: gzipData(t, `{"name": "world"}`)},
+				"creatures/goblin/index.json.gz": {Data: gzipData(t, `{"hp": 1}`)},
+			},
+		},
+		{
+			name:          "jsonc gz",
+			entryFilename: "index.jsonc.gz",
+			fsys: fstest.MapFS{
+				"index.jsonc.gz":                  {Data: gzipData(t, world)},
+				"creatures/goblin/index.jsonc.gz": {Data: gzipData(t, goblin)},
+			},
+		},
+		{
+			name:          "disabled",
+			entryFilename: "index.jsonc",
+			fsys: fstest.MapFS{
+				"index.jsonc": {Data: []byte(world)},
+			},
+			opts:    Options{DisableFormatDetection: true},
+			wantErr: "invalid character '/'",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out decodeTestWorld
+			err := UnmarshalFS(test.fsys, test.entryFilename, &out, test.opts)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, want) {
+				t.Errorf("got %+v, want %+v", out, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package dfjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// indentCompactArrays is like json.Indent but arrays that only hold scalar
+// values are kept on a single line, ie. [1, 2, 3], if that line is no longer
+// than width bytes.
+//
+// If alignObjects is set, arrays of objects that all have the same keys
+// holding scalar values are written with an object per line and the values
+// padded to line up in columns.
+func indentCompactArrays(dst *bytes.Buffer, src []byte, prefix, indent string, width int, alignObjects bool) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, src); err != nil {
+		return err
+	}
+	indentCompact(dst, compact.Bytes(), prefix, indent, width, alignObjects)
+	return nil
+}
+
+// indentCompact is like indentCompactArrays but src must already be compact
+func indentCompact(dst *bytes.Buffer, src []byte, prefix, indent string, width int, alignObjects bool) {
+	depth := 0
+	newline := func() {
+		dst.WriteByte('\n')
+		dst.WriteString(prefix)
+		for i := 0; i < depth; i++ {
+			dst.WriteString(indent)
+		}
+	}
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch c {
+		case '"':
+			end := stringEnd(src, i)
+			dst.Write(src[i:end])
+			i = end - 1
+		case '[', '{':
+			if c == '[' && alignObjects {
+				if rows, end := objectArrayRows(src, i); end != -1 {
+					dst.WriteByte('[')
+					depth++
+					for j, row := range rows {
+						newline()
+						dst.Write(row)
+						if j < len(rows)-1 {
+							dst.WriteByte(',')
+						}
+					}
+					depth--
+					newline()
+					dst.WriteByte(']')
+					i = end
+					continue
+				}
+			}
+			if c == '[' && width > 0 {
+				if end := scalarArrayEnd(src, i); end != -1 {
+					if line := inlineArray(src[i : end+1]); len(line) <= width {
+						dst.Write(line)
+						i = end
+						continue
+					}
+				}
+			}
+			dst.WriteByte(c)
+			if next := src[i+1]; next == ']' || next == '}' {
+				// Keep empty arrays and objects compact like json.Indent
+				dst.WriteByte(next)
+				i++
+				continue
+			}
+			depth++
+			newline()
+		case ']', '}':
+			depth--
+			newline()
+			dst.WriteByte(c)
+		case ',':
+			dst.WriteByte(c)
+			newline()
+		case ':':
+			dst.WriteString(": ")
+		default:
+			dst.WriteByte(c)
+		}
+	}
+}
+
+// stringEnd returns the index just after the end of the string
+// that starts at src[start] in compact JSON
+func stringEnd(src []byte, start int) int {
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+// scalarArrayEnd returns the index of the closing bracket of the array that
+// starts at src[start] in compact JSON, or -1 if the array is empty or holds
+// objects or arrays.
+func scalarArrayEnd(src []byte, start int) int {
+	if src[start+1] == ']' {
+		return -1
+	}
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case '"':
+			i = stringEnd(src, i) - 1
+		case '[', '{':
+			return -1
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// objectArrayRows returns each object of the array that starts at src[start]
+// in compact JSON on a single line, with values padded so that they line up,
+// and the index of the closing bracket of the array. It returns -1 if the
+// array is empty or any of its elements isn't an object with the same keys
+// in the same order as the first, holding only scalar values.
+func objectArrayRows(src []byte, start int) ([][]byte, int) {
+	// cells[row][column] is `"key": value`
+	var cells [][][]byte
+	i := start + 1
+	for {
+		if i >= len(src) || src[i] != '{' || src[i+1] == '}' {
+			return nil, -1
+		}
+		i++
+		var row [][]byte
+		for {
+			cellStart := i
+			if src[i] != '"' {
+				return nil, -1
+			}
+			keyEnd := stringEnd(src, i)
+			if keyEnd >= len(src) || src[keyEnd] != ':' {
+				return nil, -1
+			}
+			i = keyEnd + 1
+			valueStart := i
+			if i < len(src) && src[i] == '"' {
+				i = stringEnd(src, i)
+			} else {
+				for i < len(src) && src[i] != ',' && src[i] != '}' {
+					if src[i] == '[' || src[i] == '{' {
+						return nil, -1
+					}
+					i++
+				}
+			}
+			if i >= len(src) {
+				return nil, -1
+			}
+			cell := make([]byte, 0, i-cellStart+1)
+			cell = append(cell, src[cellStart:keyEnd]...)
+			cell = append(cell, ": "...)
+			cell = append(cell, src[valueStart:i]...)
+			row = append(row, cell)
+			if src[i] == '}' {
+				i++
+				break
+			}
+			i++
+		}
+		if len(cells) > 0 {
+			first := cells[0]
+			if len(row) != len(first) {
+				return nil, -1
+			}
+			for j := range row {
+				if !bytes.Equal(cellKey(row[j]), cellKey(first[j])) {
+					return nil, -1
+				}
+			}
+		}
+		cells = append(cells, row)
+		if i >= len(src) {
+			return nil, -1
+		}
+		if src[i] == ']' {
+			break
+		}
+		if src[i] != ',' {
+			return nil, -1
+		}
+		i++
+	}
+
+	// Pad every column but the last to the width of its widest cell
+	widths := make([]int, len(cells[0]))
+	for _, row := range cells {
+		for j, cell := range row {
+			if n := utf8.RuneCount(cell); n > widths[j] {
+				widths[j] = n
+			}
+		}
+	}
+	rows := make([][]byte, len(cells))
+	for r, row := range cells {
+		line := []byte{'{'}
+		for j, cell := range row {
+			line = append(line, cell...)
+			if j < len(row)-1 {
+				line = append(line, ',')
+				line = append(line, bytes.Repeat([]byte{' '}, widths[j]-utf8.RuneCount(cell)+1)...)
+			}
+		}
+		rows[r] = append(line, '}')
+	}
+	return rows, i
+}
+
+// cellKey returns the quoted key of a cell returned by objectArrayRows
+func cellKey(cell []byte) []byte {
+	return cell[:stringEnd(cell, 0)]
+}
+
+// inlineArray returns the compact JSON array in src with
+// a space after each comma, ie. [1, 2, 3]
+func inlineArray(src []byte) []byte {
+	line := make([]byte, 0, len(src)+len(src)/2)
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"':
+			end := stringEnd(src, i)
+			line = append(line, src[i:end]...)
+			i = end - 1
+		case ',':
+			line = append(line, ", "...)
+		default:
+			line = append(line, c)
+		}
+	}
+	return line
+}
@@ -0,0 +1,193 @@
+package dfjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestIndentCompactArrays(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		width int
+		want  string
+	}{
+		{
+			name:  "short scalar array",
+			src:   `{"a": [1, 2, 3]}`,
+			width: 20,
+			want:  "{\n\t\"a\": [1, 2, 3]\n}",
+		},
+		{
+			name:  "mixed scalars",
+			src:   `[true, null, "x", 1.5]`,
+			width: 30,
+			want:  `[true, null, "x", 1.5]`,
+		},
+		{
+			name:  "strings holding brackets and commas",
+			src:   `["[a, b]", "{}"]`,
+			width: 30,
+			want:  `["[a, b]", "{}"]`,
+		},
+		{
+			name:  "exactly the width",
+			src:   `[1,2,3]`,
+			width: len(`[1, 2, 3]`),
+			want:  `[1, 2, 3]`,
+		},
+		{
+			name:  "longer than the width",
+			src:   `[1,2,3]`,
+			width: len(`[1, 2, 3]`) - 1,
+			want:  "[\n\t1,\n\t2,\n\t3\n]",
+		},
+		{
+			name:  "array of objects",
+			src:   `[{"a": 1}]`,
+			width: 30,
+			want:  "[\n\t{\n\t\t\"a\": 1\n\t}\n]",
+		},
+		{
+			name:  "array of arrays",
+			src:   `[[1], [2]]`,
+			width: 30,
+			want:  "[\n\t[1],\n\t[2]\n]",
+		},
+		{
+			name:  "empty array",
+			src:   `{"a": []}`,
+			width: 30,
+			want:  "{\n\t\"a\": []\n}",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := indentCompactArrays(&buf, []byte(test.src), "", "\t", test.width, false); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+type indentTestValues struct {
+	Values []int `json:"values"`
+}
+
+func TestCompactArrayWidth(t *testing.T) {
+	in := &struct {
+		Small []int                        `json:"small"`
+		Large []int                        `json:"large"`
+		Items map[string]*indentTestValues `json:"items" dfjson:"distributable"`
+		Pairs []encodeTestCreature         `json:"pairs"`
+	}{
+		Small: []int{1, 2, 3},
+		Large: []int{100000, 200000, 300000},
+		Items: map[string]*indentTestValues{"a": {Values: []int{4, 5}}},
+		Pairs: []encodeTestCreature{{"a", 1}},
+	}
+	files, err := MarshalWithOptions("index.json", in, Options{CompactArrayWidth: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"index.json":         "{\n\t\"small\": [1, 2, 3],\n\t\"large\": [\n\t\t100000,\n\t\t200000,\n\t\t300000\n\t],\n\t\"pairs\": [\n\t\t{\n\t\t\t\"name\": \"a\",\n\t\t\t\"hp\": 1\n\t\t}\n\t]\n}",
+		"items/a/index.json": "{\n\t\"values\": [4, 5]\n}",
+	}
+	if got := fileData(files); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIndentAlignObjectArrays(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "uniform objects",
+			src:  `[{"name":"Goblin","hp":12},{"name":"Orc Chief","hp":145}]`,
+			want: "[\n\t{\"name\": \"Goblin\",    \"hp\": 12},\n\t{\"name\": \"Orc Chief\", \"hp\": 145}\n]",
+		},
+		{
+			name: "within an object",
+			src:  `{"rows":[{"a":1,"b":true},{"a":100,"b":null}]}`,
+			want: "{\n\t\"rows\": [\n\t\t{\"a\": 1,   \"b\": true},\n\t\t{\"a\": 100, \"b\": null}\n\t]\n}",
+		},
+		{
+			name: "multi-byte characters",
+			src:  `[{"k":"ü","v":1},{"k":"ab","v":2}]`,
+			want: "[\n\t{\"k\": \"ü\",  \"v\": 1},\n\t{\"k\": \"ab\", \"v\": 2}\n]",
+		},
+		{
+			name: "strings holding delimiters",
+			src:  `[{"k":"a,}","v":1},{"k":"[\"","v":2}]`,
+			want: "[\n\t{\"k\": \"a,}\", \"v\": 1},\n\t{\"k\": \"[\\\"\", \"v\": 2}\n]",
+		},
+		{
+			name: "different keys",
+			src:  `[{"a":1},{"b":2}]`,
+			want: "[\n\t{\n\t\t\"a\": 1\n\t},\n\t{\n\t\t\"b\": 2\n\t}\n]",
+		},
+		{
+			name: "keys in a different order",
+			src:  `[{"a":1,"b":2},{"b":2,"a":1}]`,
+			want: "[\n\t{\n\t\t\"a\": 1,\n\t\t\"b\": 2\n\t},\n\t{\n\t\t\"b\": 2,\n\t\t\"a\": 1\n\t}\n]",
+		},
+		{
+			name: "nested values",
+			src:  `[{"a":[1]},{"a":[2]}]`,
+			want: "[\n\t{\n\t\t\"a\": [\n\t\t\t1\n\t\t]\n\t},\n\t{\n\t\t\"a\": [\n\t\t\t2\n\t\t]\n\t}\n]",
+		},
+		{
+			name: "empty object",
+			src:  `[{}]`,
+			want: "[\n\t{}\n]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := indentCompactArrays(&buf, []byte(test.src), "", "\t", 0, true); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			// The output is still the same JSON value
+			var got, want interface{}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.src), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAlignObjectArrays(t *testing.T) {
+	in := &struct {
+		Rows []encodeTestCreature `json:"rows"`
+	}{
+		Rows: []encodeTestCreature{{"Goblin", 12}, {"Orc", 145}},
+	}
+	files, err := MarshalWithOptions("index.json", in, Options{AlignObjectArrays: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n\t\"rows\": [\n\t\t{\"name\": \"Goblin\", \"hp\": 12},\n\t\t{\"name\": \"Orc\",    \"hp\": 145}\n\t]\n}"
+	if got := fileData(files)["index.json"]; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,38 @@
+package dfjson
+
+import (
+	"reflect"
+)
+
+// internStrings walks v and replaces every string it can set with a
+// previously seen equal string so that they share backing memory.
+func internStrings(v interface{}) {
+	canonicalStrings := make(map[string]string)
+	canonical := func(s string) string {
+		if existing, ok := canonicalStrings[s]; ok {
+			return existing
+		}
+		canonicalStrings[s] = s
+		return s
+	}
+	w := valueWalker{
+		visit: func(v reflect.Value) error {
+			if v.Kind() == reflect.String {
+				v.SetString(canonical(v.String()))
+			}
+			return nil
+		},
+		visitKey: func(key reflect.Value) reflect.Value {
+			if key.Kind() != reflect.String {
+				return key
+			}
+			// Assigning with an equal key replaces the stored key,
+			// so the canonical string is what the map keeps.
+			canonicalKey := reflect.New(key.Type()).Elem()
+			canonicalKey.SetString(canonical(key.String()))
+			return canonicalKey
+		},
+	}
+	// visit never returns an error
+	_ = w.walk(reflect.ValueOf(v))
+}
@@ -0,0 +1,137 @@
+package dfjson
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+type internTestEntity struct {
+	Tag   string            `json:"tag"`
+	Tags  []string          `json:"tags"`
+	Props map[string]string `json:"props"`
+	Any   interface{}       `json:"any"`
+}
+
+type internTestWorld struct {
+	Entities map[string]*internTestEntity `json:"entities" dfjson:"distributable"`
+}
+
+// internTestString is the string that's repeated throughout the test data
+const internTestString = "a category shared by many of the entities"
+
+// newInternTestWorld returns n entities that each hold their own copies of
+// internTestString, like encoding/json returns when decoding separate documents
+func newInternTestWorld(n int) *internTestWorld {
+	world := &internTestWorld{Entities: make(map[string]*internTestEntity, n)}
+	copyString := func() string {
+		return string([]byte(internTestString))
+	}
+	for i := 0; i < n; i++ {
+		world.Entities[strconv.Itoa(i)] = &internTestEntity{
+			Tag:   copyString(),
+			Tags:  []string{"unique" + strconv.Itoa(i), copyString()},
+			Props: map[string]string{copyString(): copyString()},
+			Any:   []interface{}{copyString()},
+		}
+	}
+	return world
+}
+
+// stringData returns the address of the bytes of s
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestInternStrings(t *testing.T) {
+	tests := []struct {
+		name    string
+		strings func(entity *internTestEntity) []string
+	}{
+		{"field", func(entity *internTestEntity) []string {
+			return []string{entity.Tag}
+		}},
+		{"slice element", func(entity *internTestEntity) []string {
+			return []string{entity.Tags[1]}
+		}},
+		{"map key and value", func(entity *internTestEntity) []string {
+			var strings []string
+			for key, value := range entity.Props {
+				strings = append(strings, key, value)
+			}
+			return strings
+		}},
+		{"interface", func(entity *internTestEntity) []string {
+			return []string{entity.Any.([]interface{})[0].(string)}
+		}},
+	}
+	world := newInternTestWorld(20)
+	internStrings(world)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addrs := make(map[uintptr]bool)
+			for _, entity := range world.Entities {
+				for _, s := range test.strings(entity) {
+					addrs[stringData(s)] = true
+				}
+			}
+			if len(addrs) != 1 {
+				t.Errorf("got %d distinct copies of the string, want 1", len(addrs))
+			}
+		})
+	}
+	unique := make(map[uintptr]bool)
+	for _, entity := range world.Entities {
+		unique[stringData(entity.Tags[0])] = true
+	}
+	if len(unique) != len(world.Entities) {
+		t.Errorf("got %d copies of unique strings, want %d", len(unique), len(world.Entities))
+	}
+}
+
+func TestUnmarshalInternStrings(t *testing.T) {
+	files, err := Marshal("index.json", newInternTestWorld(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out internTestWorld
+	if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{InternStrings: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&out, newInternTestWorld(20)) {
+		t.Fatal("decoded value differs from the encoded one")
+	}
+	addrs := make(map[uintptr]bool)
+	for _, entity := range out.Entities {
+		addrs[stringData(entity.Tag)] = true
+		addrs[stringData(entity.Tags[1])] = true
+	}
+	if len(addrs) != 1 {
+		t.Errorf("got %d distinct copies of the string, want 1", len(addrs))
+	}
+}
+
+func BenchmarkInternStrings(b *testing.B) {
+	for _, isInterned := range []bool{false, true} {
+		b.Run("intern="+strconv.FormatBool(isInterned), func(b *testing.B) {
+			b.ReportAllocs()
+			var retained uint64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				world := newInternTestWorld(2000)
+				if isInterned {
+					internStrings(world)
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(world)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Package gittest creates Git repositories stopped on merge conflicts, for
+// testing the drivers that read the sides of conflicted files from them.
+package gittest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// Repo creates a git repository in a temporary directory and
+// changes into it, skipping the test if git isn't installed
+func Repo(t testing.TB) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+	Git(t, "init", "-q", "-b", "main")
+	Git(t, "config", "user.email", "test@example.com")
+	Git(t, "config", "user.name", "test")
+	Git(t, "config", "commit.gpgsign", "false")
+	return dir
+}
+
+// Git runs git in the working directory and returns its output
+func Git(t testing.TB, arguments ...string) string {
+	t.Helper()
+	output, err := exec.Command("git", arguments...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(arguments, " "), err, output)
+	}
+	return string(output)
+}
+
+// GitMayFail is like Git but ignores the exit code, ie. of a conflicting merge
+func GitMayFail(t testing.TB, arguments ...string) {
+	t.Helper()
+	exec.Command("git", arguments...).Run()
+}
+
+// TopPath returns the absolute slash-separated path of the
+// repository in the working directory
+func TopPath(t testing.TB) string {
+	t.Helper()
+	return strings.TrimSpace(Git(t, "rev-parse", "--show-toplevel"))
+}
+
+// WriteFile writes data to path, creating its directory if needed
+func WriteFile(t testing.TB, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ConflictedRepo creates a repository stopped on a merge of the "other"
+// branch into "main" where n files conflict, alongside an index.json
+// that merged cleanly. It returns the absolute slash-separated paths of
+// index.json and of the conflicted files, whose sides each hold
+// {"side":"ours"}, {"side":"theirs"} and {"side":"base"}.
+func ConflictedRepo(t testing.TB, n int) (clean string, conflicted []string) {
+	t.Helper()
+	dir := Repo(t)
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, "creatures/c"+strconv.Itoa(i)+"/index.json")
+	}
+	setFiles := func(side string) {
+		for _, name := range names {
+			WriteFile(t, filepath.Join(dir, filepath.FromSlash(name)), `{"side":"`+side+`"}`)
+		}
+	}
+	setFiles("base")
+	WriteFile(t, filepath.Join(dir, "index.json"), `{"name":"base"}`)
+	Git(t, "add", ".")
+	Git(t, "commit", "-q", "-m", "base")
+	Git(t, "checkout", "-q", "-b", "other")
+	setFiles("theirs")
+	WriteFile(t, filepath.Join(dir, "index.json"), `{"name":"theirs"}`)
+	Git(t, "commit", "-q", "-am", "other")
+	Git(t, "checkout", "-q", "main")
+	setFiles("ours")
+	Git(t, "commit", "-q", "-am", "main")
+	GitMayFail(t, "merge", "-q", "other")
+
+	topPath := TopPath(t)
+	conflicted = make([]string, len(names))
+	for i, name := range names {
+		conflicted[i] = topPath + "/" + name
+	}
+	return topPath + "/index.json", conflicted
+}
+
+// ReadSides reads path with driver, returning each side that it wrote
+func ReadSides(t testing.TB, driver dfvcs.SidesDriver, path string) (map[string]string, bool) {
+	t.Helper()
+	sides := map[string]*bytes.Buffer{
+		dfvcs.SideOurs:   new(bytes.Buffer),
+		dfvcs.SideTheirs: new(bytes.Buffer),
+		dfvcs.SideBase:   new(bytes.Buffer),
+	}
+	hasFile, err := driver.HandleFileSides(context.Background(), path, sides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string, len(sides))
+	for side, buf := range sides {
+		result[side] = buf.String()
+	}
+	return result, hasFile
+}
@@ -0,0 +1,254 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// keysFilename is the file written next to the directories of a map
+// when some keys had to be renamed, it maps directory names back to
+// their original keys.
+const keysFilename = "_keys.json"
+
+// KeyPolicy controls how map keys that can't be used as a directory name
+// as-is are handled when encoding. A key is problematic if it's not a valid
+// directory name (ie. "../etc" or "a/b"), is reserved (ie. ".git", the index
+// filename or a device name on Windows such as "con"), isn't valid UTF-8 or
+// would be written to the same directory as another key.
+//
+// Renamed keys that aren't valid UTF-8 decode with invalid bytes replaced by
+// U+FFFD, as with any other string encoded by encoding/json.
+type KeyPolicy int
+
+const (
+	// KeyPolicyDefault escapes keys with PercentKeyEscaper, unless
+	// Options.KeyEscaper is set, and returns an error naming the first
+	// key that's still problematic, ie. keys that only differ by case.
+	KeyPolicyDefault KeyPolicy = iota
+
+	// KeyPolicyError returns an error naming the first problematic key
+	// without escaping keys first, unless Options.KeyEscaper is set
+	KeyPolicyError
+
+	// KeyPolicyEscape percent-encodes the characters that make a key
+	// problematic, ie. "a/b" is written to "a%2Fb". Keys that still collide
+	// after escaping get a numeric suffix as with KeyPolicySuffix.
+	KeyPolicyEscape
+
+	// KeyPolicySuffix replaces the characters that make a key problematic
+	// with an underscore and appends a numeric suffix if that collides with
+	// another key, ie. "name", "name_2".
+	KeyPolicySuffix
+)
+
+// isRenamingKeys reports whether KeyPolicy renames problematic keys
+// and records them in a "_keys.json" file
+func (opts *Options) isRenamingKeys() bool {
+	return opts.KeyPolicy == KeyPolicyEscape || opts.KeyPolicy == KeyPolicySuffix
+}
+
+// windowsDeviceNames can't be used as file names on Windows, even with an extension
+var windowsDeviceNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// mapDirNames returns the directory name to use for each key, keys must be sorted.
+//
+// Problematic keys (see KeyPolicy) are an error unless Options.KeyPolicy says
+// otherwise, in which case they're renamed. Keys are compared case-insensitively
+// as Windows and macOS filesystems are case-insensitive. Decoding with the same
+// KeyPolicy restores the renamed keys from the "_keys.json" file.
+func (state *encodeState) mapDirNames(keys []string) ([]string, error) {
+	dirNames := make([]string, len(keys))
+	used := make(map[string]string, len(keys))
+	var renamed []int
+	for i, key := range keys {
+		err := state.checkKey(key)
+		if err == nil {
+			if existing, ok := used[strings.ToLower(key)]; ok {
+				err = fmt.Errorf("map keys %q and %q would be written to the same directory", existing, key)
+			}
+		}
+		if err != nil {
+			if !state.opts.isRenamingKeys() {
+				return nil, err
+			}
+			renamed = append(renamed, i)
+			continue
+		}
+		used[strings.ToLower(key)] = key
+		dirNames[i] = key
+	}
+	// Renamed keys are assigned after every other key has claimed its
+	// name so that a renamed key never takes the name of another key
+	for _, i := range renamed {
+		base := state.sanitizeKey(keys[i])
+		for n := 1; ; n++ {
+			dirName := base
+			if n > 1 {
+				dirName += "_" + strconv.Itoa(n)
+			}
+			folded := strings.ToLower(dirName)
+			if _, ok := used[folded]; ok || state.checkKey(dirName) != nil {
+				continue
+			}
+			used[folded] = keys[i]
+			dirNames[i] = dirName
+			break
+		}
+	}
+	return dirNames, nil
+}
+
+// checkKey returns an error if key can't be used as a directory name as-is
+func (state *encodeState) checkKey(key string) error {
+	if err := checkDirName(key); err != nil {
+		return fmt.Errorf("map key %q: %w", key, err)
+	}
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("map key %q is not valid UTF-8", key)
+	}
+	name := strings.ToLower(key)
+	if isHiddenDir(name) || name == strings.ToLower(state.opts.indexFilename()) || name == keysFilename || name == orderFilename {
+		return fmt.Errorf("map key %q is a reserved name", key)
+	}
+	if i := strings.IndexByte(name, '.'); i != -1 {
+		name = name[:i]
+	}
+	if windowsDeviceNames[name] {
+		return fmt.Errorf("map key %q is a reserved name on Windows", key)
+	}
+	return nil
+}
+
+// sanitizeKey returns key with the characters that make it
+// problematic escaped or replaced, depending on the KeyPolicy
+func (state *encodeState) sanitizeKey(key string) string {
+	var b strings.Builder
+	replace := func(c byte) {
+		if state.opts.KeyPolicy == KeyPolicyEscape {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	for i := 0; i < len(key); {
+		r, size := utf8.DecodeRuneInString(key[i:])
+		switch {
+		case r == utf8.RuneError && size == 1,
+			r == '/', r == '\\', r < 0x20,
+			i == 0 && r == '.':
+			replace(key[i])
+		case r == '%' && state.opts.KeyPolicy == KeyPolicyEscape:
+			// Escape the escape character so escaped names can't be
+			// mistaken for another key
+			replace(key[i])
+		default:
+			b.WriteString(key[i : i+size])
+		}
+		i += size
+	}
+	if b.Len() == 0 {
+		// An empty key
+		b.WriteByte('_')
+	}
+	name := b.String()
+	if state.checkKey(name) != nil {
+		// Reserved names, ie. "con"
+		name = "_" + name
+	}
+	return name
+}
+
+// checkDirName returns an error if name can't be used as the name of a single
+// directory within its parent, ie. "../../etc" or "/abs" would resolve to a
+// path outside of the tree.
+func checkDirName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("directory name must not be empty")
+	case name == "." || name == "..":
+		return errors.New("directory name must not be \".\" or \"..\"")
+	case strings.ContainsAny(name, "/\\\x00"):
+		return errors.New("directory name must not contain a path separator")
+	case filepath.IsAbs(name) || filepath.VolumeName(name) != "":
+		return errors.New("directory name must not be an absolute path")
+	}
+	return nil
+}
+
+// readKeysFile reads the directory name to original key mapping
+// written by encode, if the file exists.
+func (state *decodeState) readKeysFile(path string) (map[string]string, error) {
+	f, err := state.source.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := state.countBytes(path, int64(len(data))); err != nil {
+		return nil, err
+	}
+	var renamedKeys map[string]string
+	if err := json.Unmarshal(data, &renamedKeys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return renamedKeys, nil
+}
+
+// KeyCase is a policy for canonicalizing the case of directory names when
+// decoding them into the keys of a map. Keys restored from a "_keys.json"
+// file are left as-is.
+type KeyCase int
+
+const (
+	// KeyCasePreserve uses directory names as-is
+	KeyCasePreserve KeyCase = iota
+
+	// KeyCaseLower lowercases directory names
+	KeyCaseLower
+
+	// KeyCaseUpper uppercases directory names
+	KeyCaseUpper
+)
+
+// canonicalKey returns the key that the directory called name decodes to
+// within a value of type t
+func (opts *Options) canonicalKey(t reflect.Type, name string) string {
+	if opts.KeyCase == KeyCasePreserve {
+		return name
+	}
+	// Struct fields already match case-insensitively, so use the name
+	// of the field to detect directories that differ only by case
+	if f, ok := structField(t, name); ok {
+		return f.name
+	}
+	if t = derefType(t); t == nil || t.Kind() != reflect.Map {
+		return name
+	}
+	switch opts.KeyCase {
+	case KeyCaseLower:
+		return strings.ToLower(name)
+	case KeyCaseUpper:
+		return strings.ToUpper(name)
+	}
+	return name
+}
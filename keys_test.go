@@ -0,0 +1,349 @@
+package dfjson
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// filesFS returns the encoded files as a filesystem that can be decoded with UnmarshalFS
+func filesFS(files []JSONFile) fstest.MapFS {
+	fsys := make(fstest.MapFS, len(files))
+	for _, file := range files {
+		fsys[file.Path] = &fstest.MapFile{Data: file.Data}
+	}
+	return fsys
+}
+
+// filePaths returns the paths of the encoded files
+func filePaths(files []JSONFile) []string {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+	return paths
+}
+
+type keysTestValue struct {
+	Items map[string]int `dfjson:"distributable"`
+}
+
+func TestMapKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		opts    Options
+		dirs    []string
+		wantErr string
+	}{
+		{
+			name: "default escapes",
+			keys: []string{"a/b", "c:d", "100%"},
+			dirs: []string{"100%25", "a%2Fb", "c%3Ad"},
+		},
+		{
+			name: "default errors on case collision",
+			keys: []string{"Name", "name"},
+			// Both keys are escaped but still collide
+			wantErr: `map keys "Name" and "name" would be written to the same directory`,
+		},
+		{
+			name:    "error policy",
+			keys:    []string{"a/b"},
+			opts:    Options{KeyPolicy: KeyPolicyError},
+			wantErr: `map key "a/b": directory name must not contain a path separator`,
+		},
+		{
+			name:    "error policy rejects traversal",
+			keys:    []string{".."},
+			opts:    Options{KeyPolicy: KeyPolicyError},
+			wantErr: `map key "..": directory name must not be "." or ".."`,
+		},
+		{
+			name: "default escapes traversal",
+			keys: []string{"../../etc", "/abs", ".."},
+			dirs: []string{"%2E%2E", "%2E.%2F..%2Fetc", "%2Fabs"},
+		},
+		{
+			name:    "error policy rejects parent directories",
+			keys:    []string{"../../etc"},
+			opts:    Options{KeyPolicy: KeyPolicyError},
+			wantErr: `map key "../../etc": directory name must not contain a path separator`,
+		},
+		{
+			name:    "error policy rejects absolute paths",
+			keys:    []string{"/abs"},
+			opts:    Options{KeyPolicy: KeyPolicyError},
+			wantErr: `map key "/abs": directory name must not contain a path separator`,
+		},
+		{
+			name: "error policy with escaper",
+			keys: []string{"a/b"},
+			opts: Options{KeyPolicy: KeyPolicyError, KeyEscaper: PercentKeyEscaper},
+			dirs: []string{"a%2Fb"},
+		},
+		{
+			name: "escape policy",
+			keys: []string{"a/b", "..", "con"},
+			opts: Options{KeyPolicy: KeyPolicyEscape},
+			dirs: []string{"%2E.", "_con", "a%2Fb"},
+		},
+		{
+			name: "suffix policy",
+			keys: []string{"a/b", "a_b", "Name", "name"},
+			opts: Options{KeyPolicy: KeyPolicySuffix},
+			dirs: []string{"Name", "a_b", "a_b_2", "name_2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := keysTestValue{Items: make(map[string]int)}
+			for i, key := range test.keys {
+				in.Items[key] = i + 1
+			}
+			files, err := MarshalWithOptions("index.json", &in, test.opts)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, dir := range test.dirs {
+				if _, ok := filesFS(files)["Items/"+dir+"/index.json"]; !ok {
+					t.Errorf("missing directory %q in %q", dir, filePaths(files))
+				}
+			}
+			var out keysTestValue
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, in) {
+				t.Errorf("got %v, want %v", out, in)
+			}
+		})
+	}
+}
+
+func TestKeysFile(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		opts Options
+		want string
+	}{
+		{
+			name: "suffix",
+			keys: []string{"a/b", "a\\b", "a_b", "A_B"},
+			opts: Options{KeyPolicy: KeyPolicySuffix},
+			// "A_B" sorts first so keeps its name, the rest are
+			// renamed in sorted order
+			want: "{\n\t\"a_b_2\": \"a/b\",\n\t\"a_b_3\": \"a\\\\b\",\n\t\"a_b_4\": \"a_b\"\n}",
+		},
+		{
+			name: "escape",
+			keys: []string{"x", "X"},
+			opts: Options{KeyPolicy: KeyPolicyEscape},
+			want: "{\n\t\"x_2\": \"x\"\n}",
+		},
+		{
+			name: "nothing renamed",
+			keys: []string{"a", "b"},
+			opts: Options{KeyPolicy: KeyPolicySuffix},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := keysTestValue{Items: make(map[string]int)}
+			for i, key := range test.keys {
+				in.Items[key] = i + 1
+			}
+			files, err := MarshalWithOptions("index.json", &in, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileData(files)["Items/"+keysFilename]; got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			var out keysTestValue
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, in) {
+				t.Errorf("got %v, want %v", out, in)
+			}
+		})
+	}
+}
+
+func TestCheckDirName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"goblin", ""},
+		{"%2E.", ""},
+		{"", "directory name must not be empty"},
+		{".", `directory name must not be "." or ".."`},
+		{"..", `directory name must not be "." or ".."`},
+		{"../../etc", "directory name must not contain a path separator"},
+		{"/abs", "directory name must not contain a path separator"},
+		{`..\etc`, "directory name must not contain a path separator"},
+		{"a\x00b", "directory name must not contain a path separator"},
+	}
+	for _, test := range tests {
+		err := checkDirName(test.name)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: got error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.wantErr {
+			t.Errorf("%q: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestKeyPolicies(t *testing.T) {
+	// A key of each problematic kind: empty, path-unsafe, reserved,
+	// not valid UTF-8 and colliding
+	keys := []string{"", "a/b", "..", ".git", "index.json", "_keys.json", "con", "\xff", "Name", "name"}
+	tests := []struct {
+		name    string
+		policy  KeyPolicy
+		dirs    []string
+		wantErr string
+	}{
+		{
+			name:    "default",
+			policy:  KeyPolicyDefault,
+			wantErr: `Items: map key "": directory name must not be empty`,
+		},
+		{
+			name:    "error",
+			policy:  KeyPolicyError,
+			wantErr: `Items: map key "": directory name must not be empty`,
+		},
+		{
+			name:   "escape",
+			policy: KeyPolicyEscape,
+			dirs:   []string{"%2E.", "%2Egit", "%FF", "Name", "_", "__keys.json", "_con", "_index.json", "a%2Fb", "name_2"},
+		},
+		{
+			name:   "suffix",
+			policy: KeyPolicySuffix,
+			dirs:   []string{"Name", "_", "_.", "__2", "__keys.json", "_con", "_git", "_index.json", "a_b", "name_2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := keysTestValue{Items: make(map[string]int)}
+			for i, key := range keys {
+				in.Items[key] = i
+			}
+			opts := Options{KeyPolicy: test.policy}
+			files, err := MarshalWithOptions("index.json", &in, opts)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dirs []string
+			for _, path := range filePaths(files) {
+				if strings.HasPrefix(path, "Items/") && strings.HasSuffix(path, "/index.json") {
+					dirs = append(dirs, strings.TrimSuffix(strings.TrimPrefix(path, "Items/"), "/index.json"))
+				}
+			}
+			sort.Strings(dirs)
+			if !reflect.DeepEqual(dirs, test.dirs) {
+				t.Errorf("got directories %q, want %q", dirs, test.dirs)
+			}
+
+			var out keysTestValue
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			// As with encoding/json, invalid UTF-8 is replaced
+			in.Items["�"] = in.Items["\xff"]
+			delete(in.Items, "\xff")
+			if !reflect.DeepEqual(out, in) {
+				t.Errorf("got %q, want %q", out.Items, in.Items)
+			}
+		})
+	}
+}
+
+func TestKeyCase(t *testing.T) {
+	tests := []struct {
+		name string
+		// dirs are the directories of the creatures on disk
+		dirs     []string
+		keyCase  KeyCase
+		wantKeys []string
+		wantErr  string
+	}{
+		{
+			name:     "preserve",
+			dirs:     []string{"Goblin", "orc"},
+			keyCase:  KeyCasePreserve,
+			wantKeys: []string{"Goblin", "orc"},
+		},
+		{
+			name:     "lower",
+			dirs:     []string{"Goblin", "ORC"},
+			keyCase:  KeyCaseLower,
+			wantKeys: []string{"goblin", "orc"},
+		},
+		{
+			name:     "upper",
+			dirs:     []string{"Goblin", "orc"},
+			keyCase:  KeyCaseUpper,
+			wantKeys: []string{"GOBLIN", "ORC"},
+		},
+		{
+			name:    "directories differing by case",
+			dirs:    []string{"Goblin", "goblin"},
+			keyCase: KeyCaseLower,
+			wantErr: `directories "Goblin" and "goblin" are both key "goblin"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The field directory is "Creatures" rather than "creatures"
+			fsys := fstest.MapFS{
+				"index.json": &fstest.MapFile{Data: []byte(`{"name": "world"}`)},
+			}
+			for i, dir := range test.dirs {
+				fsys["Creatures/"+dir+"/index.json"] = &fstest.MapFile{Data: []byte(`{"hp": ` + strconv.Itoa(i+1) + `}`)}
+			}
+			var out decodeTestWorld
+			err := UnmarshalFS(fsys, "index.json", &out, Options{KeyCase: test.keyCase})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &decodeTestWorld{Name: "world", Creatures: make(map[string]*decodeTestCreature)}
+			for i, key := range test.wantKeys {
+				want.Creatures[key] = &decodeTestCreature{HP: i + 1}
+			}
+			if !reflect.DeepEqual(&out, want) {
+				t.Errorf("got %+v, want %+v", out.Creatures, want.Creatures)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package dfjson
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// CheckLayout compares the layout that the type of v would be encoded with
+// against the files that were written into dir and returns a description of
+// each field whose distribution status no longer matches, ie. a field that
+// was made inline but still has a directory or a field that was made
+// distributable but is still defined inline in its parent's file.
+//
+// Data that's left in the old layout is either ignored or rejected when
+// decoding, so this is useful for detecting data that needs migrating after
+// changing which fields are tagged with "dfjson:distributable".
+func CheckLayout(dir, entryFilename string, v interface{}) ([]string, error) {
+	var problems []string
+	if err := checkLayout(&problems, dir, cleanPath(entryFilename), reflect.TypeOf(v)); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// checkLayout checks the file at path, relative to root, and the
+// directories next to it against type t.
+func checkLayout(problems *[]string, root, path string, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if isCustomMarshalerType(t) {
+		// Written as-is to a single file
+		return nil
+	}
+	dir := dirOf(path)
+	dirNames, err := layoutDirNames(filepath.Join(root, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		for _, name := range dirNames {
+			if err := checkLayout(problems, root, dir+"/"+name+"/"+defaultIndexFilename, t.Elem()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		// Check fields below
+	default:
+		return nil
+	}
+
+	var fileKeys map[string]bool
+	data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		fileKeys, err = objectKeys(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	hasDir := make(map[string]bool, len(dirNames))
+	for _, name := range dirNames {
+		hasDir[name] = true
+	}
+	for _, f := range typeFields(t) {
+		if !f.distributable {
+			if hasDir[f.name] {
+				*problems = append(*problems, fmt.Sprintf("%s/%s: field %s.%s is inline but is stored as a directory", dir, f.name, t.String(), f.goName))
+			}
+			continue
+		}
+		if fileKeys[f.name] {
+			*problems = append(*problems, fmt.Sprintf("%s: field %s.%s is distributable but is defined inline", path, t.String(), f.goName))
+		}
+		fieldDir := f.name
+		if f.group != "" {
+			fieldDir = f.group + "/" + f.name
+			if hasDir[f.name] {
+				*problems = append(*problems, fmt.Sprintf("%s/%s: field %s.%s is in group %q but is stored outside of it", dir, f.name, t.String(), f.goName, f.group))
+			}
+			info, err := os.Stat(longPath(filepath.Join(root, filepath.FromSlash(dir+"/"+fieldDir))))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err != nil || !info.IsDir() {
+				continue
+			}
+		} else if !hasDir[f.name] {
+			continue
+		}
+		if err := checkLayout(problems, root, dir+"/"+fieldDir+"/"+defaultIndexFilename, f.typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layoutDirNames returns the names of the directories within dir,
+// or nothing if dir does not exist.
+func layoutDirNames(dir string) ([]string, error) {
+	infos, err := os.ReadDir(longPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() && !isHiddenDir(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// isCustomMarshalerType reports whether values of type t, or pointers
+// to them, marshal themselves.
+func isCustomMarshalerType(t reflect.Type) bool {
+	ptrType := reflect.PtrTo(t)
+	return t.Implements(marshalerType) || t.Implements(textMarshalerType) ||
+		ptrType.Implements(marshalerType) || ptrType.Implements(textMarshalerType)
+}
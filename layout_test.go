@@ -0,0 +1,72 @@
+package dfjson
+
+import (
+	"reflect"
+	"testing"
+)
+
+type layoutTestStats struct {
+	Level int `json:"level"`
+}
+
+type layoutTestDistributed struct {
+	Name      string                      `json:"name"`
+	Stats     *layoutTestStats            `json:"stats" dfjson:"distributable"`
+	Creatures map[string]*layoutTestStats `json:"creatures" dfjson:"distributable"`
+}
+
+type layoutTestInline struct {
+	Name      string                      `json:"name"`
+	Stats     *layoutTestStats            `json:"stats"`
+	Creatures map[string]*layoutTestStats `json:"creatures" dfjson:"distributable"`
+}
+
+func TestCheckLayout(t *testing.T) {
+	stats := &layoutTestStats{Level: 1}
+	creatures := map[string]*layoutTestStats{"goblin": {Level: 2}}
+	tests := []struct {
+		name    string
+		written interface{}
+		v       interface{}
+		want    []string
+	}{
+		{
+			name:    "unchanged",
+			written: &layoutTestDistributed{Stats: stats, Creatures: creatures},
+			v:       &layoutTestDistributed{},
+		},
+		{
+			name:    "distributable to inline",
+			written: &layoutTestDistributed{Stats: stats, Creatures: creatures},
+			v:       &layoutTestInline{},
+			want:    []string{"data/stats: field dfjson.layoutTestInline.Stats is inline but is stored as a directory"},
+		},
+		{
+			name:    "inline to distributable",
+			written: &layoutTestInline{Stats: stats, Creatures: creatures},
+			v:       &layoutTestDistributed{},
+			want:    []string{"data/index.json: field dfjson.layoutTestDistributed.Stats is distributable but is defined inline"},
+		},
+		{
+			name:    "within a map",
+			written: map[string]*layoutTestInline{"a": {Stats: stats}},
+			v:       map[string]*layoutTestDistributed{},
+			want:    []string{"data/a/index.json: field dfjson.layoutTestDistributed.Stats is distributable but is defined inline"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := MarshalTo(root, "data/index.json", test.written, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := CheckLayout(root, "data/index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package dfjson
+
+// longPath returns path as-is as only Windows has path length limits
+// that we need to work around.
+func longPath(path string) string {
+	return path
+}
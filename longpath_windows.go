@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+package dfjson
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the MAX_PATH limit of the Windows API minus the 12 characters
+// reserved for an 8.3 filename when creating directories.
+const maxPath = 260 - 12
+
+// longPath returns path prefixed with \\?\ if it's too long for the
+// Windows API to accept otherwise, which is common for deeply nested
+// distributable data.
+func longPath(path string) string {
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	// Windows does no normalization on \\?\ paths, so it must be
+	// absolute, cleaned and only use backslashes.
+	abs = filepath.Clean(abs)
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path, ie. \\server\share
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,61 @@
+//go:build windows
+// +build windows
+
+package dfjson
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type longPathTestValue struct {
+	Items map[string]*longPathTestValue `dfjson:"distributable"`
+	Name  string
+}
+
+func TestLongPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+	}{
+		{"below limit", 1},
+		{"above limit", 12},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			in := &longPathTestValue{Name: "root"}
+			key := strings.Repeat("k", 20)
+			for v, i := in, 0; i < test.depth; i++ {
+				child := &longPathTestValue{Name: key}
+				v.Items = map[string]*longPathTestValue{key: child}
+				v = child
+			}
+			if err := MarshalTo(root, "data/index.json", in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			files, err := Marshal("data/index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			longest := 0
+			for _, file := range files {
+				if n := len(filepath.Join(root, filepath.FromSlash(file.Path))); n > longest {
+					longest = n
+				}
+			}
+			if test.depth > 1 && longest < 260 {
+				t.Fatalf("longest path of %d characters is below the limit", longest)
+			}
+			var out longPathTestValue
+			if _, err := Unmarshal(filepath.Join(root, "data", "index.json"), &out, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
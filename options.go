@@ -0,0 +1,421 @@
+package dfjson
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Options configures how data is encoded and decoded.
+//
+// The zero value matches the behaviour of Marshal and Unmarshal.
+type Options struct {
+	// InternStrings makes equal strings across the decoded value share the
+	// same backing memory. This is useful for game data where the same
+	// tag or category strings are repeated across thousands of entities.
+	InternStrings bool
+
+	// Formatter is applied to the bytes of each file after encoding, which
+	// allows running a custom formatter over the output.
+	//
+	// If nil, each file is indented with Indent using json.Indent.
+	Formatter func(data []byte) ([]byte, error)
+
+	// Indent is the string each level of nesting is indented with.
+	//
+	// If empty, a tab is used.
+	Indent string
+
+	// Compact writes each file without any indentation or whitespace, for
+	// trees that are only read by programs. Indent, CompactArrayWidth and
+	// AlignObjectArrays are ignored, Formatter still applies if set.
+	Compact bool
+
+	// TrailingNewline ends each encoded file with a newline, as most editors
+	// and POSIX tools expect of text files. Files that already end with one,
+	// ie. from a Codec, are left as they are.
+	TrailingNewline bool
+
+	// DisableHTMLEscaping stops encoding from escaping <, > and & in strings
+	// as \u003c, \u003e and \u0026, which encoding/json does so that the JSON
+	// is safe to embed in HTML but makes data files harder to read.
+	DisableHTMLEscaping bool
+
+	// UnsortedMapKeys skips sorting map keys when encoding, which is faster
+	// for large maps but makes the order of the returned files vary between
+	// calls. It has no effect if KeyPolicy is set as renamed keys are
+	// assigned in sorted order.
+	UnsortedMapKeys bool
+
+	// IndexFilename is the name of the file that the value of each distributable
+	// field or map key is written to within its directory. Encoding and decoding
+	// must use the same name.
+	//
+	// If empty, "index.json" is used.
+	IndexFilename string
+
+	// AllowComments allows // and /* */ comments and trailing commas in files
+	// when decoding, such as in JSONC files.
+	AllowComments bool
+
+	// DisallowUnknownFields makes decoding return an error when a file or
+	// directory holds a key that isn't a field of the struct it's decoded
+	// into, like json.Decoder.DisallowUnknownFields, ie. a misspelt directory.
+	DisallowUnknownFields bool
+
+	// UseNumber makes decoding store numbers in interface{} values as a
+	// json.Number rather than a float64, like json.Decoder.UseNumber, so
+	// that large integers and decimals don't lose precision.
+	UseNumber bool
+
+	// Gzip decompresses each file with gzip when decoding
+	Gzip bool
+
+	// DisableFormatDetection stops decoding from configuring the options above
+	// based on the extension of the entry file. By default an entry file ending
+	// in ".jsonc" or ".json5" sets AllowComments and one ending in ".gz" sets
+	// Gzip. If IndexFilename isn't set, the files of distributed data are
+	// then expected to have the same extension, ie. "index.jsonc".
+	//
+	// Only the comments and trailing commas of JSON5 are supported.
+	DisableFormatDetection bool
+
+	// CompactArrayWidth keeps arrays that only hold scalar values on a single
+	// line, ie. [1, 2, 3], if the array is at most this many bytes long.
+	// Longer arrays and arrays of objects or arrays are indented as usual.
+	//
+	// If 0, every array element is written on its own line. This has no
+	// effect if a Formatter is set.
+	CompactArrayWidth int
+
+	// AlignObjectArrays writes arrays of objects that all have the same keys
+	// holding scalar values with an object per line, padding the values so
+	// that they line up in columns like a table. This has no effect if a
+	// Formatter is set.
+	AlignObjectArrays bool
+
+	// MaxTotalBytes stops decoding with an error once the total number of bytes
+	// read from files exceeds it. This protects against loading enormous data
+	// directories from untrusted sources, such as mods.
+	//
+	// If 0, there is no limit.
+	MaxTotalBytes int64
+
+	// PreserveUnchanged makes MarshalTo and Encoder.EncodeWrite leave existing
+	// files alone if they already contain equivalent JSON, keeping any manual
+	// formatting applied by authors and their modification times, so that
+	// only files that actually changed show up in version control.
+	PreserveUnchanged bool
+
+	// RemoveStale makes MarshalTo remove files and directories written by a
+	// previous call that are no longer part of the output, ie. the directory
+	// of a deleted map key, so that decoding doesn't bring it back.
+	//
+	// Only index, "_keys.json" and chunk files are removed, directories are
+	// only removed once they're empty so unrelated files are never touched.
+	RemoveStale bool
+
+	// SwapDir makes MarshalTo write the whole tree into a temporary directory
+	// next to the directory of the entry file and then swap it into place,
+	// so the old and new tree are never mixed, even if the process crashes.
+	// Everything in the directory of the entry file is replaced, so it must
+	// only hold the data, and the entry file can't be directly within root.
+	SwapDir bool
+
+	// KeyPolicy controls how map keys that can't be written to a directory
+	// of the same name are handled, see KeyPolicy. Set KeyPolicyError to
+	// stop keys from being percent-encoded by default.
+	KeyPolicy KeyPolicy
+
+	// KeyEscaper converts map keys into directory names when encoding and
+	// back when decoding. If nil, PercentKeyEscaper is used with the default
+	// KeyPolicy.
+	KeyEscaper KeyEscaper
+
+	// KeyCase canonicalizes the case of directory names when decoding them
+	// into map keys, ie. so that a directory authored as "Goblins" decodes to
+	// the same key after a case-insensitive filesystem stored it as "goblins".
+	// Directories whose names only differ by case are an error.
+	//
+	// If zero, directory names are used as-is.
+	KeyCase KeyCase
+
+	// WrapKey wraps the data of the entry file under the given key,
+	// ie. {"data": {...}}, so the dataset can be embedded in a larger JSON
+	// document. Decoding with the same WrapKey strips the wrapper again.
+	WrapKey string
+
+	// OmitFields lists fields to skip when encoding, either by JSON name or
+	// by dotted path from the top-level value, ie. "notes" or "creatures.goblin.notes".
+	// Unlike `json:"-"` this can differ per call, ie. when exporting data externally.
+	//
+	// Only fields of structs that are written to their own file are checked,
+	// fields nested within inline values are encoded by encoding/json as-is.
+	OmitFields []string
+
+	// TypeTransform maps a type to a function that is applied to every value
+	// of that type after decoding, ie. trimming whitespace from all strings
+	// or clamping numbers. The function must return a value of the same type.
+	TypeTransform map[reflect.Type]func(interface{}) interface{}
+
+	// KeyFilter is called with the name of each directory found while decoding,
+	// directories it returns false for are neither read nor stitched into the
+	// result. This allows loading a subset of the data, ie. only creatures with
+	// a certain prefix.
+	//
+	// It's called for directories at every level, so it must also return true
+	// for the directories of distributable fields leading to the data.
+	KeyFilter func(dirName string) bool
+
+	// DirFilter is called with the name of each directory found while decoding,
+	// directories it returns false for are ignored as if they don't exist. Unlike
+	// KeyFilter this is meant for directories that aren't part of the data at all.
+	//
+	// If nil, directories whose names start with a dot are ignored, ie. ".git" or ".svn".
+	DirFilter func(dirName string) bool
+
+	// Provenance adds a "__source" key to each file when encoding with the Go
+	// expression of the value it was produced from, ie. `main.World.Creatures["goblin"]`,
+	// which is useful for debugging. Decoding with Provenance set strips the key again.
+	Provenance bool
+
+	// InitialBufferSize is the number of bytes that buffers are allocated with
+	// up front to avoid growing them repeatedly. When encoding this is the
+	// buffer of each file, so it should be about the size of a typical file.
+	// When decoding this is the buffer that every file is stitched together
+	// in, so it should be about the total size of the data.
+	//
+	// If 0, buffers start empty and grow as needed.
+	InitialBufferSize int
+
+	// PathTransform is applied to the path of each file after encoding, relative
+	// to the directory of the entry file, ie. "Creatures/Goblin/index.json".
+	// This allows naming conventions such as lowercase directories without
+	// changing the keys in the JSON. The file name itself must be kept.
+	//
+	// Decoding must set InversePathTransform to reverse it, otherwise the
+	// directory names are used as keys as-is.
+	PathTransform func(path string) string
+
+	// InversePathTransform is applied to the path of each directory found when
+	// decoding, relative to the directory of the entry file, ie. "creatures/goblin".
+	// It must return the path before PathTransform, ie. "Creatures/Goblin",
+	// the last element of which is then used as the key.
+	InversePathTransform func(path string) string
+
+	// ExtraFiles is called with the value being encoded and returns files to
+	// write alongside it, ie. an index summarizing every entity. Paths are
+	// relative to the directory of the entry file and data is written as-is.
+	ExtraFiles func(v interface{}) ([]JSONFile, error)
+
+	// IgnoreExtra lists files and directories, relative to the directory of
+	// the entry file, that decoding skips, ie. those written by ExtraFiles.
+	// A directory is also skipped if its index file is listed.
+	IgnoreExtra []string
+
+	// Granularity controls how much of the data is written to each file,
+	// decoding must use the same Granularity if any slices are chunked.
+	//
+	// If zero, every distributable field and map key gets its own file.
+	Granularity Granularity
+
+	// MaxDepth is the number of directories deep that encoding and decoding
+	// will go below the entry file before stopping with an error. This protects
+	// against recursing forever, ie. on a symlink loop or self-referential data.
+	//
+	// If 0, a depth of 64 is used. If negative, there is no limit.
+	MaxDepth int
+
+	// ConflictMarkers, if set, makes decoding split files containing conflict
+	// markers, ie. a hand-edited file left over from a merge, into the sides
+	// of a merge conflict without needing a dfvcs driver.
+	ConflictMarkers *ConflictMarkers
+
+	// ConflictResolver, if set, resolves each conflicted file while decoding
+	// so that a single merged value is decoded, rather than reporting a merge
+	// conflict. Files that aren't conflicted are read as usual.
+	ConflictResolver ConflictResolver
+
+	// Schema is a JSON Schema that the document stitched together from the
+	// files is validated against before it's decoded, catching malformed
+	// hand edits. It's validated with SchemaValidator, which must be set too.
+	Schema []byte
+
+	// SchemaValidator validates documents against Schema, see SchemaValidator.
+	SchemaValidator SchemaValidator
+
+	// Codecs maps the name of a format to the Codec that converts it to and
+	// from JSON, for the subtrees of fields tagged with its name, ie.
+	// `dfjson:"distributable,format=yaml"`. Their index files are named after
+	// the format, ie. "index.yaml", and the subtrees of nested distributable
+	// fields use the same format unless tagged otherwise, ie. "format=json".
+	// Chunk files are always JSON.
+	Codecs map[string]Codec
+
+	// ReadWorkers is the number of files that decoding reads at once. If above
+	// 1, the index files of the subdirectories of each directory are read in
+	// the background as soon as it's listed, which speeds up decoding on
+	// filesystems with a high latency, ie. network drives. The data is still
+	// assembled in the same order as when reading one file at a time.
+	ReadWorkers int
+
+	// Stats, if set, is filled in with statistics about the data once decoding succeeds.
+	Stats *DecodeStats
+}
+
+// DecodeStats holds statistics about the data that was decoded
+type DecodeStats struct {
+	// FilesRead is the number of files that were read
+	FilesRead int
+	// BytesRead is the total size of the files that were read
+	BytesRead int64
+	// EmptyDirs lists directories that contained no files at any depth.
+	// These are decoded as if they didn't exist, and are usually left over
+	// from deleting data so they can be cleaned up.
+	EmptyDirs []string
+}
+
+// Granularity is a level of how finely data is distributed across files
+type Granularity int
+
+const (
+	// GranularityPerField writes every distributable field and map key
+	// to its own file
+	GranularityPerField Granularity = iota
+
+	// GranularityPerTopLevel writes each distributable field and map key of
+	// the top-level value to its own file holding its whole subtree
+	GranularityPerTopLevel
+
+	// GranularitySingle writes everything into the entry file
+	GranularitySingle
+)
+
+// isCombined reports whether the value written to path, with the entry file
+// at depth entryDepth, is written as a whole rather than distributed further
+func (opts *Options) isCombined(path string, entryDepth int) bool {
+	switch opts.Granularity {
+	case GranularityPerTopLevel:
+		return pathDepth(path)-entryDepth >= 1
+	case GranularitySingle:
+		return true
+	}
+	return false
+}
+
+// withDefaults returns opts with the settings that
+// default to something other than their zero value set
+func (opts Options) withDefaults() Options {
+	if opts.KeyEscaper == nil && opts.KeyPolicy == KeyPolicyDefault {
+		opts.KeyEscaper = PercentKeyEscaper
+	}
+	return opts
+}
+
+// Option configures an Encoder or Decoder
+type Option func(*Options)
+
+// WithOptions replaces the configuration with opts
+func WithOptions(opts Options) Option {
+	return func(o *Options) {
+		*o = opts
+	}
+}
+
+// WithIndent sets the string each level of nesting is indented with
+func WithIndent(indent string) Option {
+	return func(o *Options) {
+		o.Indent = indent
+	}
+}
+
+// WithTrailingNewline sets whether each encoded file ends with a newline
+func WithTrailingNewline(trailingNewline bool) Option {
+	return func(o *Options) {
+		o.TrailingNewline = trailingNewline
+	}
+}
+
+// WithEscapeHTML sets whether <, > and & in strings are escaped when
+// encoding, they're escaped by default.
+func WithEscapeHTML(escape bool) Option {
+	return func(o *Options) {
+		o.DisableHTMLEscaping = !escape
+	}
+}
+
+// WithSortedMapKeys sets whether map keys are sorted when encoding,
+// they're sorted by default.
+func WithSortedMapKeys(sorted bool) Option {
+	return func(o *Options) {
+		o.UnsortedMapKeys = !sorted
+	}
+}
+
+// WithIndexFilename sets the name of the file that the value of each
+// distributable field or map key is written to within its directory
+func WithIndexFilename(name string) Option {
+	return func(o *Options) {
+		o.IndexFilename = name
+	}
+}
+
+// WithDirFilter sets the function that decides which directories
+// found while decoding are part of the data
+func WithDirFilter(filter func(dirName string) bool) Option {
+	return func(o *Options) {
+		o.DirFilter = filter
+	}
+}
+
+// defaultIndexFilename is used when Options.IndexFilename isn't set
+const defaultIndexFilename = "index.json"
+
+// indexFilename returns IndexFilename or the default if it's not set
+func (opts *Options) indexFilename() string {
+	if opts.IndexFilename == "" {
+		return defaultIndexFilename
+	}
+	return opts.IndexFilename
+}
+
+// defaultMaxDepth is used when Options.MaxDepth isn't set
+const defaultMaxDepth = 64
+
+// checkDepth returns an error if path is more than MaxDepth
+// directories below the entry file at depth entryDepth
+func (opts *Options) checkDepth(path string, entryDepth int) error {
+	maxDepth := opts.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = defaultMaxDepth
+	}
+	if maxDepth > 0 && pathDepth(path)-entryDepth > maxDepth {
+		return fmt.Errorf("%s: exceeded maximum depth of %d", dirOf(filepath.ToSlash(path)), maxDepth)
+	}
+	return nil
+}
+
+// pathDepth returns the number of directories in path
+func pathDepth(path string) int {
+	return strings.Count(filepath.ToSlash(path), "/")
+}
+
+// skipDir reports whether the directory called dirName should be ignored
+// when decoding, according to DirFilter and KeyFilter
+func (opts *Options) skipDir(dirName string) bool {
+	if opts.DirFilter != nil {
+		if !opts.DirFilter(dirName) {
+			return true
+		}
+	} else if isHiddenDir(dirName) {
+		return true
+	}
+	return opts.KeyFilter != nil && !opts.KeyFilter(dirName)
+}
+
+// isHiddenDir reports whether dirName is hidden by convention, such as
+// the directories version control systems keep their data in
+func isHiddenDir(dirName string) bool {
+	return strings.HasPrefix(dirName, ".")
+}
@@ -0,0 +1,138 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+)
+
+// orderFilename is the file written next to the directories of a map field
+// tagged with an order option, ie. `dfjson:"distributable,order=MenuOrder"`.
+// It lists the keys of the map in the order given by the named []string field
+// of the same struct, which is filled in from it again when decoding.
+//
+// Keys that aren't in the order field come after those that are, sorted.
+const orderFilename = "_order.json"
+
+// orderField returns the field named by the order option of f
+func orderField(t reflect.Type, fields []field, f field) (field, error) {
+	for _, other := range fields {
+		if other.goName != f.orderField {
+			continue
+		}
+		if other.distributable || other.typ != reflect.TypeOf([]string(nil)) {
+			return field{}, fmt.Errorf("%s.%s: order field %s must be an inline []string", t.String(), f.goName, f.orderField)
+		}
+		return other, nil
+	}
+	return field{}, fmt.Errorf("%s.%s: order field %s does not exist", t.String(), f.goName, f.orderField)
+}
+
+// isOrderField reports whether the field called goName holds the order of a
+// map field, which is written to that map's order file rather than inline
+func isOrderField(fields []field, goName string) bool {
+	for _, f := range fields {
+		if f.orderField == goName {
+			return true
+		}
+	}
+	return false
+}
+
+// mapOrder returns the keys of the map m in the order listed by order,
+// followed by any keys that order doesn't list, sorted.
+func mapOrder(m reflect.Value, order []string) ([]string, error) {
+	keys := make(map[string]bool, m.Len())
+	for _, mapKey := range m.MapKeys() {
+		key, err := mapKeyString(mapKey)
+		if err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	result := make([]string, 0, len(keys))
+	for _, key := range order {
+		if keys[key] {
+			result = append(result, key)
+			delete(keys, key)
+		}
+	}
+	rest := make([]string, 0, len(keys))
+	for key := range keys {
+		rest = append(rest, key)
+	}
+	sort.Strings(rest)
+	return append(result, rest...), nil
+}
+
+// encodeOrder writes the order file of the map field f into the directory
+// of the file at mapPath
+func (state *encodeState) encodeOrder(mapPath string, el reflect.Value, fields []field, f field) error {
+	order, err := orderField(el.Type(), fields, f)
+	if err != nil {
+		return err
+	}
+	field, _ := fieldByIndex(el, f.index)
+	m := reflect.Indirect(field)
+	if m.Kind() != reflect.Map {
+		return fmt.Errorf("%s.%s: order option can only be used on a map", el.Type().String(), f.goName)
+	}
+	var orderKeys []string
+	if orderValue, ok := fieldByIndex(el, order.index); ok {
+		orderKeys = orderValue.Interface().([]string)
+	}
+	keys, err := mapOrder(m, orderKeys)
+	if err != nil {
+		return err
+	}
+	data, err := state.marshalValue(keys)
+	if err != nil {
+		return err
+	}
+	return state.addFile(JSONFile{
+		Path: joinDir(dirOf(mapPath), orderFilename),
+		Data: data,
+	})
+}
+
+// orderKey returns the JSON name of the field holding
+// the order of field f of struct type t, if it has one
+func orderKey(t reflect.Type, f field) string {
+	if f.orderField == "" {
+		return ""
+	}
+	for _, other := range typeFields(derefType(t)) {
+		if other.goName == f.orderField {
+			return other.name
+		}
+	}
+	return ""
+}
+
+// readOrderFile reads the order file at path as raw JSON,
+// or returns nil if it doesn't exist.
+func (state *decodeState) readOrderFile(path string) ([]byte, error) {
+	f, err := state.source.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := state.countBytes(path, int64(len(data))); err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,125 @@
+package dfjson
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type orderTestMenu struct {
+	Title     string                         `json:"title"`
+	Items     map[string]*encodeTestCreature `json:"items" dfjson:"distributable,order=ItemOrder"`
+	ItemOrder []string                       `json:"itemOrder"`
+}
+
+type orderTestMissingField struct {
+	Items map[string]int `json:"items" dfjson:"distributable,order=Order"`
+}
+
+type orderTestWrongType struct {
+	Items map[string]int `json:"items" dfjson:"distributable,order=Order"`
+	Order []int          `json:"order"`
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []string
+		order     []string
+		wantOrder []string
+		wantFile  string
+	}{
+		{
+			name:      "every key",
+			keys:      []string{"new", "open", "save", "quit"},
+			order:     []string{"new", "open", "save", "quit"},
+			wantOrder: []string{"new", "open", "save", "quit"},
+			wantFile:  "[\n\t\"new\",\n\t\"open\",\n\t\"save\",\n\t\"quit\"\n]",
+		},
+		{
+			name:      "unordered keys are sorted last",
+			keys:      []string{"new", "open", "save", "quit"},
+			order:     []string{"quit", "new"},
+			wantOrder: []string{"quit", "new", "open", "save"},
+			wantFile:  "[\n\t\"quit\",\n\t\"new\",\n\t\"open\",\n\t\"save\"\n]",
+		},
+		{
+			name:      "keys that don't exist are dropped",
+			keys:      []string{"new", "quit"},
+			order:     []string{"quit", "deleted", "new"},
+			wantOrder: []string{"quit", "new"},
+			wantFile:  "[\n\t\"quit\",\n\t\"new\"\n]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := &orderTestMenu{
+				Title:     "File",
+				Items:     make(map[string]*encodeTestCreature),
+				ItemOrder: test.order,
+			}
+			for _, key := range test.keys {
+				in.Items[key] = &encodeTestCreature{Name: key}
+			}
+			files, err := Marshal("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := fileData(files)
+			if got := data["items/"+orderFilename]; got != test.wantFile {
+				t.Errorf("got order file %q, want %q", got, test.wantFile)
+			}
+			// The order is only written to the sidecar
+			if got, want := data["index.json"], "{\n\t\"title\": \"File\"\n}"; got != want {
+				t.Errorf("got index.json %q, want %q", got, want)
+			}
+
+			var out orderTestMenu
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.ItemOrder, test.wantOrder) {
+				t.Errorf("got order %q, want %q", out.ItemOrder, test.wantOrder)
+			}
+			if !reflect.DeepEqual(out.Items, in.Items) {
+				t.Errorf("got items %+v, want %+v", out.Items, in.Items)
+			}
+
+			// Stitching without the type ignores the sidecar
+			stitched, err := StitchBytes("index.json", files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(stitched), "_order") {
+				t.Errorf("stitched document holds the order file: %s", stitched)
+			}
+		})
+	}
+}
+
+func TestOrderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		wantErr string
+	}{
+		{
+			name:    "missing field",
+			v:       &orderTestMissingField{Items: map[string]int{"a": 1}},
+			wantErr: "dfjson.orderTestMissingField.Items: order field Order does not exist",
+		},
+		{
+			name:    "wrong type",
+			v:       &orderTestWrongType{Items: map[string]int{"a": 1}},
+			wantErr: "dfjson.orderTestWrongType.Items: order field Order must be an inline []string",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Marshal("index.json", test.v)
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package dfjson
+
+import (
+	"reflect"
+	"sync"
+)
+
+// parentTag is the value of the dfjson tag that marks a field to be set to
+// the node it's nested within after decoding, ie. for a skill tree
+//
+//	type Skill struct {
+//		Parent   *Skill            `json:"-" dfjson:"parent"`
+//		Children map[string]*Skill `dfjson:"distributable"`
+//	}
+//
+// The field is set to the closest enclosing struct whose pointer can be
+// assigned to it, or left nil if there isn't one. Parent fields are skipped
+// when encoding distributable structs, but should also be tagged with
+// `json:"-"` so that encoding/json skips them in inline data.
+const parentTag = "parent"
+
+// isParentField reports whether field f is tagged with "dfjson:parent"
+func isParentField(f reflect.StructField) bool {
+	name, _ := parseTag(f.Tag.Get("dfjson"))
+	return name == parentTag
+}
+
+// parentFieldCache maps a type to the result of hasParentFields
+var parentFieldCache sync.Map
+
+// hasParentFields reports whether a value of type t can hold
+// a field tagged with "dfjson:parent"
+func hasParentFields(t reflect.Type) bool {
+	return containsField(&parentFieldCache, t, isParentField)
+}
+
+// linkParents walks v and sets every field tagged with "dfjson:parent"
+func linkParents(v interface{}) {
+	var l parentLinker
+	l.link(reflect.ValueOf(v), true)
+}
+
+type parentLinker struct {
+	// ancestors are pointers to the structs enclosing the current value
+	ancestors []reflect.Value
+	seen      map[uintptr]bool
+}
+
+// link walks v, addressable is false if v is a copy that
+// its children can't keep a pointer to, ie. a map value.
+func (l *parentLinker) link(v reflect.Value, addressable bool) {
+	if !v.IsValid() || !hasParentFields(v.Type()) {
+		// Nothing below v to set, so skip walking it
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		// Avoid looping forever on self-referential data
+		ptr := v.Pointer()
+		if l.seen == nil {
+			l.seen = make(map[uintptr]bool)
+		}
+		if l.seen[ptr] {
+			return
+		}
+		l.seen[ptr] = true
+		l.link(v.Elem(), true)
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		// Only values held by pointer can be linked
+		if elem := v.Elem(); elem.Kind() == reflect.Ptr {
+			l.link(elem, true)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || !isParentField(f) {
+				continue
+			}
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			// Use the closest ancestor that fits
+			field.Set(reflect.Zero(field.Type()))
+			for j := len(l.ancestors) - 1; j >= 0; j-- {
+				if ancestor := l.ancestors[j]; ancestor.Type().AssignableTo(field.Type()) {
+					field.Set(ancestor)
+					break
+				}
+			}
+		}
+		if addressable && v.CanAddr() {
+			l.ancestors = append(l.ancestors, v.Addr())
+			defer func() {
+				l.ancestors = l.ancestors[:len(l.ancestors)-1]
+			}()
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || isParentField(f) {
+				continue
+			}
+			l.link(v.Field(i), addressable)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			l.link(v.Index(i), addressable)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		elemType := v.Type().Elem()
+		iter := v.MapRange()
+		for iter.Next() {
+			if elemType.Kind() == reflect.Ptr {
+				l.link(iter.Value(), true)
+				continue
+			}
+			// Map values are not settable, so copy them out,
+			// link the copy and put it back.
+			elem := reflect.New(elemType).Elem()
+			elem.Set(iter.Value())
+			l.link(elem, false)
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+}
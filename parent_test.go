@@ -0,0 +1,75 @@
+package dfjson
+
+import (
+	"reflect"
+	"testing"
+)
+
+type parentTestSkill struct {
+	Parent   *parentTestSkill            `json:"-" dfjson:"parent"`
+	Name     string                      `json:"name"`
+	Children map[string]*parentTestSkill `json:"children" dfjson:"distributable"`
+}
+
+type parentTestTree struct {
+	Root   *parentTestSkill           `json:"root" dfjson:"distributable"`
+	Values map[string]parentTestValue `json:"values"`
+}
+
+type parentTestValue struct {
+	Tree *parentTestTree `json:"-" dfjson:"parent"`
+	N    int             `json:"n"`
+}
+
+func TestLinkParents(t *testing.T) {
+	in := parentTestTree{
+		Root: &parentTestSkill{
+			Name: "root",
+			Children: map[string]*parentTestSkill{
+				"a": {Name: "a", Children: map[string]*parentTestSkill{"b": {Name: "b"}}},
+			},
+		},
+		Values: map[string]parentTestValue{"x": {N: 1}},
+	}
+	files, err := Marshal("index.json", &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out parentTestTree
+	if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	a := out.Root.Children["a"]
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"root has no parent skill", out.Root.Parent, (*parentTestSkill)(nil)},
+		{"child", a.Parent, out.Root},
+		{"grandchild", a.Children["b"].Parent, a},
+		{"map value copy", out.Values["x"].Tree, &out},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %p, want %p", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestHasParentFields(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want bool
+	}{
+		{&parentTestTree{}, true},
+		{map[string]parentTestValue{}, true},
+		{&validateTestNode{}, false},
+		{map[string]int{}, false},
+		{[]interface{}{}, true},
+	}
+	for _, test := range tests {
+		if got := hasParentFields(reflect.TypeOf(test.v)); got != test.want {
+			t.Errorf("%T: got %v, want %v", test.v, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package dfjson
+
+import (
+	"path"
+	"strings"
+)
+
+// transformPath applies Options.PathTransform to the path of a file relative
+// to the directory of the entry file, the entry file is kept as-is.
+func transformPath(entryFilename string, filePath string, transform func(path string) string) string {
+	if filePath == entryFilename {
+		return filePath
+	}
+	entryDir := dirOf(entryFilename)
+	relPath := filePath
+	if entryDir != "." {
+		relPath = strings.TrimPrefix(relPath, entryDir+"/")
+	}
+	return joinDir(entryDir, transform(relPath))
+}
+
+// originalDirName returns the name that the directory called dirName within
+// topDir had before Options.PathTransform was applied, using the inverse.
+func (state *decodeState) originalDirName(topDir, dirName string) string {
+	if state.opts.InversePathTransform == nil {
+		return dirName
+	}
+	relPath := strings.TrimPrefix(topDir+"/"+dirName, dirOf(state.entryFilename)+"/")
+	return path.Base(state.opts.InversePathTransform(relPath))
+}
@@ -0,0 +1,104 @@
+package dfjson
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type pathTransformTestWorld struct {
+	Name      string                         `json:"Name"`
+	Creatures map[string]*encodeTestCreature `json:"Creatures" dfjson:"distributable"`
+}
+
+func TestPathTransform(t *testing.T) {
+	in := &pathTransformTestWorld{
+		Name: "world",
+		Creatures: map[string]*encodeTestCreature{
+			"Goblin":   {Name: "Goblin", HP: 12},
+			"OrcChief": {Name: "Orc Chief", HP: 45},
+		},
+	}
+	// Lowercasing loses information, so the inverse looks up the original
+	// name of each directory
+	original := map[string]string{
+		"creatures": "Creatures",
+		"goblin":    "Goblin",
+		"orcchief":  "OrcChief",
+	}
+	inverse := func(p string) string {
+		parts := strings.Split(p, "/")
+		for i, part := range parts {
+			if name, ok := original[part]; ok {
+				parts[i] = name
+			}
+		}
+		return strings.Join(parts, "/")
+	}
+	tests := []struct {
+		name      string
+		entry     string
+		wantPaths []string
+	}{
+		{
+			name:      "entry in root",
+			entry:     "index.json",
+			wantPaths: []string{"creatures/goblin/index.json", "creatures/orcchief/index.json", "index.json"},
+		},
+		{
+			name:  "entry in subdirectory",
+			entry: "World/index.json",
+			// The directory of the entry file isn't transformed
+			wantPaths: []string{"World/creatures/goblin/index.json", "World/creatures/orcchief/index.json", "World/index.json"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := MarshalWithOptions(test.entry, in, Options{PathTransform: strings.ToLower})
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := filePaths(files)
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.wantPaths) {
+				t.Errorf("got paths %q, want %q", paths, test.wantPaths)
+			}
+			// JSON keys are unchanged
+			if got, want := fileData(files)[test.entry], "{\n\t\"Name\": \"world\"\n}"; got != want {
+				t.Errorf("got entry file %q, want %q", got, want)
+			}
+
+			var out pathTransformTestWorld
+			if err := UnmarshalFS(filesFS(files), test.entry, &out, Options{InversePathTransform: inverse}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+
+			// Without the inverse the transformed names are used as keys
+			out = pathTransformTestWorld{}
+			err = UnmarshalFS(filesFS(files), test.entry, &out, Options{})
+			if err == nil && reflect.DeepEqual(&out, in) {
+				t.Error("decoded the original keys without the inverse transform")
+			}
+		})
+	}
+}
+
+func TestTransformPath(t *testing.T) {
+	tests := []struct {
+		entry, path, want string
+	}{
+		{"index.json", "index.json", "index.json"},
+		{"index.json", "creatures/goblin/index.json", "CREATURES/GOBLIN/INDEX.JSON"},
+		{"data/world.json", "data/world.json", "data/world.json"},
+		{"data/world.json", "data/creatures/goblin/world.json", "data/CREATURES/GOBLIN/WORLD.JSON"},
+	}
+	for _, test := range tests {
+		if got := transformPath(test.entry, test.path, strings.ToUpper); got != test.want {
+			t.Errorf("transformPath(%q, %q) = %q, want %q", test.entry, test.path, got, test.want)
+		}
+	}
+}
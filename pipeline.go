@@ -0,0 +1,130 @@
+package dfjson
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// errWriteAborted stops encoding once writing has failed
+var errWriteAborted = errors.New("write aborted")
+
+// MarshalWrite encodes v like Marshal and writes the files into the directory
+// dir as they're encoded, so encoding and writing overlap. Files are encoded
+// on the calling goroutine and written by workers goroutines.
+//
+// As with WriteFiles, files are written to temporary files that are only
+// renamed into place once every file was written, so an error from either
+// encoding or writing leaves the existing files untouched.
+func MarshalWrite(dir, entryFilename string, v interface{}, workers int) error {
+	return NewEncoder().EncodeWrite(dir, entryFilename, v, workers)
+}
+
+// EncodeWrite encodes v and writes the files into the directory dir
+// using workers goroutines, see MarshalWrite.
+func (enc *Encoder) EncodeWrite(dir, entryFilename string, v interface{}, workers int) error {
+	return enc.encodeWriteFS(osWriteFS{}, dir, entryFilename, v, workers, 0644)
+}
+
+func (enc *Encoder) encodeWriteFS(fsys WriteFS, root, entryFilename string, v interface{}, workers int, perm os.FileMode) error {
+	if workers < 1 {
+		workers = 1
+	}
+	suffix, err := tempSuffix()
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu        sync.Mutex
+		writeErr  error
+		paths     []string
+		tempPaths []string
+	)
+	// aborted is closed on the first error from a writer
+	aborted := make(chan struct{})
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if writeErr == nil {
+			writeErr = err
+			close(aborted)
+		}
+	}
+	files := make(chan JSONFile, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				select {
+				case <-aborted:
+					// Drain the remaining files without writing them
+					continue
+				default:
+				}
+				path := filepath.Join(root, filepath.FromSlash(file.Path))
+				if enc.opts.PreserveUnchanged {
+					isUnchanged, err := isFileUnchanged(fsys, path, file.Data)
+					if err != nil {
+						fail(err)
+						continue
+					}
+					if isUnchanged {
+						continue
+					}
+				}
+				tempPath := path + suffix
+				if err := fsys.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					fail(err)
+					continue
+				}
+				err := fsys.WriteFile(tempPath, file.Data, perm)
+				mu.Lock()
+				// Record the temporary file even if writing failed
+				// so that whatever was written is removed
+				paths = append(paths, path)
+				tempPaths = append(tempPaths, tempPath)
+				mu.Unlock()
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	encodeErr := enc.encodeFunc(context.Background(), entryFilename, v, func(file JSONFile) error {
+		select {
+		case files <- file:
+			return nil
+		case <-aborted:
+			return errWriteAborted
+		}
+	})
+	close(files)
+	wg.Wait()
+
+	removeTempFiles := func(tempPaths []string) {
+		for _, tempPath := range tempPaths {
+			fsys.Remove(tempPath)
+		}
+	}
+	if writeErr != nil {
+		removeTempFiles(tempPaths)
+		return writeErr
+	}
+	if encodeErr != nil {
+		removeTempFiles(tempPaths)
+		return encodeErr
+	}
+	for i, path := range paths {
+		if err := fsys.Rename(tempPaths[i], path); err != nil {
+			removeTempFiles(tempPaths[i:])
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package dfjson
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMarshalWrite(t *testing.T) {
+	world := newBenchmarkWorld(200)
+	serialRoot := t.TempDir()
+	files, err := Marshal("data/index.json", world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFiles(serialRoot, files, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := readTree(t, serialRoot)
+	for _, workers := range []int{0, 1, 4, 16} {
+		t.Run("workers="+strconv.Itoa(workers), func(t *testing.T) {
+			root := t.TempDir()
+			if err := MarshalWrite(root, "data/index.json", world, workers); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, root); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %d files differing from the %d written serially", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestMarshalWriteErrors(t *testing.T) {
+	// Creatures are encoded in sorted order, so the failing value
+	// comes after others were already written
+	withUnsupported := map[string]interface{}{
+		"a": map[string]int{"hp": 1},
+		"b": map[string]int{"hp": 2},
+		"z": map[string]interface{}{"bad": make(chan int)},
+	}
+	tests := []struct {
+		name      string
+		v         interface{}
+		failWrite string
+		wantErr   string
+	}{
+		{
+			name: "encode fails",
+			v: &struct {
+				Creatures map[string]interface{} `json:"creatures" dfjson:"distributable"`
+			}{withUnsupported},
+			wantErr: "json: unsupported type: chan int",
+		},
+		{
+			name:      "write fails",
+			v:         newBenchmarkWorld(100),
+			failWrite: filepath.Join("creature50", "index.json"),
+			wantErr:   "no space left on device",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, workers := range []int{1, 4} {
+				fsys := newMemWriteFS()
+				fsys.failWrite = test.failWrite
+				err := NewEncoder().encodeWriteFS(fsys, "root", "index.json", test.v, workers, 0644)
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("workers %d: got error %v, want %q", workers, err, test.wantErr)
+				}
+				// Neither temporary files nor some of the new files are left behind
+				if len(fsys.files) != 0 {
+					t.Errorf("workers %d: got %d files after an error, want none", workers, len(fsys.files))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMarshalWrite(b *testing.B) {
+	world := newBenchmarkWorld(1000)
+	b.Run("serial", func(b *testing.B) {
+		// Each iteration overwrites the files of the last
+		root := b.TempDir()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			files, err := Marshal("index.json", world)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := WriteFiles(root, files, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, workers := range []int{1, 4, 16} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			root := b.TempDir()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := MarshalWrite(root, "index.json", world, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package dfjson
+
+import (
+	"context"
+)
+
+// PlanLayout returns the paths of the files that Marshal would return for v,
+// in the same order, without encoding any of the data. This allows showing
+// which directories and files would be created before writing them.
+//
+// As values aren't encoded, errors that encoding/json would return for them,
+// ie. an unsupported type, are only reported by Marshal.
+func PlanLayout(entryFilename string, v interface{}) ([]string, error) {
+	var paths []string
+	state := encodeState{
+		ctx:      context.Background(),
+		opts:     Options{}.withDefaults(),
+		planOnly: true,
+		emit: func(file JSONFile) error {
+			paths = append(paths, file.Path)
+			return nil
+		},
+	}
+	if err := state.marshal(entryFilename, v); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
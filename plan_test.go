@@ -0,0 +1,81 @@
+package dfjson
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanLayout(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+		v     interface{}
+	}{
+		{"map", "index.json", newEncodeTestWorld()},
+		{"entry in subdirectory", "data/world/index.json", newEncodeTestWorld()},
+		{"escaped keys", "index.json", &keysTestValue{Items: map[string]int{"a/b": 1, "..": 2, "c:d": 3}}},
+		{"slices", "index.json", &encodeTestLevels{Levels: []encodeTestCreature{{Name: "a"}, {Name: "b"}}}},
+		{"chunks", "index.json", &chunkTestWorld{Values: make([]int, 7)}},
+		{"groups", "index.json", &encodeTestGroups{
+			HP:    &encodeTestCreature{},
+			MP:    map[string]int{"fire": 3},
+			Items: []encodeTestCreature{{Name: "sword"}},
+		}},
+		{"order", "index.json", &orderTestMenu{Items: map[string]*encodeTestCreature{"b": {}, "a": {}}, ItemOrder: []string{"b"}}},
+		{"nested", "index.json", &encodeTestGranularity{
+			Zones: map[string]*encodeTestLevels{"cave": {Levels: []encodeTestCreature{{}}}},
+			Boss:  &encodeTestCreature{},
+		}},
+		{"large map", "index.json", newBenchmarkWorld(500)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Marshal(test.entry, test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths, err := PlanLayout(test.entry, test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filePaths(files); !reflect.DeepEqual(paths, want) {
+				t.Errorf("got %q, want %q", paths, want)
+			}
+		})
+	}
+}
+
+func TestPlanLayoutErrors(t *testing.T) {
+	a := &encodeTestListNode{Name: "a"}
+	a.Next = &encodeTestListNode{Name: "b", Prev: a}
+	_, planErr := PlanLayout("index.json", a)
+	_, marshalErr := Marshal("index.json", a)
+	if planErr == nil || marshalErr == nil || planErr.Error() != marshalErr.Error() {
+		t.Errorf("got error %v, want the error from Marshal %v", planErr, marshalErr)
+	}
+
+	// Values aren't encoded, so only Marshal reports unsupported types
+	v := &struct {
+		Values map[string]interface{} `json:"values" dfjson:"distributable"`
+	}{map[string]interface{}{"a": make(chan int)}}
+	paths, err := PlanLayout("index.json", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"values/a/index.json", "index.json"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %q, want %q", paths, want)
+	}
+	if _, err := Marshal("index.json", v); err == nil {
+		t.Error("expected Marshal to fail on an unsupported type")
+	}
+}
+
+func BenchmarkPlanLayout(b *testing.B) {
+	world := newBenchmarkWorld(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := PlanLayout("index.json", world); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
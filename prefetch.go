@@ -0,0 +1,156 @@
+package dfjson
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// prefetchSource wraps a fileSource and reads the files that decoding is
+// about to open concurrently, as soon as it has listed the directories
+// they're in. Decoding still opens files one at a time and in order, but
+// most of them have already been read by the time they're opened, which
+// hides the latency of slow filesystems, ie. network drives.
+type prefetchSource struct {
+	fileSource
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wg waits for every file to be read, see stop
+	wg sync.WaitGroup
+
+	// workers limits the number of files being read at once
+	workers chan struct{}
+	// maxBytes is the most bytes that are prefetched in total, or 0 if
+	// there's no limit. Files that would go over it are left for decoding
+	// to read, which then reports that it's over Options.MaxTotalBytes.
+	maxBytes int64
+
+	mu        sync.Mutex
+	pending   map[string]*prefetchedFile
+	bytesRead int64
+}
+
+// prefetchedFile is a file being read in the background, data, err and
+// skipped are set once done is closed
+type prefetchedFile struct {
+	done chan struct{}
+	data []byte
+	err  error
+	// skipped is set if the file wasn't read, so it's opened as usual
+	skipped bool
+}
+
+func newPrefetchSource(ctx context.Context, source fileSource, opts *Options) *prefetchSource {
+	ctx, cancel := context.WithCancel(ctx)
+	return &prefetchSource{
+		fileSource: source,
+		ctx:        ctx,
+		cancel:     cancel,
+		workers:    make(chan struct{}, opts.ReadWorkers),
+		maxBytes:   opts.MaxTotalBytes,
+		pending:    make(map[string]*prefetchedFile),
+	}
+}
+
+// prefetch starts reading the file at path in the background
+func (source *prefetchSource) prefetch(path string) {
+	file := &prefetchedFile{done: make(chan struct{})}
+	source.mu.Lock()
+	if _, ok := source.pending[path]; ok {
+		source.mu.Unlock()
+		return
+	}
+	source.pending[path] = file
+	source.mu.Unlock()
+
+	source.wg.Add(1)
+	go func() {
+		defer source.wg.Done()
+		defer close(file.done)
+		select {
+		case source.workers <- struct{}{}:
+		case <-source.ctx.Done():
+			file.skipped = true
+			return
+		}
+		defer func() {
+			<-source.workers
+		}()
+		file.skipped = !source.read(path, file)
+	}()
+}
+
+// read reads the file at path into file, returning false if it wasn't
+// read because decoding was cancelled or it's over the byte limit
+func (source *prefetchSource) read(path string, file *prefetchedFile) bool {
+	if source.ctx.Err() != nil {
+		return false
+	}
+	var remaining int64
+	if source.maxBytes > 0 {
+		source.mu.Lock()
+		remaining = source.maxBytes - source.bytesRead
+		source.mu.Unlock()
+		if remaining <= 0 {
+			return false
+		}
+	}
+	f, err := source.fileSource.Open(path)
+	if err != nil {
+		file.err = err
+		return true
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if source.maxBytes > 0 {
+		// Stop reading once it's clear the file doesn't fit
+		r = io.LimitReader(f, remaining+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		file.err = err
+		return true
+	}
+	if source.maxBytes > 0 {
+		source.mu.Lock()
+		defer source.mu.Unlock()
+		if source.bytesRead+int64(len(data)) > source.maxBytes {
+			return false
+		}
+		source.bytesRead += int64(len(data))
+	}
+	file.data = data
+	return true
+}
+
+// stop cancels reading the files that haven't been started yet and waits
+// for the rest, so that nothing is read from the source once decoding is
+// done, ie. files the merge conflict driver gave the contents of
+func (source *prefetchSource) stop() {
+	source.cancel()
+	source.wg.Wait()
+}
+
+// Open returns the prefetched file at path, waiting for it to be read if
+// needed, or opens it directly if it wasn't prefetched
+func (source *prefetchSource) Open(path string) (io.ReadCloser, error) {
+	source.mu.Lock()
+	file, ok := source.pending[path]
+	if ok {
+		// Each file is only opened once, so free it up once it's been used
+		delete(source.pending, path)
+	}
+	source.mu.Unlock()
+	if !ok {
+		return source.fileSource.Open(path)
+	}
+	<-file.done
+	if file.skipped {
+		return source.fileSource.Open(path)
+	}
+	if file.err != nil {
+		return nil, file.err
+	}
+	return io.NopCloser(bytes.NewReader(file.data)), nil
+}
@@ -0,0 +1,276 @@
+package dfjson
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// slowSource is a fileSource that takes latency to open each file, like a
+// network drive, and records the most files that were open at once
+type slowSource struct {
+	fileSource
+	latency time.Duration
+
+	mu         sync.Mutex
+	open       int
+	maxOpen    int
+	openedPath map[string]int
+	bytesRead  int64
+}
+
+func (source *slowSource) Open(path string) (io.ReadCloser, error) {
+	source.mu.Lock()
+	source.open++
+	if source.open > source.maxOpen {
+		source.maxOpen = source.open
+	}
+	if source.openedPath != nil {
+		source.openedPath[path]++
+	}
+	source.mu.Unlock()
+	time.Sleep(source.latency)
+	source.mu.Lock()
+	source.open--
+	source.mu.Unlock()
+	f, err := source.fileSource.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{ReadCloser: f, source: source}, nil
+}
+
+// slowFile counts the bytes read from a file opened by slowSource
+type slowFile struct {
+	io.ReadCloser
+	source *slowSource
+}
+
+func (f *slowFile) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	f.source.mu.Lock()
+	f.source.bytesRead += int64(n)
+	f.source.mu.Unlock()
+	return n, err
+}
+
+func TestReadWorkers(t *testing.T) {
+	files, err := Marshal("index.json", newBenchmarkWorld(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFile := func(path, data string) []JSONFile {
+		files := append([]JSONFile(nil), files...)
+		for i, file := range files {
+			if file.Path == path {
+				files[i].Data = []byte(data)
+				return files
+			}
+		}
+		return append(files, JSONFile{Path: path, Data: []byte(data)})
+	}
+	conflicted := dfvcs.NewMockDriver()
+	conflicted.Add("creatures/creature7/index.json", []byte(`{"hp": 70}`), []byte(`{"hp": 71}`))
+	conflicted.Add("creatures/creature30/index.json", []byte(`{"hp": 300}`), []byte(`{"hp": 301}`))
+
+	tests := []struct {
+		name   string
+		files  []JSONFile
+		driver dfvcs.SidesDriver
+	}{
+		{"world", files, nil},
+		{"merge conflicts", files, conflicted},
+		{"invalid file", withFile("creatures/creature20/index.json", `{"hp": `), nil},
+		{"directory without a file", withFile("creatures/creature20/loot/readme.txt", ``), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			type result struct {
+				hasMergeConflict bool
+				ours, theirs     encodeTestWorld
+			}
+			decode := func(workers int) (result, error) {
+				source := &slowSource{fileSource: newMemorySource(test.files), openedPath: make(map[string]int)}
+				var ours, theirs encodeTestWorld
+				targets := map[string]interface{}{dfvcs.SideOurs: &ours, dfvcs.SideTheirs: &theirs}
+				hasMergeConflict, err := unmarshalSides(context.Background(), source, "index.json", targets, test.driver, Options{ReadWorkers: workers})
+				for path, n := range source.openedPath {
+					if n > 1 {
+						t.Errorf("workers %d: opened %s %d times", workers, path, n)
+					}
+				}
+				if workers > 0 && source.maxOpen > workers {
+					t.Errorf("workers %d: got %d files open at once", workers, source.maxOpen)
+				}
+				return result{hasMergeConflict, ours, theirs}, err
+			}
+			want, wantErr := decode(0)
+			if test.driver != nil && !want.hasMergeConflict {
+				t.Fatal("expected a merge conflict")
+			}
+			for _, workers := range []int{1, 2, 8, 64} {
+				got, err := decode(workers)
+				if fmt.Sprint(err) != fmt.Sprint(wantErr) {
+					t.Errorf("workers %d: got error %v, want %v", workers, err, wantErr)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("workers %d: got %+v, want %+v", workers, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadWorkersOutput(t *testing.T) {
+	in := newBenchmarkWorld(100)
+	files, err := Marshal("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{0, 1, 4, 16} {
+		t.Run("workers="+strconv.Itoa(workers), func(t *testing.T) {
+			var out encodeTestWorld
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, Options{ReadWorkers: workers}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+func TestReadWorkersPaths(t *testing.T) {
+	groups, err := Marshal("index.json", &encodeTestGroups{
+		Name:  "player",
+		HP:    &encodeTestCreature{Name: "hp", HP: 10},
+		MP:    map[string]int{"fire": 3},
+		Items: []encodeTestCreature{{Name: "sword"}, {Name: "shield"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codecOpts := Options{Codecs: map[string]Codec{"yaml": flatYAMLCodec{}}}
+	formats, err := MarshalWithOptions("index.json", &codecTestWorld{
+		Name:      "world",
+		Config:    &codecTestConfig{Difficulty: "hard", Lives: 3},
+		Monsters:  map[string]*encodeTestCreature{"dragon": {Name: "Dragon", HP: 500}},
+		Creatures: map[string]*encodeTestCreature{"goblin": {Name: "Goblin", HP: 12}},
+	}, codecOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		files    []JSONFile
+		newValue func() interface{}
+		opts     Options
+	}{
+		{"groups and arrays", groups, func() interface{} { return new(encodeTestGroups) }, Options{}},
+		{"formats", formats, func() interface{} { return new(codecTestWorld) }, codecOpts},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Only the files that decoding opens are read, so none are
+			// read and thrown away
+			decode := func(workers int) map[string]int {
+				source := &slowSource{fileSource: newMemorySource(test.files), openedPath: make(map[string]int)}
+				opts := test.opts
+				opts.ReadWorkers = workers
+				targets := map[string]interface{}{dfvcs.SideOurs: test.newValue()}
+				if _, err := unmarshalSides(context.Background(), source, "index.json", targets, nil, opts); err != nil {
+					t.Fatal(err)
+				}
+				return source.openedPath
+			}
+			want := decode(0)
+			if got := decode(8); !reflect.DeepEqual(got, want) {
+				t.Errorf("got opened paths %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadWorkersMaxTotalBytes(t *testing.T) {
+	files, err := Marshal("index.json", newBenchmarkWorld(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, file := range files {
+		size += int64(len(file.Data))
+	}
+	const maxBytes = 2000
+	for _, workers := range []int{0, 8} {
+		t.Run("workers="+strconv.Itoa(workers), func(t *testing.T) {
+			source := &slowSource{fileSource: newMemorySource(files)}
+			var out encodeTestWorld
+			targets := map[string]interface{}{dfvcs.SideOurs: &out}
+			_, err := unmarshalSides(context.Background(), source, "index.json", targets, nil, Options{ReadWorkers: workers, MaxTotalBytes: maxBytes})
+			if want := "exceeded maximum total size of 2000 bytes"; err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("got error %v, want %q", err, want)
+			}
+			// Prefetching stops at the limit, rather than reading all
+			// of the files, though files that don't fit may be read
+			// again by decoding
+			if source.bytesRead > 3*maxBytes {
+				t.Errorf("read %d of %d bytes, want about %d at most", source.bytesRead, size, maxBytes)
+			}
+		})
+	}
+}
+
+func TestReadWorkersCancel(t *testing.T) {
+	files, err := Marshal("index.json", newBenchmarkWorld(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow := &slowSource{fileSource: newMemorySource(files), latency: time.Millisecond}
+	source := &cancelSource{fileSource: slow, cancel: cancel, cancelAfter: 10}
+	var out encodeTestWorld
+	targets := map[string]interface{}{dfvcs.SideOurs: &out}
+	_, err = unmarshalSides(ctx, source, "index.json", targets, nil, Options{ReadWorkers: workers})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	// Decoding waits for any reads that had already started
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if source.opened > source.cancelAfter+workers {
+		t.Errorf("opened %d files, want at most %d once cancelled", source.opened, source.cancelAfter+workers)
+	}
+}
+
+// BenchmarkReadWorkers decodes from a filesystem that takes 100µs to open
+// each file, where workers=0 reads them one at a time
+func BenchmarkReadWorkers(b *testing.B) {
+	files, err := Marshal("index.json", newBenchmarkWorld(500))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, workers := range []int{0, 1, 4, 16, 64} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			source := &slowSource{fileSource: newMemorySource(files), latency: 100 * time.Microsecond}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var out encodeTestWorld
+				targets := map[string]interface{}{dfvcs.SideOurs: &out}
+				if _, err := unmarshalSides(context.Background(), source, "index.json", targets, nil, Options{ReadWorkers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package dfjson
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// sourceKey is the key written to each file when Options.Provenance is set
+const sourceKey = "__source"
+
+// removeObjectKey returns data with key removed from the top-level JSON object
+// in data, keeping the formatting of the remaining data intact.
+func removeObjectKey(data []byte, key string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		// Nothing to remove if it's not an object
+		return data, nil
+	}
+	isFirstMember := true
+	for dec.More() {
+		// For every member but the first, this includes the comma before it
+		memberStart := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		memberEnd := dec.InputOffset()
+		if tok != key {
+			isFirstMember = false
+			continue
+		}
+		if isFirstMember {
+			// Remove the comma after the member instead
+			rest := bytes.TrimLeft(data[memberEnd:], " \t\r\n")
+			if len(rest) > 0 && rest[0] == ',' {
+				memberEnd = int64(len(data)-len(rest)) + 1
+			}
+		}
+		result := make([]byte, 0, len(data))
+		result = append(result, data[:memberStart]...)
+		result = append(result, data[memberEnd:]...)
+		return result, nil
+	}
+	return data, nil
+}
@@ -0,0 +1,77 @@
+package dfjson
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	tests := []struct {
+		name       string
+		provenance bool
+		want       map[string]string
+	}{
+		{
+			name: "disabled",
+			want: map[string]string{
+				"index.json":                  "{\n\t\"name\": \"world\"\n}",
+				"creatures/goblin/index.json": "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}",
+				"creatures/orc/index.json":    "{\n\t\"name\": \"Orc\",\n\t\"hp\": 30\n}",
+			},
+		},
+		{
+			name:       "enabled",
+			provenance: true,
+			want: map[string]string{
+				"index.json":                  "{\n\t\"__source\": \"dfjson.encodeTestWorld\",\n\t\"name\": \"world\"\n}",
+				"creatures/goblin/index.json": "{\n\t\"__source\": \"dfjson.encodeTestWorld.Creatures[\\\"goblin\\\"]\",\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}",
+				"creatures/orc/index.json":    "{\n\t\"__source\": \"dfjson.encodeTestWorld.Creatures[\\\"orc\\\"]\",\n\t\"name\": \"Orc\",\n\t\"hp\": 30\n}",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := Options{Provenance: test.provenance}
+			in := newEncodeTestWorld()
+			files, err := MarshalWithOptions("index.json", in, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileData(files); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+
+			opts.DisallowUnknownFields = true
+			var out encodeTestWorld
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("decoded %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+func TestRemoveObjectKey(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`{"__source": "x", "a": 1}`, `{ "a": 1}`},
+		{`{"a": 1, "__source": "x", "b": 2}`, `{"a": 1, "b": 2}`},
+		{`{"a": 1, "__source": {"nested": [1, 2]}}`, `{"a": 1}`},
+		{`{"a": {"__source": "x"}}`, `{"a": {"__source": "x"}}`},
+		{`{"__source": "x"}`, `{}`},
+		{`[1, 2]`, `[1, 2]`},
+	}
+	for _, test := range tests {
+		got, err := removeObjectKey([]byte(test.data), sourceKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("removeObjectKey(%s) = %s, want %s", test.data, got, test.want)
+		}
+	}
+}
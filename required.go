@@ -0,0 +1,77 @@
+package dfjson
+
+import (
+	"path"
+	"reflect"
+	"strings"
+)
+
+// RequiredError is returned by Unmarshal when the directories of distributable
+// fields tagged with `required:"true"`, or of the map keys listed by a
+// `requiredKeys:"goblin,orc"` tag, don't exist.
+type RequiredError struct {
+	// Missing lists the path of each missing directory
+	Missing []string
+}
+
+func (e *RequiredError) Error() string {
+	messages := make([]string, len(e.Missing))
+	for i, path := range e.Missing {
+		messages[i] = path + ": required directory is missing"
+	}
+	return strings.Join(messages, "\n")
+}
+
+// checkRequired records the required directories of the value of type t
+// in topDir that are missing. present maps the keys that have a directory to
+// the directory and fileKeys returns the keys defined in the file itself,
+// which also count.
+func (state *decodeState) checkRequired(topDir string, t reflect.Type, present map[string]string, fileKeys func() (map[string]bool, error)) error {
+	isMissing := func(key string) (bool, error) {
+		if _, ok := present[key]; ok {
+			return false, nil
+		}
+		keys, err := fileKeys()
+		if err != nil {
+			return false, err
+		}
+		return !keys[key], nil
+	}
+	// Keys required by the field holding this map
+	for _, key := range state.requiredKeys[topDir] {
+		missing, err := isMissing(key)
+		if err != nil {
+			return err
+		}
+		if missing {
+			state.missing = append(state.missing, path.Join(topDir, key))
+		}
+	}
+	t = derefType(t)
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	for _, f := range typeFields(t) {
+		if !f.required && len(f.requiredKeys) == 0 {
+			continue
+		}
+		missing, err := isMissing(f.name)
+		if err != nil {
+			return err
+		}
+		dir := path.Join(topDir, f.group, f.name)
+		if !missing {
+			if fieldDir, ok := present[f.name]; ok && len(f.requiredKeys) > 0 {
+				state.requiredKeys[path.Join(topDir, fieldDir)] = f.requiredKeys
+			}
+			continue
+		}
+		if f.required {
+			state.missing = append(state.missing, dir)
+		}
+		for _, key := range f.requiredKeys {
+			state.missing = append(state.missing, path.Join(dir, key))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package dfjson
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type requiredTestWorld struct {
+	Name      string                         `json:"name"`
+	Creatures map[string]*encodeTestCreature `json:"creatures" dfjson:"distributable" requiredKeys:"goblin,orc"`
+	Items     map[string]int                 `json:"items" dfjson:"distributable" required:"true"`
+}
+
+func TestRequired(t *testing.T) {
+	tests := []struct {
+		name        string
+		remove      []string
+		wantMissing []string
+	}{
+		{
+			name: "all present",
+		},
+		{
+			name:        "missing field",
+			remove:      []string{"items/sword/index.json"},
+			wantMissing: []string{"items"},
+		},
+		{
+			name:        "missing key",
+			remove:      []string{"creatures/orc/index.json"},
+			wantMissing: []string{"creatures/orc"},
+		},
+		{
+			name:        "errors are aggregated",
+			remove:      []string{"items/sword/index.json", "creatures/goblin/index.json", "creatures/orc/index.json"},
+			wantMissing: []string{"creatures/goblin", "creatures/orc", "items"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := &requiredTestWorld{
+				Name: "world",
+				Creatures: map[string]*encodeTestCreature{
+					"goblin": {Name: "Goblin", HP: 12},
+					"orc":    {Name: "Orc", HP: 30},
+				},
+				Items: map[string]int{"sword": 3},
+			}
+			files, err := Marshal("index.json", in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fsys := filesFS(files)
+			for _, path := range test.remove {
+				delete(fsys, path)
+			}
+			var out requiredTestWorld
+			err = UnmarshalFS(fsys, "index.json", &out, Options{})
+			if test.wantMissing == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(&out, in) {
+					t.Errorf("got %+v, want %+v", out, in)
+				}
+				return
+			}
+			var requiredErr *RequiredError
+			if !errors.As(err, &requiredErr) {
+				t.Fatalf("got error %v, want a *RequiredError", err)
+			}
+			if !reflect.DeepEqual(requiredErr.Missing, test.wantMissing) {
+				t.Errorf("got missing %q, want %q", requiredErr.Missing, test.wantMissing)
+			}
+		})
+	}
+}
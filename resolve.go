@@ -0,0 +1,49 @@
+package dfjson
+
+import (
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// ConflictResolver returns the contents that a conflicted file should be
+// decoded with, given our and their side of it, see Options.ConflictResolver.
+//
+// ours and theirs are only valid until it returns.
+type ConflictResolver func(path string, ours, theirs []byte) ([]byte, error)
+
+// OursWins is a ConflictResolver that keeps our side of every conflicted file
+func OursWins(path string, ours, theirs []byte) ([]byte, error) {
+	return ours, nil
+}
+
+// TheirsWins is a ConflictResolver that keeps their side of every conflicted file
+func TheirsWins(path string, ours, theirs []byte) ([]byte, error) {
+	return theirs, nil
+}
+
+// resolveDriverConflict resolves the conflicted file that the driver
+// last wrote into each buffer, see resolveConflict.
+func (state *decodeState) resolveDriverConflict(path string, fileStarts []int) error {
+	ours := state.bufs[0].Bytes()[fileStarts[0]:]
+	theirs := ours
+	for i, side := range state.sides {
+		if side == dfvcs.SideTheirs {
+			theirs = state.bufs[i].Bytes()[fileStarts[i]:]
+			break
+		}
+	}
+	return state.resolveConflict(path, fileStarts, ours, theirs)
+}
+
+// resolveConflict replaces the file that was last written into each buffer
+// with the result of calling Options.ConflictResolver on ours and theirs.
+func (state *decodeState) resolveConflict(path string, fileStarts []int, ours, theirs []byte) error {
+	data, err := state.opts.ConflictResolver(path, ours, theirs)
+	if err != nil {
+		return err
+	}
+	// data may be a side held by the buffers, so copy it before they're rewritten
+	data = copyBytes(data)
+	return state.rewriteFile(fileStarts, func([]byte) ([]byte, error) {
+		return data, nil
+	})
+}
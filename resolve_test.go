@@ -0,0 +1,144 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// maxHPWins is a ConflictResolver that merges creatures by
+// keeping the highest HP of either side
+func maxHPWins(path string, ours, theirs []byte) ([]byte, error) {
+	var oursCreature, theirsCreature decodeTestCreature
+	if err := json.Unmarshal(ours, &oursCreature); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(theirs, &theirsCreature); err != nil {
+		return nil, err
+	}
+	if theirsCreature.HP > oursCreature.HP {
+		return theirs, nil
+	}
+	return ours, nil
+}
+
+func TestConflictResolver(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver ConflictResolver
+		want     map[string]*decodeTestCreature
+		wantErr  string
+	}{
+		{
+			name:     "ours wins",
+			resolver: OursWins,
+			want:     map[string]*decodeTestCreature{"goblin": {HP: 10}, "orc": {HP: 30}, "dragon": {HP: 100}},
+		},
+		{
+			name:     "theirs wins",
+			resolver: TheirsWins,
+			want:     map[string]*decodeTestCreature{"goblin": {HP: 15}, "orc": {HP: 25}, "dragon": {HP: 100}},
+		},
+		{
+			name:     "callback",
+			resolver: maxHPWins,
+			want:     map[string]*decodeTestCreature{"goblin": {HP: 15}, "orc": {HP: 30}, "dragon": {HP: 100}},
+		},
+		{
+			name: "callback error",
+			resolver: func(path string, ours, theirs []byte) ([]byte, error) {
+				return nil, errors.New("cannot resolve")
+			},
+			wantErr: "index.json: cannot resolve",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			in := &decodeTestWorld{Name: "world", Creatures: map[string]*decodeTestCreature{
+				"goblin": {HP: 1}, "orc": {HP: 1}, "dragon": {HP: 100},
+			}}
+			if err := MarshalTo(root, "index.json", in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			// Only the goblin and orc are conflicted, the dragon is read from disk
+			driver := dfvcs.NewMockDriver()
+			driver.Add(filepath.Join(root, "creatures", "goblin", "index.json"), []byte(`{"hp": 10}`), []byte(`{"hp": 15}`))
+			driver.Add(filepath.Join(root, "creatures", "orc", "index.json"), []byte(`{"hp": 30}`), []byte(`{"hp": 25}`))
+
+			var resolvedPaths []string
+			resolver := func(path string, ours, theirs []byte) ([]byte, error) {
+				resolvedPaths = append(resolvedPaths, filepath.ToSlash(path))
+				return test.resolver(path, ours, theirs)
+			}
+			var out decodeTestWorld
+			opts := Options{ConflictResolver: resolver}
+			hasMergeConflict, err := UnmarshalWithOptions(filepath.Join(root, "index.json"), &out, nil, driver, opts)
+			if test.wantErr != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every conflict was resolved into a single value
+			if hasMergeConflict {
+				t.Error("got a merge conflict, want it resolved")
+			}
+			if !reflect.DeepEqual(out.Creatures, test.want) {
+				t.Errorf("got %+v, want %+v", out.Creatures, test.want)
+			}
+			for _, path := range resolvedPaths {
+				if !strings.HasSuffix(path, "/goblin/index.json") && !strings.HasSuffix(path, "/orc/index.json") {
+					t.Errorf("resolved %s, which isn't conflicted", path)
+				}
+			}
+			if len(resolvedPaths) != 2 {
+				t.Errorf("resolved %q, want the goblin and orc", resolvedPaths)
+			}
+		})
+	}
+}
+
+func TestConflictResolverMarkers(t *testing.T) {
+	root := t.TempDir()
+	writeFile := func(path, data string) {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("index.json", `{"name": "world"}`)
+	writeFile("creatures/goblin/index.json", "{\n<<<<<<< HEAD\n\t\"hp\": 10\n=======\n\t\"hp\": 15\n>>>>>>> other\n}")
+	for _, test := range []struct {
+		resolver ConflictResolver
+		want     int
+	}{
+		{OursWins, 10},
+		{TheirsWins, 15},
+	} {
+		var out decodeTestWorld
+		opts := Options{ConflictMarkers: &ConflictMarkers{}, ConflictResolver: test.resolver}
+		hasMergeConflict, err := UnmarshalWithOptions(filepath.Join(root, "index.json"), &out, nil, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasMergeConflict {
+			t.Error("got a merge conflict, want it resolved")
+		}
+		if got := out.Creatures["goblin"].HP; got != test.want {
+			t.Errorf("got hp %d, want %d", got, test.want)
+		}
+	}
+}
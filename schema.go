@@ -0,0 +1,53 @@
+package dfjson
+
+import (
+	"errors"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// SchemaValidator validates a document against a JSON Schema, allowing
+// any JSON Schema implementation to be used with Options.Schema.
+type SchemaValidator interface {
+	// Validate returns an error describing every way that document,
+	// the stitched JSON of the decoded files, violates schema.
+	Validate(schema []byte, document []byte) error
+}
+
+// SchemaError is returned by Unmarshal when the stitched
+// document doesn't match Options.Schema
+type SchemaError struct {
+	// Side is the side of a merge conflict that failed validation,
+	// ie. "theirs", or empty if it was ours
+	Side string
+	// Err is the error returned by the SchemaValidator
+	Err error
+}
+
+func (e *SchemaError) Error() string {
+	if e.Side != "" {
+		return e.Side + ": schema validation failed: " + e.Err.Error()
+	}
+	return "schema validation failed: " + e.Err.Error()
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// validateSchema validates the stitched document of side against Options.Schema
+func (opts *Options) validateSchema(side string, document []byte) error {
+	if len(opts.Schema) == 0 {
+		return nil
+	}
+	if opts.SchemaValidator == nil {
+		return errors.New("Options.Schema is set but Options.SchemaValidator is nil")
+	}
+	if err := opts.SchemaValidator.Validate(opts.Schema, document); err != nil {
+		if side == dfvcs.SideOurs {
+			side = ""
+		}
+		return &SchemaError{Side: side, Err: err}
+	}
+	return nil
+}
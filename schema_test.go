@@ -0,0 +1,131 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// requiredValidator is a SchemaValidator that only supports
+// the "required" keyword of the top-level object
+type requiredValidator struct{}
+
+func (requiredValidator) Validate(schema []byte, document []byte) error {
+	var s struct {
+		Required []string `json:"required"`
+	}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return err
+	}
+	var missing []string
+	for _, key := range s.Required {
+		if _, ok := doc[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing properties: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func TestSchema(t *testing.T) {
+	const schema = `{"type": "object", "required": ["name", "creatures"]}`
+	tests := []struct {
+		name      string
+		files     map[string]string
+		validator SchemaValidator
+		wantErr   string
+	}{
+		{
+			name: "valid",
+			files: map[string]string{
+				"index.json":                  `{"name": "world"}`,
+				"creatures/goblin/index.json": `{"hp": 1}`,
+			},
+			validator: requiredValidator{},
+		},
+		{
+			name: "missing field",
+			files: map[string]string{
+				"index.json": `{"name": "world"}`,
+			},
+			validator: requiredValidator{},
+			wantErr:   "schema validation failed: missing properties: creatures",
+		},
+		{
+			name: "missing fields",
+			files: map[string]string{
+				"index.json": `{}`,
+			},
+			validator: requiredValidator{},
+			wantErr:   "schema validation failed: missing properties: name, creatures",
+		},
+		{
+			name: "no validator",
+			files: map[string]string{
+				"index.json": `{"name": "world"}`,
+			},
+			wantErr: "Options.Schema is set but Options.SchemaValidator is nil",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := make(fstest.MapFS, len(test.files))
+			for path, data := range test.files {
+				fsys[path] = &fstest.MapFile{Data: []byte(data)}
+			}
+			var out decodeTestWorld
+			opts := Options{Schema: []byte(schema), SchemaValidator: test.validator}
+			err := UnmarshalFS(fsys, "index.json", &out, opts)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+			if test.validator != nil {
+				var schemaErr *SchemaError
+				if !errors.As(err, &schemaErr) || schemaErr.Side != "" {
+					t.Errorf("got error %#v, want a *SchemaError for our side", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaSides(t *testing.T) {
+	root := t.TempDir()
+	in := &decodeTestWorld{Name: "world", Creatures: map[string]*decodeTestCreature{"goblin": {HP: 1}}}
+	if err := MarshalTo(root, "index.json", in, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// Their side of the entry file removed the name
+	entryFilename := filepath.Join(root, "index.json")
+	driver := dfvcs.NewMockDriver()
+	driver.Add(entryFilename, []byte(`{"name": "world"}`), []byte(`{}`))
+
+	var ours, theirs decodeTestWorld
+	opts := Options{Schema: []byte(`{"required": ["name"]}`), SchemaValidator: requiredValidator{}}
+	_, err := UnmarshalWithOptions(entryFilename, &ours, &theirs, driver, opts)
+	if want := "theirs: schema validation failed: missing properties: name"; err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) || schemaErr.Side != dfvcs.SideTheirs {
+		t.Errorf("got error %#v, want a *SchemaError for their side", err)
+	}
+}
@@ -0,0 +1,115 @@
+package dfjson
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// fileSource is what decode reads files and directories from
+type fileSource interface {
+	// Open opens the file at path, returning an error that
+	// satisfies os.IsNotExist if there is no such file.
+	Open(path string) (io.ReadCloser, error)
+	// ReadDirNames returns the names of the directories within dir, sorted
+	// so that decoding writes keys in the same order on every machine
+	ReadDirNames(dir string) ([]string, error)
+}
+
+// osSource reads from the operating system's filesystem
+type osSource struct{}
+
+func (osSource) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (osSource) ReadDirNames(dir string) ([]string, error) {
+	// os.ReadDir returns the entries sorted by name
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// fsSource reads from an fs.FS
+type fsSource struct {
+	fsys fs.FS
+}
+
+func (source fsSource) Open(name string) (io.ReadCloser, error) {
+	return source.fsys.Open(cleanPath(name))
+}
+
+func (source fsSource) ReadDirNames(dir string) ([]string, error) {
+	entries, err := fs.ReadDir(source.fsys, cleanPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	// fs.ReadDir leaves sorting to filesystems that implement fs.ReadDirFS
+	sort.Strings(names)
+	return names, nil
+}
+
+// memorySource reads from files held in memory, such as those returned by Marshal
+type memorySource struct {
+	files map[string][]byte
+	dirs  map[string][]string
+}
+
+func newMemorySource(files []JSONFile) *memorySource {
+	source := &memorySource{
+		files: make(map[string][]byte, len(files)),
+		dirs:  make(map[string][]string),
+	}
+	hasDir := make(map[string]bool)
+	for _, file := range files {
+		filePath := cleanPath(file.Path)
+		source.files[filePath] = file.Data
+		// Register each directory leading to the file with its parent
+		for dir := path.Dir(filePath); dir != "." && dir != "/" && !hasDir[dir]; dir = path.Dir(dir) {
+			hasDir[dir] = true
+			parent := path.Dir(dir)
+			source.dirs[parent] = append(source.dirs[parent], path.Base(dir))
+		}
+	}
+	for _, names := range source.dirs {
+		sort.Strings(names)
+	}
+	return source
+}
+
+func (source *memorySource) Open(filePath string) (io.ReadCloser, error) {
+	data, ok := source.files[cleanPath(filePath)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filePath, Err: os.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (source *memorySource) ReadDirNames(dir string) ([]string, error) {
+	return source.dirs[cleanPath(dir)], nil
+}
+
+// cleanPath normalizes path to use / and removes redundant elements,
+// ie. "./creatures/goblin/index.json" becomes "creatures/goblin/index.json"
+func cleanPath(p string) string {
+	return path.Clean(strings.ReplaceAll(p, "\\", "/"))
+}
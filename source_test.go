@@ -0,0 +1,238 @@
+package dfjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// unsortedFS is an fs.FS that doesn't implement fs.ReadDirFS and
+// whose directories list their entries in reverse order
+type unsortedFS struct {
+	fs.FS
+}
+
+func (fsys unsortedFS) Open(name string) (fs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir, ok := f.(fs.ReadDirFile); ok {
+		return &reversedDir{dir}, nil
+	}
+	return f, nil
+}
+
+// reversedDir lists its entries in reverse order
+type reversedDir struct {
+	fs.ReadDirFile
+}
+
+func (dir *reversedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := dir.ReadDirFile.ReadDir(n)
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+// sourceTestRawWorld keeps the document assembled by the decoder
+type sourceTestRawWorld struct {
+	Name      string                         `json:"name"`
+	Creatures map[string]*decodeTestCreature `json:"creatures" dfjson:"distributable"`
+	raw       []byte
+}
+
+func (w *sourceTestRawWorld) UnmarshalJSON(data []byte) error {
+	w.raw = append([]byte(nil), data...)
+	return nil
+}
+
+// shuffledFS is an fs.ReadDirFS that returns entries in a random order,
+// as fs.ReadDir only sorts them for filesystems that don't implement it
+type shuffledFS struct {
+	fs.FS
+	rand *rand.Rand
+}
+
+func (fsys shuffledFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(fsys.FS, name)
+	fsys.rand.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+	return entries, err
+}
+
+func TestDecodeOrder(t *testing.T) {
+	in := &decodeTestWorld{Name: "world", Creatures: make(map[string]*decodeTestCreature)}
+	for _, name := range []string{"orc", "bat", "goblin", "zombie", "ant"} {
+		in.Creatures[name] = &decodeTestCreature{HP: len(name)}
+	}
+	files, err := Marshal("index.json", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	fsyss := []fs.FS{filesFS(files), unsortedFS{filesFS(files)}}
+	for seed := int64(0); seed < 10; seed++ {
+		fsyss = append(fsyss, shuffledFS{filesFS(files), rand.New(rand.NewSource(seed))})
+	}
+	for _, fsys := range fsyss {
+		var out sourceTestRawWorld
+		if err := UnmarshalFS(fsys, "index.json", &out, Options{}); err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			want = out.raw
+			continue
+		}
+		if string(out.raw) != string(want) {
+			t.Errorf("got document\n%s\nwant\n%s", out.raw, want)
+		}
+	}
+	var keys []string
+	dec := json.NewDecoder(bytes.NewReader(want))
+	for depth := 0; ; {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch tok := tok.(type) {
+		case json.Delim:
+			if tok == '{' || tok == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		case string:
+			// Keys of the creatures object
+			if depth == 2 {
+				keys = append(keys, tok)
+			}
+		}
+	}
+	if want := []string{"ant", "bat", "goblin", "orc", "zombie"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %q, want %q", keys, want)
+	}
+}
+
+func TestSources(t *testing.T) {
+	files, err := Marshal("index.json", newEncodeTestWorld())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := MarshalTo(root, "index.json", newEncodeTestWorld(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	rootSlash := filepath.ToSlash(root)
+	tests := []struct {
+		name   string
+		source fileSource
+		// prefix is prepended to the paths within source
+		prefix string
+	}{
+		{"os", osSource{}, rootSlash + "/"},
+		{"fs", fsSource{fsys: os.DirFS(root)}, ""},
+		{"fs without ReadDirFS", fsSource{fsys: unsortedFS{filesFS(files)}}, ""},
+		{"fs with dot prefix", fsSource{fsys: filesFS(files)}, "./"},
+		{"memory", newMemorySource(files), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, dir := range []string{test.prefix + "creatures", test.prefix + "creatures/"} {
+				names, err := test.source.ReadDirNames(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := []string{"goblin", "orc"}; !reflect.DeepEqual(names, want) {
+					t.Errorf("ReadDirNames(%q) = %q, want %q", dir, names, want)
+				}
+			}
+			names, err := test.source.ReadDirNames(test.prefix + "creatures/goblin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 0 {
+				t.Errorf("got directories %q within a directory holding only a file", names)
+			}
+
+			f, err := test.source.Open(test.prefix + "creatures/goblin/index.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(data), fileData(files)["creatures/goblin/index.json"]; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+
+			if _, err := test.source.Open(test.prefix + "creatures/troll/index.json"); !os.IsNotExist(err) {
+				t.Errorf("got error %v opening a missing file, want one satisfying os.IsNotExist", err)
+			}
+		})
+	}
+}
+
+func TestDecodeFS(t *testing.T) {
+	root := t.TempDir()
+	if err := MarshalTo(filepath.Join(root, "assets", "world"), "index.json", newEncodeTestWorld(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		fsys  fs.FS
+		entry string
+	}{
+		{"os.DirFS", os.DirFS(root), "assets/world/index.json"},
+		{"sub", mustSub(t, os.DirFS(root), "assets"), "world/index.json"},
+		{"unclean entry", os.DirFS(root), "./assets/world/../world/index.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out encodeTestWorld
+			if err := NewDecoder().DecodeFS(test.fsys, test.entry, &out); err != nil {
+				t.Fatal(err)
+			}
+			if want := newEncodeTestWorld(); !reflect.DeepEqual(&out, want) {
+				t.Errorf("got %+v, want %+v", out, want)
+			}
+		})
+	}
+
+	// Decoding from the OS filesystem is still the default
+	var out encodeTestWorld
+	if _, err := Unmarshal(filepath.Join(root, "assets", "world", "index.json"), &out, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := newEncodeTestWorld(); !reflect.DeepEqual(&out, want) {
+		t.Errorf("got %+v, want %+v", out, want)
+	}
+
+	err := NewDecoder().DecodeFS(os.DirFS(root), "missing/index.json", &out)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v, want a missing file error", err)
+	}
+}
+
+func mustSub(t *testing.T, fsys fs.FS, dir string) fs.FS {
+	t.Helper()
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
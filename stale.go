@@ -0,0 +1,126 @@
+package dfjson
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// removeStale removes files and directories written by a previous call to
+// Marshal from the entry directory that are not part of files anymore,
+// ie. the directory of a map key that has since been deleted.
+//
+// Only files that dfjson writes itself are removed, directories are only
+// removed once they're empty so unrelated files are never touched.
+func removeStale(root string, entryFilename string, t reflect.Type, files []JSONFile, opts *Options) error {
+	return walkStale(root, entryFilename, t, files, opts, func(path string, isDir bool) error {
+		if !isDir {
+			return os.Remove(longPath(path))
+		}
+		remaining, err := os.ReadDir(longPath(path))
+		if err != nil {
+			return err
+		}
+		if len(remaining) == 0 {
+			return os.Remove(longPath(path))
+		}
+		return nil
+	})
+}
+
+// walkStale calls fn with the path of each managed file below the entry
+// directory that isn't part of files, and then with each directory
+// that isn't either, after its contents have been walked.
+//
+// Only the directories of the distributable fields of t and the top-level
+// directories of files are walked, as the entry directory can hold other
+// data, ie. when the entry file is directly in root. Files directly in the
+// entry directory are never passed to fn for the same reason.
+func walkStale(root string, entryFilename string, t reflect.Type, files []JSONFile, opts *Options, fn func(path string, isDir bool) error) error {
+	keep := make(map[string]bool, len(files))
+	entryDir := filepath.Join(root, filepath.FromSlash(dirOf(entryFilename)))
+	managed := make(map[string]bool)
+	for _, dirName := range distributableDirNames(t) {
+		managed[filepath.Join(entryDir, dirName)] = true
+	}
+	for _, file := range files {
+		path := filepath.Join(root, filepath.FromSlash(file.Path))
+		keep[path] = true
+		// Keep every directory leading to the file as well
+		for dir := filepath.Dir(path); len(dir) > len(entryDir) && !keep[dir]; dir = filepath.Dir(dir) {
+			keep[dir] = true
+			if filepath.Dir(dir) == entryDir {
+				managed[dir] = true
+			}
+		}
+	}
+	return walkStaleDir(entryDir, keep, managed, opts, fn)
+}
+
+// distributableDirNames returns the names of the directories that the
+// distributable fields of t are written to within its directory
+func distributableDirNames(t reflect.Type) []string {
+	if !isStructType(t) {
+		return nil
+	}
+	var dirNames []string
+	for _, f := range typeFields(derefType(t)) {
+		if !f.distributable {
+			continue
+		}
+		if f.group != "" {
+			dirNames = append(dirNames, strings.SplitN(f.group, "/", 2)[0])
+			continue
+		}
+		dirNames = append(dirNames, f.name)
+	}
+	return dirNames
+}
+
+// walkStaleDir calls fn with the managed files within dir that aren't in keep
+// and recurses into its subdirectories, see walkStale. If managed is set, dir
+// is the entry directory, so only the subdirectories in it are walked and its
+// files are left alone.
+func walkStaleDir(dir string, keep map[string]bool, managed map[string]bool, opts *Options, fn func(path string, isDir bool) error) error {
+	infos, err := os.ReadDir(longPath(dir))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if managed != nil && (!info.IsDir() || !managed[path]) {
+			// Files next to the entry file may belong to something
+			// else, ie. another entry file's index.json
+			continue
+		}
+		if keep[path] {
+			if info.IsDir() {
+				if err := walkStaleDir(path, keep, nil, opts, fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !info.IsDir() {
+			// Only touch files that dfjson writes itself
+			if name := info.Name(); opts.isIndexFilename(name) || name == keysFilename || name == orderFilename || isChunkFilename(name) {
+				if err := fn(path, false); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if isHiddenDir(info.Name()) {
+			// Never touch directories that aren't part of the data, ie. ".git"
+			continue
+		}
+		if err := walkStaleDir(path, keep, nil, opts, fn); err != nil {
+			return err
+		}
+		if err := fn(path, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
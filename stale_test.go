@@ -0,0 +1,106 @@
+package dfjson
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type staleTestValue struct {
+	Items map[string]int `dfjson:"distributable"`
+	Extra *struct {
+		Name string
+	} `dfjson:"distributable"`
+}
+
+func TestRemoveStale(t *testing.T) {
+	tests := []struct {
+		name        string
+		entry       string
+		before      staleTestValue
+		after       staleTestValue
+		unrelated   []string
+		wantRemoved []string
+		wantKept    []string
+	}{
+		{
+			name:        "entry in root",
+			entry:       "index.json",
+			before:      staleTestValue{Items: map[string]int{"a": 1, "b": 2}},
+			after:       staleTestValue{Items: map[string]int{"a": 1}},
+			unrelated:   []string{"other/index.json", "other/b/index.json"},
+			wantRemoved: []string{"Items/b/index.json", "Items/b"},
+			wantKept:    []string{"index.json", "Items/a/index.json", "other/index.json", "other/b/index.json"},
+		},
+		{
+			name:        "entry in subdirectory",
+			entry:       "data/index.json",
+			before:      staleTestValue{Items: map[string]int{"a": 1, "b": 2}},
+			after:       staleTestValue{Items: map[string]int{"b": 2}},
+			unrelated:   []string{"other/index.json", "data/notes.txt"},
+			wantRemoved: []string{"data/Items/a"},
+			wantKept:    []string{"data/Items/b/index.json", "other/index.json", "data/notes.txt"},
+		},
+		{
+			name:  "field set to nil",
+			entry: "index.json",
+			before: staleTestValue{Items: map[string]int{"a": 1}, Extra: &struct {
+				Name string
+			}{"x"}},
+			after:       staleTestValue{Items: map[string]int{"a": 1}},
+			unrelated:   []string{"other/index.json"},
+			wantRemoved: []string{"Extra/index.json", "Extra"},
+			wantKept:    []string{"Items/a/index.json", "other/index.json"},
+		},
+		{
+			// Files next to the entry file aren't written by this
+			// encode, even if they have the names of files it writes
+			name:        "files next to the entry file",
+			entry:       "data/world.json",
+			before:      staleTestValue{Items: map[string]int{"a": 1, "b": 2}},
+			after:       staleTestValue{Items: map[string]int{"a": 1}},
+			unrelated:   []string{"data/index.json", "data/_keys.json", "data/_order.json", "data/chunk_0.json"},
+			wantRemoved: []string{"data/Items/b"},
+			wantKept:    []string{"data/world.json", "data/Items/a/index.json", "data/index.json", "data/_keys.json", "data/_order.json", "data/chunk_0.json"},
+		},
+		{
+			name:        "unrelated files in managed directory",
+			entry:       "index.json",
+			before:      staleTestValue{Items: map[string]int{"a": 1, "b": 2}},
+			after:       staleTestValue{Items: map[string]int{"a": 1}},
+			unrelated:   []string{"Items/b/notes.txt"},
+			wantRemoved: []string{"Items/b/index.json"},
+			wantKept:    []string{"Items/b/notes.txt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := MarshalTo(root, test.entry, &test.before, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range test.unrelated {
+				path = filepath.Join(root, filepath.FromSlash(path))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := MarshalTo(root, test.entry, &test.after, Options{RemoveStale: true}); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range test.wantRemoved {
+				if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(path))); !os.IsNotExist(err) {
+					t.Errorf("%s: got %v, want it removed", path, err)
+				}
+			}
+			for _, path := range test.wantKept {
+				if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(path))); err != nil {
+					t.Errorf("%s: %v", path, err)
+				}
+			}
+		})
+	}
+}
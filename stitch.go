@@ -0,0 +1,54 @@
+package dfjson
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/silbinarywolf/sweditor/internal/dfjson/dfvcs"
+)
+
+// StitchBytes stitches the files returned by Marshal back into the single
+// JSON document they represent, in memory and without touching the disk.
+//
+// Keys written inline in a file come before keys that were distributed into
+// directories, so the order of keys may differ from encoding/json. As the type
+// of the encoded value isn't known, arrays that were distributed into numbered
+// directories are stitched as objects keyed by index, use MarshalStitched to
+// restore them.
+func StitchBytes(entryFilename string, files []JSONFile) ([]byte, error) {
+	return stitchBytes(entryFilename, files, nil)
+}
+
+// stitchBytes is StitchBytes but t is the type of the encoded value
+// so that arrays written into numbered directories are restored.
+func stitchBytes(entryFilename string, files []JSONFile, t reflect.Type) ([]byte, error) {
+	var state decodeState
+	state.ctx = context.Background()
+	state.opts = Options{}.withDefaults()
+	state.source = newMemorySource(files)
+	state.initSides([]string{dfvcs.SideOurs})
+	// Files of subtrees tagged with a format are still JSON
+	state.rawFormats = true
+	entryFilename = cleanPath(entryFilename)
+	state.entryFilename = entryFilename
+	if err := state.decode(entryFilename, t); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, state.bufs[0].Bytes()); err != nil {
+		return nil, state.fileError(err, 0)
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalStitched returns the single JSON document that the files produced by
+// Marshal represent, ie. for serving the data over HTTP.
+func MarshalStitched(entryFilename string, v interface{}) ([]byte, error) {
+	files, err := marshal(entryFilename, v, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return stitchBytes(entryFilename, files, reflect.TypeOf(v))
+}
@@ -0,0 +1,81 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type stitchTestWorld struct {
+	Name      string                         `json:"name"`
+	Creatures map[string]*encodeTestCreature `json:"creatures" dfjson:"distributable"`
+	Waves     []stitchTestWave               `json:"waves" dfjson:"distributable"`
+	Boss      *encodeTestCreature            `json:"boss,omitempty" dfjson:"distributable"`
+}
+
+type stitchTestWave struct {
+	Spawns []string `json:"spawns"`
+}
+
+// jsonValue returns data decoded into an interface{} so that
+// documents can be compared regardless of the order of their keys
+func jsonValue(t testing.TB, data []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	return v
+}
+
+func TestMarshalStitched(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"map", newEncodeTestWorld()},
+		{"arrays and pointers", &stitchTestWorld{
+			Name:      "world",
+			Creatures: map[string]*encodeTestCreature{"goblin": {Name: "Goblin", HP: 12}, "a/b": {}},
+			Waves:     []stitchTestWave{{Spawns: []string{"goblin"}}, {Spawns: []string{"goblin", "orc"}}},
+			Boss:      &encodeTestCreature{Name: "Boss", HP: 100},
+		}},
+		{"empty", &stitchTestWorld{Creatures: map[string]*encodeTestCreature{}, Waves: []stitchTestWave{}}},
+		{"top level map", map[string]*encodeTestCreature{"goblin": {Name: "Goblin"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MarshalStitched("index.json", test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.MarshalIndent(test.v, "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(jsonValue(t, got), jsonValue(t, want)) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestStitchBytes(t *testing.T) {
+	files, err := Marshal("data/index.json", &stitchTestWorld{
+		Name:  "world",
+		Waves: []stitchTestWave{{Spawns: []string{"goblin"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := StitchBytes("data/index.json", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the type, distributed arrays come back as objects keyed by index
+	// and nil distributable fields are left out as they have no directory
+	want := `{"name":"world","waves":{"0":{"spawns":["goblin"]}}}`
+	if !reflect.DeepEqual(jsonValue(t, got), jsonValue(t, []byte(want))) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
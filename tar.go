@@ -0,0 +1,69 @@
+package dfjson
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MarshalToTar encodes v with MarshalWithOptions and writes the resulting files to w
+// as a tar stream, so that the output can be piped into other tools, ie. "tar -x".
+//
+// Entries are written in sorted path order with fixed modification times so that
+// marshaling the same value always produces the same stream.
+func MarshalToTar(w io.Writer, entryFilename string, v interface{}, opts Options) error {
+	files, err := MarshalWithOptions(entryFilename, v, opts)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		files[i].Path = tarPath(files[i].Path)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	tw := tar.NewWriter(w)
+	hasWrittenDir := make(map[string]bool)
+	for _, file := range files {
+		// Write the parent directories before the file so extracting
+		// doesn't rely on the tool creating them
+		var dirs []string
+		for dir := path.Dir(file.Path); dir != "." && dir != "/" && !hasWrittenDir[dir]; dir = path.Dir(dir) {
+			dirs = append(dirs, dir)
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			dir := dirs[i]
+			hasWrittenDir[dir] = true
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir + "/",
+				Mode:     0755,
+				ModTime:  time.Unix(0, 0),
+			}); err != nil {
+				return err
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.Path,
+			Mode:     0644,
+			Size:     int64(len(file.Data)),
+			ModTime:  time.Unix(0, 0),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// tarPath returns path as a clean relative path for a tar entry
+func tarPath(p string) string {
+	p = path.Clean(strings.ReplaceAll(p, "\\", "/"))
+	return strings.TrimLeft(p, "/")
+}
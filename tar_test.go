@@ -0,0 +1,84 @@
+package dfjson
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMarshalToTar(t *testing.T) {
+	tests := []struct {
+		name          string
+		entryFilename string
+		wantNames     []string
+	}{
+		{
+			name:          "entry in root",
+			entryFilename: "index.json",
+			wantNames: []string{
+				"creatures/", "creatures/goblin/", "creatures/goblin/index.json",
+				"creatures/orc/", "creatures/orc/index.json", "index.json",
+			},
+		},
+		{
+			name:          "entry in subdirectory",
+			entryFilename: "/data/index.json",
+			wantNames: []string{
+				"data/", "data/creatures/", "data/creatures/goblin/", "data/creatures/goblin/index.json",
+				"data/creatures/orc/", "data/creatures/orc/index.json", "data/index.json",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := newEncodeTestWorld()
+			var stream bytes.Buffer
+			if err := MarshalToTar(&stream, test.entryFilename, in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			var again bytes.Buffer
+			if err := MarshalToTar(&again, test.entryFilename, in, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stream.Bytes(), again.Bytes()) {
+				t.Error("marshaling the same value twice produced different streams")
+			}
+
+			// Extract the stream in memory and decode it
+			fsys := make(fstest.MapFS)
+			var names []string
+			tr := tar.NewReader(&stream)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, header.Name)
+				if header.Typeflag != tar.TypeReg {
+					continue
+				}
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fsys[header.Name] = &fstest.MapFile{Data: data}
+			}
+			if !reflect.DeepEqual(names, test.wantNames) {
+				t.Errorf("got entries %q, want %q", names, test.wantNames)
+			}
+			var out encodeTestWorld
+			if err := UnmarshalFS(fsys, tarPath(test.entryFilename), &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
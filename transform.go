@@ -0,0 +1,30 @@
+package dfjson
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// transformTypes walks v and replaces every value whose type has a function
+// in transforms with the result of calling that function on it.
+func transformTypes(v interface{}, transforms map[reflect.Type]func(interface{}) interface{}) error {
+	w := valueWalker{
+		visit: func(v reflect.Value) error {
+			transform, ok := transforms[v.Type()]
+			if !ok {
+				return nil
+			}
+			result := reflect.ValueOf(transform(v.Interface()))
+			if !result.IsValid() {
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			if !result.Type().AssignableTo(v.Type()) {
+				return fmt.Errorf("transform for %s returned %s", v.Type().String(), result.Type().String())
+			}
+			v.Set(result)
+			return nil
+		},
+	}
+	return w.walk(reflect.ValueOf(v))
+}
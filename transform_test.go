@@ -0,0 +1,90 @@
+package dfjson
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+type transformTestWorld struct {
+	Name      string                            `json:"name"`
+	Tags      []string                          `json:"tags"`
+	Creatures map[string]*transformTestCreature `json:"creatures" dfjson:"distributable"`
+}
+
+type transformTestCreature struct {
+	Name  string      `json:"name"`
+	HP    int         `json:"hp"`
+	Extra interface{} `json:"extra"`
+}
+
+func TestTypeTransform(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.json":                  {Data: []byte(`{"name": " world ", "tags": ["  a", "b  "]}`)},
+		"creatures/goblin/index.json": {Data: []byte(`{"name": "\tGoblin\n", "hp": 150, "extra": ["  x  "]}`)},
+	}
+	trim := func(v interface{}) interface{} {
+		return strings.TrimSpace(v.(string))
+	}
+	clamp := func(v interface{}) interface{} {
+		if n := v.(int); n > 100 {
+			return 100
+		}
+		return v
+	}
+	tests := []struct {
+		name       string
+		transforms map[reflect.Type]func(interface{}) interface{}
+		want       transformTestWorld
+		wantErr    string
+	}{
+		{
+			name:       "trim strings",
+			transforms: map[reflect.Type]func(interface{}) interface{}{reflect.TypeOf(""): trim},
+			want: transformTestWorld{
+				Name: "world",
+				Tags: []string{"a", "b"},
+				Creatures: map[string]*transformTestCreature{
+					"goblin": {Name: "Goblin", HP: 150, Extra: []interface{}{"x"}},
+				},
+			},
+		},
+		{
+			name:       "clamp ints",
+			transforms: map[reflect.Type]func(interface{}) interface{}{reflect.TypeOf(0): clamp},
+			want: transformTestWorld{
+				Name: " world ",
+				Tags: []string{"  a", "b  "},
+				Creatures: map[string]*transformTestCreature{
+					"goblin": {Name: "\tGoblin\n", HP: 100, Extra: []interface{}{"  x  "}},
+				},
+			},
+		},
+		{
+			name: "wrong type",
+			transforms: map[reflect.Type]func(interface{}) interface{}{reflect.TypeOf(0): func(v interface{}) interface{} {
+				return "100"
+			}},
+			wantErr: "transform for int returned string",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out transformTestWorld
+			err := UnmarshalFS(fsys, "index.json", &out, Options{TypeTransform: test.transforms})
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, test.want) {
+				t.Errorf("got %+v, want %+v", out, test.want)
+			}
+		})
+	}
+}
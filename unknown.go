@@ -0,0 +1,48 @@
+package dfjson
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// hasField reports whether key is the name of a field of struct type t as
+// matched by encoding/json, including the fields promoted from embedded structs.
+func hasField(t reflect.Type, key string) bool {
+	for _, f := range typeFields(derefType(t)) {
+		if strings.EqualFold(f.name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnknownField reports whether key should be rejected as it isn't
+// a field of type t and Options.DisallowUnknownFields is set
+func (state *decodeState) isUnknownField(t reflect.Type, key string) bool {
+	if !state.opts.DisallowUnknownFields {
+		return false
+	}
+	if t = derefType(t); t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	return !hasField(t, key)
+}
+
+// checkUnknownFields returns an error if the object in the file that
+// was last written into each buffer has a key that isn't a field of type t
+func (state *decodeState) checkUnknownFields(path string, t reflect.Type, fileStarts []int) error {
+	for i, buf := range state.bufs {
+		keys, err := objectKeys(buf.Bytes()[fileStarts[i]:])
+		if err != nil {
+			// Let encoding/json report the syntax error
+			return nil
+		}
+		for key := range keys {
+			if state.isUnknownField(t, key) {
+				return fmt.Errorf("%s: unknown field %q", path, key)
+			}
+		}
+	}
+	return nil
+}
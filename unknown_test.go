@@ -0,0 +1,98 @@
+package dfjson
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+type unknownTestBase struct {
+	ID string `json:"id"`
+}
+
+type unknownTestWorld struct {
+	unknownTestBase
+	Name      string                         `json:"name"`
+	Creatures map[string]*decodeTestCreature `json:"creatures" dfjson:"distributable"`
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name: "known fields",
+			files: map[string]string{
+				"index.json":                  `{"id": "w", "NAME": "world"}`,
+				"creatures/goblin/index.json": `{"hp": 1}`,
+			},
+		},
+		{
+			name: "directory without a field",
+			files: map[string]string{
+				"index.json":          `{"name": "world"}`,
+				"treasure/index.json": `{"gold": 1}`,
+			},
+			wantErr: `treasure: unknown field "treasure"`,
+		},
+		{
+			name: "key in the entry file",
+			files: map[string]string{
+				"index.json": `{"name": "world", "size": 3}`,
+			},
+			wantErr: `index.json: unknown field "size"`,
+		},
+		{
+			name: "key in a distributed file",
+			files: map[string]string{
+				"index.json":                  `{"name": "world"}`,
+				"creatures/goblin/index.json": `{"hp": 1, "mp": 2}`,
+			},
+			wantErr: `creatures/goblin/index.json: unknown field "mp"`,
+		},
+		{
+			name: "directory within a distributed struct",
+			files: map[string]string{
+				"index.json":                       `{"name": "world"}`,
+				"creatures/goblin/index.json":      `{"hp": 1}`,
+				"creatures/goblin/loot/index.json": `{}`,
+			},
+			wantErr: `creatures/goblin/loot: unknown field "loot"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := make(fstest.MapFS, len(test.files))
+			for path, data := range test.files {
+				fsys[path] = &fstest.MapFile{Data: []byte(data)}
+			}
+			var out unknownTestWorld
+			dec := NewDecoder()
+			dec.DisallowUnknownFields()
+			err := dec.DecodeFS(fsys, "index.json", &out)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				// Unknown fields are ignored by default
+				if err := UnmarshalFS(fsys, "index.json", &out, Options{}); err != nil {
+					t.Errorf("got error %v without DisallowUnknownFields", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := unknownTestWorld{
+				unknownTestBase: unknownTestBase{ID: "w"},
+				Name:            "world",
+				Creatures:       map[string]*decodeTestCreature{"goblin": {HP: 1}},
+			}
+			if !reflect.DeepEqual(out, want) {
+				t.Errorf("got %+v, want %+v", out, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package dfjson
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RangeError describes a decoded number that falls outside of the range
+// declared by the `validate:"min=0,max=100"` tag of its field.
+type RangeError struct {
+	// Path is the dotted path to the value, ie. "creatures.goblin.hp"
+	Path  string
+	Value float64
+	// Bound is the part of the tag that was violated, ie. "max=100"
+	Bound string
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%s: %s violates %s", e.Path, strconv.FormatFloat(e.Value, 'g', -1, 64), e.Bound)
+}
+
+// ValidationError is returned by Unmarshal when one or
+// more decoded values fail validation.
+type ValidationError struct {
+	Errors []*RangeError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// numberRange is a parsed `validate` tag
+type numberRange struct {
+	min, max       float64
+	hasMin, hasMax bool
+}
+
+// parseRangeTag parses a `validate` tag such as "min=0,max=100",
+// either bound can be left out.
+func parseRangeTag(tag string) (numberRange, error) {
+	var r numberRange
+	for _, part := range strings.Split(tag, ",") {
+		name, value := part, ""
+		if i := strings.Index(part, "="); i != -1 {
+			name, value = part[:i], part[i+1:]
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return r, fmt.Errorf("invalid validate tag %q: %q is not a number", tag, value)
+		}
+		switch name {
+		case "min":
+			r.min, r.hasMin = n, true
+		case "max":
+			r.max, r.hasMax = n, true
+		default:
+			return r, fmt.Errorf("invalid validate tag %q: unknown rule %q", tag, name)
+		}
+	}
+	return r, nil
+}
+
+// validateFieldCache maps a type to the result of hasValidateFields
+var validateFieldCache sync.Map
+
+// hasValidateFields reports whether a value of type t can hold
+// a field with a `validate` tag
+func hasValidateFields(t reflect.Type) bool {
+	return containsField(&validateFieldCache, t, func(f reflect.StructField) bool {
+		_, ok := f.Tag.Lookup("validate")
+		return ok
+	})
+}
+
+// validateRanges walks v and returns a *ValidationError listing every number
+// that is outside of the range declared by its field's `validate` tag.
+func validateRanges(v interface{}) error {
+	var violations []*RangeError
+	if err := validate(&violations, "", reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Errors: violations}
+	}
+	return nil
+}
+
+func validate(violations *[]*RangeError, path string, v reflect.Value) error {
+	if !v.IsValid() || !hasValidateFields(v.Type()) {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return validate(violations, path, v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		for _, f := range typeFields(t) {
+			fieldPath := joinPath(path, f.name)
+			fieldValue, ok := fieldByIndex(v, f.index)
+			if !ok {
+				continue
+			}
+			if f.validateErr != nil {
+				return fmt.Errorf("%s.%s: %w", t.String(), f.goName, f.validateErr)
+			}
+			if f.validate != nil {
+				if err := f.validate.check(violations, fieldPath, fieldValue); err != nil {
+					return fmt.Errorf("%s.%s: %w", t.String(), f.goName, err)
+				}
+				continue
+			}
+			if err := validate(violations, fieldPath, fieldValue); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]reflect.Value, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := mapKeyString(iter.Key())
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			values[key] = iter.Value()
+		}
+		// Report violations in a stable order
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := validate(violations, joinPath(path, key), values[key]); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := validate(violations, joinPath(path, strconv.Itoa(i)), v.Index(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check adds a violation if the number held by v is outside of the range
+func (r numberRange) check(violations *[]*RangeError, path string, v reflect.Value) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	var n float64
+	switch kind := v.Kind(); kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	default:
+		return fmt.Errorf("validate tag is not supported on kind: %s", kind.String())
+	}
+	if r.hasMin && n < r.min {
+		*violations = append(*violations, &RangeError{
+			Path:  path,
+			Value: n,
+			Bound: "min=" + strconv.FormatFloat(r.min, 'g', -1, 64),
+		})
+	}
+	if r.hasMax && n > r.max {
+		*violations = append(*violations, &RangeError{
+			Path:  path,
+			Value: n,
+			Bound: "max=" + strconv.FormatFloat(r.max, 'g', -1, 64),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package dfjson
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type validateTestCreature struct {
+	HP    int      `json:"hp" validate:"min=0,max=100"`
+	Speed *float64 `json:"speed" validate:"min=1"`
+}
+
+type validateTestWorld struct {
+	Creatures map[string]validateTestCreature `json:"creatures" dfjson:"distributable"`
+	Boss      *validateTestCreature           `json:"boss"`
+}
+
+type validateTestBadTag struct {
+	HP int `validate:"min=zero"`
+}
+
+type validateTestUnsupported struct {
+	Name string `validate:"max=1"`
+}
+
+type validateTestNode struct {
+	Children []*validateTestNode
+	Value    int
+}
+
+func TestValidateRanges(t *testing.T) {
+	slow := 0.5
+	tests := []struct {
+		name    string
+		v       interface{}
+		wantErr string
+	}{
+		{
+			name: "valid",
+			v:    &validateTestWorld{Creatures: map[string]validateTestCreature{"goblin": {HP: 100}}},
+		},
+		{
+			name:    "violations in key order",
+			v:       &validateTestWorld{Creatures: map[string]validateTestCreature{"orc": {HP: 101}, "goblin": {HP: -1, Speed: &slow}}},
+			wantErr: "creatures.goblin.hp: -1 violates min=0\ncreatures.goblin.speed: 0.5 violates min=1\ncreatures.orc.hp: 101 violates max=100",
+		},
+		{
+			name:    "pointer to struct",
+			v:       &validateTestWorld{Boss: &validateTestCreature{HP: 200}},
+			wantErr: "boss.hp: 200 violates max=100",
+		},
+		{
+			name:    "interface",
+			v:       &[]interface{}{validateTestCreature{HP: -5}},
+			wantErr: "0.hp: -5 violates min=0",
+		},
+		{
+			name:    "invalid tag",
+			v:       &validateTestBadTag{},
+			wantErr: `dfjson.validateTestBadTag.HP: invalid validate tag "min=zero": "zero" is not a number`,
+		},
+		{
+			name:    "unsupported kind",
+			v:       &validateTestUnsupported{},
+			wantErr: "dfjson.validateTestUnsupported.Name: validate tag is not supported on kind: string",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateRanges(test.v)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHasValidateFields(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want bool
+	}{
+		{&validateTestWorld{}, true},
+		{map[string][]validateTestCreature{}, true},
+		{&validateTestNode{}, false},
+		{&keysTestValue{}, false},
+		{&[]interface{}{}, true},
+	}
+	for _, test := range tests {
+		if got := hasValidateFields(reflect.TypeOf(test.v)); got != test.want {
+			t.Errorf("%T: got %v, want %v", test.v, got, test.want)
+		}
+	}
+}
+
+func TestUnmarshalValidates(t *testing.T) {
+	in := validateTestWorld{Creatures: map[string]validateTestCreature{"goblin": {HP: 101}}}
+	files, err := Marshal("index.json", &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out validateTestWorld
+	err = UnmarshalFS(filesFS(files), "index.json", &out, Options{})
+	if want := "creatures.goblin.hp: 101 violates max=100"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+}
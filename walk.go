@@ -0,0 +1,93 @@
+package dfjson
+
+import (
+	"reflect"
+)
+
+// valueWalker walks every settable value within a value, such as a decoded
+// value after it's been unmarshaled.
+type valueWalker struct {
+	// visit is called on each settable value before walking into it
+	visit func(v reflect.Value) error
+
+	// visitKey, if set, is called on each map key and returns
+	// the key the map entry should be stored under
+	visitKey func(key reflect.Value) reflect.Value
+
+	seen map[uintptr]bool
+}
+
+func (w *valueWalker) walk(v reflect.Value) error {
+	if v.CanSet() {
+		if err := w.visit(v); err != nil {
+			return err
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		// Avoid looping forever on self-referential data
+		ptr := v.Pointer()
+		if w.seen == nil {
+			w.seen = make(map[uintptr]bool)
+		}
+		if w.seen[ptr] {
+			return nil
+		}
+		w.seen[ptr] = true
+		return w.walk(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() || !v.CanSet() {
+			return nil
+		}
+		// Values held by an interface are not settable, so
+		// copy them out, walk the copy and put it back.
+		elem := v.Elem()
+		copied := reflect.New(elem.Type()).Elem()
+		copied.Set(elem)
+		if err := w.walk(copied); err != nil {
+			return err
+		}
+		v.Set(copied)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				// Ignore unexported field
+				continue
+			}
+			if err := w.walk(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := w.walk(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		elemType := v.Type().Elem()
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key()
+			if w.visitKey != nil {
+				key = w.visitKey(key)
+			}
+			// Map values are not settable, so copy them out,
+			// walk the copy and put it back.
+			elem := reflect.New(elemType).Elem()
+			elem.Set(iter.Value())
+			if err := w.walk(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
+}
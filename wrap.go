@@ -0,0 +1,27 @@
+package dfjson
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// wrapKey returns data wrapped in an object under key, ie. {"key": data}
+func wrapKey(data []byte, key string, escapeHTML bool) ([]byte, error) {
+	return marshalJSON(map[string]json.RawMessage{
+		key: data,
+	}, escapeHTML)
+}
+
+// unwrapKey returns the value stored under key of the object in data.
+// It is the reverse of wrapKey.
+func unwrapKey(data []byte, key string) ([]byte, error) {
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return nil, err
+	}
+	value, ok := wrapper[key]
+	if !ok {
+		return nil, fmt.Errorf("missing wrap key %q", key)
+	}
+	return value, nil
+}
@@ -0,0 +1,52 @@
+package dfjson
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestWrapKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		wrapKey   string
+		wantEntry string
+	}{
+		{"no wrap key", "", "{\n\t\"name\": \"world\"\n}"},
+		{"wrap key", "data", "{\n\t\"data\": {\n\t\t\"name\": \"world\"\n\t}\n}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := newEncodeTestWorld()
+			opts := Options{WrapKey: test.wrapKey}
+			files, err := MarshalWithOptions("index.json", in, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := fileData(files)
+			if got := data["index.json"]; got != test.wantEntry {
+				t.Errorf("got %q, want %q", got, test.wantEntry)
+			}
+			if got, want := data["creatures/goblin/index.json"], "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}"; got != want {
+				t.Errorf("only the entry file should be wrapped, got %q", got)
+			}
+			var out encodeTestWorld
+			if err := UnmarshalFS(filesFS(files), "index.json", &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+func TestWrapKeyMissing(t *testing.T) {
+	fsys := fstest.MapFS{"index.json": {Data: []byte(`{"name": "world"}`)}}
+	var out encodeTestWorld
+	err := UnmarshalFS(fsys, "index.json", &out, Options{WrapKey: "data"})
+	if want := `missing wrap key "data"`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,263 @@
+package dfjson
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// MarshalToDir encodes v with Marshal and writes the resulting files into the
+// root directory with WriteFiles.
+func MarshalToDir(root string, entryFilename string, v interface{}) error {
+	return MarshalTo(root, entryFilename, v, Options{})
+}
+
+// MarshalTo encodes v with MarshalWithOptions and writes each of the resulting
+// files into the root directory with WriteFiles.
+//
+// If Options.PreserveUnchanged is set, files that already exist on disk with
+// equivalent JSON are left untouched so that any manual formatting is kept.
+//
+// If Options.RemoveStale is set, files and directories from a previous call
+// that are no longer part of the output are removed once writing succeeds.
+//
+// Each file is replaced atomically, so a file is never seen half written. If
+// writing fails part way no file is replaced, but a crash while the files are
+// being renamed into place can leave a mix of old and new files. Set
+// Options.SwapDir to replace the whole tree at once instead.
+func MarshalTo(root string, entryFilename string, v interface{}, opts Options) error {
+	files, err := MarshalWithOptions(entryFilename, v, opts)
+	if err != nil {
+		return err
+	}
+	if opts.SwapDir {
+		return writeSwapDir(root, entryFilename, files, 0644)
+	}
+	allFiles := files
+	if opts.PreserveUnchanged {
+		changedFiles := make([]JSONFile, 0, len(files))
+		for _, file := range files {
+			isUnchanged, err := isFileUnchanged(osWriteFS{}, filepath.Join(root, filepath.FromSlash(file.Path)), file.Data)
+			if err != nil {
+				return err
+			}
+			if !isUnchanged {
+				changedFiles = append(changedFiles, file)
+			}
+		}
+		files = changedFiles
+	}
+	if err := WriteFiles(root, files, 0644); err != nil {
+		return err
+	}
+	if opts.RemoveStale {
+		if err := removeStale(root, entryFilename, reflect.TypeOf(v), allFiles, &opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFS is a filesystem that files can be written to with WriteFilesFS,
+// ie. an in-memory filesystem in tests. Paths use the separator of the OS.
+type WriteFS interface {
+	MkdirAll(path string, perm os.FileMode) error
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// ReadFileFS is a WriteFS that existing files can also be read from, which
+// allows skipping files that wouldn't change with Options.PreserveUnchanged.
+type ReadFileFS interface {
+	WriteFS
+	// ReadFile returns the contents of the file called name, or an error
+	// that os.IsNotExist reports as true if it doesn't exist
+	ReadFile(name string) ([]byte, error)
+}
+
+// osWriteFS writes to the filesystem of the OS
+type osWriteFS struct{}
+
+func (osWriteFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(longPath(path), perm)
+}
+
+func (osWriteFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(longPath(name), data, perm)
+}
+
+func (osWriteFS) Rename(oldpath, newpath string) error {
+	return os.Rename(longPath(oldpath), longPath(newpath))
+}
+
+func (osWriteFS) Remove(name string) error {
+	return os.Remove(longPath(name))
+}
+
+func (osWriteFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(longPath(name))
+}
+
+// WriteFiles writes each file returned by Marshal into the root directory,
+// creating parent directories as needed.
+//
+// Every file is written to a temporary file next to it first and only renamed
+// into place once all of them were written successfully, so an error part way
+// through doesn't leave a mix of old and new files behind.
+func WriteFiles(root string, files []JSONFile, perm os.FileMode) error {
+	return WriteFilesFS(osWriteFS{}, root, files, perm)
+}
+
+// WriteFilesFS is like WriteFiles but writes to fsys rather than
+// the filesystem of the OS.
+func WriteFilesFS(fsys WriteFS, root string, files []JSONFile, perm os.FileMode) error {
+	suffix, err := tempSuffix()
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(files))
+	tempPaths := make([]string, 0, len(files))
+	removeTempFiles := func() {
+		for _, tempPath := range tempPaths {
+			fsys.Remove(tempPath)
+		}
+	}
+	for _, file := range files {
+		path := filepath.Join(root, filepath.FromSlash(file.Path))
+		if err := fsys.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			removeTempFiles()
+			return err
+		}
+		tempPath := path + suffix
+		if err := fsys.WriteFile(tempPath, file.Data, perm); err != nil {
+			fsys.Remove(tempPath)
+			removeTempFiles()
+			return err
+		}
+		paths = append(paths, path)
+		tempPaths = append(tempPaths, tempPath)
+	}
+	for i, path := range paths {
+		if err := fsys.Rename(tempPaths[i], path); err != nil {
+			tempPaths = tempPaths[i:]
+			removeTempFiles()
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSwapDir writes files into a temporary directory next to the directory
+// of the entry file and then swaps it with the directory of the entry file.
+//
+// The swap takes two renames, the old directory is moved aside and the new one
+// moved into place. If the process crashes between them, the directory of the
+// entry file is missing and the old tree is left in a directory with the
+// ".old" suffix, but the directory never holds a mix of both trees.
+func writeSwapDir(root string, entryFilename string, files []JSONFile, perm os.FileMode) error {
+	entryDir := dirOf(cleanPath(entryFilename))
+	if entryDir == "." || entryDir == "/" {
+		return errors.New("SwapDir requires the entry file to be in a subdirectory of root")
+	}
+	dirFiles := make([]JSONFile, len(files))
+	for i, file := range files {
+		path := cleanPath(file.Path)
+		if !strings.HasPrefix(path, entryDir+"/") {
+			return fmt.Errorf("%s: SwapDir requires every file to be within %s", file.Path, entryDir)
+		}
+		dirFiles[i] = JSONFile{
+			Path: strings.TrimPrefix(path, entryDir+"/"),
+			Data: file.Data,
+		}
+	}
+	suffix, err := tempSuffix()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(root, filepath.FromSlash(entryDir))
+	tempDir := dir + suffix
+	oldDir := dir + ".old" + strings.TrimPrefix(suffix, ".tmp")
+	if err := WriteFiles(tempDir, dirFiles, perm); err != nil {
+		os.RemoveAll(longPath(tempDir))
+		return err
+	}
+	hasOldDir := true
+	if err := os.Rename(longPath(dir), longPath(oldDir)); err != nil {
+		if !os.IsNotExist(err) {
+			os.RemoveAll(longPath(tempDir))
+			return err
+		}
+		hasOldDir = false
+	}
+	if err := os.Rename(longPath(tempDir), longPath(dir)); err != nil {
+		if hasOldDir {
+			os.Rename(longPath(oldDir), longPath(dir))
+		}
+		os.RemoveAll(longPath(tempDir))
+		return err
+	}
+	if hasOldDir {
+		return os.RemoveAll(longPath(oldDir))
+	}
+	return nil
+}
+
+// tempSuffix returns a random suffix for the names of temporary files so
+// that they don't clash with the files of another write in progress
+func tempSuffix() (string, error) {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return ".tmp" + hex.EncodeToString(b[:]), nil
+}
+
+// isFileUnchanged reports whether the file at path in fsys exists and
+// contains the same JSON as data, ignoring formatting. It's always false
+// if fsys can't read files.
+func isFileUnchanged(fsys WriteFS, path string, data []byte) (bool, error) {
+	readFS, ok := fsys.(ReadFileFS)
+	if !ok {
+		return false, nil
+	}
+	existing, err := readFS.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return jsonEqual(existing, data), nil
+}
+
+// jsonEqual reports whether a and b hold the same JSON value, ignoring
+// formatting and the order of object keys.
+func jsonEqual(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var aValue, bValue interface{}
+	if err := unmarshalUseNumber(a, &aValue); err != nil {
+		return false
+	}
+	if err := unmarshalUseNumber(b, &bValue); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// unmarshalUseNumber is json.Unmarshal but numbers are kept as json.Number
+// so they can be compared without losing precision.
+func unmarshalUseNumber(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return decodeValue(dec, data, v)
+}
@@ -0,0 +1,352 @@
+package dfjson
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// readTree returns the contents of each file in root by slash-separated path
+func readTree(t testing.TB, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		tree[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestPreserveUnchanged(t *testing.T) {
+	const reformatted = "{\"hp\":12,   \"name\":\"Goblin\"}\n"
+	tests := []struct {
+		name              string
+		preserveUnchanged bool
+		wantGoblin        string
+	}{
+		{"enabled", true, reformatted},
+		{"disabled", false, "{\n\t\"name\": \"Goblin\",\n\t\"hp\": 12\n}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			world := newEncodeTestWorld()
+			if err := MarshalTo(root, "index.json", world, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			goblinPath := filepath.Join(root, "creatures", "goblin", "index.json")
+			if err := os.WriteFile(goblinPath, []byte(reformatted), 0644); err != nil {
+				t.Fatal(err)
+			}
+			world.Creatures["orc"].HP = 31
+			if err := MarshalTo(root, "index.json", world, Options{PreserveUnchanged: test.preserveUnchanged}); err != nil {
+				t.Fatal(err)
+			}
+			tree := readTree(t, root)
+			if got := tree["creatures/goblin/index.json"]; got != test.wantGoblin {
+				t.Errorf("goblin: got %q, want %q", got, test.wantGoblin)
+			}
+			if got, want := tree["creatures/orc/index.json"], "{\n\t\"name\": \"Orc\",\n\t\"hp\": 31\n}"; got != want {
+				t.Errorf("orc: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPreserveUnchangedModTime(t *testing.T) {
+	opts := Options{PreserveUnchanged: true}
+	writers := []struct {
+		name  string
+		write func(root string, v interface{}) error
+	}{
+		{"MarshalTo", func(root string, v interface{}) error {
+			return MarshalTo(root, "index.json", v, opts)
+		}},
+		{"EncodeWrite", func(root string, v interface{}) error {
+			return NewEncoder(WithOptions(opts)).EncodeWrite(root, "index.json", v, 4)
+		}},
+	}
+	for _, writer := range writers {
+		t.Run(writer.name, func(t *testing.T) {
+			root := t.TempDir()
+			world := newEncodeTestWorld()
+			if err := writer.write(root, world); err != nil {
+				t.Fatal(err)
+			}
+			// Date every file back so that a rewrite can't get the same mtime
+			old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+			for path := range readTree(t, root) {
+				if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(path)), old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+			world.Creatures["orc"].HP = 31
+			if err := writer.write(root, world); err != nil {
+				t.Fatal(err)
+			}
+			for path := range readTree(t, root) {
+				info, err := os.Stat(filepath.Join(root, filepath.FromSlash(path)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantRewritten := path == "creatures/orc/index.json"
+				if isRewritten := !info.ModTime().Equal(old); isRewritten != wantRewritten {
+					t.Errorf("%s: got rewritten %v, want %v", path, isRewritten, wantRewritten)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{`{"a": 1, "b": [1, 2]}`, "{\n\t\"b\": [1,2],\n\t\"a\": 1\n}", true},
+		{`{"a": 1}`, `{"a": 1.0}`, false},
+		{`{"a": 12345678901234567890}`, `{"a": 12345678901234567891}`, false},
+		{`{"a": "x"}`, `{"a": "y"}`, false},
+		{`{"a": 1}`, `{"a": 1`, false},
+		{`{"a": 1}`, `{"a": 1} {"b": 2}`, false},
+		{`{"a": 1}`, "{\"a\": 1}\n", true},
+	}
+	for _, test := range tests {
+		if got := jsonEqual([]byte(test.a), []byte(test.b)); got != test.want {
+			t.Errorf("jsonEqual(%s, %s) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// memWriteFS is an in-memory WriteFS, safe for use by the workers
+// of MarshalWrite
+type memWriteFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	// failWrite and failRename make writing or renaming to a path with
+	// the suffix fail, to simulate a full disk
+	failWrite, failRename string
+}
+
+func newMemWriteFS() *memWriteFS {
+	return &memWriteFS{
+		files: make(map[string][]byte),
+		dirs:  make(map[string]bool),
+	}
+}
+
+var errMemWriteFS = errors.New("no space left on device")
+
+func (fsys *memWriteFS) MkdirAll(path string, perm os.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	for ; path != "." && path != string(filepath.Separator); path = filepath.Dir(path) {
+		fsys.dirs[path] = true
+	}
+	return nil
+}
+
+func (fsys *memWriteFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if !fsys.dirs[filepath.Dir(name)] {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if fsys.failWrite != "" && strings.Contains(name, fsys.failWrite) {
+		return &os.PathError{Op: "write", Path: name, Err: errMemWriteFS}
+	}
+	fsys.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (fsys *memWriteFS) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	data, ok := fsys.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if fsys.failRename != "" && strings.HasSuffix(newpath, fsys.failRename) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errMemWriteFS}
+	}
+	delete(fsys.files, oldpath)
+	fsys.files[newpath] = data
+	return nil
+}
+
+func (fsys *memWriteFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if _, ok := fsys.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fsys.files, name)
+	return nil
+}
+
+func (fsys *memWriteFS) ReadFile(name string) ([]byte, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	data, ok := fsys.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return data, nil
+}
+
+// mapFS returns the files within root as an fs.FS
+func (fsys *memWriteFS) mapFS(root string) fstest.MapFS {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	mapFS := make(fstest.MapFS, len(fsys.files))
+	for name, data := range fsys.files {
+		if rel, err := filepath.Rel(root, name); err == nil && !strings.HasPrefix(rel, "..") {
+			mapFS[filepath.ToSlash(rel)] = &fstest.MapFile{Data: data}
+		}
+	}
+	return mapFS
+}
+
+func TestWriteFilesFS(t *testing.T) {
+	files, err := Marshal("index.json", newEncodeTestWorld())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name                  string
+		failWrite, failRename string
+		wantErr               string
+	}{
+		{name: "success"},
+		{
+			name:      "write fails",
+			failWrite: filepath.Join("orc", "index.json"),
+			wantErr:   "no space left on device",
+		},
+		{
+			name:       "rename fails",
+			failRename: filepath.Join("orc", "index.json"),
+			wantErr:    "no space left on device",
+		},
+	}
+	root := filepath.Join("data", "world")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := newMemWriteFS()
+			fsys.failWrite, fsys.failRename = test.failWrite, test.failRename
+			err := WriteFilesFS(fsys, root, files, 0644)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				// Nothing is renamed into place unless every file was
+				// written, renames before a failed one aren't undone
+				if test.failWrite != "" && len(fsys.files) != 0 {
+					t.Errorf("got %d files after a failed write, want none", len(fsys.files))
+				}
+				for name := range fsys.files {
+					if strings.Contains(filepath.Base(name), ".tmp") {
+						t.Errorf("temporary file %s was left behind", name)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(fsys.files), len(files); got != want {
+				t.Errorf("got %d files, want %d", got, want)
+			}
+			var out encodeTestWorld
+			if err := UnmarshalFS(fsys.mapFS(root), "index.json", &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			if want := newEncodeTestWorld(); !reflect.DeepEqual(&out, want) {
+				t.Errorf("got %+v, want %+v", out, want)
+			}
+		})
+	}
+}
+
+func TestWriteFilesFailure(t *testing.T) {
+	root := t.TempDir()
+	if err := MarshalTo(root, "index.json", newEncodeTestWorld(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	before := readTree(t, root)
+	// A file where the directory of a new creature needs to be makes
+	// writing fail part way through
+	if err := os.WriteFile(filepath.Join(root, "creatures", "troll"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	before["creatures/troll"] = ""
+
+	world := newEncodeTestWorld()
+	world.Name = "changed"
+	world.Creatures["goblin"].HP = 99
+	world.Creatures["troll"] = &encodeTestCreature{Name: "Troll"}
+	world.Creatures["zombie"] = &encodeTestCreature{Name: "Zombie"}
+	if err := MarshalTo(root, "index.json", world, Options{}); err == nil {
+		t.Fatal("expected an error")
+	}
+	// No file was replaced and no temporary file is visible
+	if got := readTree(t, root); !reflect.DeepEqual(got, before) {
+		t.Errorf("got %q, want the files before writing %q", got, before)
+	}
+}
+
+func TestSwapDir(t *testing.T) {
+	root := t.TempDir()
+	opts := Options{SwapDir: true}
+	if err := MarshalTo(root, "data/index.json", newEncodeTestWorld(), opts); err != nil {
+		t.Fatal(err)
+	}
+	world := newEncodeTestWorld()
+	delete(world.Creatures, "orc")
+	world.Creatures["troll"] = &encodeTestCreature{Name: "Troll"}
+	if err := MarshalTo(root, "data/index.json", world, opts); err != nil {
+		t.Fatal(err)
+	}
+	files, err := Marshal("data/index.json", world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The old tree is replaced as a whole, so the orc is gone
+	// and nothing is left next to the directory
+	if got, want := readTree(t, root), fileData(files); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d entries in root, want only the data directory", len(entries))
+	}
+
+	err = MarshalTo(root, "index.json", world, opts)
+	if want := "SwapDir requires the entry file to be in a subdirectory of root"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}